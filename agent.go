@@ -1,6 +1,8 @@
 package smppth
 
 import (
+	"fmt"
+
 	"github.com/blorticus/smpp"
 )
 
@@ -33,8 +35,66 @@ const (
 	// ApplicationError is the AgentEvent type when an Agent experiences some sort of error at the
 	// SMPP layer
 	ApplicationError
+	// ProtocolError is the AgentEvent type when an Agent receives a PDU that it cannot decode, and answers
+	// it with a generic-nack, or when a peer answers a request from the Agent with a generic-nack
+	ProtocolError
+	// ReceivedCompleteMessage is the AgentEvent type raised by a MessageReassembler when every segment of a
+	// concatenated message has been received from a peer
+	ReceivedCompleteMessage
+	// IncompleteMessageTimedOut is the AgentEvent type raised by a MessageReassembler when some segments of a
+	// concatenated message were received from a peer, but the rest did not arrive before the timeout
+	IncompleteMessageTimedOut
+	// DeliveryReceiptReceived is the AgentEvent type raised by a DeliveryReceiptTracker when an agent receives a
+	// deliver-sm that is a delivery receipt
+	DeliveryReceiptReceived
+	// DeliveryQueued is the AgentEvent type raised by a StandardApplication when an SMSC holds a deliver-sm that it
+	// could not deliver to a peer (e.g., because the peer is not bound), to be retried later
+	DeliveryQueued
+	// DeliveryRetried is the AgentEvent type raised by a StandardApplication when an SMSC tries again to send a held
+	// deliver-sm to a peer
+	DeliveryRetried
+	// DeliveryAbandoned is the AgentEvent type raised by a StandardApplication when an SMSC gives up on a held
+	// deliver-sm, because it expired or was attempted the maximum number of times
+	DeliveryAbandoned
 )
 
+var agentEventTypeNames = map[AgentEventType]string{
+	ReceivedPDU:               "ReceivedPDU",
+	SentPDU:                   "SentPDU",
+	CompletedBind:             "CompletedBind",
+	CompletedUnbind:           "CompletedUnbind",
+	PeerTransportClosed:       "PeerTransportClosed",
+	TransportError:            "TransportError",
+	ApplicationError:          "ApplicationError",
+	ProtocolError:             "ProtocolError",
+	ReceivedCompleteMessage:   "ReceivedCompleteMessage",
+	IncompleteMessageTimedOut: "IncompleteMessageTimedOut",
+	DeliveryReceiptReceived:   "DeliveryReceiptReceived",
+	DeliveryQueued:            "DeliveryQueued",
+	DeliveryRetried:           "DeliveryRetried",
+	DeliveryAbandoned:         "DeliveryAbandoned",
+}
+
+// String returns the name of the AgentEventType constant (e.g., "ReceivedPDU")
+func (eventType AgentEventType) String() string {
+	if name, isKnown := agentEventTypeNames[eventType]; isKnown {
+		return name
+	}
+
+	return fmt.Sprintf("AgentEventType(%d)", int(eventType))
+}
+
+// AgentEventTypeFromString returns the AgentEventType named by its constant (e.g., "ReceivedPDU")
+func AgentEventTypeFromString(name string) (AgentEventType, error) {
+	for eventType, eventTypeName := range agentEventTypeNames {
+		if name == eventTypeName {
+			return eventType, nil
+		}
+	}
+
+	return 0, fmt.Errorf("(%s) is not an agent event type", name)
+}
+
 // AgentEvent is an event from an smpp agent.  SourceAgent is always the Agent that sourced
 // this event.  RemotePeerName is always the name of the remote peer for the event.  For CompletedBind,
 // the SmppPDU is the transceiver-bind-resp.  For CompletedUnbind, it is the unbind-resp.  For
@@ -43,13 +103,25 @@ const (
 // peer name -- unless it is at connection setup, in which case, it will be "" -- and SmppPDU will be nil.
 // For ApplicationError, RemotePeerName may be empty or may have a value, and SmppPDU may be nil or
 // may be defined.  If SmppPDU is defined for ApplicationError, then the error relates to the PDU in some
-// way.
+// way.  For ProtocolError, when the Agent could not decode a PDU, Error is a *PduDecodeError and SmppPDU is
+// the generic-nack sent in response.  When a peer answered with a generic-nack, SmppPDU is the request that
+// the peer rejected.  In either case, the session with the peer remains open.  For ReceivedCompleteMessage
+// and IncompleteMessageTimedOut, ReassembledMessage describes the message, and SmppPDU is the most recently
+// received segment.  ReassembledMessage is nil for all other types.  For DeliveryReceiptReceived, SmppPDU is the
+// deliver-sm and DeliveryReceipt describes the receipt.  DeliveryReceipt is nil for all other types.  For
+// DeliveryQueued, DeliveryRetried and DeliveryAbandoned, RemotePeerName is the peer to which the delivery is
+// addressed, SmppPDU is the deliver-sm, QueuedDelivery describes the delivery, and DeliveryQueueDepth is the number
+// of deliveries held for the peer after the event.  QueuedDelivery is nil for all other types.
 type AgentEvent struct {
-	Type           AgentEventType
-	SourceAgent    Agent
-	RemotePeerName string
-	SmppPDU        *smpp.PDU
-	Error          error
+	Type               AgentEventType
+	SourceAgent        Agent
+	RemotePeerName     string
+	SmppPDU            *smpp.PDU
+	Error              error
+	ReassembledMessage *ReassembledMessage
+	DeliveryReceipt    *ReceivedDeliveryReceipt
+	QueuedDelivery     *QueuedDelivery
+	DeliveryQueueDepth int
 }
 
 // A MessageDescriptor is provided to smpp agents, indicating what PDU to send, the name of
@@ -37,6 +37,36 @@ func (group *AgentGroup) AttachDebugLoggerWriter(writer io.Writer) {
 	group.debugLogger = log.New(writer, "(AgentGroup): ", 0)
 }
 
+// AttachWireTraceWriter enables wire tracing on every managed agent that supports it (i.e., that implements
+// WireTraceableAgent), sending the trace for all of their peer sessions to the provided Writer.
+func (group *AgentGroup) AttachWireTraceWriter(writer io.Writer) {
+	for _, agent := range group.mapOfAgentNameToAgentObject {
+		if traceableAgent, isTraceable := agent.(WireTraceableAgent); isTraceable {
+			traceableAgent.AttachWireTraceWriter(writer)
+		}
+	}
+}
+
+// AttachWireTraceWriterForPeer enables wire tracing on the named managed agent for its session with the
+// named peer, sending the trace to the provided Writer.  An error is returned if the agent is not managed
+// by this group, or if it does not support wire tracing.
+func (group *AgentGroup) AttachWireTraceWriterForPeer(nameOfAgent string, nameOfPeer string, writer io.Writer) error {
+	agentObject := group.mapOfAgentNameToAgentObject[nameOfAgent]
+
+	if agentObject == nil {
+		return fmt.Errorf("This AgentGroup is not managing an agent named [%s]", nameOfAgent)
+	}
+
+	traceableAgent, isTraceable := agentObject.(WireTraceableAgent)
+	if !isTraceable {
+		return fmt.Errorf("The agent named [%s] does not support wire tracing", nameOfAgent)
+	}
+
+	traceableAgent.AttachWireTraceWriterForPeer(nameOfPeer, writer)
+
+	return nil
+}
+
 // RoutePduToAgentForSending accepts an SMPP PDU, and routes it to the named source peer,
 // so that peer can send it to the named destination peer
 func (group *AgentGroup) RoutePduToAgentForSending(nameOfSourcePeer string, nameOfDestinationPeer string, pduToSend *smpp.PDU) error {
@@ -0,0 +1,327 @@
+package smppth
+
+import (
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/blorticus/smpp"
+)
+
+// TextEncoding is the character set used to encode the text of a short_message or message_payload, along with
+// the packing for the GSM 03.38 default alphabet
+type TextEncoding int
+
+const (
+	// TextEncodingGsm7 is the GSM 03.38 default alphabet, with the extension table, with one septet per octet.  This
+	// is the usual encoding for data_coding 0 on an SMPP connection.
+	TextEncodingGsm7 TextEncoding = iota
+	// TextEncodingGsm7Packed is the GSM 03.38 default alphabet, with the extension table, with eight septets packed
+	// into seven octets.  It shares data_coding 0 with TextEncodingGsm7, so it can be chosen for sending, but a
+	// received message with data_coding 0 is decoded as TextEncodingGsm7.  Use DecodeText() to decode packed
+	// octets explicitly.
+	TextEncodingGsm7Packed
+	// TextEncodingASCII is IA5 (data_coding 1)
+	TextEncodingASCII
+	// TextEncodingLatin1 is ISO-8859-1 (data_coding 3)
+	TextEncodingLatin1
+	// TextEncodingUcs2 is UCS2 (data_coding 8).  Characters outside of the Basic Multilingual Plane are encoded
+	// as UTF-16BE surrogate pairs.
+	TextEncodingUcs2
+	// TextEncodingBinary is 8-bit binary data (data_coding 4).  The octets of the text are used as they are.
+	TextEncodingBinary
+)
+
+var textEncodingNames = map[TextEncoding]string{
+	TextEncodingGsm7:       "gsm7",
+	TextEncodingGsm7Packed: "gsm7-packed",
+	TextEncodingASCII:      "ascii",
+	TextEncodingLatin1:     "latin1",
+	TextEncodingUcs2:       "ucs2",
+	TextEncodingBinary:     "binary",
+}
+
+var textEncodingDataCoding = map[TextEncoding]uint8{
+	TextEncodingGsm7:       0,
+	TextEncodingGsm7Packed: 0,
+	TextEncodingASCII:      1,
+	TextEncodingLatin1:     3,
+	TextEncodingUcs2:       8,
+	TextEncodingBinary:     4,
+}
+
+// String returns the name of the TextEncoding, which is accepted by TextEncodingFromString()
+func (encoding TextEncoding) String() string {
+	if name, isKnown := textEncodingNames[encoding]; isKnown {
+		return name
+	}
+
+	return fmt.Sprintf("TextEncoding(%d)", int(encoding))
+}
+
+// DataCoding returns the data_coding value that identifies the TextEncoding
+func (encoding TextEncoding) DataCoding() uint8 {
+	return textEncodingDataCoding[encoding]
+}
+
+// TextEncodingFromString returns the TextEncoding for one of the names gsm7, gsm7-packed, ascii (or ia5),
+// latin1, ucs2 or binary
+func TextEncodingFromString(name string) (TextEncoding, error) {
+	if name == "ia5" {
+		return TextEncodingASCII, nil
+	}
+
+	for encoding, encodingName := range textEncodingNames {
+		if encodingName == name {
+			return encoding, nil
+		}
+	}
+
+	return TextEncodingGsm7, fmt.Errorf("encoding must be one of gsm7, gsm7-packed, ascii, latin1, ucs2 or binary, not (%s)", name)
+}
+
+// TextEncodingForDataCoding returns the TextEncoding used to decode a message with the provided data_coding.
+// data_coding 0, and the GSM 03.38 message class values with the default alphabet, are treated as unpacked
+// GSM 03.38, because data_coding does not say whether the septets are packed.  Values that do not identify a
+// supported character set are treated as binary.
+func TextEncodingForDataCoding(dataCoding uint8) TextEncoding {
+	switch {
+	case dataCoding == 0:
+		return TextEncodingGsm7
+	case dataCoding == 1:
+		return TextEncodingASCII
+	case dataCoding == 3:
+		return TextEncodingLatin1
+	case dataCoding == 8:
+		return TextEncodingUcs2
+	case dataCoding&0xF0 == 0xF0 && dataCoding&0x04 == 0:
+		return TextEncodingGsm7
+	}
+
+	return TextEncodingBinary
+}
+
+// EncodeText encodes text using the provided TextEncoding.  An error is returned if the text contains a character
+// that cannot be represented in the encoding.
+func EncodeText(text string, encoding TextEncoding) ([]byte, error) {
+	switch encoding {
+	case TextEncodingGsm7:
+		return encodeGsm7Septets(text)
+
+	case TextEncodingGsm7Packed:
+		septets, err := encodeGsm7Septets(text)
+		if err != nil {
+			return nil, err
+		}
+		return packSeptets(septets, 0), nil
+
+	case TextEncodingASCII, TextEncodingLatin1:
+		highestCodePoint := rune(0xFF)
+		if encoding == TextEncodingASCII {
+			highestCodePoint = 0x7F
+		}
+
+		encoded := make([]byte, 0, len(text))
+		for _, character := range text {
+			if character > highestCodePoint {
+				return nil, fmt.Errorf("character (%c) cannot be encoded in %s", character, encoding)
+			}
+			encoded = append(encoded, byte(character))
+		}
+		return encoded, nil
+
+	case TextEncodingUcs2:
+		codeUnits := utf16.Encode([]rune(text))
+		encoded := make([]byte, 0, 2*len(codeUnits))
+		for _, codeUnit := range codeUnits {
+			encoded = append(encoded, uint8(codeUnit>>8), uint8(codeUnit))
+		}
+		return encoded, nil
+	}
+
+	return []byte(text), nil
+}
+
+// DecodeText decodes octets using the provided TextEncoding.  Octets that have no meaning in the encoding
+// (e.g., a trailing odd octet for UCS2) are ignored, and GSM 03.38 septets with no character become '?'.
+func DecodeText(octets []byte, encoding TextEncoding) string {
+	switch encoding {
+	case TextEncodingGsm7:
+		return decodeGsm7Septets(octets)
+
+	case TextEncodingGsm7Packed:
+		return decodeGsm7Septets(unpackSeptets(octets, 0))
+
+	case TextEncodingASCII, TextEncodingLatin1:
+		decoded := make([]rune, 0, len(octets))
+		for _, octet := range octets {
+			decoded = append(decoded, rune(octet))
+		}
+		return string(decoded)
+
+	case TextEncodingUcs2:
+		codeUnits := make([]uint16, 0, len(octets)/2)
+		for i := 0; i+1 < len(octets); i += 2 {
+			codeUnits = append(codeUnits, uint16(octets[i])<<8|uint16(octets[i+1]))
+		}
+		return string(utf16.Decode(codeUnits))
+	}
+
+	return string(octets)
+}
+
+// ShortMessageText returns the short_message of a submit-sm or deliver-sm, decoded according to its data_coding.
+// If the PDU has no short_message, but has a message_payload TLV, the message_payload is decoded instead.
+func ShortMessageText(pdu *smpp.PDU) string {
+	if len(pdu.MandatoryParameters) < 17 {
+		return ""
+	}
+
+	dataCoding, _ := pdu.MandatoryParameters[14].Value.(uint8)
+
+	shortMessage := []byte(shortMessageFromPdu(pdu))
+	if len(shortMessage) == 0 {
+		if payload := findTlvParameter(pdu, tlvTagMessagePayload); payload != nil {
+			shortMessage = []byte(tlvValueAsString(payload))
+		}
+	}
+
+	if esmClass, _ := pdu.MandatoryParameters[7].Value.(uint8); esmClass&esmClassUdhIndicator != 0 && len(shortMessage) > 0 && len(shortMessage) > int(shortMessage[0]) {
+		shortMessage = shortMessage[int(shortMessage[0])+1:]
+	}
+
+	return DecodeText(shortMessage, TextEncodingForDataCoding(dataCoding))
+}
+
+const gsm7EscapeSeptet = 0x1B
+
+// gsm7BasicCharacterSet is the GSM 03.38 default alphabet, indexed by septet.  The escape to the extension table
+// (0x1B) is represented by a character that is never encoded.
+var gsm7BasicCharacterSet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsm7ExtensionCharacterSet maps the septet following an escape to its character
+var gsm7ExtensionCharacterSet = map[byte]rune{
+	0x0A: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2F: '\\',
+	0x3C: '[',
+	0x3D: '~',
+	0x3E: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+var gsm7SeptetsForCharacter = buildGsm7SeptetsForCharacter()
+
+func buildGsm7SeptetsForCharacter() map[rune][]byte {
+	septetsForCharacter := make(map[rune][]byte)
+
+	for septet, character := range gsm7BasicCharacterSet {
+		if septet != gsm7EscapeSeptet {
+			septetsForCharacter[character] = []byte{byte(septet)}
+		}
+	}
+
+	for septet, character := range gsm7ExtensionCharacterSet {
+		septetsForCharacter[character] = []byte{gsm7EscapeSeptet, septet}
+	}
+
+	return septetsForCharacter
+}
+
+// encodeGsm7Septets encodes text as GSM 03.38 septets, one per octet.  A character in the extension table
+// produces two septets.
+func encodeGsm7Septets(text string) ([]byte, error) {
+	septets := make([]byte, 0, len(text))
+
+	for _, character := range text {
+		septetsForCharacter, isEncodable := gsm7SeptetsForCharacter[character]
+		if !isEncodable {
+			return nil, fmt.Errorf("character (%c) cannot be encoded in the GSM 03.38 default alphabet", character)
+		}
+
+		septets = append(septets, septetsForCharacter...)
+	}
+
+	return septets, nil
+}
+
+func decodeGsm7Septets(septets []byte) string {
+	decoded := make([]rune, 0, len(septets))
+
+	for i := 0; i < len(septets); i++ {
+		septet := septets[i] & 0x7F
+
+		if septet == gsm7EscapeSeptet && i+1 < len(septets) {
+			i++
+			if character, isKnown := gsm7ExtensionCharacterSet[septets[i]&0x7F]; isKnown {
+				decoded = append(decoded, character)
+			} else {
+				decoded = append(decoded, gsm7BasicCharacterSet[septets[i]&0x7F])
+			}
+			continue
+		}
+
+		if septet == gsm7EscapeSeptet {
+			decoded = append(decoded, '?')
+			continue
+		}
+
+		decoded = append(decoded, gsm7BasicCharacterSet[septet])
+	}
+
+	return string(decoded)
+}
+
+// packSeptets packs septets into octets, least significant bit first, after fillBits bits of padding.  The
+// padding aligns packed text that follows a UDH on a septet boundary.  If the last octet would have seven unused
+// bits, they are set to a carriage return, as GSM 03.38 requires, so that they are not read as '@'.
+func packSeptets(septets []byte, fillBits int) []byte {
+	if (fillBits+7*len(septets))%8 == 1 {
+		septets = append(append([]byte{}, septets...), '\r')
+	}
+
+	packed := make([]byte, (fillBits+7*len(septets)+7)/8)
+
+	for i, septet := range septets {
+		bitPosition := fillBits + 7*i
+		octetIndex, shift := bitPosition/8, uint(bitPosition%8)
+
+		packed[octetIndex] |= (septet & 0x7F) << shift
+		if shift > 1 {
+			packed[octetIndex+1] |= (septet & 0x7F) >> (8 - shift)
+		}
+	}
+
+	return packed
+}
+
+// unpackSeptets reverses packSeptets, dropping a trailing carriage return that fills the last octet
+func unpackSeptets(packed []byte, fillBits int) []byte {
+	availableBits := 8*len(packed) - fillBits
+	if availableBits < 7 {
+		return []byte{}
+	}
+
+	septets := make([]byte, availableBits/7)
+
+	for i := range septets {
+		bitPosition := fillBits + 7*i
+		octetIndex, shift := bitPosition/8, uint(bitPosition%8)
+
+		septet := packed[octetIndex] >> shift
+		if shift > 1 {
+			septet |= packed[octetIndex+1] << (8 - shift)
+		}
+
+		septets[i] = septet & 0x7F
+	}
+
+	if availableBits%7 == 0 && septets[len(septets)-1] == '\r' {
+		septets = septets[:len(septets)-1]
+	}
+
+	return septets
+}
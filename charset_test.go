@@ -0,0 +1,159 @@
+package smppth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGsm7EncodingAndDecoding(t *testing.T) {
+	if len(gsm7BasicCharacterSet) != 128 {
+		t.Fatalf("Expected 128 characters in GSM 03.38 basic character set, got (%d)", len(gsm7BasicCharacterSet))
+	}
+
+	text := "@£$ Hello {world} €5 ñ"
+	expectedSeptets := []byte{0x00, 0x01, 0x02, 0x20, 'H', 'e', 'l', 'l', 'o', 0x20, 0x1B, 0x28, 'w', 'o', 'r', 'l', 'd', 0x1B, 0x29, 0x20, 0x1B, 0x65, '5', 0x20, 0x7D}
+
+	septets, err := EncodeText(text, TextEncodingGsm7)
+	if err != nil {
+		t.Fatalf("Expected no error on EncodeText for gsm7, got = (%s)", err)
+	}
+
+	if !bytes.Equal(septets, expectedSeptets) {
+		t.Errorf("Expected gsm7 septets = (%v), got = (%v)", expectedSeptets, septets)
+	}
+
+	if decoded := DecodeText(septets, TextEncodingGsm7); decoded != text {
+		t.Errorf("Expected decoded gsm7 = (%s), got = (%s)", text, decoded)
+	}
+
+	if _, err := EncodeText("日本", TextEncodingGsm7); err == nil {
+		t.Errorf("Expected error on EncodeText for gsm7 with characters outside of the alphabet, got none")
+	}
+}
+
+func TestGsm7PackedEncodingAndDecoding(t *testing.T) {
+	packed, err := EncodeText("hellohello", TextEncodingGsm7Packed)
+	if err != nil {
+		t.Fatalf("Expected no error on EncodeText for gsm7-packed, got = (%s)", err)
+	}
+
+	expectedPacked := []byte{0xE8, 0x32, 0x9B, 0xFD, 0x46, 0x97, 0xD9, 0xEC, 0x37}
+	if !bytes.Equal(packed, expectedPacked) {
+		t.Errorf("Expected packed octets = (%X), got = (%X)", expectedPacked, packed)
+	}
+
+	for _, text := range []string{"hellohello", "1234567", "12345678", "ends in CR\r", "{[]}"} {
+		packed, _ := EncodeText(text, TextEncodingGsm7Packed)
+		if decoded := DecodeText(packed, TextEncodingGsm7Packed); decoded != text {
+			t.Errorf("Expected packed (%q) to decode to itself, got = (%q)", text, decoded)
+		}
+	}
+
+	if packed, _ := EncodeText("1234567", TextEncodingGsm7Packed); len(packed) != 7 || packed[6]>>1 != '\r' {
+		t.Errorf("Expected 7 septets to pack into 7 octets with a trailing CR, got = (%X)", packed)
+	}
+}
+
+func TestLatin1Ucs2AndBinaryEncodingAndDecoding(t *testing.T) {
+	latin1, err := EncodeText("café", TextEncodingLatin1)
+	if err != nil || !bytes.Equal(latin1, []byte{'c', 'a', 'f', 0xE9}) {
+		t.Errorf("Expected latin1 encoding of café = (63 61 66 E9), got = (%X), error = (%v)", latin1, err)
+	}
+
+	if _, err := EncodeText("€", TextEncodingLatin1); err == nil {
+		t.Errorf("Expected error on EncodeText for latin1 with €, got none")
+	}
+
+	if _, err := EncodeText("café", TextEncodingASCII); err == nil {
+		t.Errorf("Expected error on EncodeText for ascii with é, got none")
+	}
+
+	ucs2, _ := EncodeText("a€", TextEncodingUcs2)
+	if !bytes.Equal(ucs2, []byte{0x00, 'a', 0x20, 0xAC}) || DecodeText(ucs2, TextEncodingUcs2) != "a€" {
+		t.Errorf("Expected ucs2 encoding of a€ = (0061 20AC), got = (%X)", ucs2)
+	}
+
+	if binary, _ := EncodeText("\x00\xFF", TextEncodingBinary); !bytes.Equal(binary, []byte{0x00, 0xFF}) {
+		t.Errorf("Expected binary octets to be used as they are, got = (%X)", binary)
+	}
+
+	for dataCoding, expectedEncoding := range map[uint8]TextEncoding{0: TextEncodingGsm7, 1: TextEncodingASCII, 3: TextEncodingLatin1, 4: TextEncodingBinary, 8: TextEncodingUcs2, 0xF1: TextEncodingGsm7, 0xF4: TextEncodingBinary} {
+		if encoding := TextEncodingForDataCoding(dataCoding); encoding != expectedEncoding {
+			t.Errorf("Expected data_coding (%d) to be (%s), got (%s)", dataCoding, expectedEncoding, encoding)
+		}
+	}
+}
+
+func TestPduFactoryAndOutputUseEncoding(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	submitSm, err := factory.CreateSubmitSm(map[string]string{"short_message": "café", "encoding": "latin1"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSubmitSm with encoding=latin1, got = (%s)", err)
+	}
+
+	if submitSm.MandatoryParameters[14].Value.(uint8) != 3 || !bytes.Equal(submitSm.MandatoryParameters[17].Value.([]byte), []byte{'c', 'a', 'f', 0xE9}) {
+		t.Errorf("Expected data_coding (3) and latin1 short_message")
+	}
+
+	if text := ShortMessageText(submitSm); text != "café" {
+		t.Errorf("Expected ShortMessageText = (café), got = (%s)", text)
+	}
+
+	output := NewStandardOutputGenerator().SayThatAPduWasReceivedByAnAgent("esme01", "smsc01", submitSm)
+	if !strings.HasSuffix(output, "short_message=(café)") {
+		t.Errorf("Expected output to include decoded short_message, got = (%s)", output)
+	}
+
+	if _, err := factory.CreateSubmitSm(map[string]string{"short_message": "x", "encoding": "ebcdic"}); err == nil {
+		t.Errorf("Expected error on CreateSubmitSm with unknown encoding, got none")
+	}
+
+	pdus, err := factory.CreateSegmentedSubmitSm(map[string]string{"short_message": strings.Repeat("{x}", 100), "encoding": "gsm7-packed", "segmentation": "udh"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSegmentedSubmitSm with gsm7-packed, got = (%s)", err)
+	}
+
+	if len(pdus) != 4 {
+		t.Fatalf("Expected 4 segments for 500 septets, got (%d)", len(pdus))
+	}
+
+	reassembled := ""
+	for _, pdu := range pdus {
+		shortMessage := pdu.MandatoryParameters[17].Value.([]byte)
+		if len(shortMessage) > 140 {
+			t.Errorf("Expected no more than 140 octets in a packed segment, got (%d)", len(shortMessage))
+		}
+		reassembled += decodeGsm7Septets(unpackSeptets(shortMessage[6:], 1))
+	}
+
+	if reassembled != strings.Repeat("{x}", 100) {
+		t.Errorf("Expected packed segments to reassemble to the original message, got = (%s)", reassembled)
+	}
+}
+
+func TestPduFactoryPassesThroughTextOutsideOfGsm7ByDefault(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	submitSm, err := factory.CreateSubmitSm(map[string]string{"short_message": "a`b"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSubmitSm with text outside of GSM 03.38 and no encoding, got = (%s)", err)
+	}
+
+	if submitSm.MandatoryParameters[14].Value.(uint8) != 0 || !bytes.Equal(submitSm.MandatoryParameters[17].Value.([]byte), []byte("a`b")) {
+		t.Errorf("Expected data_coding (0) and short_message passed through unchanged")
+	}
+
+	if pdus, err := factory.CreateSegmentedSubmitSm(map[string]string{"short_message": strings.Repeat("a`b", 100)}); err != nil || len(pdus) != 3 {
+		t.Errorf("Expected segmented submit-sm with text outside of GSM 03.38 and no encoding to produce (3) PDUs, got (%d) and error = (%v)", len(pdus), err)
+	}
+
+	if submitSm, _ := factory.CreateSubmitSm(map[string]string{"short_message": "a@b"}); !bytes.Equal(submitSm.MandatoryParameters[17].Value.([]byte), []byte{'a', 0x00, 'b'}) {
+		t.Errorf("Expected text in GSM 03.38 to still be encoded as septets by default")
+	}
+
+	if _, err := factory.CreateSubmitSm(map[string]string{"short_message": "a`b", "encoding": "gsm7"}); err == nil {
+		t.Errorf("Expected error on CreateSubmitSm with text outside of GSM 03.38 and encoding=gsm7, got none")
+	}
+}
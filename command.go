@@ -12,11 +12,24 @@ const (
 	SendPDU = iota
 	Help
 	Quit
+	Stats
+	Sessions
+	Outstanding
+	Messages
+	Responses
+	Pending
+	Respond
+	SubmitMultiFailures
 )
 
 // UserCommand represents a user instruction provided to an Agent in an AgentGroup.
 // When Type is SendPDU, Details must be of type SendPduDetails.  When Type is Help,
-// Details must by nil.
+// Details must by nil.  When Type is Stats, Details must be of type StatsDetails.  When
+// Type is Sessions, Details must be nil.  When Type is Outstanding, Details must be of
+// type OutstandingDetails.  When Type is Messages, Details must be of type MessagesDetails.  When
+// Type is Responses, Details must be of type ResponsesDetails.  When Type is Pending, Details must be
+// of type PendingDetails.  When Type is Respond, Details must be of type RespondDetails.  When Type is
+// SubmitMultiFailures, Details must be of type SubmitMultiFailuresDetails.
 type UserCommand struct {
 	Type    UserCommandType
 	Details interface{}
@@ -31,3 +44,59 @@ type SendPduDetails struct {
 	TypeOfSmppPDU                  smpp.CommandIDType
 	StringParametersMap            map[string]string
 }
+
+// StatsDetails identifies the agent for which operational statistics should be reported.
+// If NameOfAgent is the empty string, statistics are reported for all agents.
+type StatsDetails struct {
+	NameOfAgent string
+}
+
+// OutstandingDetails identifies the session for which unanswered requests should be reported.
+type OutstandingDetails struct {
+	NameOfAgent string
+	NameOfPeer  string
+}
+
+// MessagesDetails identifies the SMSC whose stored messages should be reported, and the filter
+// that selects them.
+type MessagesDetails struct {
+	NameOfSmsc string
+	Filter     *MessageFilter
+}
+
+// ResponsesDetails describes a change to the ResponsePolicy of the application.  If RuleToAdd is set, the rule is
+// added.  If NameOfRuleToRemove is set, that rule is removed.  If RemoveAllRules is true, every rule is removed.  In
+// every case, the resulting rules are then reported.
+type ResponsesDetails struct {
+	RuleToAdd          *ResponseRule
+	NameOfRuleToRemove string
+	RemoveAllRules     bool
+}
+
+// SubmitMultiFailuresDetails describes a change to the per-destination failures in automatic submit-multi-resp
+// messages.  If DestinationToFail is set, it fails with ErrorStatusCode.  If DestinationToClear is set, its failure is
+// removed.  If ClearAll is true, every failure is removed.  In every case, the resulting failures are then reported.
+type SubmitMultiFailuresDetails struct {
+	DestinationToFail  string
+	ErrorStatusCode    uint32
+	DestinationToClear string
+	ClearAll           bool
+}
+
+// PendingDetails identifies the agent whose pending requests should be reported.  If NameOfPeer is the empty string,
+// the requests from all of its peers are reported.
+type PendingDetails struct {
+	NameOfAgent string
+	NameOfPeer  string
+}
+
+// RespondDetails instructs an agent to answer a pending request from a peer.  The request is identified by its
+// SequenceNumber, and the response carries CommandStatus.  StringParametersMap provides the fields of the response
+// that depend on the request type (e.g., message_id for a submit-sm-resp).
+type RespondDetails struct {
+	NameOfAgentThatWillRespond string
+	NameOfPeerThatSentRequest  string
+	SequenceNumber             uint32
+	CommandStatus              uint32
+	StringParametersMap        map[string]string
+}
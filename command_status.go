@@ -0,0 +1,144 @@
+package smppth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SMPP 3.4 command_status values
+const (
+	EsmeRok              uint32 = 0x00000000
+	EsmeRinvmsglen       uint32 = 0x00000001
+	EsmeRinvcmdlen       uint32 = 0x00000002
+	EsmeRinvcmdid        uint32 = 0x00000003
+	EsmeRinvbndsts       uint32 = 0x00000004
+	EsmeRalybnd          uint32 = 0x00000005
+	EsmeRinvprtflg       uint32 = 0x00000006
+	EsmeRinvregdlvflg    uint32 = 0x00000007
+	EsmeRsyserr          uint32 = 0x00000008
+	EsmeRinvsrcadr       uint32 = 0x0000000A
+	EsmeRinvdstadr       uint32 = 0x0000000B
+	EsmeRinvmsgid        uint32 = 0x0000000C
+	EsmeRbindfail        uint32 = 0x0000000D
+	EsmeRinvpaswd        uint32 = 0x0000000E
+	EsmeRinvsysid        uint32 = 0x0000000F
+	EsmeRcancelfail      uint32 = 0x00000011
+	EsmeRreplacefail     uint32 = 0x00000013
+	EsmeRmsgqful         uint32 = 0x00000014
+	EsmeRinvsertyp       uint32 = 0x00000015
+	EsmeRinvnumdests     uint32 = 0x00000033
+	EsmeRinvdlname       uint32 = 0x00000034
+	EsmeRinvdestflag     uint32 = 0x00000040
+	EsmeRinvsubrep       uint32 = 0x00000042
+	EsmeRinvesmclass     uint32 = 0x00000043
+	EsmeRcntsubdl        uint32 = 0x00000044
+	EsmeRsubmitfail      uint32 = 0x00000045
+	EsmeRinvsrcton       uint32 = 0x00000048
+	EsmeRinvsrcnpi       uint32 = 0x00000049
+	EsmeRinvdstton       uint32 = 0x00000050
+	EsmeRinvdstnpi       uint32 = 0x00000051
+	EsmeRinvsystyp       uint32 = 0x00000053
+	EsmeRinvrepflag      uint32 = 0x00000054
+	EsmeRinvnummsgs      uint32 = 0x00000055
+	EsmeRthrottled       uint32 = 0x00000058
+	EsmeRinvsched        uint32 = 0x00000061
+	EsmeRinvexpiry       uint32 = 0x00000062
+	EsmeRinvdftmsgid     uint32 = 0x00000063
+	EsmeRxTAppn          uint32 = 0x00000064
+	EsmeRxPAppn          uint32 = 0x00000065
+	EsmeRxRAppn          uint32 = 0x00000066
+	EsmeRqueryfail       uint32 = 0x00000067
+	EsmeRinvoptparstream uint32 = 0x000000C0
+	EsmeRoptparnotallwd  uint32 = 0x000000C1
+	EsmeRinvparlen       uint32 = 0x000000C2
+	EsmeRmissingoptparam uint32 = 0x000000C3
+	EsmeRinvoptparamval  uint32 = 0x000000C4
+	EsmeRdeliveryfailure uint32 = 0x000000FE
+	EsmeRunknownerr      uint32 = 0x000000FF
+)
+
+var commandStatusNameByValue = map[uint32]string{
+	EsmeRok:              "ESME_ROK",
+	EsmeRinvmsglen:       "ESME_RINVMSGLEN",
+	EsmeRinvcmdlen:       "ESME_RINVCMDLEN",
+	EsmeRinvcmdid:        "ESME_RINVCMDID",
+	EsmeRinvbndsts:       "ESME_RINVBNDSTS",
+	EsmeRalybnd:          "ESME_RALYBND",
+	EsmeRinvprtflg:       "ESME_RINVPRTFLG",
+	EsmeRinvregdlvflg:    "ESME_RINVREGDLVFLG",
+	EsmeRsyserr:          "ESME_RSYSERR",
+	EsmeRinvsrcadr:       "ESME_RINVSRCADR",
+	EsmeRinvdstadr:       "ESME_RINVDSTADR",
+	EsmeRinvmsgid:        "ESME_RINVMSGID",
+	EsmeRbindfail:        "ESME_RBINDFAIL",
+	EsmeRinvpaswd:        "ESME_RINVPASWD",
+	EsmeRinvsysid:        "ESME_RINVSYSID",
+	EsmeRcancelfail:      "ESME_RCANCELFAIL",
+	EsmeRreplacefail:     "ESME_RREPLACEFAIL",
+	EsmeRmsgqful:         "ESME_RMSGQFUL",
+	EsmeRinvsertyp:       "ESME_RINVSERTYP",
+	EsmeRinvnumdests:     "ESME_RINVNUMDESTS",
+	EsmeRinvdlname:       "ESME_RINVDLNAME",
+	EsmeRinvdestflag:     "ESME_RINVDESTFLAG",
+	EsmeRinvsubrep:       "ESME_RINVSUBREP",
+	EsmeRinvesmclass:     "ESME_RINVESMCLASS",
+	EsmeRcntsubdl:        "ESME_RCNTSUBDL",
+	EsmeRsubmitfail:      "ESME_RSUBMITFAIL",
+	EsmeRinvsrcton:       "ESME_RINVSRCTON",
+	EsmeRinvsrcnpi:       "ESME_RINVSRCNPI",
+	EsmeRinvdstton:       "ESME_RINVDSTTON",
+	EsmeRinvdstnpi:       "ESME_RINVDSTNPI",
+	EsmeRinvsystyp:       "ESME_RINVSYSTYP",
+	EsmeRinvrepflag:      "ESME_RINVREPFLAG",
+	EsmeRinvnummsgs:      "ESME_RINVNUMMSGS",
+	EsmeRthrottled:       "ESME_RTHROTTLED",
+	EsmeRinvsched:        "ESME_RINVSCHED",
+	EsmeRinvexpiry:       "ESME_RINVEXPIRY",
+	EsmeRinvdftmsgid:     "ESME_RINVDFTMSGID",
+	EsmeRxTAppn:          "ESME_RX_T_APPN",
+	EsmeRxPAppn:          "ESME_RX_P_APPN",
+	EsmeRxRAppn:          "ESME_RX_R_APPN",
+	EsmeRqueryfail:       "ESME_RQUERYFAIL",
+	EsmeRinvoptparstream: "ESME_RINVOPTPARSTREAM",
+	EsmeRoptparnotallwd:  "ESME_ROPTPARNOTALLWD",
+	EsmeRinvparlen:       "ESME_RINVPARLEN",
+	EsmeRmissingoptparam: "ESME_RMISSINGOPTPARAM",
+	EsmeRinvoptparamval:  "ESME_RINVOPTPARAMVAL",
+	EsmeRdeliveryfailure: "ESME_RDELIVERYFAILURE",
+	EsmeRunknownerr:      "ESME_RUNKNOWNERR",
+}
+
+var commandStatusValueByName = func() map[string]uint32 {
+	valueByName := make(map[string]uint32)
+	for value, name := range commandStatusNameByValue {
+		valueByName[name] = value
+	}
+	return valueByName
+}()
+
+// CommandStatusName returns the SMPP mnemonic for a command_status value (e.g., "ESME_RINVDSTADR").  If the
+// value has no defined mnemonic, the value is returned as an eight digit hex string (e.g., "0x00000400").
+func CommandStatusName(commandStatus uint32) string {
+	if name, isDefined := commandStatusNameByValue[commandStatus]; isDefined {
+		return name
+	}
+
+	return fmt.Sprintf("0x%08x", commandStatus)
+}
+
+// CommandStatusFromString converts a command_status mnemonic (e.g., "ESME_RSYSERR", case insensitive)
+// or an integer value (e.g., "8" or "0x00000008") to a command_status value.  An error is returned if the
+// string is neither.
+func CommandStatusFromString(commandStatusString string) (uint32, error) {
+	if value, isDefined := commandStatusValueByName[strings.ToUpper(commandStatusString)]; isDefined {
+		return value, nil
+	}
+
+	value, err := strconv.ParseUint(commandStatusString, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Command status (%s) is neither a known ESME_R* name nor an integer", commandStatusString)
+	}
+
+	return uint32(value), nil
+}
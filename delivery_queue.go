@@ -0,0 +1,305 @@
+package smppth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// DeliveryRetrySchedule determines when an SMSC tries again to deliver a deliver-sm that could not be sent, or that
+// the peer rejected.  The delay before the nth retry is the nth interval, and the last interval is used for every
+// retry after that.  Once a delivery has been attempted the maximum number of times, it is abandoned.  A maximum of
+// zero means that a delivery is retried until it expires.
+type DeliveryRetrySchedule struct {
+	intervals       []time.Duration
+	maximumAttempts int
+}
+
+// NewDeliveryRetrySchedule creates a DeliveryRetrySchedule with intervals of 10 seconds, 30 seconds, 1 minute and
+// 5 minutes, and no maximum number of attempts
+func NewDeliveryRetrySchedule() *DeliveryRetrySchedule {
+	return &DeliveryRetrySchedule{
+		intervals:       []time.Duration{10 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute},
+		maximumAttempts: 0,
+	}
+}
+
+// SetIntervals sets the delays between attempts.  An error is returned if there are no intervals, or if an interval
+// is negative.
+func (schedule *DeliveryRetrySchedule) SetIntervals(intervals []time.Duration) error {
+	if len(intervals) == 0 {
+		return fmt.Errorf("delivery retry schedule must have at least one interval")
+	}
+
+	for _, interval := range intervals {
+		if interval < 0 {
+			return fmt.Errorf("delivery retry interval (%s) must not be negative", interval)
+		}
+	}
+
+	schedule.intervals = append([]time.Duration{}, intervals...)
+	return nil
+}
+
+// SetMaximumAttempts sets the number of attempts after which a delivery is abandoned.  Zero means no maximum.
+func (schedule *DeliveryRetrySchedule) SetMaximumAttempts(maximumAttempts int) *DeliveryRetrySchedule {
+	schedule.maximumAttempts = maximumAttempts
+	return schedule
+}
+
+// MaximumAttempts returns the number of attempts after which a delivery is abandoned, or zero if there is no maximum
+func (schedule *DeliveryRetrySchedule) MaximumAttempts() int {
+	return schedule.maximumAttempts
+}
+
+// IntervalAfterAttempt returns the delay before the next attempt, after the provided number of attempts
+func (schedule *DeliveryRetrySchedule) IntervalAfterAttempt(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	if attempts > len(schedule.intervals) {
+		return schedule.intervals[len(schedule.intervals)-1]
+	}
+
+	return schedule.intervals[attempts-1]
+}
+
+// QueuedDelivery is a deliver-sm that an SMSC must deliver to the peer (that is, the bind system_id) named NameOfPeer.
+// It carries the stored message MessageID or, if IsDeliveryReceipt, is the delivery receipt for that message.
+// Attempts is the number of times that sending it has been tried, and LastFailure describes why the most recent
+// attempt failed.  While the delivery is held, it is retried at NextAttemptAt, or as soon as the peer binds.  If it is
+// not delivered by ExpiresAt (unless that is the zero time), it is abandoned.
+type QueuedDelivery struct {
+	NameOfPeer        string
+	MessageID         string
+	IsDeliveryReceipt bool
+	PDU               *smpp.PDU
+	Attempts          int
+	LastFailure       string
+	QueuedAt          time.Time
+	NextAttemptAt     time.Time
+	ExpiresAt         time.Time
+}
+
+// deliveryQueueInFlightKey identifies a deliver-sm sent to a peer that is awaiting its deliver-sm-resp
+type deliveryQueueInFlightKey struct {
+	nameOfPeer     string
+	sequenceNumber uint32
+}
+
+// DeliveryQueue holds, for each peer of an SMSC, the deliveries that could not be made, so that they can be retried
+// according to the DeliveryRetrySchedule, or when the peer binds.  It also tracks each delivery that has been sent
+// until its deliver-sm-resp arrives, so that a rejected delivery, or one that is lost when the transport closes, can
+// be held again.  Methods that return deliveries return copies.  A DeliveryQueue is safe for concurrent use.
+type DeliveryQueue struct {
+	lock                        sync.Mutex
+	retrySchedule               *DeliveryRetrySchedule
+	heldDeliveriesByNameOfPeer  map[string][]*QueuedDelivery
+	inFlightDeliveriesBySentKey map[deliveryQueueInFlightKey]*QueuedDelivery
+}
+
+// NewDeliveryQueue creates an empty DeliveryQueue, with the default DeliveryRetrySchedule
+func NewDeliveryQueue() *DeliveryQueue {
+	return &DeliveryQueue{
+		retrySchedule:               NewDeliveryRetrySchedule(),
+		heldDeliveriesByNameOfPeer:  make(map[string][]*QueuedDelivery),
+		inFlightDeliveriesBySentKey: make(map[deliveryQueueInFlightKey]*QueuedDelivery),
+	}
+}
+
+// SetRetrySchedule replaces the schedule on which held deliveries are retried
+func (queue *DeliveryQueue) SetRetrySchedule(schedule *DeliveryRetrySchedule) *DeliveryQueue {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.retrySchedule = schedule
+	return queue
+}
+
+// RetrySchedule returns the schedule on which held deliveries are retried
+func (queue *DeliveryQueue) RetrySchedule() *DeliveryRetrySchedule {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	return queue.retrySchedule
+}
+
+// Depth returns the number of deliveries held for the named peer, or for all peers if nameOfPeer is the empty string
+func (queue *DeliveryQueue) Depth(nameOfPeer string) int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	return queue.depth(nameOfPeer)
+}
+
+// HeldDeliveries returns the deliveries held for the named peer, or for all peers if nameOfPeer is the empty string,
+// in the order in which they were first held
+func (queue *DeliveryQueue) HeldDeliveries(nameOfPeer string) []*QueuedDelivery {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	deliveries := make([]*QueuedDelivery, 0)
+	for peer, heldDeliveries := range queue.heldDeliveriesByNameOfPeer {
+		if nameOfPeer == "" || nameOfPeer == peer {
+			for _, delivery := range heldDeliveries {
+				deliveryCopy := *delivery
+				deliveries = append(deliveries, &deliveryCopy)
+			}
+		}
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].QueuedAt.Before(deliveries[j].QueuedAt) })
+
+	return deliveries
+}
+
+// hold adds a delivery whose most recent attempt failed to the queue for its peer, to be retried after the interval
+// in the retry schedule.  It returns false, and does not hold the delivery, if the delivery has been attempted the
+// maximum number of times.
+func (queue *DeliveryQueue) hold(delivery *QueuedDelivery, failure string, now time.Time) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	delivery.LastFailure = failure
+
+	if queue.retrySchedule.maximumAttempts > 0 && delivery.Attempts >= queue.retrySchedule.maximumAttempts {
+		return false
+	}
+
+	if delivery.QueuedAt.IsZero() {
+		delivery.QueuedAt = now
+	}
+	delivery.NextAttemptAt = now.Add(queue.retrySchedule.IntervalAfterAttempt(delivery.Attempts))
+
+	queue.heldDeliveriesByNameOfPeer[delivery.NameOfPeer] = append(queue.heldDeliveriesByNameOfPeer[delivery.NameOfPeer], delivery)
+	return true
+}
+
+// takeDueDeliveries removes and returns no more than maximumNumberOfDeliveries of the held deliveries whose
+// NextAttemptAt is at or before now
+func (queue *DeliveryQueue) takeDueDeliveries(now time.Time, maximumNumberOfDeliveries int) []*QueuedDelivery {
+	return queue.takeHeldDeliveries(func(delivery *QueuedDelivery) bool { return !delivery.NextAttemptAt.After(now) }, maximumNumberOfDeliveries)
+}
+
+// makeDeliveriesForPeerDue sets the NextAttemptAt of every delivery held for the named peer to now (e.g., because
+// the peer has bound), so that they are taken by the next takeDueDeliveries()
+func (queue *DeliveryQueue) makeDeliveriesForPeerDue(nameOfPeer string, now time.Time) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	for _, delivery := range queue.heldDeliveriesByNameOfPeer[nameOfPeer] {
+		delivery.NextAttemptAt = now
+	}
+}
+
+// takeExpiredDeliveries removes and returns the held deliveries whose ExpiresAt is before now
+func (queue *DeliveryQueue) takeExpiredDeliveries(now time.Time) []*QueuedDelivery {
+	return queue.takeHeldDeliveries(func(delivery *QueuedDelivery) bool {
+		return !delivery.ExpiresAt.IsZero() && delivery.ExpiresAt.Before(now)
+	}, 0)
+}
+
+// takeHeldDeliveries removes and returns the held deliveries for which shouldBeTaken is true, but no more than
+// maximumNumberOfDeliveries of them, unless that is zero
+func (queue *DeliveryQueue) takeHeldDeliveries(shouldBeTaken func(*QueuedDelivery) bool, maximumNumberOfDeliveries int) []*QueuedDelivery {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	takenDeliveries := make([]*QueuedDelivery, 0)
+	for nameOfPeer, heldDeliveries := range queue.heldDeliveriesByNameOfPeer {
+		remainingDeliveries := heldDeliveries[:0]
+		for _, delivery := range heldDeliveries {
+			if shouldBeTaken(delivery) && (maximumNumberOfDeliveries == 0 || len(takenDeliveries) < maximumNumberOfDeliveries) {
+				takenDeliveries = append(takenDeliveries, delivery)
+			} else {
+				remainingDeliveries = append(remainingDeliveries, delivery)
+			}
+		}
+
+		if len(remainingDeliveries) == 0 {
+			delete(queue.heldDeliveriesByNameOfPeer, nameOfPeer)
+		} else {
+			queue.heldDeliveriesByNameOfPeer[nameOfPeer] = remainingDeliveries
+		}
+	}
+
+	return takenDeliveries
+}
+
+// trackInFlight records a delivery that was sent, until its deliver-sm-resp arrives
+func (queue *DeliveryQueue) trackInFlight(delivery *QueuedDelivery) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.inFlightDeliveriesBySentKey[deliveryQueueInFlightKey{delivery.NameOfPeer, delivery.PDU.SequenceNumber}] = delivery
+}
+
+// acknowledge removes and returns the delivery sent to the named peer in the deliver-sm with the provided
+// sequence_number, or nil if there is none
+func (queue *DeliveryQueue) acknowledge(nameOfPeer string, sequenceNumber uint32) *QueuedDelivery {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	key := deliveryQueueInFlightKey{nameOfPeer, sequenceNumber}
+	delivery := queue.inFlightDeliveriesBySentKey[key]
+	delete(queue.inFlightDeliveriesBySentKey, key)
+
+	return delivery
+}
+
+// takeInFlightDeliveriesForPeer removes and returns the deliveries sent to the named peer that are awaiting their
+// deliver-sm-resp (e.g., because the transport to the peer closed)
+func (queue *DeliveryQueue) takeInFlightDeliveriesForPeer(nameOfPeer string) []*QueuedDelivery {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	takenDeliveries := make([]*QueuedDelivery, 0)
+	for key, delivery := range queue.inFlightDeliveriesBySentKey {
+		if key.nameOfPeer == nameOfPeer {
+			takenDeliveries = append(takenDeliveries, delivery)
+			delete(queue.inFlightDeliveriesBySentKey, key)
+		}
+	}
+
+	return takenDeliveries
+}
+
+// hasDeliveryOfMessage returns true if a deliver-sm carrying the stored message with the messageID (and not its
+// delivery receipt) is held or awaiting its deliver-sm-resp
+func (queue *DeliveryQueue) hasDeliveryOfMessage(messageID string) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	for _, heldDeliveries := range queue.heldDeliveriesByNameOfPeer {
+		for _, delivery := range heldDeliveries {
+			if delivery.MessageID == messageID && !delivery.IsDeliveryReceipt {
+				return true
+			}
+		}
+	}
+
+	for _, delivery := range queue.inFlightDeliveriesBySentKey {
+		if delivery.MessageID == messageID && !delivery.IsDeliveryReceipt {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (queue *DeliveryQueue) depth(nameOfPeer string) int {
+	if nameOfPeer != "" {
+		return len(queue.heldDeliveriesByNameOfPeer[nameOfPeer])
+	}
+
+	depth := 0
+	for _, heldDeliveries := range queue.heldDeliveriesByNameOfPeer {
+		depth += len(heldDeliveries)
+	}
+
+	return depth
+}
@@ -0,0 +1,115 @@
+package smppth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestDeliveryRetrySchedule(t *testing.T) {
+	schedule := NewDeliveryRetrySchedule()
+
+	if err := schedule.SetIntervals([]time.Duration{}); err == nil {
+		t.Errorf("Expected error on SetIntervals() with no intervals, got none")
+	}
+
+	if err := schedule.SetIntervals([]time.Duration{time.Second, -time.Second}); err == nil {
+		t.Errorf("Expected error on SetIntervals() with negative interval, got none")
+	}
+
+	if err := schedule.SetIntervals([]time.Duration{time.Second, 5 * time.Second}); err != nil {
+		t.Fatalf("Expected no error on SetIntervals(), got = (%s)", err)
+	}
+
+	for attempts, expectedInterval := range map[int]time.Duration{0: time.Second, 1: time.Second, 2: 5 * time.Second, 9: 5 * time.Second} {
+		if interval := schedule.IntervalAfterAttempt(attempts); interval != expectedInterval {
+			t.Errorf("Expected interval after (%d) attempts = (%s), got = (%s)", attempts, expectedInterval, interval)
+		}
+	}
+}
+
+func TestDeliveryQueueHoldAndTake(t *testing.T) {
+	queue := NewDeliveryQueue()
+	schedule := NewDeliveryRetrySchedule().SetMaximumAttempts(3)
+	schedule.SetIntervals([]time.Duration{time.Second, 10 * time.Second})
+	queue.SetRetrySchedule(schedule)
+
+	now := time.Now()
+
+	deliveries := []*QueuedDelivery{
+		{NameOfPeer: "esme01", MessageID: "msg01", Attempts: 1},
+		{NameOfPeer: "esme01", MessageID: "msg02", Attempts: 2, ExpiresAt: now.Add(5 * time.Second)},
+		{NameOfPeer: "esme02", MessageID: "msg03", Attempts: 1, IsDeliveryReceipt: true},
+	}
+
+	for _, delivery := range deliveries {
+		if !queue.hold(delivery, "not bound", now) {
+			t.Fatalf("Expected delivery for (%s) to be held", delivery.MessageID)
+		}
+	}
+
+	if queue.hold(&QueuedDelivery{NameOfPeer: "esme01", MessageID: "msg04", Attempts: 3}, "not bound", now) {
+		t.Errorf("Expected delivery attempted the maximum number of times not to be held")
+	}
+
+	if depth := queue.Depth("esme01"); depth != 2 {
+		t.Errorf("Expected depth for esme01 = 2, got = (%d)", depth)
+	}
+
+	if depth := queue.Depth(""); depth != 3 {
+		t.Errorf("Expected depth for all peers = 3, got = (%d)", depth)
+	}
+
+	if held := queue.HeldDeliveries("esme02"); len(held) != 1 || held[0].MessageID != "msg03" || held[0].LastFailure != "not bound" || !held[0].NextAttemptAt.Equal(now.Add(time.Second)) {
+		t.Errorf("Expected msg03 held for esme02 until one second from now, got = (%+v)", held)
+	}
+
+	due := queue.takeDueDeliveries(now.Add(time.Second), 1)
+	if len(due) != 1 || queue.Depth("") != 2 {
+		t.Errorf("Expected no more than the maximum number of due deliveries to be taken, got (%d) due and (%d) held", len(due), queue.Depth(""))
+	}
+
+	due = append(due, queue.takeDueDeliveries(now.Add(time.Second), 0)...)
+	if len(due) != 2 || queue.Depth("") != 1 {
+		t.Errorf("Expected msg01 and msg03 to be due after one second, got (%d) due and (%d) held", len(due), queue.Depth(""))
+	}
+
+	if expired := queue.takeExpiredDeliveries(now.Add(6 * time.Second)); len(expired) != 1 || expired[0].MessageID != "msg02" {
+		t.Errorf("Expected msg02 to expire, got = (%+v)", expired)
+	}
+
+	queue.hold(deliveries[0], "rejected", now)
+	queue.hold(deliveries[2], "rejected", now)
+
+	queue.makeDeliveriesForPeerDue("esme01", now)
+	if flushed := queue.takeDueDeliveries(now, 0); len(flushed) != 1 || flushed[0].MessageID != "msg01" || queue.Depth("esme01") != 0 || queue.Depth("esme02") != 1 {
+		t.Errorf("Expected only the deliveries for esme01 to be due when it binds, got = (%+v)", flushed)
+	}
+}
+
+func TestDeliveryQueueInFlight(t *testing.T) {
+	queue := NewDeliveryQueue()
+
+	first := &QueuedDelivery{NameOfPeer: "esme01", MessageID: "msg01", PDU: smpp.NewPDU(smpp.CommandDeliverSm, 0, 7, []*smpp.Parameter{}, []*smpp.Parameter{})}
+	second := &QueuedDelivery{NameOfPeer: "esme01", MessageID: "msg02", PDU: smpp.NewPDU(smpp.CommandDeliverSm, 0, 8, []*smpp.Parameter{}, []*smpp.Parameter{})}
+
+	queue.trackInFlight(first)
+	queue.trackInFlight(second)
+
+	if delivery := queue.acknowledge("esme02", 7); delivery != nil {
+		t.Errorf("Expected no delivery in flight to esme02")
+	}
+
+	if delivery := queue.acknowledge("esme01", 7); delivery != first {
+		t.Errorf("Expected acknowledge() to return msg01, got = (%+v)", delivery)
+	}
+
+	if delivery := queue.acknowledge("esme01", 7); delivery != nil {
+		t.Errorf("Expected a delivery to be acknowledged only once")
+	}
+
+	if lost := queue.takeInFlightDeliveriesForPeer("esme01"); len(lost) != 1 || lost[0] != second {
+		t.Errorf("Expected msg02 to be taken when transport closes, got = (%+v)", lost)
+	}
+}
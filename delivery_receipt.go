@@ -0,0 +1,243 @@
+package smppth
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// registered_delivery values for the SMSC delivery receipt (bits 1 and 0)
+const (
+	registeredDeliveryReceiptMask      = 0x03
+	registeredDeliveryReceiptOnOutcome = 0x01
+	registeredDeliveryReceiptOnFailure = 0x02
+)
+
+// esmClassDeliveryReceipt is the esm_class message type for an SMSC delivery receipt
+const esmClassDeliveryReceipt = 0x04
+
+// optional parameters carried by a delivery receipt
+const (
+	tlvTagReceiptedMessageID uint16 = 0x001E
+	tlvTagMessageState       uint16 = 0x0427
+)
+
+// maximumDeliveryReceiptTextLength is the number of characters of the original message included in the text: field
+const maximumDeliveryReceiptTextLength = 20
+
+// DeliveryReceipt is the content of an SMSC delivery receipt, as carried in the short_message of a deliver-sm
+type DeliveryReceipt struct {
+	MessageID  string
+	Submitted  int
+	Delivered  int
+	SubmitDate time.Time
+	DoneDate   time.Time
+	State      MessageState
+	ErrorCode  int
+	Text       string
+}
+
+// String returns the receipt in the de facto standard format (SMPP 3.4 Appendix B), i.e.,
+// id:IIIIIIIIII sub:SSS dlvrd:DDD submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:DDDDDDD err:E text:...
+func (receipt *DeliveryReceipt) String() string {
+	return fmt.Sprintf("id:%s sub:%03d dlvrd:%03d submit date:%s done date:%s stat:%s err:%03d text:%s",
+		receipt.MessageID,
+		receipt.Submitted,
+		receipt.Delivered,
+		receipt.SubmitDate.UTC().Format("0601021504"),
+		receipt.DoneDate.UTC().Format("0601021504"),
+		receipt.State.ReceiptStat(),
+		receipt.ErrorCode,
+		receipt.Text)
+}
+
+var deliveryReceiptTextMatcher = regexp.MustCompile(`(?i)^id:(\S*)\s+sub:(\d+)\s+dlvrd:(\d+)\s+submit date:(\d{10}|\d{12})\s+done date:(\d{10}|\d{12})\s+stat:(\w+)\s+err:(\w+)(?:\s+text:(.*))?`)
+
+// ParseDeliveryReceipt parses the text of a delivery receipt in the format produced by DeliveryReceipt.String().
+// The field names are not case sensitive, the dates may include seconds (YYMMDDhhmmss), and the text: field may be
+// absent.  The dates are treated as UTC.  An err: value that is not decimal is read as hex.
+func ParseDeliveryReceipt(text string) (*DeliveryReceipt, error) {
+	groups := deliveryReceiptTextMatcher.FindStringSubmatch(text)
+	if groups == nil {
+		return nil, fmt.Errorf("(%s) is not in the delivery receipt format", text)
+	}
+
+	submitted, _ := strconv.Atoi(groups[2])
+	delivered, _ := strconv.Atoi(groups[3])
+
+	submitDate, err := parseDeliveryReceiptDate(groups[4])
+	if err != nil {
+		return nil, fmt.Errorf("delivery receipt submit date (%s) is not valid", groups[4])
+	}
+
+	doneDate, err := parseDeliveryReceiptDate(groups[5])
+	if err != nil {
+		return nil, fmt.Errorf("delivery receipt done date (%s) is not valid", groups[5])
+	}
+
+	state, err := MessageStateFromString(groups[6])
+	if err != nil {
+		return nil, fmt.Errorf("delivery receipt stat (%s) is not a message state", groups[6])
+	}
+
+	errorCode, err := strconv.ParseInt(groups[7], 10, 32)
+	if err != nil {
+		if errorCode, err = strconv.ParseInt(groups[7], 16, 32); err != nil {
+			return nil, fmt.Errorf("delivery receipt err (%s) is not a number", groups[7])
+		}
+	}
+
+	return &DeliveryReceipt{
+		MessageID:  groups[1],
+		Submitted:  submitted,
+		Delivered:  delivered,
+		SubmitDate: submitDate,
+		DoneDate:   doneDate,
+		State:      state,
+		ErrorCode:  int(errorCode),
+		Text:       groups[8],
+	}, nil
+}
+
+func parseDeliveryReceiptDate(value string) (time.Time, error) {
+	if len(value) == 12 {
+		return time.Parse("060102150405", value)
+	}
+
+	return time.Parse("0601021504", value)
+}
+
+// DeliveryReceiptRule sets the final state reported in the delivery receipt for messages that match it.  A nil
+// pattern matches any address.  ErrorCode is the value reported as err: in the receipt text.
+type DeliveryReceiptRule struct {
+	SourceAddrPattern      *regexp.Regexp
+	DestinationAddrPattern *regexp.Regexp
+	FinalState             MessageState
+	ErrorCode              int
+}
+
+func (rule *DeliveryReceiptRule) matches(sourceAddr string, destinationAddr string) bool {
+	if rule.SourceAddrPattern != nil && !rule.SourceAddrPattern.MatchString(sourceAddr) {
+		return false
+	}
+
+	return rule.DestinationAddrPattern == nil || rule.DestinationAddrPattern.MatchString(destinationAddr)
+}
+
+// DeliveryReceiptPolicy determines when an SMSC sends a delivery receipt for an accepted submit-sm, and what the
+// receipt reports.  The receipt is sent after the delay, with the final state from the first rule that matches the
+// message.  If no rule matches, the final state is DELIVERED.  A receipt is sent only if the submit-sm asks for one
+// in registered_delivery: for any final state (1), or only for a final state other than DELIVERED (2).
+type DeliveryReceiptPolicy struct {
+	delay time.Duration
+	rules []*DeliveryReceiptRule
+}
+
+// NewDeliveryReceiptPolicy creates a DeliveryReceiptPolicy with no rules and a delay of one second
+func NewDeliveryReceiptPolicy() *DeliveryReceiptPolicy {
+	return &DeliveryReceiptPolicy{
+		delay: time.Second,
+		rules: make([]*DeliveryReceiptRule, 0),
+	}
+}
+
+// SetDelay sets the time between the acceptance of a message and the delivery receipt for it
+func (policy *DeliveryReceiptPolicy) SetDelay(delay time.Duration) *DeliveryReceiptPolicy {
+	policy.delay = delay
+	return policy
+}
+
+// Delay returns the time between the acceptance of a message and the delivery receipt for it
+func (policy *DeliveryReceiptPolicy) Delay() time.Duration {
+	return policy.delay
+}
+
+// AddRule appends a rule.  Rules are evaluated in the order in which they are added.  An error is returned if
+// the rule FinalState is not a final state.
+func (policy *DeliveryReceiptPolicy) AddRule(rule *DeliveryReceiptRule) error {
+	if !rule.FinalState.IsFinal() {
+		return fmt.Errorf("delivery receipt rule final state must be a final state (e.g., DELIVRD, UNDELIV, EXPIRED or REJECTD), not (%s)", rule.FinalState)
+	}
+
+	policy.rules = append(policy.rules, rule)
+	return nil
+}
+
+// outcomeForSubmitSm returns the final state and error code to report for a submit-sm, and whether
+// registered_delivery asks for a receipt with that outcome
+func (policy *DeliveryReceiptPolicy) outcomeForSubmitSm(submitSm *smpp.PDU) (finalState MessageState, errorCode int, receiptIsRequested bool) {
+	finalState = MessageStateDelivered
+
+	for _, rule := range policy.rules {
+		if rule.matches(mandatoryStringParameter(submitSm, 3), mandatoryStringParameter(submitSm, 6)) {
+			finalState, errorCode = rule.FinalState, rule.ErrorCode
+			break
+		}
+	}
+
+	if len(submitSm.MandatoryParameters) < 13 {
+		return finalState, errorCode, false
+	}
+
+	registeredDelivery, _ := submitSm.MandatoryParameters[12].Value.(uint8)
+
+	return finalState, errorCode, deliveryReceiptIsRequested(registeredDelivery, finalState)
+}
+
+// deliveryReceiptIsRequested returns true if registered_delivery asks for a receipt for a message that reaches the
+// final state
+func deliveryReceiptIsRequested(registeredDelivery uint8, finalState MessageState) bool {
+	switch registeredDelivery & registeredDeliveryReceiptMask {
+	case registeredDeliveryReceiptOnOutcome:
+		return true
+	case registeredDeliveryReceiptOnFailure:
+		return finalState != MessageStateDelivered
+	}
+
+	return false
+}
+
+// PendingDeliveryReceipt is a delivery receipt that an SMSC will send for a stored message.  At DueAt, the message
+// moves to FinalState (unless it has already reached a final state, such as EXPIRED), and the receipt is sent to the
+// peer named NameOfPeer.
+type PendingDeliveryReceipt struct {
+	NameOfPeer string
+	DueAt      time.Time
+	FinalState MessageState
+	ErrorCode  int
+}
+
+// createDeliveryReceiptDeliverSm creates the deliver-sm that carries a receipt for a message from sourceAddr to
+// destinationAddr.  The receipt goes back to the original sender, so the addresses are reversed.
+func createDeliveryReceiptDeliverSm(factory PduFactory, receipt *DeliveryReceipt, sourceAddr string, destinationAddr string) (*smpp.PDU, error) {
+	return factory.CreateDeliverSm(map[string]string{
+		"source_addr":          destinationAddr,
+		"destination_addr":     sourceAddr,
+		"esm_class":            strconv.Itoa(esmClassDeliveryReceipt),
+		"encoding":             "ascii",
+		"short_message":        receipt.String(),
+		"receipted_message_id": receipt.MessageID,
+		"message_state":        strconv.Itoa(int(receipt.State)),
+	})
+}
+
+// deliveryReceiptText returns the first characters of a message for the text: field of a receipt.  Octets that
+// are not printable ASCII are replaced with '.'.
+func deliveryReceiptText(shortMessage []byte) string {
+	if len(shortMessage) > maximumDeliveryReceiptTextLength {
+		shortMessage = shortMessage[:maximumDeliveryReceiptTextLength]
+	}
+
+	text := make([]byte, len(shortMessage))
+	for i, octet := range shortMessage {
+		if octet < 0x20 || octet > 0x7E {
+			octet = '.'
+		}
+		text[i] = octet
+	}
+
+	return string(text)
+}
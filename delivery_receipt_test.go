@@ -0,0 +1,136 @@
+package smppth
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestDeliveryReceiptText(t *testing.T) {
+	receipt := &DeliveryReceipt{
+		MessageID:  "abc123",
+		Submitted:  1,
+		Delivered:  0,
+		SubmitDate: time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC),
+		DoneDate:   time.Date(2030, 1, 2, 15, 6, 0, 0, time.UTC),
+		State:      MessageStateUndeliverable,
+		ErrorCode:  7,
+		Text:       deliveryReceiptText([]byte("The quick brown fox\x01 jumps")),
+	}
+
+	expected := "id:abc123 sub:001 dlvrd:000 submit date:3001021504 done date:3001021506 stat:UNDELIV err:007 text:The quick brown fox."
+	if receipt.String() != expected {
+		t.Errorf("Expected receipt text = (%s), got = (%s)", expected, receipt.String())
+	}
+}
+
+func TestDeliveryReceiptPolicyOutcome(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	policy := NewDeliveryReceiptPolicy()
+
+	if err := policy.AddRule(&DeliveryReceiptRule{DestinationAddrPattern: regexp.MustCompile(`^999`), FinalState: MessageStateUndeliverable, ErrorCode: 1}); err != nil {
+		t.Fatalf("Expected no error on AddRule, got = (%s)", err)
+	}
+
+	if err := policy.AddRule(&DeliveryReceiptRule{FinalState: MessageStateEnroute}); err == nil {
+		t.Errorf("Expected error on AddRule with ENROUTE final state, got none")
+	}
+
+	for _, testCase := range []struct {
+		destinationAddr    string
+		registeredDelivery string
+		expectedState      MessageState
+		expectedError      int
+		expectedRequested  bool
+	}{
+		{"1000", "0", MessageStateDelivered, 0, false},
+		{"1000", "1", MessageStateDelivered, 0, true},
+		{"1000", "2", MessageStateDelivered, 0, false},
+		{"9991", "1", MessageStateUndeliverable, 1, true},
+		{"9991", "2", MessageStateUndeliverable, 1, true},
+		{"9991", "0x11", MessageStateUndeliverable, 1, true},
+	} {
+		submitSm, err := factory.CreateSubmitSm(map[string]string{"destination_addr": testCase.destinationAddr, "registered_delivery": testCase.registeredDelivery})
+		if err != nil {
+			t.Fatalf("Expected no error on CreateSubmitSm, got = (%s)", err)
+		}
+
+		state, errorCode, requested := policy.outcomeForSubmitSm(submitSm)
+		if state != testCase.expectedState || errorCode != testCase.expectedError || requested != testCase.expectedRequested {
+			t.Errorf("For destination_addr (%s) and registered_delivery (%s) expected (%s, %d, %t), got (%s, %d, %t)", testCase.destinationAddr, testCase.registeredDelivery,
+				testCase.expectedState, testCase.expectedError, testCase.expectedRequested, state, errorCode, requested)
+		}
+	}
+}
+
+func TestDeliveryReceiptDeliverSm(t *testing.T) {
+	receipt := &DeliveryReceipt{MessageID: "abc123", Submitted: 1, Delivered: 1, State: MessageStateDelivered, Text: "hello"}
+
+	deliverSm, err := createDeliveryReceiptDeliverSm(NewDefaultPduFactory(), receipt, "1000", "2000")
+	if err != nil {
+		t.Fatalf("Expected no error on createDeliveryReceiptDeliverSm, got = (%s)", err)
+	}
+
+	encoded, _ := deliverSm.Encode()
+	decoded, err := decodePDU(encoded)
+	if err != nil {
+		t.Fatalf("Expected no error decoding receipt deliver-sm, got = (%s)", err)
+	}
+
+	if mandatoryStringParameter(decoded, 3) != "2000" || mandatoryStringParameter(decoded, 6) != "1000" {
+		t.Errorf("Expected receipt from (2000) to (1000), got from (%s) to (%s)", mandatoryStringParameter(decoded, 3), mandatoryStringParameter(decoded, 6))
+	}
+
+	if esmClass := decoded.MandatoryParameters[7].Value.(uint8); esmClass != esmClassDeliveryReceipt {
+		t.Errorf("Expected esm_class (0x04), got (0x%02X)", esmClass)
+	}
+
+	if text := ShortMessageText(decoded); text != receipt.String() {
+		t.Errorf("Expected short_message = (%s), got = (%s)", receipt.String(), text)
+	}
+
+	if tlv := findTlvParameter(decoded, tlvTagReceiptedMessageID); tlv == nil || describeTlvValue(tlv) != "abc123" {
+		t.Errorf("Expected receipted_message_id (abc123)")
+	}
+
+	if tlv := findTlvParameter(decoded, tlvTagMessageState); tlv == nil || tlvValueAsUint(tlv) != uint32(MessageStateDelivered) {
+		t.Errorf("Expected message_state (2)")
+	}
+}
+
+func TestParseDeliveryReceipt(t *testing.T) {
+	original := &DeliveryReceipt{
+		MessageID:  "abc123",
+		Submitted:  1,
+		Delivered:  1,
+		SubmitDate: time.Date(2030, 1, 2, 15, 4, 0, 0, time.UTC),
+		DoneDate:   time.Date(2030, 1, 2, 15, 6, 0, 0, time.UTC),
+		State:      MessageStateDelivered,
+		ErrorCode:  0,
+		Text:       "hello there",
+	}
+
+	parsed, err := ParseDeliveryReceipt(original.String())
+	if err != nil {
+		t.Fatalf("Expected no error on ParseDeliveryReceipt, got = (%s)", err)
+	}
+
+	if *parsed != *original {
+		t.Errorf("Expected parsed receipt = (%+v), got = (%+v)", original, parsed)
+	}
+
+	parsed, err = ParseDeliveryReceipt("id:99 sub:001 dlvrd:000 submit date:300102150405 done date:300102150607 stat:REJECTD err:00F")
+	if err != nil {
+		t.Fatalf("Expected no error on ParseDeliveryReceipt with seconds, hex err and no text, got = (%s)", err)
+	}
+
+	if parsed.MessageID != "99" || parsed.State != MessageStateRejected || parsed.ErrorCode != 0x0F || parsed.DoneDate.Second() != 7 || parsed.Text != "" {
+		t.Errorf("Expected id 99, REJECTD, err 0x0F, done date seconds 7 and no text, got = (%+v)", parsed)
+	}
+
+	for _, text := range []string{"hello", "id:1 sub:001 dlvrd:000 submit date:30010215 done date:3001021504 stat:DELIVRD err:000", "id:1 sub:001 dlvrd:000 submit date:3001021504 done date:3001021504 stat:LOST err:000"} {
+		if _, err := ParseDeliveryReceipt(text); err == nil {
+			t.Errorf("Expected error on ParseDeliveryReceipt(%s), got none", text)
+		}
+	}
+}
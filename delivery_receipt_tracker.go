@@ -0,0 +1,229 @@
+package smppth
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// esmClassMessageTypeMask selects the message type bits (bits 5 through 2) of esm_class
+const esmClassMessageTypeMask = 0x3C
+
+// TrackedMessage is a submit-sm sent by an agent that asked for a delivery receipt.  MessageID is empty until
+// the submit-sm-resp arrives.
+type TrackedMessage struct {
+	AgentName          string
+	PeerName           string
+	SequenceNumber     uint32
+	MessageID          string
+	SourceAddr         string
+	DestinationAddr    string
+	RegisteredDelivery uint8
+	SubmittedAt        time.Time
+}
+
+// ReceivedDeliveryReceipt is a delivery receipt received by an agent.  DeliveryReceipt holds the fields parsed from
+// the receipt text.  If the text could not be parsed, only MessageID and State are set, from the
+// receipted_message_id and message_state TLVs.  When the receipt is for a message tracked by the
+// DeliveryReceiptTracker, TrackedMessage is that message, and Latency is the time from the submit-sm to the
+// receipt.  Otherwise, TrackedMessage is nil and Latency is zero.
+type ReceivedDeliveryReceipt struct {
+	DeliveryReceipt
+	ReceivedAt     time.Time
+	TrackedMessage *TrackedMessage
+	Latency        time.Duration
+}
+
+// trackerSessionKey identifies the session between an agent and a peer
+type trackerSessionKey struct {
+	agentName string
+	peerName  string
+}
+
+// DeliveryReceiptTracker follows each submit-sm sent by an agent that asks for a delivery receipt (that is, with
+// registered_delivery of 1 or 2).  The submit-sm is linked to the message_id in its submit-sm-resp, and then to
+// the deliver-sm delivery receipt that carries that message_id, either in receipted_message_id or in the receipt
+// text.  A submit-sm whose submit-sm-resp has a non-zero command_status is no longer tracked.  Each AgentEvent
+// should be passed to ObserveAgentEvent().  A DeliveryReceiptTracker is safe for concurrent use.
+type DeliveryReceiptTracker struct {
+	lock                               sync.Mutex
+	messagesAwaitingResponseBySequence map[trackerSessionKey]map[uint32]*TrackedMessage
+	messagesAwaitingReceiptByMessageID map[trackerSessionKey]map[string]*TrackedMessage
+}
+
+// NewDeliveryReceiptTracker creates a DeliveryReceiptTracker that is tracking no messages
+func NewDeliveryReceiptTracker() *DeliveryReceiptTracker {
+	return &DeliveryReceiptTracker{
+		messagesAwaitingResponseBySequence: make(map[trackerSessionKey]map[uint32]*TrackedMessage),
+		messagesAwaitingReceiptByMessageID: make(map[trackerSessionKey]map[string]*TrackedMessage),
+	}
+}
+
+// ObserveAgentEvent accepts an AgentEvent.  If it is a ReceivedPDU event for a deliver-sm delivery receipt, a
+// DeliveryReceiptReceived event is returned, whether or not the receipt is for a tracked message.  Otherwise,
+// nil is returned.
+func (tracker *DeliveryReceiptTracker) ObserveAgentEvent(event *AgentEvent) *AgentEvent {
+	if event == nil || event.SourceAgent == nil {
+		return nil
+	}
+
+	sessionKey := trackerSessionKey{agentName: event.SourceAgent.Name(), peerName: event.RemotePeerName}
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	switch event.Type {
+	case SentPDU:
+		if event.SmppPDU != nil && event.SmppPDU.CommandID == smpp.CommandSubmitSm {
+			tracker.trackSubmitSm(sessionKey, event.SmppPDU)
+		}
+
+	case ReceivedPDU:
+		if event.SmppPDU == nil {
+			return nil
+		}
+
+		switch event.SmppPDU.CommandID {
+		case smpp.CommandSubmitSmResp:
+			tracker.linkSubmitSmResp(sessionKey, event.SmppPDU)
+
+		case smpp.CommandDeliverSm:
+			if isDeliveryReceipt(event.SmppPDU) {
+				return &AgentEvent{
+					Type:            DeliveryReceiptReceived,
+					SourceAgent:     event.SourceAgent,
+					RemotePeerName:  event.RemotePeerName,
+					SmppPDU:         event.SmppPDU,
+					DeliveryReceipt: tracker.matchDeliveryReceipt(sessionKey, event.SmppPDU),
+				}
+			}
+		}
+
+	case PeerTransportClosed:
+		delete(tracker.messagesAwaitingResponseBySequence, sessionKey)
+	}
+
+	return nil
+}
+
+// MessagesAwaitingReceipts returns the tracked messages sent by the named agent to the named peer for which no
+// delivery receipt has arrived, including those still waiting for a submit-sm-resp, ordered by the time that they
+// were sent.  If agentName or peerName is the empty string, messages for all agents or all peers are returned.
+func (tracker *DeliveryReceiptTracker) MessagesAwaitingReceipts(agentName string, peerName string) []*TrackedMessage {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	messages := make([]*TrackedMessage, 0)
+	appendMessagesForSession := func(sessionKey trackerSessionKey, message *TrackedMessage) {
+		if (agentName == "" || agentName == sessionKey.agentName) && (peerName == "" || peerName == sessionKey.peerName) {
+			messageCopy := *message
+			messages = append(messages, &messageCopy)
+		}
+	}
+
+	for sessionKey, messagesBySequence := range tracker.messagesAwaitingResponseBySequence {
+		for _, message := range messagesBySequence {
+			appendMessagesForSession(sessionKey, message)
+		}
+	}
+
+	for sessionKey, messagesByMessageID := range tracker.messagesAwaitingReceiptByMessageID {
+		for _, message := range messagesByMessageID {
+			appendMessagesForSession(sessionKey, message)
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].SubmittedAt.Before(messages[j].SubmittedAt) })
+
+	return messages
+}
+
+func (tracker *DeliveryReceiptTracker) trackSubmitSm(sessionKey trackerSessionKey, submitSm *smpp.PDU) {
+	if len(submitSm.MandatoryParameters) < 13 {
+		return
+	}
+
+	registeredDelivery, _ := submitSm.MandatoryParameters[12].Value.(uint8)
+	if receiptRequest := registeredDelivery & registeredDeliveryReceiptMask; receiptRequest != registeredDeliveryReceiptOnOutcome && receiptRequest != registeredDeliveryReceiptOnFailure {
+		return
+	}
+
+	messagesBySequence, sessionIsKnown := tracker.messagesAwaitingResponseBySequence[sessionKey]
+	if !sessionIsKnown {
+		messagesBySequence = make(map[uint32]*TrackedMessage)
+		tracker.messagesAwaitingResponseBySequence[sessionKey] = messagesBySequence
+	}
+
+	messagesBySequence[submitSm.SequenceNumber] = &TrackedMessage{
+		AgentName:          sessionKey.agentName,
+		PeerName:           sessionKey.peerName,
+		SequenceNumber:     submitSm.SequenceNumber,
+		SourceAddr:         mandatoryStringParameter(submitSm, 3),
+		DestinationAddr:    mandatoryStringParameter(submitSm, 6),
+		RegisteredDelivery: registeredDelivery,
+		SubmittedAt:        time.Now(),
+	}
+}
+
+func (tracker *DeliveryReceiptTracker) linkSubmitSmResp(sessionKey trackerSessionKey, submitSmResp *smpp.PDU) {
+	message, isTracked := tracker.messagesAwaitingResponseBySequence[sessionKey][submitSmResp.SequenceNumber]
+	if !isTracked {
+		return
+	}
+
+	delete(tracker.messagesAwaitingResponseBySequence[sessionKey], submitSmResp.SequenceNumber)
+
+	if submitSmResp.CommandStatus != 0 {
+		return
+	}
+
+	message.MessageID = mandatoryStringParameter(submitSmResp, 0)
+
+	messagesByMessageID, sessionIsKnown := tracker.messagesAwaitingReceiptByMessageID[sessionKey]
+	if !sessionIsKnown {
+		messagesByMessageID = make(map[string]*TrackedMessage)
+		tracker.messagesAwaitingReceiptByMessageID[sessionKey] = messagesByMessageID
+	}
+
+	messagesByMessageID[message.MessageID] = message
+}
+
+func (tracker *DeliveryReceiptTracker) matchDeliveryReceipt(sessionKey trackerSessionKey, deliverSm *smpp.PDU) *ReceivedDeliveryReceipt {
+	received := &ReceivedDeliveryReceipt{ReceivedAt: time.Now()}
+
+	if parsedReceipt, err := ParseDeliveryReceipt(ShortMessageText(deliverSm)); err == nil {
+		received.DeliveryReceipt = *parsedReceipt
+	} else {
+		received.State = MessageStateUnknown
+	}
+
+	if receiptedMessageID := findTlvParameter(deliverSm, tlvTagReceiptedMessageID); receiptedMessageID != nil {
+		received.MessageID = strings.TrimRight(tlvValueAsString(receiptedMessageID), "\x00")
+	}
+
+	if messageState := findTlvParameter(deliverSm, tlvTagMessageState); messageState != nil {
+		received.State = MessageState(tlvValueAsUint(messageState))
+	}
+
+	if message, isTracked := tracker.messagesAwaitingReceiptByMessageID[sessionKey][received.MessageID]; isTracked {
+		delete(tracker.messagesAwaitingReceiptByMessageID[sessionKey], received.MessageID)
+		received.TrackedMessage = message
+		received.Latency = received.ReceivedAt.Sub(message.SubmittedAt)
+	}
+
+	return received
+}
+
+// isDeliveryReceipt returns true if the PDU is a deliver-sm with the esm_class message type of an SMSC delivery
+// receipt
+func isDeliveryReceipt(pdu *smpp.PDU) bool {
+	if pdu.CommandID != smpp.CommandDeliverSm || len(pdu.MandatoryParameters) < 8 {
+		return false
+	}
+
+	esmClass, _ := pdu.MandatoryParameters[7].Value.(uint8)
+	return esmClass&esmClassMessageTypeMask == esmClassDeliveryReceipt
+}
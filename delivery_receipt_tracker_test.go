@@ -0,0 +1,90 @@
+package smppth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestDeliveryReceiptTrackerLinksSubmitSmToReceipt(t *testing.T) {
+	esme := NewEsme("esme01", net.ParseIP("127.0.0.1"), 2775)
+	factory := NewDefaultPduFactory()
+	tracker := NewDeliveryReceiptTracker()
+
+	trackedSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000", "registered_delivery": "1"})
+	rejectedSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2001", "registered_delivery": "1"})
+	untrackedSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2002"})
+	trackedSubmitSm.SequenceNumber, rejectedSubmitSm.SequenceNumber, untrackedSubmitSm.SequenceNumber = 10, 11, 12
+
+	for _, submitSm := range []*smpp.PDU{trackedSubmitSm, rejectedSubmitSm, untrackedSubmitSm} {
+		if event := tracker.ObserveAgentEvent(&AgentEvent{Type: SentPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: submitSm}); event != nil {
+			t.Fatalf("Expected no event for sent submit-sm, got (%s)", eventTypeToString(event.Type))
+		}
+	}
+
+	if awaiting := tracker.MessagesAwaitingReceipts("esme01", "smsc01"); len(awaiting) != 2 || awaiting[0].MessageID != "" {
+		t.Fatalf("Expected two messages awaiting submit-sm-resp, got (%d)", len(awaiting))
+	}
+
+	rejectedSubmitSmResp := factory.CreateSubmitSmRespFromRequest(rejectedSubmitSm, "")
+	rejectedSubmitSmResp.CommandStatus = EsmeRinvdstadr
+	tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", factory.CreateSubmitSmRespFromRequest(trackedSubmitSm, "msg01")))
+	tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", rejectedSubmitSmResp))
+
+	awaiting := tracker.MessagesAwaitingReceipts("", "")
+	if len(awaiting) != 1 || awaiting[0].MessageID != "msg01" || awaiting[0].DestinationAddr != "2000" {
+		t.Fatalf("Expected only msg01 awaiting a receipt, got (%d) messages", len(awaiting))
+	}
+
+	if awaiting := tracker.MessagesAwaitingReceipts("esme02", ""); len(awaiting) != 0 {
+		t.Errorf("Expected no messages awaiting receipts for esme02, got (%d)", len(awaiting))
+	}
+
+	receipt := &DeliveryReceipt{MessageID: "msg01", Submitted: 1, SubmitDate: time.Now(), DoneDate: time.Now(), State: MessageStateExpired, ErrorCode: 4}
+	receiptDeliverSm, _ := createDeliveryReceiptDeliverSm(factory, receipt, "1000", "2000")
+
+	event := tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", receiptDeliverSm))
+	if event == nil || event.Type != DeliveryReceiptReceived {
+		t.Fatalf("Expected DeliveryReceiptReceived event for receipt, got = (%v)", event)
+	}
+
+	if received := event.DeliveryReceipt; received.MessageID != "msg01" || received.State != MessageStateExpired || received.ErrorCode != 4 || received.TrackedMessage == nil || received.Latency <= 0 {
+		t.Errorf("Expected receipt for tracked msg01 with state EXPIRED, err 4 and a latency, got = (%+v)", received)
+	}
+
+	if awaiting := tracker.MessagesAwaitingReceipts("", ""); len(awaiting) != 0 {
+		t.Errorf("Expected no messages awaiting receipts, got (%d)", len(awaiting))
+	}
+
+	event = tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", receiptDeliverSm))
+	if event == nil || event.DeliveryReceipt.TrackedMessage != nil || event.DeliveryReceipt.Latency != 0 {
+		t.Errorf("Expected DeliveryReceiptReceived for an untracked message on a repeated receipt")
+	}
+
+	ordinaryDeliverSm, _ := factory.CreateDeliverSm(map[string]string{"short_message": "id:msg01 is not a receipt"})
+	if event := tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", ordinaryDeliverSm)); event != nil {
+		t.Errorf("Expected no event for a deliver-sm that is not a receipt, got (%s)", eventTypeToString(event.Type))
+	}
+}
+
+func TestDeliveryReceiptTrackerMatchesByReceiptText(t *testing.T) {
+	esme := NewEsme("esme01", net.ParseIP("127.0.0.1"), 2775)
+	factory := NewDefaultPduFactory()
+	tracker := NewDeliveryReceiptTracker()
+
+	submitSm, _ := factory.CreateSubmitSm(map[string]string{"destination_addr": "2000", "registered_delivery": "2"})
+	tracker.ObserveAgentEvent(&AgentEvent{Type: SentPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: submitSm})
+	tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", factory.CreateSubmitSmRespFromRequest(submitSm, "7F3A")))
+
+	receiptDeliverSm, _ := factory.CreateDeliverSm(map[string]string{
+		"esm_class":     "4",
+		"short_message": "id:7F3A sub:001 dlvrd:000 submit date:3001021504 done date:3001021505 stat:UNDELIV err:00B text:hello",
+	})
+
+	event := tracker.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", receiptDeliverSm))
+	if event == nil || event.DeliveryReceipt.TrackedMessage == nil || event.DeliveryReceipt.State != MessageStateUndeliverable || event.DeliveryReceipt.ErrorCode != 0x0B {
+		t.Errorf("Expected receipt matched by text with state UNDELIV and err 0x0B, got = (%+v)", event)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/blorticus/smpp"
 	"golang.org/x/sys/unix"
@@ -18,7 +21,9 @@ type ESME struct {
 	port                                        uint16
 	peerBinds                                   []smppBindInfo
 	mapOfConnectorForRemotePeerByRemotePeerName map[string]*esmePeerMessageListener
+	connectorMapLock                            sync.RWMutex
 	agentEventChannel                           chan<- *AgentEvent
+	wireTraceAttachments                        *wireTraceAttachments
 }
 
 // NewEsme creates an SMPP 3.4 client with the given name, and using the given IP and port for outgoing
@@ -30,7 +35,8 @@ func NewEsme(esmeName string, esmeIP net.IP, esmePort uint16) *ESME {
 		port:      esmePort,
 		peerBinds: make([]smppBindInfo, 0, 10),
 		mapOfConnectorForRemotePeerByRemotePeerName: make(map[string]*esmePeerMessageListener),
-		agentEventChannel: nil,
+		agentEventChannel:    nil,
+		wireTraceAttachments: newWireTraceAttachments(),
 	}
 }
 
@@ -44,11 +50,26 @@ func (esme *ESME) Name() string {
 	return esme.name
 }
 
+// AttachWireTraceWriter enables wire tracing for the sessions with all peers, writing the trace to the
+// provided writer.  It replaces any tracer previously attached for all peers, but a tracer attached for a
+// specific peer with AttachWireTraceWriterForPeer takes precedence for that peer.
+func (esme *ESME) AttachWireTraceWriter(writer io.Writer) {
+	esme.wireTraceAttachments.attachForAllPeers(NewWireTracer(writer))
+	esme.applyWireTracersToPeerSessions()
+}
+
+// AttachWireTraceWriterForPeer enables wire tracing for the session with the named peer, writing the
+// trace to the provided writer.
+func (esme *ESME) AttachWireTraceWriterForPeer(nameOfPeer string, writer io.Writer) {
+	esme.wireTraceAttachments.attachForPeer(nameOfPeer, NewWireTracer(writer))
+	esme.applyWireTracersToPeerSessions()
+}
+
 // SendMessageToPeer instructs this ESME agent to send a message to the peer identified in the
 // MessageDescriptor.  No effort is made to validate that the MessageDescriptor SourceAgentName
 // matches this agent's name.
 func (esme *ESME) SendMessageToPeer(message *MessageDescriptor) error {
-	connector := esme.mapOfConnectorForRemotePeerByRemotePeerName[message.NameOfReceivingPeer]
+	connector := esme.connectorForPeer(message.NameOfReceivingPeer)
 
 	if connector == nil {
 		return fmt.Errorf("No such SMSC peer named (%s) is known to this ESME", message.NameOfReceivingPeer)
@@ -63,28 +84,77 @@ func (esme *ESME) SendMessageToPeer(message *MessageDescriptor) error {
 func (esme *ESME) StartEventLoop() {
 	for _, peerBind := range esme.peerBinds {
 		conn, err := esme.connectTransportToPeer(peerBind.remoteIP, peerBind.remotePort)
+		if err != nil {
+			esme.sendTransportErrorEvent(err, peerBind.smscName)
+			continue
+		}
 
 		peerConnector := newEsmePeerMessageListener(peerBind.smscName, esme, conn)
+		peerConnector.peerConnection.setTracer(esme.wireTraceAttachments.tracerForPeer(peerBind.smscName))
 
 		if err = peerConnector.completeTransceiverBindingTowardPeer(peerBind.systemID, peerBind.systemType, peerBind.password); err != nil {
 			esme.sendApplicationErrorEvent(err, nil)
 			return
 		}
 
+		esme.connectorMapLock.Lock()
 		esme.mapOfConnectorForRemotePeerByRemotePeerName[peerBind.smscName] = peerConnector
+		esme.connectorMapLock.Unlock()
 
 		go peerConnector.startListeningForIncomingMessagesFromPeer()
 	}
 }
 
+// ClosePeerTransport closes the transport toward the named SMSC peer without unbinding, as if the connection were
+// lost.  A PeerTransportClosed AgentEvent is raised once the transport is closed.  An error is returned if no such
+// peer is known to this ESME.
+func (esme *ESME) ClosePeerTransport(nameOfPeer string) error {
+	connector := esme.connectorForPeer(nameOfPeer)
+
+	if connector == nil {
+		return fmt.Errorf("No such SMSC peer named (%s) is known to this ESME", nameOfPeer)
+	}
+
+	connector.close()
+	return nil
+}
+
 // UnbindAll instructs this ESME agent to both unbind all outstanding peer
 // connections, and close their corresponding transports.
 func (esme *ESME) UnbindAll() {
-	for _, peerHandler := range esme.mapOfConnectorForRemotePeerByRemotePeerName {
+	for _, peerHandler := range esme.connectorsByNameOfPeer() {
 		peerHandler.stop()
 	}
 }
 
+func (esme *ESME) applyWireTracersToPeerSessions() {
+	for nameOfPeer, peerConnector := range esme.connectorsByNameOfPeer() {
+		peerConnector.peerConnection.setTracer(esme.wireTraceAttachments.tracerForPeer(nameOfPeer))
+	}
+}
+
+// connectorForPeer returns the connector for the named SMSC peer, or nil if there is none.  Connectors are added by
+// StartEventLoop() while other goroutines send messages, so the map is only accessed with its lock held.
+func (esme *ESME) connectorForPeer(nameOfPeer string) *esmePeerMessageListener {
+	esme.connectorMapLock.RLock()
+	defer esme.connectorMapLock.RUnlock()
+
+	return esme.mapOfConnectorForRemotePeerByRemotePeerName[nameOfPeer]
+}
+
+// connectorsByNameOfPeer returns a copy of the map of connectors, so that it can be iterated without the lock held
+func (esme *ESME) connectorsByNameOfPeer() map[string]*esmePeerMessageListener {
+	esme.connectorMapLock.RLock()
+	defer esme.connectorMapLock.RUnlock()
+
+	connectors := make(map[string]*esmePeerMessageListener, len(esme.mapOfConnectorForRemotePeerByRemotePeerName))
+	for nameOfPeer, connector := range esme.mapOfConnectorForRemotePeerByRemotePeerName {
+		connectors[nameOfPeer] = connector
+	}
+
+	return connectors
+}
+
 func (esme *ESME) sendApplicationErrorEvent(err error, pduRelatedToErrorOrNilIfNone *smpp.PDU) {
 	esme.sendEventIfChannelDefined(&AgentEvent{
 		Type:           ApplicationError,
@@ -157,14 +227,14 @@ func dialControlFunctionToSetReuse(network, address string, c syscall.RawConn) e
 }
 
 func (esme *ESME) connectTransportToPeer(remoteIP net.IP, remotePort uint16) (net.Conn, error) {
-	laddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", esme.ip.String(), esme.port))
+	laddr, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(esme.ip.String(), strconv.Itoa(int(esme.port))))
 
 	d := net.Dialer{
 		Control:   dialControlFunctionToSetReuse,
 		LocalAddr: laddr,
 	}
 
-	return d.Dial("tcp", fmt.Sprintf("%s:%d", remoteIP.String(), remotePort))
+	return d.Dial("tcp", net.JoinHostPort(remoteIP.String(), strconv.Itoa(int(remotePort))))
 }
 
 type smppBindInfo struct {
@@ -177,23 +247,30 @@ type smppBindInfo struct {
 }
 
 type esmePeerMessageListener struct {
-	streamReader                                  *smpp.NetworkStreamReader
-	peerConnection                                net.Conn
+	streamReader                                  *pduStreamReader
+	peerConnection                                *wireTracingConn
 	extraPDUsCollectedWhileWaitingForBindResponse []*smpp.PDU
 	nameOfRemotePeer                              string
 	parentESME                                    *ESME
 	nextGeneratedSmppRequestPduSeqNumber          uint32
+	sendLock                                      sync.Mutex
+	sentRequests                                  *sentRequestTracker
 	stopChannel                                   chan bool
+	closeChannel                                  chan bool
 }
 
 func newEsmePeerMessageListener(nameOfPeer string, parentESME *ESME, connectionToRemotePeer net.Conn) *esmePeerMessageListener {
+	tracingConnectionToRemotePeer := newWireTracingConn(connectionToRemotePeer, wireTraceSessionID(parentESME.Name(), nameOfPeer))
+
 	return &esmePeerMessageListener{
 		nameOfRemotePeer:                     nameOfPeer,
 		parentESME:                           parentESME,
-		peerConnection:                       connectionToRemotePeer,
-		streamReader:                         smpp.NewNetworkStreamReader(connectionToRemotePeer),
+		peerConnection:                       tracingConnectionToRemotePeer,
+		streamReader:                         newPduStreamReader(tracingConnectionToRemotePeer),
 		nextGeneratedSmppRequestPduSeqNumber: 1,
+		sentRequests:                         newSentRequestTracker(),
 		stopChannel:                          make(chan bool),
+		closeChannel:                         make(chan bool, 1),
 	}
 }
 
@@ -260,12 +337,7 @@ type peerMessageListenerStreamReaderOutput struct {
 
 func (connector *esmePeerMessageListener) startListeningForIncomingMessagesFromPeer() {
 	for _, pdu := range connector.extraPDUsCollectedWhileWaitingForBindResponse {
-		connector.parentESME.sendEventIfChannelDefined(&AgentEvent{
-			Type:           ReceivedPDU,
-			SmppPDU:        pdu,
-			RemotePeerName: connector.nameOfRemotePeer,
-			SourceAgent:    connector.parentESME,
-		})
+		connector.processPduReceivedFromPeer(pdu)
 	}
 
 	streamReaderReceiptChannel := make(chan *peerMessageListenerStreamReaderOutput)
@@ -280,17 +352,25 @@ func (connector *esmePeerMessageListener) startListeningForIncomingMessagesFromP
 	for {
 		select {
 		case incomingStreamReaderResults := <-streamReaderReceiptChannel:
-			if connector.parentESME.sendTransportErrorEventAndStopAllWhenErrorDefined(incomingStreamReaderResults.err, connector.nameOfRemotePeer) {
-				return
+			for _, pdu := range incomingStreamReaderResults.pdus {
+				connector.processPduReceivedFromPeer(pdu)
 			}
 
-			for _, pdu := range incomingStreamReaderResults.pdus {
-				connector.parentESME.sendEventIfChannelDefined(&AgentEvent{
-					Type:           ReceivedPDU,
-					SmppPDU:        pdu,
-					RemotePeerName: connector.nameOfRemotePeer,
-					SourceAgent:    connector.parentESME,
-				})
+			if decodeError, isDecodeError := incomingStreamReaderResults.err.(*PduDecodeError); isDecodeError {
+				if connector.parentESME.sendTransportErrorEventAndStopAllWhenErrorDefined(connector.answerUndecodablePduWithGenericNack(decodeError), connector.nameOfRemotePeer) {
+					return
+				}
+
+				if decodeError.TransportMustClose {
+					connector.closePeerTransport()
+					return
+				}
+
+				continue
+			}
+
+			if connector.parentESME.sendTransportErrorEventAndStopAllWhenErrorDefined(incomingStreamReaderResults.err, connector.nameOfRemotePeer) {
+				return
 			}
 
 		case <-connector.stopChannel:
@@ -299,22 +379,79 @@ func (connector *esmePeerMessageListener) startListeningForIncomingMessagesFromP
 			}
 
 			return
+
+		case <-connector.closeChannel:
+			connector.closePeerTransport()
+			return
 		}
 	}
 }
 
-func (connector *esmePeerMessageListener) sendSmppPduToPeer(pdu *smpp.PDU) error {
+// closePeerTransport closes the transport without unbinding, then emits a PeerTransportClosed event
+func (connector *esmePeerMessageListener) closePeerTransport() {
+	if err := connector.peerConnection.Close(); err != nil {
+		connector.parentESME.sendTransportErrorEvent(fmt.Errorf("On local connection close: %s", err), connector.nameOfRemotePeer)
+		return
+	}
+
+	connector.parentESME.sendEventIfChannelDefined(&AgentEvent{
+		Type:           PeerTransportClosed,
+		SourceAgent:    connector.parentESME,
+		RemotePeerName: connector.nameOfRemotePeer,
+	})
+}
+
+// processPduReceivedFromPeer emits a ReceivedPDU event for the PDU.  If it is a generic-nack that rejects a
+// request sent on this session, a ProtocolError event is also emitted.
+func (connector *esmePeerMessageListener) processPduReceivedFromPeer(pdu *smpp.PDU) {
+	connector.parentESME.sendEventIfChannelDefined(&AgentEvent{
+		Type:           ReceivedPDU,
+		SmppPDU:        pdu,
+		RemotePeerName: connector.nameOfRemotePeer,
+		SourceAgent:    connector.parentESME,
+	})
+
 	if pdu.IsRequest() {
-		connector.resetSmppRequestPduSequenceNumberToLocalSequence(pdu)
+		return
 	}
 
-	encodedPDU, err := pdu.Encode()
-	if err != nil {
+	if rejectedRequest := connector.sentRequests.removeRequestMatchingResponse(pdu); rejectedRequest != nil && pdu.CommandID == smpp.CommandGenericNack {
+		connector.parentESME.sendEventIfChannelDefined(&AgentEvent{
+			Type:           ProtocolError,
+			SmppPDU:        rejectedRequest,
+			RemotePeerName: connector.nameOfRemotePeer,
+			SourceAgent:    connector.parentESME,
+			Error:          genericNackRejectionError(pdu, rejectedRequest),
+		})
+	}
+}
+
+// answerUndecodablePduWithGenericNack sends a generic-nack for a PDU that could not be decoded, then emits
+// a ProtocolError event.  An error is returned only if the generic-nack could not be sent.
+func (connector *esmePeerMessageListener) answerUndecodablePduWithGenericNack(decodeError *PduDecodeError) error {
+	genericNack := generateGenericNackForDecodeError(decodeError)
+
+	if err := connector.sendSmppPduToPeer(genericNack); err != nil {
 		return err
 	}
 
-	_, err = connector.peerConnection.Write(encodedPDU)
-	if err != nil {
+	connector.parentESME.sendEventIfChannelDefined(&AgentEvent{
+		Type:           ProtocolError,
+		SmppPDU:        genericNack,
+		RemotePeerName: connector.nameOfRemotePeer,
+		SourceAgent:    connector.parentESME,
+		Error:          decodeError,
+	})
+
+	return nil
+}
+
+// sendSmppPduToPeer writes a PDU to the peer, then emits a SentPDU event.  A request is given the next local
+// sequence_number.  PDUs may be sent from several goroutines at once (e.g., parallel scenario branches), so the
+// sequence_number is assigned, and the PDU is written, with the send lock held.  That way, no two requests share a
+// sequence_number, and requests reach the peer in sequence_number order.
+func (connector *esmePeerMessageListener) sendSmppPduToPeer(pdu *smpp.PDU) error {
+	if err := connector.writeSmppPduToPeer(pdu); err != nil {
 		return err
 	}
 
@@ -328,6 +465,31 @@ func (connector *esmePeerMessageListener) sendSmppPduToPeer(pdu *smpp.PDU) error
 	return nil
 }
 
+func (connector *esmePeerMessageListener) writeSmppPduToPeer(pdu *smpp.PDU) error {
+	connector.sendLock.Lock()
+	defer connector.sendLock.Unlock()
+
+	if pdu.IsRequest() {
+		connector.resetSmppRequestPduSequenceNumberToLocalSequence(pdu)
+	}
+
+	encodedPDU, err := pdu.Encode()
+	if err != nil {
+		return err
+	}
+
+	if pdu.IsRequest() {
+		connector.sentRequests.add(pdu, time.Now())
+	}
+
+	if _, err = connector.peerConnection.Write(encodedPDU); err != nil {
+		connector.sentRequests.removeRequestMatchingResponse(pdu)
+		return err
+	}
+
+	return nil
+}
+
 func (connector *esmePeerMessageListener) resetSmppRequestPduSequenceNumberToLocalSequence(requestPdu *smpp.PDU) {
 	requestPdu.SequenceNumber = connector.nextGeneratedSmppRequestPduSeqNumber
 	connector.nextGeneratedSmppRequestPduSeqNumber++
@@ -336,3 +498,12 @@ func (connector *esmePeerMessageListener) resetSmppRequestPduSequenceNumberToLoc
 func (connector *esmePeerMessageListener) stop() {
 	connector.stopChannel <- true
 }
+
+// close asks the listener to close the transport without unbinding.  It does not block, and does nothing if a close
+// has already been requested.
+func (connector *esmePeerMessageListener) close() {
+	select {
+	case connector.closeChannel <- true:
+	default:
+	}
+}
@@ -16,7 +16,7 @@ func TestEsmePeerMessageListener(t *testing.T) {
 	conn := newFakeNetConn()
 
 	connector := newEsmePeerMessageListener("testSmsc01", esme, conn)
-	connector.streamReader = smpp.NewNetworkStreamReader(conn)
+	connector.streamReader = newPduStreamReader(conn)
 
 	conn.nextReadValue = testSmppMsgTransceiverResp01()
 	connector.completeTransceiverBindingTowardPeer("esme01", "system", "password")
@@ -250,3 +250,122 @@ func simulatedSmscReceivePDUWithExpectations(conn net.Conn, expectedCommandID sm
 
 	return pdu, nil
 }
+
+func TestEsmePeerMessageListenerAnswersUndecodablePduWithGenericNack(t *testing.T) {
+	esme := NewEsme("test-esme", nil, 0)
+	conn := newFakeNetConn()
+	connector := newEsmePeerMessageListener("testSmsc01", esme, conn)
+
+	eventMsgChannel := make(chan *AgentEvent, 10)
+	esme.SetAgentEventChannel(eventMsgChannel)
+
+	submitSm := testSmppPDUSubmitSm01()
+	if err := connector.sendSmppPduToPeer(submitSm); err != nil {
+		t.Fatalf("Expected no error on sendSmppPduToPeer, got = (%s)", err)
+	}
+	if _, err := eventChannelTypeCheck(eventMsgChannel, SentPDU); err != nil {
+		t.Fatalf("On submit-sm send, %s", err)
+	}
+
+	unknownCommandID := []byte{0, 0, 0, 0x10, 0, 0, 0x01, 0x99, 0, 0, 0, 0, 0, 0, 0, 0x21}
+	genericNackForSubmitSm, _ := smpp.NewPDU(smpp.CommandGenericNack, EsmeRinvcmdid, submitSm.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{}).Encode()
+	conn.nextReadValue = append(append([]byte{}, genericNackForSubmitSm...), unknownCommandID...)
+
+	go connector.startListeningForIncomingMessagesFromPeer()
+
+	event, err := eventChannelTypeCheck(eventMsgChannel, ReceivedPDU)
+	if err != nil {
+		t.Fatalf("On generic-nack from peer, %s", err)
+	}
+	if event.SmppPDU.CommandID != smpp.CommandGenericNack {
+		t.Errorf("Expected received generic-nack, got (%s)", event.SmppPDU.CommandName())
+	}
+
+	event, err = eventChannelTypeCheck(eventMsgChannel, ProtocolError)
+	if err != nil {
+		t.Fatalf("On generic-nack from peer, %s", err)
+	}
+	if event.SmppPDU != submitSm {
+		t.Errorf("Expected ProtocolError for generic-nack to carry the rejected submit-sm")
+	}
+
+	event, err = eventChannelTypeCheck(eventMsgChannel, SentPDU)
+	if err != nil {
+		t.Fatalf("On PDU with unknown command_id from peer, %s", err)
+	}
+	if event.SmppPDU.CommandID != smpp.CommandGenericNack || event.SmppPDU.CommandStatus != EsmeRinvcmdid || event.SmppPDU.SequenceNumber != 0x21 {
+		t.Errorf("Expected generic-nack with ESME_RINVCMDID and sequence number (0x21), got (%s) with status (%s) and sequence number (%d)", event.SmppPDU.CommandName(), CommandStatusName(event.SmppPDU.CommandStatus), event.SmppPDU.SequenceNumber)
+	}
+
+	event, err = eventChannelTypeCheck(eventMsgChannel, ProtocolError)
+	if err != nil {
+		t.Fatalf("On PDU with unknown command_id from peer, %s", err)
+	}
+	if decodeError, isDecodeError := event.Error.(*PduDecodeError); !isDecodeError || decodeError.CommandID != 0x00000199 {
+		t.Errorf("Expected ProtocolError with *PduDecodeError for command_id (0x00000199), got = (%v)", event.Error)
+	}
+
+	if _, err := eventChannelTypeCheck(eventMsgChannel, ReceivedPDU); err != nil {
+		t.Errorf("Expected session to remain open after generic-nack, %s", err)
+	}
+}
+
+func TestEsmePeerMessageListenerClosesTransportOnOversizedPdu(t *testing.T) {
+	esme := NewEsme("test-esme", nil, 0)
+	conn := newFakeNetConn()
+	connector := newEsmePeerMessageListener("testSmsc01", esme, conn)
+
+	eventMsgChannel := make(chan *AgentEvent, 10)
+	esme.SetAgentEventChannel(eventMsgChannel)
+
+	conn.nextReadValue = []byte{0x7f, 0, 0, 0, 0, 0, 0, 0x04, 0, 0, 0, 0, 0, 0, 0, 0x22}
+	go connector.startListeningForIncomingMessagesFromPeer()
+
+	event, err := eventChannelTypeCheck(eventMsgChannel, SentPDU)
+	if err != nil {
+		t.Fatalf("On PDU with oversized command_length from peer, %s", err)
+	}
+	if event.SmppPDU.CommandID != smpp.CommandGenericNack || event.SmppPDU.CommandStatus != EsmeRinvcmdlen || event.SmppPDU.SequenceNumber != 0x22 {
+		t.Errorf("Expected generic-nack with ESME_RINVCMDLEN and sequence number (0x22), got (%s) with status (%s) and sequence number (%d)", event.SmppPDU.CommandName(), CommandStatusName(event.SmppPDU.CommandStatus), event.SmppPDU.SequenceNumber)
+	}
+
+	if _, err := eventChannelTypeCheck(eventMsgChannel, ProtocolError); err != nil {
+		t.Fatalf("On PDU with oversized command_length from peer, %s", err)
+	}
+
+	if _, err := eventChannelTypeCheck(eventMsgChannel, PeerTransportClosed); err != nil {
+		t.Errorf("Expected transport to be closed after oversized PDU, %s", err)
+	}
+}
+
+func TestEsmeClosePeerTransport(t *testing.T) {
+	esme := NewEsme("test-esme", nil, 0)
+	localConn, remoteConn := net.Pipe()
+	connector := newEsmePeerMessageListener("testSmsc01", esme, localConn)
+	esme.mapOfConnectorForRemotePeerByRemotePeerName["testSmsc01"] = connector
+
+	eventMsgChannel := make(chan *AgentEvent, 10)
+	esme.SetAgentEventChannel(eventMsgChannel)
+
+	go connector.startListeningForIncomingMessagesFromPeer()
+
+	if err := esme.ClosePeerTransport("testSmsc02"); err == nil {
+		t.Errorf("Expected error on ClosePeerTransport() for unknown peer, got none")
+	}
+
+	if err := esme.ClosePeerTransport("testSmsc01"); err != nil {
+		t.Fatalf("Expected no error on ClosePeerTransport(), got = (%s)", err)
+	}
+
+	event, err := eventChannelTypeCheck(eventMsgChannel, PeerTransportClosed)
+	if err != nil {
+		t.Fatalf("On ClosePeerTransport(), %s", err)
+	}
+	if event.RemotePeerName != "testSmsc01" {
+		t.Errorf("Expected PeerTransportClosed for (testSmsc01), got (%s)", event.RemotePeerName)
+	}
+
+	if _, err := remoteConn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected transport to be closed without an unbind, but read from it succeeded")
+	}
+}
@@ -0,0 +1,90 @@
+package smppth
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+const (
+	// maximumAgeOfSentRequest is how long a sent request is retained while waiting for its response
+	maximumAgeOfSentRequest = 5 * time.Minute
+
+	// maximumNumberOfSentRequests is the most requests retained for a single peer session
+	maximumNumberOfSentRequests = 10000
+)
+
+type sentRequest struct {
+	pdu    *smpp.PDU
+	sentAt time.Time
+}
+
+// sentRequestTracker retains the requests sent on a peer session until a response with the same sequence
+// number arrives, so that a generic-nack from the peer can be linked to the request that it rejects.  A request
+// is forgotten when it has waited longer than maximumAgeOfSentRequest, and the oldest request is forgotten when
+// more than maximumNumberOfSentRequests are waiting, so a peer that never responds cannot grow the tracker.
+type sentRequestTracker struct {
+	lock                    sync.Mutex
+	requestsInOrderOfSend   *list.List
+	elementBySequenceNumber map[uint32]*list.Element
+}
+
+func newSentRequestTracker() *sentRequestTracker {
+	return &sentRequestTracker{
+		requestsInOrderOfSend:   list.New(),
+		elementBySequenceNumber: make(map[uint32]*list.Element),
+	}
+}
+
+func (tracker *sentRequestTracker) add(requestPDU *smpp.PDU, sentAt time.Time) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if element, requestIsKnown := tracker.elementBySequenceNumber[requestPDU.SequenceNumber]; requestIsKnown {
+		tracker.requestsInOrderOfSend.Remove(element)
+	}
+
+	tracker.elementBySequenceNumber[requestPDU.SequenceNumber] = tracker.requestsInOrderOfSend.PushBack(&sentRequest{pdu: requestPDU, sentAt: sentAt})
+
+	for oldest := tracker.requestsInOrderOfSend.Front(); oldest != nil; oldest = tracker.requestsInOrderOfSend.Front() {
+		if tracker.requestsInOrderOfSend.Len() <= maximumNumberOfSentRequests && sentAt.Sub(oldest.Value.(*sentRequest).sentAt) <= maximumAgeOfSentRequest {
+			break
+		}
+
+		tracker.removeElement(oldest)
+	}
+}
+
+// removeRequestMatchingResponse removes and returns the request with the same sequence number as the
+// response, or returns nil if there is no such request
+func (tracker *sentRequestTracker) removeRequestMatchingResponse(responsePDU *smpp.PDU) *smpp.PDU {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	element, requestIsKnown := tracker.elementBySequenceNumber[responsePDU.SequenceNumber]
+	if !requestIsKnown {
+		return nil
+	}
+
+	return tracker.removeElement(element)
+}
+
+func (tracker *sentRequestTracker) removeElement(element *list.Element) *smpp.PDU {
+	request := tracker.requestsInOrderOfSend.Remove(element).(*sentRequest)
+	delete(tracker.elementBySequenceNumber, request.pdu.SequenceNumber)
+
+	return request.pdu
+}
+
+// generateGenericNackForDecodeError creates the generic-nack answering a PDU that could not be decoded
+func generateGenericNackForDecodeError(decodeError *PduDecodeError) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandGenericNack, decodeError.CommandStatus, decodeError.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+}
+
+// genericNackRejectionError describes a generic-nack from a peer that rejects a request sent by an agent
+func genericNackRejectionError(genericNack *smpp.PDU, rejectedRequest *smpp.PDU) error {
+	return fmt.Errorf("Peer rejected %s with sequence number (%d) with generic-nack, command_status=(%s)", rejectedRequest.CommandName(), rejectedRequest.SequenceNumber, CommandStatusName(genericNack.CommandStatus))
+}
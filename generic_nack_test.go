@@ -0,0 +1,48 @@
+package smppth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestSentRequestTrackerForgetsOldAndExcessRequests(t *testing.T) {
+	tracker := newSentRequestTracker()
+	start := time.Now()
+
+	enquireLink := func(sequenceNumber uint32) *smpp.PDU {
+		return smpp.NewPDU(smpp.CommandEnquireLink, 0, sequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+	}
+	enquireLinkResp := func(sequenceNumber uint32) *smpp.PDU {
+		return smpp.NewPDU(smpp.CommandEnquireLinkResp, 0, sequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+	}
+
+	tracker.add(enquireLink(1), start)
+	tracker.add(enquireLink(2), start.Add(time.Minute))
+	tracker.add(enquireLink(3), start.Add(maximumAgeOfSentRequest+time.Second))
+
+	if tracker.removeRequestMatchingResponse(enquireLinkResp(1)) != nil {
+		t.Errorf("Expected request older than maximumAgeOfSentRequest to be forgotten")
+	}
+
+	if request := tracker.removeRequestMatchingResponse(enquireLinkResp(2)); request == nil || request.SequenceNumber != 2 {
+		t.Errorf("Expected request within maximumAgeOfSentRequest to be retained")
+	}
+
+	for sequenceNumber := uint32(10); sequenceNumber < 10+maximumNumberOfSentRequests+5; sequenceNumber++ {
+		tracker.add(enquireLink(sequenceNumber), start.Add(maximumAgeOfSentRequest+time.Second))
+	}
+
+	if tracker.requestsInOrderOfSend.Len() != maximumNumberOfSentRequests || len(tracker.elementBySequenceNumber) != maximumNumberOfSentRequests {
+		t.Errorf("Expected tracker to hold (%d) requests, got (%d)", maximumNumberOfSentRequests, tracker.requestsInOrderOfSend.Len())
+	}
+
+	if tracker.removeRequestMatchingResponse(enquireLinkResp(3)) != nil || tracker.removeRequestMatchingResponse(enquireLinkResp(14)) != nil {
+		t.Errorf("Expected oldest requests to be forgotten when the tracker is full")
+	}
+
+	if tracker.removeRequestMatchingResponse(enquireLinkResp(15)) == nil {
+		t.Errorf("Expected newer requests to be retained when the tracker is full")
+	}
+}
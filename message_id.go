@@ -0,0 +1,202 @@
+package smppth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maximumMessageIDLength is the longest message_id permitted by SMPP 3.4, excluding the terminating NUL
+const maximumMessageIDLength = 64
+
+// MessageIDGenerator produces the message_id for a message accepted by an agent (e.g., in a submit-sm-resp).
+// NextMessageID must be safe for concurrent use, and must not return the same message_id twice.
+type MessageIDGenerator interface {
+	NextMessageID(nameOfAgent string) string
+}
+
+// messageIDForgetter is a MessageIDGenerator that remembers the message_ids that it produced (e.g.,
+// RandomMessageIDGenerator), and so must be told when one is no longer in use
+type messageIDForgetter interface {
+	ForgetMessageID(messageID string)
+}
+
+// forgetMessageID releases messageID in generator, if the generator remembers the message_ids that it produced
+func forgetMessageID(generator MessageIDGenerator, messageID string) {
+	if forgetter, generatorRemembersMessageIDs := generator.(messageIDForgetter); generatorRemembersMessageIDs {
+		forgetter.ForgetMessageID(messageID)
+	}
+}
+
+// nextMessageIDNotInStore returns the next message_id from generator that is not already in store.  Because a
+// generator never repeats a message_id, this asks the generator for no more than one message_id more than the
+// number of stored messages.
+func nextMessageIDNotInStore(generator MessageIDGenerator, nameOfAgent string, store *MessageStore) string {
+	for {
+		messageID := generator.NextMessageID(nameOfAgent)
+		if !store.HasMessage(messageID) {
+			return messageID
+		}
+	}
+}
+
+// SequentialMessageIDGenerator produces decimal message_ids (e.g., 1, 2, 3), counting up from a starting value
+type SequentialMessageIDGenerator struct {
+	nextValue uint64
+}
+
+// NewSequentialMessageIDGenerator creates a SequentialMessageIDGenerator whose first message_id is firstValue
+func NewSequentialMessageIDGenerator(firstValue uint64) *SequentialMessageIDGenerator {
+	return &SequentialMessageIDGenerator{nextValue: firstValue}
+}
+
+// NextMessageID returns the next decimal message_id
+func (generator *SequentialMessageIDGenerator) NextMessageID(nameOfAgent string) string {
+	return strconv.FormatUint(atomic.AddUint64(&generator.nextValue, 1)-1, 10)
+}
+
+// HexMessageIDGenerator produces upper-case hex message_ids (e.g., 9, A, B), counting up from a starting value
+type HexMessageIDGenerator struct {
+	nextValue uint64
+}
+
+// NewHexMessageIDGenerator creates a HexMessageIDGenerator whose first message_id is firstValue, in hex
+func NewHexMessageIDGenerator(firstValue uint64) *HexMessageIDGenerator {
+	return &HexMessageIDGenerator{nextValue: firstValue}
+}
+
+// NextMessageID returns the next hex message_id
+func (generator *HexMessageIDGenerator) NextMessageID(nameOfAgent string) string {
+	return strings.ToUpper(strconv.FormatUint(atomic.AddUint64(&generator.nextValue, 1)-1, 16))
+}
+
+// UUIDMessageIDGenerator produces random (version 4) UUIDs as message_ids
+type UUIDMessageIDGenerator struct{}
+
+// NewUUIDMessageIDGenerator creates a UUIDMessageIDGenerator
+func NewUUIDMessageIDGenerator() *UUIDMessageIDGenerator {
+	return &UUIDMessageIDGenerator{}
+}
+
+// NextMessageID returns a new UUID (e.g., 3f2b8c1e-7d4a-4e9b-a1c2-0d5e6f708192)
+func (generator *UUIDMessageIDGenerator) NextMessageID(nameOfAgent string) string {
+	octets := make([]byte, 16)
+	rand.Read(octets)
+
+	octets[6] = octets[6]&0x0F | 0x40
+	octets[8] = octets[8]&0x3F | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", octets[0:4], octets[4:6], octets[6:8], octets[8:10], octets[10:16])
+}
+
+// maximumRandomMessageIDAttempts is how many random message_ids RandomMessageIDGenerator tries at one width
+// before it widens the message_ids
+const maximumRandomMessageIDAttempts = 16
+
+// RandomMessageIDGenerator produces random upper-case hex message_ids of a fixed width.  The message_ids already
+// produced are remembered, so that none is repeated, until they are released with ForgetMessageID().  If a quarter of
+// the message_ids of the current width are in use, or no unused one is found after a few attempts, the width grows
+// by one hex digit (to no more than 64), so that a message_id is always found.
+type RandomMessageIDGenerator struct {
+	lock      sync.Mutex
+	width     int
+	limit     *big.Int
+	issuedIDs map[string]bool
+}
+
+// NewRandomMessageIDGenerator creates a RandomMessageIDGenerator that produces message_ids of width hex digits.
+// width must be between 4 and 64.
+func NewRandomMessageIDGenerator(width int) (*RandomMessageIDGenerator, error) {
+	if width < 4 || width > maximumMessageIDLength {
+		return nil, fmt.Errorf("random message_id width must be between 4 and %d, not (%d)", maximumMessageIDLength, width)
+	}
+
+	generator := &RandomMessageIDGenerator{issuedIDs: make(map[string]bool)}
+	generator.setWidth(width)
+
+	return generator, nil
+}
+
+// NextMessageID returns a random message_id that is not in use
+func (generator *RandomMessageIDGenerator) NextMessageID(nameOfAgent string) string {
+	generator.lock.Lock()
+	defer generator.lock.Unlock()
+
+	for {
+		if generator.width < maximumMessageIDLength && big.NewInt(int64(4*len(generator.issuedIDs))).Cmp(generator.limit) >= 0 {
+			generator.setWidth(generator.width + 1)
+		}
+
+		for attempt := 0; attempt < maximumRandomMessageIDAttempts; attempt++ {
+			value, _ := rand.Int(rand.Reader, generator.limit)
+			messageID := fmt.Sprintf("%0*X", generator.width, value)
+
+			if !generator.issuedIDs[messageID] {
+				generator.issuedIDs[messageID] = true
+				return messageID
+			}
+		}
+
+		if generator.width < maximumMessageIDLength {
+			generator.setWidth(generator.width + 1)
+		}
+	}
+}
+
+// ForgetMessageID releases a message_id returned by NextMessageID(), when the message that it identifies is no
+// longer kept (e.g., when it is removed from a MessageStore), so that it may be returned again
+func (generator *RandomMessageIDGenerator) ForgetMessageID(messageID string) {
+	generator.lock.Lock()
+	defer generator.lock.Unlock()
+
+	delete(generator.issuedIDs, messageID)
+}
+
+func (generator *RandomMessageIDGenerator) setWidth(width int) {
+	generator.width = width
+	generator.limit = new(big.Int).Lsh(big.NewInt(1), uint(4*width))
+}
+
+// defaultMessageIDTemplate is the template of the MessageIDGenerator used by an SMSC, and by a StandardApplication
+// for its other agents, unless another is set.  Including {agent} keeps the message_ids of two agents distinct.
+const defaultMessageIDTemplate = "{agent}-{seq}"
+
+// newDefaultMessageIDGenerator creates a TemplateMessageIDGenerator with the defaultMessageIDTemplate
+func newDefaultMessageIDGenerator() *TemplateMessageIDGenerator {
+	generator, _ := NewTemplateMessageIDGenerator(defaultMessageIDTemplate)
+	return generator
+}
+
+// TemplateMessageIDGenerator produces message_ids from a template, in which {agent} is replaced by the name of the
+// agent, and {seq} by a decimal counter (e.g., the template {agent}-{seq} produces smsc01-1, smsc01-2, ...).
+type TemplateMessageIDGenerator struct {
+	template  string
+	nextValue uint64
+}
+
+// NewTemplateMessageIDGenerator creates a TemplateMessageIDGenerator.  Because the counter is what makes the
+// message_ids unique, the template must include {seq}.
+func NewTemplateMessageIDGenerator(template string) (*TemplateMessageIDGenerator, error) {
+	if !strings.Contains(template, "{seq}") {
+		return nil, fmt.Errorf("message_id template (%s) must include {seq}", template)
+	}
+
+	return &TemplateMessageIDGenerator{template: template, nextValue: 1}, nil
+}
+
+// NextMessageID returns the template, with {agent} and {seq} replaced.  If the result is longer than a message_id
+// may be, the leading characters are dropped, so that the counter is kept.
+func (generator *TemplateMessageIDGenerator) NextMessageID(nameOfAgent string) string {
+	sequence := strconv.FormatUint(atomic.AddUint64(&generator.nextValue, 1)-1, 10)
+	messageID := strings.NewReplacer("{agent}", nameOfAgent, "{seq}", sequence).Replace(generator.template)
+
+	if len(messageID) > maximumMessageIDLength {
+		messageID = messageID[len(messageID)-maximumMessageIDLength:]
+	}
+
+	return messageID
+}
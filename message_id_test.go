@@ -0,0 +1,108 @@
+package smppth
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestMessageIDGeneratorFormats(t *testing.T) {
+	templateGenerator, err := NewTemplateMessageIDGenerator("{agent}-{seq}")
+	if err != nil {
+		t.Fatalf("Expected no error on NewTemplateMessageIDGenerator, got = (%s)", err)
+	}
+
+	randomGenerator, err := NewRandomMessageIDGenerator(10)
+	if err != nil {
+		t.Fatalf("Expected no error on NewRandomMessageIDGenerator, got = (%s)", err)
+	}
+
+	for _, testCase := range []struct {
+		generator        MessageIDGenerator
+		expectedFirstTwo []string
+		expectedFormatRe *regexp.Regexp
+	}{
+		{NewSequentialMessageIDGenerator(9), []string{"9", "10"}, nil},
+		{NewHexMessageIDGenerator(9), []string{"9", "A"}, nil},
+		{templateGenerator, []string{"smsc01-1", "smsc01-2"}, nil},
+		{NewUUIDMessageIDGenerator(), nil, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{randomGenerator, nil, regexp.MustCompile(`^[0-9A-F]{10}$`)},
+	} {
+		first, second := testCase.generator.NextMessageID("smsc01"), testCase.generator.NextMessageID("smsc01")
+
+		if testCase.expectedFirstTwo != nil && (first != testCase.expectedFirstTwo[0] || second != testCase.expectedFirstTwo[1]) {
+			t.Errorf("Expected message_ids (%v), got (%s, %s)", testCase.expectedFirstTwo, first, second)
+		}
+
+		if testCase.expectedFormatRe != nil && (!testCase.expectedFormatRe.MatchString(first) || first == second) {
+			t.Errorf("Expected distinct message_ids matching (%s), got (%s, %s)", testCase.expectedFormatRe, first, second)
+		}
+	}
+
+	if _, err := NewTemplateMessageIDGenerator("{agent}"); err == nil {
+		t.Errorf("Expected error on NewTemplateMessageIDGenerator without {seq}, got none")
+	}
+
+	if _, err := NewRandomMessageIDGenerator(65); err == nil {
+		t.Errorf("Expected error on NewRandomMessageIDGenerator with width 65, got none")
+	}
+}
+
+func TestMessageIDGeneratorsAreUniqueAcrossGoroutines(t *testing.T) {
+	randomGenerator, _ := NewRandomMessageIDGenerator(4)
+	templateGenerator, _ := NewTemplateMessageIDGenerator("{agent}-{seq}")
+
+	for _, generator := range []MessageIDGenerator{NewSequentialMessageIDGenerator(1), NewHexMessageIDGenerator(1), templateGenerator, randomGenerator} {
+		var lock sync.Mutex
+		var waitGroup sync.WaitGroup
+		seen := make(map[string]bool)
+
+		for session := 0; session < 8; session++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				for i := 0; i < 500; i++ {
+					messageID := generator.NextMessageID("smsc01")
+					lock.Lock()
+					if seen[messageID] {
+						t.Errorf("Expected unique message_ids, got (%s) twice", messageID)
+					}
+					seen[messageID] = true
+					lock.Unlock()
+				}
+			}()
+		}
+
+		waitGroup.Wait()
+	}
+}
+
+func TestRandomMessageIDGeneratorWidensWhenExhausted(t *testing.T) {
+	generator, _ := NewRandomMessageIDGenerator(4)
+	seen := make(map[string]bool)
+
+	for i := 0; i < 40000; i++ {
+		messageID := generator.NextMessageID("smsc01")
+		if seen[messageID] {
+			t.Fatalf("Expected unique message_ids, got (%s) twice", messageID)
+		}
+		seen[messageID] = true
+
+		expectedWidth := 4
+		if i >= 16384 {
+			expectedWidth = 5
+		}
+
+		if len(messageID) != expectedWidth {
+			t.Fatalf("Expected message_id (%d) to be (%d) hex digits, got (%s)", i, expectedWidth, messageID)
+		}
+	}
+
+	for messageID := range seen {
+		generator.ForgetMessageID(messageID)
+	}
+
+	if len(generator.issuedIDs) != 0 {
+		t.Errorf("Expected ForgetMessageID to release every message_id, (%d) remain", len(generator.issuedIDs))
+	}
+}
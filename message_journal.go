@@ -0,0 +1,222 @@
+package smppth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// defaultMessageJournalCompactionThreshold is the number of records written to a journal, since it was last
+// compacted, after which it may be compacted again
+const defaultMessageJournalCompactionThreshold = 1000
+
+// MessageJournal is an append-only file that records the messages in a MessageStore, so that they survive a restart.
+// Each time a message changes, a snapshot of the message is written as a line of JSON.  When the journal is read back,
+// the last snapshot of each message wins.  When a message is evicted from the store, a record marking it as evicted is
+// written, so that it is not restored.  Because the file grows with each change, it is compacted -- rewritten with
+// only the current snapshot of each message -- when it is replayed, and when the number of records written since the
+// last compaction reaches the compaction threshold and is more than twice the number of messages in the store.
+type MessageJournal struct {
+	lock                   sync.Mutex
+	fileName               string
+	file                   *os.File
+	recordsSinceCompaction int
+	compactionThreshold    int
+}
+
+// OpenMessageJournal opens the named journal file, creating it if it does not exist
+func OpenMessageJournal(fileName string) (*MessageJournal, error) {
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageJournal{
+		fileName:            fileName,
+		file:                file,
+		compactionThreshold: defaultMessageJournalCompactionThreshold,
+	}, nil
+}
+
+// SetCompactionThreshold sets the number of records written since the last compaction after which the journal may
+// be compacted
+func (journal *MessageJournal) SetCompactionThreshold(numberOfRecords int) *MessageJournal {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	journal.compactionThreshold = numberOfRecords
+	return journal
+}
+
+// FileName returns the name of the journal file
+func (journal *MessageJournal) FileName() string {
+	return journal.fileName
+}
+
+// Close closes the journal file
+func (journal *MessageJournal) Close() error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	return journal.file.Close()
+}
+
+// messageJournalRecord is a line in a MessageJournal: a snapshot of a message or, if Evicted is true, a record that
+// the message with the MessageID was evicted
+type messageJournalRecord struct {
+	*StoredMessage
+	Evicted bool `json:",omitempty"`
+}
+
+// append writes a snapshot of the message to the end of the journal
+func (journal *MessageJournal) append(message *StoredMessage) error {
+	return journal.appendRecord(&messageJournalRecord{StoredMessage: message})
+}
+
+// appendEviction writes a record that the message with the messageID was evicted to the end of the journal
+func (journal *MessageJournal) appendEviction(messageID string) error {
+	return journal.appendRecord(&messageJournalRecord{StoredMessage: &StoredMessage{MessageID: messageID}, Evicted: true})
+}
+
+func (journal *MessageJournal) appendRecord(message *messageJournalRecord) error {
+	record, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	if _, err := journal.file.Write(append(record, '\n')); err != nil {
+		return fmt.Errorf("failed to write to message journal (%s): %s", journal.fileName, err)
+	}
+
+	journal.recordsSinceCompaction++
+	return nil
+}
+
+// shouldBeCompacted returns true if enough records have been written since the last compaction, given the number of
+// messages in the store
+func (journal *MessageJournal) shouldBeCompacted(numberOfStoredMessages int) bool {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	return journal.recordsSinceCompaction >= journal.compactionThreshold && journal.recordsSinceCompaction > 2*numberOfStoredMessages
+}
+
+// replay reads the journal, returning the last snapshot of each message that was not evicted after it, in the order
+// in which the messages first appear.  A final line that cannot be read (e.g., because the harness stopped while
+// writing it) is ignored.
+func (journal *MessageJournal) replay() ([]*StoredMessage, error) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	file, err := os.Open(journal.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	messages := make([]*StoredMessage, 0)
+	indexOfMessageByMessageID := make(map[string]int)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var unreadableLineNumber int
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if unreadableLineNumber != 0 {
+			return nil, fmt.Errorf("message journal (%s) line %d is not a valid record", journal.fileName, unreadableLineNumber)
+		}
+
+		record := &messageJournalRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil || record.StoredMessage == nil || record.MessageID == "" {
+			unreadableLineNumber = lineNumber
+			continue
+		}
+
+		message := record.StoredMessage
+		index, isKnown := indexOfMessageByMessageID[message.MessageID]
+
+		if record.Evicted {
+			if isKnown {
+				messages[index] = nil
+				delete(indexOfMessageByMessageID, message.MessageID)
+			}
+			continue
+		}
+
+		if isKnown {
+			messages[index] = message
+		} else {
+			indexOfMessageByMessageID[message.MessageID] = len(messages)
+			messages = append(messages, message)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read message journal (%s): %s", journal.fileName, err)
+	}
+
+	remainingMessages := make([]*StoredMessage, 0, len(indexOfMessageByMessageID))
+	for _, message := range messages {
+		if message != nil {
+			remainingMessages = append(remainingMessages, message)
+		}
+	}
+
+	return remainingMessages, nil
+}
+
+// compact replaces the journal with one that holds a single snapshot of each message
+func (journal *MessageJournal) compact(messages []*StoredMessage) error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	temporaryFileName := journal.fileName + ".compacting"
+	temporaryFile, err := os.OpenFile(temporaryFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to compact message journal (%s): %s", journal.fileName, err)
+	}
+
+	writer := bufio.NewWriter(temporaryFile)
+	for _, message := range messages {
+		record, err := json.Marshal(message)
+		if err == nil {
+			_, err = writer.Write(append(record, '\n'))
+		}
+		if err != nil {
+			temporaryFile.Close()
+			os.Remove(temporaryFileName)
+			return fmt.Errorf("failed to compact message journal (%s): %s", journal.fileName, err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		temporaryFile.Close()
+		os.Remove(temporaryFileName)
+		return fmt.Errorf("failed to compact message journal (%s): %s", journal.fileName, err)
+	}
+
+	if err := temporaryFile.Close(); err != nil {
+		os.Remove(temporaryFileName)
+		return fmt.Errorf("failed to compact message journal (%s): %s", journal.fileName, err)
+	}
+
+	journal.file.Close()
+	renameErr := os.Rename(temporaryFileName, journal.fileName)
+
+	if journal.file, err = os.OpenFile(journal.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return fmt.Errorf("failed to reopen message journal (%s) after compaction: %s", journal.fileName, err)
+	}
+
+	if renameErr != nil {
+		os.Remove(temporaryFileName)
+		return fmt.Errorf("failed to compact message journal (%s): %s", journal.fileName, renameErr)
+	}
+
+	journal.recordsSinceCompaction = 0
+	return nil
+}
@@ -0,0 +1,310 @@
+package smppth
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func countLinesInFile(t *testing.T, fileName string) int {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Failed to open (%s): %s", fileName, err)
+	}
+	defer file.Close()
+
+	lineCount := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lineCount++
+	}
+
+	return lineCount
+}
+
+func TestMessageJournalReplay(t *testing.T) {
+	directory, err := ioutil.TempDir("", "smppth-journal")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileName := filepath.Join(directory, "smsc01.journal")
+	factory := NewDefaultPduFactory()
+
+	journal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error on OpenMessageJournal(), got = (%s)", err)
+	}
+
+	store := NewMessageStore()
+	store.AttachJournal(journal, func(err error) { t.Errorf("Unexpected journal error: %s", err) })
+
+	for _, messageID := range []string{"msg01", "msg02", "msg03"} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000", "short_message": "hello " + messageID})
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+
+	dueAt := time.Now().Add(time.Hour).Round(0)
+	store.SetPendingDeliveryReceipt("msg01", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: dueAt, FinalState: MessageStateUndeliverable, ErrorCode: 7})
+	store.MoveMessageToFinalState("msg02", MessageStateDelivered, time.Now())
+
+	if lineCount := countLinesInFile(t, fileName); lineCount != 5 {
+		t.Errorf("Expected 5 records in journal, got (%d)", lineCount)
+	}
+
+	journal.Close()
+
+	reopenedJournal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error reopening journal, got = (%s)", err)
+	}
+	defer reopenedJournal.Close()
+
+	restoredStore := NewMessageStore()
+	restoredStore.AttachJournal(reopenedJournal, func(err error) { t.Errorf("Unexpected journal error: %s", err) })
+	if err := restoredStore.ReplayJournal(); err != nil {
+		t.Fatalf("Expected no error on ReplayJournal(), got = (%s)", err)
+	}
+
+	messages := restoredStore.Messages(nil)
+	if len(messages) != 3 || messages[0].MessageID != "msg01" || messages[1].MessageID != "msg02" || messages[2].MessageID != "msg03" {
+		t.Fatalf("Expected msg01, msg02 and msg03 in store order after replay, got = (%+v)", messages)
+	}
+
+	if pendingReceipt := messages[0].PendingReceipt; pendingReceipt == nil || !pendingReceipt.DueAt.Equal(dueAt) || pendingReceipt.FinalState != MessageStateUndeliverable || pendingReceipt.ErrorCode != 7 {
+		t.Errorf("Expected pending receipt for msg01 to survive replay, got = (%+v)", pendingReceipt)
+	}
+
+	if messages[1].State != MessageStateDelivered || messages[1].FinalDate.IsZero() {
+		t.Errorf("Expected msg02 to be DELIVERED after replay, got = (%s)", messages[1].State)
+	}
+
+	if messages[2].Text() != "hello msg03" || messages[2].State != MessageStateEnroute {
+		t.Errorf("Expected msg03 to be ENROUTE with its short_message after replay, got = (%+v)", messages[2])
+	}
+
+	if lineCount := countLinesInFile(t, fileName); lineCount != 3 {
+		t.Errorf("Expected journal to be compacted to 3 records after replay, got (%d)", lineCount)
+	}
+
+	restoredStore.MoveMessageToFinalState("msg03", MessageStateDelivered, time.Now())
+	if lineCount := countLinesInFile(t, fileName); lineCount != 4 {
+		t.Errorf("Expected journal to be appended to after replay, got (%d) records", lineCount)
+	}
+}
+
+func TestMessageJournalCompaction(t *testing.T) {
+	directory, err := ioutil.TempDir("", "smppth-journal")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileName := filepath.Join(directory, "smsc01.journal")
+	factory := NewDefaultPduFactory()
+
+	journal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error on OpenMessageJournal(), got = (%s)", err)
+	}
+	defer journal.Close()
+
+	journal.SetCompactionThreshold(5)
+
+	store := NewMessageStore()
+	store.AttachJournal(journal, func(err error) { t.Errorf("Unexpected journal error: %s", err) })
+
+	submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+	store.StoreSubmitSm("msg01", "esme01", submitSm)
+
+	for i := 0; i < 3; i++ {
+		store.SetPendingDeliveryReceipt("msg01", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: time.Now(), FinalState: MessageStateDelivered})
+	}
+
+	if lineCount := countLinesInFile(t, fileName); lineCount != 4 {
+		t.Errorf("Expected 4 records before compaction threshold, got (%d)", lineCount)
+	}
+
+	store.SetPendingDeliveryReceipt("msg01", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: time.Now(), FinalState: MessageStateDelivered})
+
+	if lineCount := countLinesInFile(t, fileName); lineCount != 1 {
+		t.Errorf("Expected journal to be compacted to 1 record at threshold, got (%d)", lineCount)
+	}
+
+	if err := ioutil.WriteFile(fileName+".partial", []byte("{\"MessageID\":\"msg01\"}\n{\"Messa"), 0644); err != nil {
+		t.Fatalf("Failed to write partial journal: %s", err)
+	}
+
+	partialJournal, _ := OpenMessageJournal(fileName + ".partial")
+	defer partialJournal.Close()
+
+	if messages, err := partialJournal.replay(); err != nil || len(messages) != 1 {
+		t.Errorf("Expected a truncated final record to be ignored on replay, got (%d) messages and error (%v)", len(messages), err)
+	}
+
+	if err := ioutil.WriteFile(fileName+".corrupt", []byte("garbage\n{\"MessageID\":\"msg01\"}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write corrupt journal: %s", err)
+	}
+
+	corruptJournal, _ := OpenMessageJournal(fileName + ".corrupt")
+	defer corruptJournal.Close()
+
+	if _, err := corruptJournal.replay(); err == nil {
+		t.Errorf("Expected error on replay of journal with an unreadable record that is not the last, got none")
+	}
+}
+
+func TestMessageJournalRecordsEvictions(t *testing.T) {
+	directory, err := ioutil.TempDir("", "smppth-journal")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileName := filepath.Join(directory, "smsc01.journal")
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+
+	journal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error on OpenMessageJournal(), got = (%s)", err)
+	}
+
+	store := NewMessageStore()
+	store.SetFinalMessageRetention(time.Minute, 0)
+	store.AttachJournal(journal, func(err error) { t.Errorf("Unexpected journal error: %s", err) })
+
+	now := time.Now()
+	for _, messageID := range []string{"msg01", "msg02", "msg03"} {
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+	store.MoveMessageToFinalState("msg01", MessageStateDelivered, now)
+	store.MoveMessageToFinalState("msg02", MessageStateDelivered, now)
+
+	if evicted := store.EvictFinalMessages(now.Add(time.Minute)); len(evicted) != 2 {
+		t.Fatalf("Expected msg01 and msg02 to be evicted, got = (%+v)", evicted)
+	}
+
+	store.StoreSubmitSm("msg01", "esme01", submitSm)
+	journal.Close()
+
+	reopenedJournal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error reopening journal, got = (%s)", err)
+	}
+	defer reopenedJournal.Close()
+
+	restoredStore := NewMessageStore()
+	restoredStore.AttachJournal(reopenedJournal, func(err error) { t.Errorf("Unexpected journal error: %s", err) })
+	if err := restoredStore.ReplayJournal(); err != nil {
+		t.Fatalf("Expected no error on ReplayJournal(), got = (%s)", err)
+	}
+
+	messages := restoredStore.Messages(nil)
+	if len(messages) != 2 || messages[0].MessageID != "msg03" || messages[1].MessageID != "msg01" || messages[1].State != MessageStateEnroute {
+		t.Errorf("Expected msg02 to stay evicted, and msg01 to be restored as stored again after its eviction, got = (%+v)", messages)
+	}
+
+	if lineCount := countLinesInFile(t, fileName); lineCount != 2 {
+		t.Errorf("Expected journal to be compacted to 2 records after replay, got (%d)", lineCount)
+	}
+}
+
+func TestSmscRestartedOverTheSameJournalDoesNotReuseMessageIDs(t *testing.T) {
+	directory, err := ioutil.TempDir("", "smppth-journal")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileName := filepath.Join(directory, "smsc01.journal")
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+
+	storedMessageIDs := make(map[string]bool)
+	for restart := 0; restart < 3; restart++ {
+		journal, err := OpenMessageJournal(fileName)
+		if err != nil {
+			t.Fatalf("Expected no error on OpenMessageJournal(), got = (%s)", err)
+		}
+
+		smsc := NewSMSC("smsc01", "", net.ParseIP("127.0.0.1"), 2775)
+		smsc.AttachMessageJournal(journal)
+		if err := smsc.MessageStore().ReplayJournal(); err != nil {
+			t.Fatalf("Expected no error on ReplayJournal(), got = (%s)", err)
+		}
+
+		if messages := smsc.MessageStore().Messages(nil); len(messages) != len(storedMessageIDs) {
+			t.Errorf("After restart (%d), expected (%d) replayed messages, got (%d)", restart, len(storedMessageIDs), len(messages))
+		}
+
+		for i := 0; i < 3; i++ {
+			messageID := smsc.NextMessageID()
+			if storedMessageIDs[messageID] {
+				t.Errorf("After restart (%d), expected a new message_id, got (%s) again", restart, messageID)
+			}
+
+			if _, err := smsc.MessageStore().StoreSubmitSm(messageID, "esme01", submitSm); err != nil {
+				t.Errorf("After restart (%d), expected no error on StoreSubmitSm, got = (%s)", restart, err)
+			}
+			storedMessageIDs[messageID] = true
+		}
+
+		journal.Close()
+	}
+}
+
+func TestSmscReplayHoldsUndeliveredRoutedMessages(t *testing.T) {
+	directory, err := ioutil.TempDir("", "smppth-journal")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileName := filepath.Join(directory, "smsc01.journal")
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000", "short_message": "routed"})
+
+	journal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error on OpenMessageJournal(), got = (%s)", err)
+	}
+
+	store := NewMessageStore()
+	store.AttachJournal(journal, func(err error) { t.Errorf("Unexpected journal error: %s", err) })
+	for _, messageID := range []string{"msg01", "msg02", "msg03"} {
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+	store.RecordRoute("msg01", "esme02", 7)
+	store.RecordRoute("msg02", "esme02", 8)
+	store.CompleteRoute("esme02", 8, 0, time.Now())
+	journal.Close()
+
+	reopenedJournal, err := OpenMessageJournal(fileName)
+	if err != nil {
+		t.Fatalf("Expected no error reopening journal, got = (%s)", err)
+	}
+	defer reopenedJournal.Close()
+
+	smsc := NewSMSC("smsc01", "", net.ParseIP("127.0.0.1"), 2775)
+	smsc.AttachMessageJournal(reopenedJournal)
+
+	for replay := 0; replay < 2; replay++ {
+		if err := smsc.replayMessageJournal(time.Now()); err != nil {
+			t.Fatalf("Expected no error on replayMessageJournal(), got = (%s)", err)
+		}
+	}
+
+	heldDeliveries := smsc.DeliveryQueue().HeldDeliveries("")
+	if len(heldDeliveries) != 1 || heldDeliveries[0].MessageID != "msg01" || heldDeliveries[0].NameOfPeer != "esme02" || heldDeliveries[0].IsDeliveryReceipt {
+		t.Fatalf("Expected only the undelivered routed message msg01 to be held once for esme02, got = (%+v)", heldDeliveries)
+	}
+
+	deliverSm := heldDeliveries[0].PDU
+	if deliverSm.CommandID != smpp.CommandDeliverSm || mandatoryStringParameter(deliverSm, 3) != "1000" || mandatoryStringParameter(deliverSm, 6) != "2000" || string(deliverSm.MandatoryParameters[17].Value.([]byte)) != "routed" {
+		t.Errorf("Expected held deliver-sm to carry the stored message, got = (%v)", deliverSm)
+	}
+}
@@ -0,0 +1,79 @@
+package smppth
+
+import (
+	"fmt"
+)
+
+// MessageState is an SMPP message_state value, as carried in a query_sm_resp or a delivery receipt
+type MessageState uint8
+
+// SMPP 3.4 message_state values
+const (
+	MessageStateEnroute       MessageState = 1
+	MessageStateDelivered     MessageState = 2
+	MessageStateExpired       MessageState = 3
+	MessageStateDeleted       MessageState = 4
+	MessageStateUndeliverable MessageState = 5
+	MessageStateAccepted      MessageState = 6
+	MessageStateUnknown       MessageState = 7
+	MessageStateRejected      MessageState = 8
+)
+
+var messageStateNames = map[MessageState]string{
+	MessageStateEnroute:       "ENROUTE",
+	MessageStateDelivered:     "DELIVERED",
+	MessageStateExpired:       "EXPIRED",
+	MessageStateDeleted:       "DELETED",
+	MessageStateUndeliverable: "UNDELIVERABLE",
+	MessageStateAccepted:      "ACCEPTED",
+	MessageStateUnknown:       "UNKNOWN",
+	MessageStateRejected:      "REJECTED",
+}
+
+// String returns the SMPP name for the state (e.g., "ENROUTE")
+func (state MessageState) String() string {
+	if name, isDefined := messageStateNames[state]; isDefined {
+		return name
+	}
+
+	return fmt.Sprintf("message_state(%d)", uint8(state))
+}
+
+var messageStateReceiptStats = map[MessageState]string{
+	MessageStateEnroute:       "ENROUTE",
+	MessageStateDelivered:     "DELIVRD",
+	MessageStateExpired:       "EXPIRED",
+	MessageStateDeleted:       "DELETED",
+	MessageStateUndeliverable: "UNDELIV",
+	MessageStateAccepted:      "ACCEPTD",
+	MessageStateUnknown:       "UNKNOWN",
+	MessageStateRejected:      "REJECTD",
+}
+
+// ReceiptStat returns the seven character form of the state used for stat: in the text of a delivery receipt
+// (e.g., "DELIVRD")
+func (state MessageState) ReceiptStat() string {
+	if stat, isDefined := messageStateReceiptStats[state]; isDefined {
+		return stat
+	}
+
+	return "UNKNOWN"
+}
+
+// MessageStateFromString returns the MessageState named either by its SMPP name (e.g., "UNDELIVERABLE") or by
+// its delivery receipt stat (e.g., "UNDELIV")
+func MessageStateFromString(name string) (MessageState, error) {
+	for state, stateName := range messageStateNames {
+		if name == stateName || name == messageStateReceiptStats[state] {
+			return state, nil
+		}
+	}
+
+	return MessageStateUnknown, fmt.Errorf("(%s) is not a message state", name)
+}
+
+// IsFinal returns true if a message in this state can no longer change state (e.g., DELIVERED or DELETED).
+// Only ENROUTE and ACCEPTED are not final.  A message in a final state cannot be cancelled or replaced.
+func (state MessageState) IsFinal() bool {
+	return state != MessageStateEnroute && state != MessageStateAccepted
+}
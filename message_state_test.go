@@ -0,0 +1,17 @@
+package smppth
+
+import (
+	"testing"
+)
+
+func TestMessageStateFromString(t *testing.T) {
+	for name, expectedState := range map[string]MessageState{"DELIVRD": MessageStateDelivered, "UNDELIVERABLE": MessageStateUndeliverable, "REJECTD": MessageStateRejected, "EXPIRED": MessageStateExpired} {
+		if state, err := MessageStateFromString(name); err != nil || state != expectedState {
+			t.Errorf("Expected (%s) to be (%s), got (%s), error = (%v)", name, expectedState, state, err)
+		}
+	}
+
+	if _, err := MessageStateFromString("LOST"); err == nil {
+		t.Errorf("Expected error on MessageStateFromString(LOST), got none")
+	}
+}
@@ -0,0 +1,737 @@
+package smppth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// StoredMessage is a message accepted by an SMSC in a submit-sm.  NameOfPeer is the peer that submitted it.  ExpiresAt
+// is the time given by validity_period, or the zero time if the submit-sm has no validity_period.  FinalDate is the
+// zero time until the message reaches a final state.  PendingReceipt is the delivery receipt that will be sent for
+// the message, or nil if there is none.  For a message routed by an SMSC, RoutedToPeer is the peer to which it was
+// forwarded, and RoutedSequenceNumber is the sequence_number of the deliver-sm that carried it.
+type StoredMessage struct {
+	MessageID            string
+	NameOfPeer           string
+	ServiceType          string
+	SourceAddrTon        uint8
+	SourceAddrNpi        uint8
+	SourceAddr           string
+	DestAddrTon          uint8
+	DestAddrNpi          uint8
+	DestinationAddr      string
+	EsmClass             uint8
+	RegisteredDelivery   uint8
+	DataCoding           uint8
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	ShortMessage         []byte
+	State                MessageState
+	SubmitDate           time.Time
+	ExpiresAt            time.Time
+	FinalDate            time.Time
+	PendingReceipt       *PendingDeliveryReceipt
+	RoutedToPeer         string
+	RoutedSequenceNumber uint32
+	positionInStore      uint64
+	isAwaitingEviction   bool
+}
+
+func (message *StoredMessage) clone() *StoredMessage {
+	messageCopy := *message
+	messageCopy.ShortMessage = append([]byte{}, message.ShortMessage...)
+
+	if message.PendingReceipt != nil {
+		pendingReceiptCopy := *message.PendingReceipt
+		messageCopy.PendingReceipt = &pendingReceiptCopy
+	}
+
+	return &messageCopy
+}
+
+// Text returns the short_message of the stored message, decoded according to its data_coding
+func (message *StoredMessage) Text() string {
+	return DecodeText(message.ShortMessage, TextEncodingForDataCoding(message.DataCoding))
+}
+
+// MessageFilter selects stored messages.  A message matches if it matches every field that is set.
+type MessageFilter struct {
+	MessageID       string
+	NameOfPeer      string
+	SourceAddr      string
+	DestinationAddr string
+	State           MessageState
+}
+
+// ParseMessageFilter creates a MessageFilter from space separated $field=$value pairs, where $field is message_id,
+// peer, source_addr, destination_addr or state (e.g., "state=ENROUTE destination_addr=15551234").  An empty string
+// produces a filter that matches every message.
+func ParseMessageFilter(text string) (*MessageFilter, error) {
+	filter := &MessageFilter{}
+
+	for _, pair := range strings.Fields(text) {
+		nameAndValue := strings.SplitN(pair, "=", 2)
+		if len(nameAndValue) != 2 || nameAndValue[1] == "" {
+			return nil, fmt.Errorf("message filter (%s) must be in the form $field=$value", pair)
+		}
+
+		switch value := nameAndValue[1]; nameAndValue[0] {
+		case "message_id":
+			filter.MessageID = value
+		case "peer":
+			filter.NameOfPeer = value
+		case "source_addr":
+			filter.SourceAddr = value
+		case "destination_addr":
+			filter.DestinationAddr = value
+		case "state":
+			state, err := MessageStateFromString(strings.ToUpper(value))
+			if err != nil {
+				return nil, err
+			}
+			filter.State = state
+		default:
+			return nil, fmt.Errorf("message filter field must be one of message_id, peer, source_addr, destination_addr or state, not (%s)", nameAndValue[0])
+		}
+	}
+
+	return filter, nil
+}
+
+// Matches returns true if the message matches the filter
+func (filter *MessageFilter) Matches(message *StoredMessage) bool {
+	return (filter.MessageID == "" || filter.MessageID == message.MessageID) &&
+		(filter.NameOfPeer == "" || filter.NameOfPeer == message.NameOfPeer) &&
+		(filter.SourceAddr == "" || filter.SourceAddr == message.SourceAddr) &&
+		(filter.DestinationAddr == "" || filter.DestinationAddr == message.DestinationAddr) &&
+		(filter.State == 0 || filter.State == message.State)
+}
+
+// DefaultFinalMessageRetention is how long a MessageStore keeps a message after it reaches a final state, unless
+// SetFinalMessageRetention() changes it
+const DefaultFinalMessageRetention = time.Hour
+
+// DefaultMaximumNumberOfFinalMessages is the most messages in a final state that a MessageStore keeps, unless
+// SetFinalMessageRetention() changes it
+const DefaultMaximumNumberOfFinalMessages = 10000
+
+// messageRoute identifies the deliver-sm that carried a routed message
+type messageRoute struct {
+	nameOfPeer     string
+	sequenceNumber uint32
+}
+
+// MessageStore holds the messages accepted by an SMSC, keyed by message_id, and tracks the state of each.  A message
+// is ENROUTE when it is stored.  It moves to a final state when it is delivered (or fails), is cancelled, or reaches
+// its validity_period.  A message in a final state, without a pending delivery receipt, is kept for the retention
+// period set by SetFinalMessageRetention(), and is then removed by EvictFinalMessages().  Methods that return
+// messages return copies.  If a MessageJournal is attached, every change to a message is written to the journal.  A
+// MessageStore is safe for concurrent use.
+type MessageStore struct {
+	lock                         sync.Mutex
+	messagesByMessageID          map[string]*StoredMessage
+	messagesInStoreOrder         []*StoredMessage
+	nextPositionInStore          uint64
+	messagesWithPendingReceipts  map[string]*StoredMessage
+	messagesWithValidityPeriods  map[string]*StoredMessage
+	routedMessagesByRoute        map[messageRoute]*StoredMessage
+	finalMessagesInFinalOrder    []*StoredMessage
+	finalMessageRetention        time.Duration
+	maximumNumberOfFinalMessages int
+	journal                      *MessageJournal
+	journalErrorHandler          func(error)
+}
+
+// NewMessageStore creates an empty MessageStore
+func NewMessageStore() *MessageStore {
+	store := &MessageStore{
+		finalMessageRetention:        DefaultFinalMessageRetention,
+		maximumNumberOfFinalMessages: DefaultMaximumNumberOfFinalMessages,
+	}
+	store.replaceMessages(make([]*StoredMessage, 0))
+
+	return store
+}
+
+// SetFinalMessageRetention sets how long a message is kept after it reaches a final state, and the most messages in
+// a final state that are kept.  A retention of zero keeps messages until the maximum is reached, and a maximum of
+// zero places no limit on the number of messages.
+func (store *MessageStore) SetFinalMessageRetention(retention time.Duration, maximumNumberOfFinalMessages int) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.finalMessageRetention = retention
+	store.maximumNumberOfFinalMessages = maximumNumberOfFinalMessages
+}
+
+// StoreSubmitSm stores the message in a submit-sm received from the named peer, with the provided message_id.  An
+// error is returned, and nothing is stored, if a message with the same message_id is already stored.
+func (store *MessageStore) StoreSubmitSm(messageID string, nameOfPeer string, submitSm *smpp.PDU) (*StoredMessage, error) {
+	uint8Parameter := func(index int) uint8 {
+		if index >= len(submitSm.MandatoryParameters) {
+			return 0
+		}
+		value, _ := submitSm.MandatoryParameters[index].Value.(uint8)
+		return value
+	}
+
+	now := time.Now()
+
+	message := &StoredMessage{
+		MessageID:            messageID,
+		NameOfPeer:           nameOfPeer,
+		ServiceType:          mandatoryStringParameter(submitSm, 0),
+		SourceAddrTon:        uint8Parameter(1),
+		SourceAddrNpi:        uint8Parameter(2),
+		SourceAddr:           mandatoryStringParameter(submitSm, 3),
+		DestAddrTon:          uint8Parameter(4),
+		DestAddrNpi:          uint8Parameter(5),
+		DestinationAddr:      mandatoryStringParameter(submitSm, 6),
+		EsmClass:             uint8Parameter(7),
+		RegisteredDelivery:   uint8Parameter(12),
+		DataCoding:           uint8Parameter(14),
+		ScheduleDeliveryTime: mandatoryStringParameter(submitSm, 10),
+		ValidityPeriod:       mandatoryStringParameter(submitSm, 11),
+		ShortMessage:         []byte(shortMessageFromPdu(submitSm)),
+		State:                MessageStateEnroute,
+		SubmitDate:           now,
+	}
+
+	if expiresAt, isSet, err := parseSmppTime(message.ValidityPeriod, now); isSet && err == nil {
+		message.ExpiresAt = expiresAt
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, isStored := store.messagesByMessageID[messageID]; isStored {
+		return nil, fmt.Errorf("a message with message_id (%s) is already stored", messageID)
+	}
+
+	message.positionInStore = store.nextPositionInStore
+	store.nextPositionInStore++
+	store.messagesByMessageID[messageID] = message
+	store.messagesInStoreOrder = append(store.messagesInStoreOrder, message)
+	store.recordChange(message)
+
+	return message.clone(), nil
+}
+
+// AttachJournal attaches a MessageJournal, to which every change to a message is written.  If writing to the journal
+// fails, journalErrorHandler is called with the error.  Call ReplayJournal() to load the messages already in the
+// journal.
+func (store *MessageStore) AttachJournal(journal *MessageJournal, journalErrorHandler func(error)) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.journal = journal
+	store.journalErrorHandler = journalErrorHandler
+}
+
+// ReplayJournal replaces the messages in the store with those in the attached MessageJournal, then compacts the
+// journal.  It does nothing if no journal is attached.
+func (store *MessageStore) ReplayJournal() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.journal == nil {
+		return nil
+	}
+
+	messages, err := store.journal.replay()
+	if err != nil {
+		return err
+	}
+
+	store.replaceMessages(messages)
+
+	return store.journal.compact(store.messagesInStoreOrder)
+}
+
+// hasJournal returns true if a MessageJournal is attached
+func (store *MessageStore) hasJournal() bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.journal != nil
+}
+
+// SetPendingDeliveryReceipt sets the delivery receipt that will be sent for a stored message.  It returns false if
+// there is no such message.
+func (store *MessageStore) SetPendingDeliveryReceipt(messageID string, pendingReceipt *PendingDeliveryReceipt) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, isStored := store.messagesByMessageID[messageID]
+	if !isStored {
+		return false
+	}
+
+	pendingReceiptCopy := *pendingReceipt
+	message.PendingReceipt = &pendingReceiptCopy
+	store.recordChange(message)
+
+	return true
+}
+
+// TakeDueDeliveryReceipts returns each message with a pending delivery receipt that is due at or before now, with its
+// PendingReceipt set, and removes the pending receipt from the stored message.  No more than maximumNumberOfReceipts
+// are returned, unless that is zero.  A message that is not yet in a final state moves to the FinalState of the
+// receipt.  A pending receipt for a message that was cancelled is discarded.
+func (store *MessageStore) TakeDueDeliveryReceipts(now time.Time, maximumNumberOfReceipts int) []*StoredMessage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	messagesWithDueReceipts := make([]*StoredMessage, 0)
+	for _, message := range store.messagesInStoreOrderFrom(store.messagesWithPendingReceipts) {
+		if message.PendingReceipt.DueAt.After(now) {
+			continue
+		}
+
+		if maximumNumberOfReceipts > 0 && len(messagesWithDueReceipts) == maximumNumberOfReceipts {
+			break
+		}
+
+		if !message.State.IsFinal() {
+			message.State = message.PendingReceipt.FinalState
+			message.FinalDate = now
+		}
+
+		if message.State != MessageStateDeleted {
+			messagesWithDueReceipts = append(messagesWithDueReceipts, message.clone())
+		}
+
+		message.PendingReceipt = nil
+		store.recordChange(message)
+	}
+
+	return messagesWithDueReceipts
+}
+
+// Message returns the message with the provided message_id, or false if there is no such message
+func (store *MessageStore) Message(messageID string) (*StoredMessage, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, isStored := store.messagesByMessageID[messageID]
+	if !isStored {
+		return nil, false
+	}
+
+	return message.clone(), true
+}
+
+// HasMessage returns true if a message with the provided message_id is stored
+func (store *MessageStore) HasMessage(messageID string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, isStored := store.messagesByMessageID[messageID]
+	return isStored
+}
+
+// Messages returns the stored messages that match the filter, in the order in which they were stored.  If filter
+// is nil, every message is returned.
+func (store *MessageStore) Messages(filter *MessageFilter) []*StoredMessage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	messages := make([]*StoredMessage, 0)
+	for _, message := range store.messagesInStoreOrder {
+		if filter == nil || filter.Matches(message) {
+			messages = append(messages, message.clone())
+		}
+	}
+
+	return messages
+}
+
+// MoveMessageToFinalState sets the state of a message, unless the message is unknown or is already in a final state
+// (e.g., because it was cancelled).  The message, as it is after the change, is returned, along with false if the
+// state was not changed.
+func (store *MessageStore) MoveMessageToFinalState(messageID string, finalState MessageState, finalDate time.Time) (*StoredMessage, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, isStored := store.messagesByMessageID[messageID]
+	if !isStored || message.State.IsFinal() {
+		return nil, false
+	}
+
+	message.State = finalState
+	message.FinalDate = finalDate
+	store.recordChange(message)
+
+	return message.clone(), true
+}
+
+// RecordRoute records that a stored message was forwarded to the named peer in the deliver-sm with the provided
+// sequence_number.  It returns false if there is no such message.
+func (store *MessageStore) RecordRoute(messageID string, nameOfPeer string, sequenceNumber uint32) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, isStored := store.messagesByMessageID[messageID]
+	if !isStored {
+		return false
+	}
+
+	message.RoutedToPeer = nameOfPeer
+	message.RoutedSequenceNumber = sequenceNumber
+	store.recordChange(message)
+
+	return true
+}
+
+// CompleteRoute finds the routed message carried by the deliver-sm with the provided sequence_number to the named
+// peer, and moves it to a final state according to the command_status of the deliver-sm-resp: DELIVERED if it is
+// zero, or UNDELIVERABLE otherwise.  It returns false if there is no such message, or if it is already in a final
+// state.
+func (store *MessageStore) CompleteRoute(nameOfPeer string, sequenceNumber uint32, commandStatus uint32, finalDate time.Time) (*StoredMessage, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message, isRouted := store.routedMessagesByRoute[messageRoute{nameOfPeer, sequenceNumber}]
+	if !isRouted {
+		return nil, false
+	}
+
+	message.State = MessageStateDelivered
+	if commandStatus != 0 {
+		message.State = MessageStateUndeliverable
+	}
+	message.FinalDate = finalDate
+	store.recordChange(message)
+
+	return message.clone(), true
+}
+
+// ExpireMessages moves each message that is not in a final state, and whose validity_period is before now, to
+// EXPIRED.  A pending delivery receipt for an expired message becomes due immediately, and reports EXPIRED.  The
+// expired messages are returned.
+func (store *MessageStore) ExpireMessages(now time.Time) []*StoredMessage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	expiredMessages := make([]*StoredMessage, 0)
+	for _, message := range store.messagesInStoreOrderFrom(store.messagesWithValidityPeriods) {
+		if message.ExpiresAt.Before(now) {
+			message.State = MessageStateExpired
+			message.FinalDate = now
+
+			if message.PendingReceipt != nil {
+				message.PendingReceipt.DueAt = now
+				message.PendingReceipt.FinalState = MessageStateExpired
+			}
+
+			store.recordChange(message)
+			expiredMessages = append(expiredMessages, message.clone())
+		}
+	}
+
+	return expiredMessages
+}
+
+// EvictFinalMessages removes the messages that reached a final state longer ago than the retention period, and,
+// if there are more messages in a final state than the maximum, the ones that reached a final state first.  A
+// message with a pending delivery receipt is kept until the receipt is taken, but does not hold back the eviction of
+// the messages that reached a final state after it.  The removed messages are returned.
+// Each eviction is written to an attached MessageJournal, so that the message is not restored when it is replayed.
+func (store *MessageStore) EvictFinalMessages(now time.Time) []*StoredMessage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	evictedMessages := make([]*StoredMessage, 0)
+	keptMessages := make([]*StoredMessage, 0, len(store.finalMessagesInFinalOrder))
+	numberOfFinalMessages := len(store.finalMessagesInFinalOrder)
+
+	for index, message := range store.finalMessagesInFinalOrder {
+		if store.messagesByMessageID[message.MessageID] != message {
+			numberOfFinalMessages--
+			continue
+		}
+
+		retentionHasPassed := store.finalMessageRetention > 0 && !message.FinalDate.Add(store.finalMessageRetention).After(now)
+		storeIsOverfull := store.maximumNumberOfFinalMessages > 0 && numberOfFinalMessages > store.maximumNumberOfFinalMessages
+
+		if !(retentionHasPassed || storeIsOverfull) {
+			keptMessages = append(keptMessages, store.finalMessagesInFinalOrder[index:]...)
+			break
+		}
+
+		if message.PendingReceipt != nil {
+			keptMessages = append(keptMessages, message)
+			continue
+		}
+
+		delete(store.messagesByMessageID, message.MessageID)
+		evictedMessages = append(evictedMessages, message.clone())
+		numberOfFinalMessages--
+	}
+
+	store.finalMessagesInFinalOrder = keptMessages
+
+	if len(evictedMessages) > 0 {
+		remainingMessages := make([]*StoredMessage, 0, len(store.messagesByMessageID))
+		for _, message := range store.messagesInStoreOrder {
+			if store.messagesByMessageID[message.MessageID] == message {
+				remainingMessages = append(remainingMessages, message)
+			}
+		}
+		store.messagesInStoreOrder = remainingMessages
+	}
+
+	for _, message := range evictedMessages {
+		store.journalEviction(message.MessageID)
+	}
+
+	return evictedMessages
+}
+
+// replaceMessages replaces the messages in the store, and rebuilds the indexes.  The store lock must be held, unless
+// the store is being created.
+func (store *MessageStore) replaceMessages(messages []*StoredMessage) {
+	store.messagesByMessageID = make(map[string]*StoredMessage)
+	store.messagesInStoreOrder = messages
+	store.messagesWithPendingReceipts = make(map[string]*StoredMessage)
+	store.messagesWithValidityPeriods = make(map[string]*StoredMessage)
+	store.routedMessagesByRoute = make(map[messageRoute]*StoredMessage)
+	store.finalMessagesInFinalOrder = make([]*StoredMessage, 0)
+
+	for _, message := range messages {
+		message.positionInStore = store.nextPositionInStore
+		store.nextPositionInStore++
+		store.messagesByMessageID[message.MessageID] = message
+	}
+
+	finalMessages := make([]*StoredMessage, 0)
+	for _, message := range messages {
+		if message.State.IsFinal() {
+			finalMessages = append(finalMessages, message)
+		} else {
+			store.indexMessage(message)
+		}
+	}
+
+	sort.SliceStable(finalMessages, func(i, j int) bool { return finalMessages[i].FinalDate.Before(finalMessages[j].FinalDate) })
+	for _, message := range finalMessages {
+		store.indexMessage(message)
+	}
+}
+
+// indexMessage adds a message to, or removes it from, the indexes used to find messages with pending delivery
+// receipts, messages that may expire, routed messages, and messages in a final state.  The store lock must be held.
+func (store *MessageStore) indexMessage(message *StoredMessage) {
+	if message.PendingReceipt != nil {
+		store.messagesWithPendingReceipts[message.MessageID] = message
+	} else {
+		delete(store.messagesWithPendingReceipts, message.MessageID)
+	}
+
+	if !message.State.IsFinal() && !message.ExpiresAt.IsZero() {
+		store.messagesWithValidityPeriods[message.MessageID] = message
+	} else {
+		delete(store.messagesWithValidityPeriods, message.MessageID)
+	}
+
+	route := messageRoute{message.RoutedToPeer, message.RoutedSequenceNumber}
+	if message.RoutedToPeer != "" && !message.State.IsFinal() {
+		store.routedMessagesByRoute[route] = message
+	} else if store.routedMessagesByRoute[route] == message {
+		delete(store.routedMessagesByRoute, route)
+	}
+
+	if message.State.IsFinal() && !message.isAwaitingEviction {
+		message.isAwaitingEviction = true
+		store.finalMessagesInFinalOrder = append(store.finalMessagesInFinalOrder, message)
+	}
+}
+
+// messagesInStoreOrderFrom returns the messages in an index, in the order in which they were stored.  The store lock
+// must be held.
+func (store *MessageStore) messagesInStoreOrderFrom(index map[string]*StoredMessage) []*StoredMessage {
+	messages := make([]*StoredMessage, 0, len(index))
+	for _, message := range index {
+		messages = append(messages, message)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].positionInStore < messages[j].positionInStore })
+
+	return messages
+}
+
+// recordChange updates the indexes for a message that was stored or changed, and writes it to the journal.  The
+// store lock must be held.
+func (store *MessageStore) recordChange(message *StoredMessage) {
+	store.indexMessage(message)
+	store.journalMessage(message)
+}
+
+// journalMessage writes a message to the attached journal, if there is one, and compacts the journal when enough
+// records have been written since it was last compacted.  The store lock must be held.
+func (store *MessageStore) journalMessage(message *StoredMessage) {
+	if store.journal == nil {
+		return
+	}
+
+	store.finishJournalWrite(store.journal.append(message))
+}
+
+// journalEviction writes the eviction of a message to the attached journal, if there is one, and compacts the
+// journal when enough records have been written since it was last compacted.  The store lock must be held.
+func (store *MessageStore) journalEviction(messageID string) {
+	if store.journal == nil {
+		return
+	}
+
+	store.finishJournalWrite(store.journal.appendEviction(messageID))
+}
+
+// finishJournalWrite compacts the attached journal after a record was written to it, if the write succeeded and
+// enough records have been written since it was last compacted.  A failure is passed to the journal error handler.
+func (store *MessageStore) finishJournalWrite(err error) {
+	if err == nil && store.journal.shouldBeCompacted(len(store.messagesInStoreOrder)) {
+		err = store.journal.compact(store.messagesInStoreOrder)
+	}
+
+	if err != nil && store.journalErrorHandler != nil {
+		store.journalErrorHandler(err)
+	}
+}
+
+// respondToQuerySm returns the query_sm_resp for a query_sm.  If the message is unknown, or the source_addr does
+// not match, the response has command_status ESME_RQUERYFAIL.
+func (store *MessageStore) respondToQuerySm(querySm *smpp.PDU, factory PduFactory) *smpp.PDU {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message := store.messagesByMessageID[mandatoryStringParameter(querySm, 0)]
+	if message == nil || message.SourceAddr != mandatoryStringParameter(querySm, 3) {
+		response := factory.CreateQuerySmRespFromRequest(querySm, "", MessageStateUnknown, 0)
+		response.CommandStatus = EsmeRqueryfail
+		return response
+	}
+
+	finalDate := ""
+	if message.State.IsFinal() {
+		finalDate = formatSmppAbsoluteTime(message.FinalDate)
+	}
+
+	return factory.CreateQuerySmRespFromRequest(querySm, finalDate, message.State, 0)
+}
+
+// respondToCancelSm returns the cancel_sm_resp for a cancel_sm, after applying it with applyCancelSm().  If there is
+// no matching message that is not in a final state, the response has command_status ESME_RCANCELFAIL.
+func (store *MessageStore) respondToCancelSm(cancelSm *smpp.PDU, factory PduFactory) *smpp.PDU {
+	response := factory.CreateCancelSmRespFromRequest(cancelSm)
+	if !store.applyCancelSm(cancelSm) {
+		response.CommandStatus = EsmeRcancelfail
+	}
+
+	return response
+}
+
+// applyCancelSm cancels the messages matched by a cancel_sm, and returns true if any was cancelled.  If message_id is
+// set, that message is cancelled.  Otherwise, every message from source_addr to destination_addr is cancelled.
+// Messages in a final state are not changed.
+func (store *MessageStore) applyCancelSm(cancelSm *smpp.PDU) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	messageID, sourceAddr, destinationAddr := mandatoryStringParameter(cancelSm, 1), mandatoryStringParameter(cancelSm, 4), mandatoryStringParameter(cancelSm, 7)
+
+	messagesToCancel := make([]*StoredMessage, 0, 1)
+	if messageID != "" {
+		if message := store.messagesByMessageID[messageID]; message != nil && message.SourceAddr == sourceAddr {
+			messagesToCancel = append(messagesToCancel, message)
+		}
+	} else {
+		for _, message := range store.messagesInStoreOrder {
+			if message.SourceAddr == sourceAddr && message.DestinationAddr == destinationAddr {
+				messagesToCancel = append(messagesToCancel, message)
+			}
+		}
+	}
+
+	cancelledAMessage := false
+	for _, message := range messagesToCancel {
+		if !message.State.IsFinal() {
+			message.State = MessageStateDeleted
+			message.FinalDate = time.Now()
+			message.PendingReceipt = nil
+			store.recordChange(message)
+			cancelledAMessage = true
+		}
+	}
+
+	return cancelledAMessage
+}
+
+// respondToReplaceSm returns the replace_sm_resp for a replace_sm, after applying it with applyReplaceSm().  If the
+// message could not be replaced, the response has command_status ESME_RREPLACEFAIL.
+func (store *MessageStore) respondToReplaceSm(replaceSm *smpp.PDU, factory PduFactory) *smpp.PDU {
+	response := factory.CreateReplaceSmRespFromRequest(replaceSm)
+	if !store.applyReplaceSm(replaceSm) {
+		response.CommandStatus = EsmeRreplacefail
+	}
+
+	return response
+}
+
+// applyReplaceSm replaces the message named by a replace_sm, and returns true if it was replaced.  If the message is
+// unknown, the source_addr does not match, or the message is in a final state, it is not changed.  Otherwise, the
+// short_message of the message is replaced, as are schedule_delivery_time and validity_period, if they are set.
+func (store *MessageStore) applyReplaceSm(replaceSm *smpp.PDU) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	message := store.messagesByMessageID[mandatoryStringParameter(replaceSm, 0)]
+	if message == nil || message.SourceAddr != mandatoryStringParameter(replaceSm, 3) || message.State.IsFinal() {
+		return false
+	}
+
+	message.ShortMessage = []byte(shortMessageFromReplaceSm(replaceSm))
+
+	if scheduleDeliveryTime := mandatoryStringParameter(replaceSm, 4); scheduleDeliveryTime != "" {
+		message.ScheduleDeliveryTime = scheduleDeliveryTime
+	}
+
+	if validityPeriod := mandatoryStringParameter(replaceSm, 5); validityPeriod != "" {
+		if expiresAt, isSet, err := parseSmppTime(validityPeriod, time.Now()); isSet && err == nil {
+			message.ValidityPeriod, message.ExpiresAt = validityPeriod, expiresAt
+		}
+	}
+
+	store.recordChange(message)
+
+	return true
+}
+
+// mandatoryStringParameter returns the value of the C-octet string mandatory parameter at the provided index,
+// or "" if the PDU has no such parameter
+func mandatoryStringParameter(pdu *smpp.PDU, index int) string {
+	if index >= len(pdu.MandatoryParameters) {
+		return ""
+	}
+
+	if value, isString := pdu.MandatoryParameters[index].Value.(string); isString {
+		return value
+	}
+
+	return ""
+}
+
+// shortMessageFromReplaceSm returns the short_message of a replace_sm.  When sm_length is zero, a decoded PDU
+// has no short_message parameter at all.
+func shortMessageFromReplaceSm(pdu *smpp.PDU) string {
+	if len(pdu.MandatoryParameters) < 10 {
+		return ""
+	}
+
+	return string(pdu.MandatoryParameters[9].Value.([]byte))
+}
@@ -0,0 +1,321 @@
+package smppth
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestMessageStoreQueryCancelReplace(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+
+	submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+	store.StoreSubmitSm("msg01", "esme01", submitSm)
+
+	querySm, _ := factory.CreateQuerySm(map[string]string{"message_id": "msg01", "source_addr": "1000"})
+	encodedQuerySmResp, _ := store.respondToQuerySm(querySm, factory).Encode()
+	querySmResp, err := decodePDU(encodedQuerySmResp)
+	if err != nil {
+		t.Fatalf("Expected no error decoding query-sm-resp, got = (%s)", err)
+	}
+
+	if querySmResp.CommandStatus != 0 || MessageState(querySmResp.MandatoryParameters[2].Value.(uint8)) != MessageStateEnroute || querySmResp.MandatoryParameters[1].Value.(string) != "" {
+		t.Errorf("Expected query-sm-resp for ENROUTE message with empty final_date, got status (%d), state (%v)", querySmResp.CommandStatus, querySmResp.MandatoryParameters[2].Value)
+	}
+
+	replaceSm, _ := factory.CreateReplaceSm(map[string]string{"message_id": "msg01", "source_addr": "1000", "short_message": "replaced"})
+	if response := store.respondToReplaceSm(replaceSm, factory); response.CommandStatus != 0 {
+		t.Errorf("Expected replace-sm-resp with status 0, got (%s)", CommandStatusName(response.CommandStatus))
+	}
+	if message, _ := store.Message("msg01"); string(message.ShortMessage) != "replaced" {
+		t.Errorf("Expected short_message to be replaced, got (%s)", string(message.ShortMessage))
+	}
+
+	cancelSm, _ := factory.CreateCancelSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+	if response := store.respondToCancelSm(cancelSm, factory); response.CommandStatus != 0 {
+		t.Errorf("Expected cancel-sm-resp with status 0, got (%s)", CommandStatusName(response.CommandStatus))
+	}
+
+	if response := store.respondToQuerySm(querySm, factory); MessageState(response.MandatoryParameters[2].Value.(uint8)) != MessageStateDeleted || response.MandatoryParameters[1].Value.(string) == "" {
+		t.Errorf("Expected query-sm-resp for DELETED message with final_date after cancel")
+	}
+
+	if response := store.respondToCancelSm(cancelSm, factory); response.CommandStatus != EsmeRcancelfail {
+		t.Errorf("Expected second cancel-sm-resp status ESME_RCANCELFAIL, got (%s)", CommandStatusName(response.CommandStatus))
+	}
+
+	if response := store.respondToReplaceSm(replaceSm, factory); response.CommandStatus != EsmeRreplacefail {
+		t.Errorf("Expected replace-sm-resp status ESME_RREPLACEFAIL for deleted message, got (%s)", CommandStatusName(response.CommandStatus))
+	}
+
+	unknownQuerySm, _ := factory.CreateQuerySm(map[string]string{"message_id": "nope"})
+	if response := store.respondToQuerySm(unknownQuerySm, factory); response.CommandStatus != EsmeRqueryfail || response.CommandID != smpp.CommandQuerySmResp {
+		t.Errorf("Expected query-sm-resp status ESME_RQUERYFAIL for unknown message, got (%s)", CommandStatusName(response.CommandStatus))
+	}
+}
+
+func TestMessageStoreMoveToFinalState(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+
+	submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000", "short_message": "hello"})
+	store.StoreSubmitSm("msg01", "esme01", submitSm)
+
+	message, stateWasChanged := store.MoveMessageToFinalState("msg01", MessageStateDelivered, time.Now())
+	if !stateWasChanged || message.State != MessageStateDelivered || string(message.ShortMessage) != "hello" {
+		t.Errorf("Expected message to move to DELIVERED")
+	}
+
+	if _, stateWasChanged := store.MoveMessageToFinalState("msg01", MessageStateExpired, time.Now()); stateWasChanged {
+		t.Errorf("Expected no change for a message already in a final state")
+	}
+
+	if _, stateWasChanged := store.MoveMessageToFinalState("nope", MessageStateDelivered, time.Now()); stateWasChanged {
+		t.Errorf("Expected no change for an unknown message")
+	}
+}
+
+func TestMessageStoreRecordsSubmitSmAndFilters(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+
+	submitSm, _ := factory.CreateSubmitSm(map[string]string{"service_type": "CMT", "source_addr": "1000", "dest_addr_ton": "1", "destination_addr": "2000", "registered_delivery": "1", "validity_period": "000000000010000R", "encoding": "latin1", "short_message": "café"})
+	stored, err := store.StoreSubmitSm("msg01", "esme01", submitSm)
+	if err != nil {
+		t.Fatalf("Expected no error on StoreSubmitSm, got = (%s)", err)
+	}
+
+	if _, err := store.StoreSubmitSm("msg01", "esme02", submitSm); err == nil {
+		t.Errorf("Expected error on StoreSubmitSm with a message_id that is already stored, got none")
+	}
+
+	if message, _ := store.Message("msg01"); message.NameOfPeer != "esme01" {
+		t.Errorf("Expected message with a duplicate message_id not to replace the stored message")
+	}
+
+	if stored.ServiceType != "CMT" || stored.DestAddrTon != 1 || stored.RegisteredDelivery != 1 || stored.DataCoding != 3 || stored.Text() != "café" || stored.State != MessageStateEnroute {
+		t.Errorf("Expected stored message fields from submit-sm, got = (%+v)", stored)
+	}
+
+	if expectedExpiry := stored.SubmitDate.Add(10 * time.Second); !stored.ExpiresAt.Equal(expectedExpiry) {
+		t.Errorf("Expected ExpiresAt = (%s), got = (%s)", expectedExpiry, stored.ExpiresAt)
+	}
+
+	otherSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1001", "destination_addr": "2000"})
+	store.StoreSubmitSm("msg02", "esme02", otherSubmitSm)
+	store.MoveMessageToFinalState("msg02", MessageStateDelivered, time.Now())
+
+	for filterText, expectedMessageIDs := range map[string][]string{
+		"":                                 {"msg01", "msg02"},
+		"destination_addr=2000":            {"msg01", "msg02"},
+		"state=enroute":                    {"msg01"},
+		"state=DELIVRD peer=esme02":        {"msg02"},
+		"source_addr=1000 state=DELIVERED": {},
+		"message_id=msg02":                 {"msg02"},
+	} {
+		filter, err := ParseMessageFilter(filterText)
+		if err != nil {
+			t.Fatalf("Expected no error on ParseMessageFilter(%s), got = (%s)", filterText, err)
+		}
+
+		messages := store.Messages(filter)
+		messageIDs := make([]string, len(messages))
+		for i, message := range messages {
+			messageIDs[i] = message.MessageID
+		}
+
+		if !reflect.DeepEqual(messageIDs, expectedMessageIDs) {
+			t.Errorf("For filter (%s) expected message_ids (%v), got (%v)", filterText, expectedMessageIDs, messageIDs)
+		}
+	}
+
+	for _, filterText := range []string{"state=LOST", "color=red", "peer"} {
+		if _, err := ParseMessageFilter(filterText); err == nil {
+			t.Errorf("Expected error on ParseMessageFilter(%s), got none", filterText)
+		}
+	}
+
+	if expired := store.ExpireMessages(time.Now()); len(expired) != 0 {
+		t.Errorf("Expected no messages to expire yet, got (%d)", len(expired))
+	}
+
+	expired := store.ExpireMessages(time.Now().Add(time.Minute))
+	if len(expired) != 1 || expired[0].MessageID != "msg01" || expired[0].State != MessageStateExpired {
+		t.Errorf("Expected msg01 to expire after its validity_period")
+	}
+}
+
+func TestMessageStorePendingDeliveryReceipts(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+	now := time.Now()
+
+	for _, messageID := range []string{"msg01", "msg02", "msg03", "msg04"} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000", "validity_period": "000000000010000R"})
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+		store.SetPendingDeliveryReceipt(messageID, &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: now.Add(time.Second), FinalState: MessageStateUndeliverable, ErrorCode: 5})
+	}
+
+	if store.SetPendingDeliveryReceipt("nope", &PendingDeliveryReceipt{}) {
+		t.Errorf("Expected SetPendingDeliveryReceipt() to return false for unknown message")
+	}
+
+	store.SetPendingDeliveryReceipt("msg04", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: now.Add(time.Hour), FinalState: MessageStateDelivered})
+
+	cancelSm, _ := factory.CreateCancelSm(map[string]string{"message_id": "msg02", "source_addr": "1000"})
+	store.respondToCancelSm(cancelSm, factory)
+
+	if due := store.TakeDueDeliveryReceipts(now, 0); len(due) != 0 {
+		t.Errorf("Expected no receipts due yet, got (%d)", len(due))
+	}
+
+	store.ExpireMessages(now.Add(20 * time.Second))
+
+	due := store.TakeDueDeliveryReceipts(now.Add(20*time.Second), 0)
+	if len(due) != 3 {
+		t.Fatalf("Expected 3 receipts due, got (%d)", len(due))
+	}
+
+	for i, expectedMessageID := range []string{"msg01", "msg03", "msg04"} {
+		if due[i].MessageID != expectedMessageID || due[i].State != MessageStateExpired || due[i].PendingReceipt == nil || due[i].PendingReceipt.FinalState != MessageStateExpired {
+			t.Errorf("Expected due receipt (%d) for (%s) reporting EXPIRED, got = (%+v)", i, expectedMessageID, due[i])
+		}
+	}
+
+	if message, _ := store.Message("msg01"); message.PendingReceipt != nil {
+		t.Errorf("Expected pending receipt to be cleared once taken")
+	}
+
+	if due := store.TakeDueDeliveryReceipts(now.Add(2*time.Hour), 0); len(due) != 0 {
+		t.Errorf("Expected each receipt to be taken only once, got (%d)", len(due))
+	}
+
+	submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+	store.StoreSubmitSm("msg05", "esme01", submitSm)
+	store.SetPendingDeliveryReceipt("msg05", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: now, FinalState: MessageStateUndeliverable, ErrorCode: 5})
+
+	due = store.TakeDueDeliveryReceipts(now, 0)
+	if len(due) != 1 || due[0].State != MessageStateUndeliverable || due[0].PendingReceipt.ErrorCode != 5 || !due[0].FinalDate.Equal(now) {
+		t.Errorf("Expected msg05 to move to UNDELIV when its receipt is due, got = (%+v)", due)
+	}
+}
+
+func TestMessageStoreRoutes(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+	now := time.Now()
+
+	for _, messageID := range []string{"msg01", "msg02"} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+
+	if store.RecordRoute("nope", "esme02", 1) {
+		t.Errorf("Expected RecordRoute() to return false for unknown message")
+	}
+
+	store.RecordRoute("msg01", "esme02", 7)
+	store.RecordRoute("msg02", "esme02", 8)
+
+	if _, isRouted := store.CompleteRoute("esme03", 7, 0, now); isRouted {
+		t.Errorf("Expected no routed message for another peer")
+	}
+
+	message, isRouted := store.CompleteRoute("esme02", 7, 0, now)
+	if !isRouted || message.MessageID != "msg01" || message.State != MessageStateDelivered || message.RoutedToPeer != "esme02" || !message.FinalDate.Equal(now) {
+		t.Errorf("Expected msg01 to be DELIVERED by deliver-sm-resp, got = (%+v)", message)
+	}
+
+	if _, isRouted := store.CompleteRoute("esme02", 7, 0, now); isRouted {
+		t.Errorf("Expected a routed message to be completed only once")
+	}
+
+	if message, isRouted := store.CompleteRoute("esme02", 8, EsmeRsyserr, now); !isRouted || message.MessageID != "msg02" || message.State != MessageStateUndeliverable {
+		t.Errorf("Expected msg02 to be UNDELIVERABLE by deliver-sm-resp with error, got = (%+v)", message)
+	}
+}
+
+func TestMessageStoreEvictsFinalMessages(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+	store.SetFinalMessageRetention(time.Minute, 3)
+	now := time.Now()
+
+	for _, messageID := range []string{"msg01", "msg02", "msg03", "msg04", "msg05", "msg06"} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+
+	store.MoveMessageToFinalState("msg01", MessageStateDelivered, now)
+	store.MoveMessageToFinalState("msg02", MessageStateDelivered, now.Add(30*time.Second))
+	store.SetPendingDeliveryReceipt("msg03", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: now.Add(time.Hour), FinalState: MessageStateDelivered})
+	store.MoveMessageToFinalState("msg03", MessageStateDelivered, now.Add(30*time.Second))
+
+	if evicted := store.EvictFinalMessages(now.Add(30 * time.Second)); len(evicted) != 0 {
+		t.Errorf("Expected no messages evicted within the retention period, got (%d)", len(evicted))
+	}
+
+	evicted := store.EvictFinalMessages(now.Add(time.Minute))
+	if len(evicted) != 1 || evicted[0].MessageID != "msg01" {
+		t.Fatalf("Expected msg01 to be evicted once the retention period passed, got = (%+v)", evicted)
+	}
+
+	if _, isStored := store.Message("msg01"); isStored || len(store.Messages(nil)) != 5 {
+		t.Errorf("Expected msg01 to be removed from the store")
+	}
+
+	if evicted := store.EvictFinalMessages(now.Add(2 * time.Minute)); len(evicted) != 1 || evicted[0].MessageID != "msg02" {
+		t.Errorf("Expected msg02 to be evicted, and msg03 kept for its pending receipt, got = (%+v)", evicted)
+	}
+
+	store.TakeDueDeliveryReceipts(now.Add(2*time.Hour), 0)
+	store.MoveMessageToFinalState("msg04", MessageStateDelivered, now.Add(2*time.Hour))
+	store.MoveMessageToFinalState("msg05", MessageStateDelivered, now.Add(2*time.Hour))
+	store.MoveMessageToFinalState("msg06", MessageStateDelivered, now.Add(2*time.Hour))
+	store.SetFinalMessageRetention(0, 2)
+
+	evicted = store.EvictFinalMessages(now.Add(2 * time.Hour))
+	if len(evicted) != 2 || evicted[0].MessageID != "msg03" || evicted[1].MessageID != "msg04" {
+		t.Errorf("Expected the oldest final messages beyond the maximum to be evicted, got = (%+v)", evicted)
+	}
+
+	if messages := store.Messages(nil); len(messages) != 2 || messages[0].MessageID != "msg05" || messages[1].MessageID != "msg06" {
+		t.Errorf("Expected msg05 and msg06 to remain, got (%d) messages", len(messages))
+	}
+}
+
+func TestMessageStoreEvictsFinalMessagesBehindPendingReceipt(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	store := NewMessageStore()
+	store.SetFinalMessageRetention(time.Minute, 0)
+	now := time.Now()
+
+	for _, messageID := range []string{"msg01", "msg02", "msg03"} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+
+	store.SetPendingDeliveryReceipt("msg01", &PendingDeliveryReceipt{NameOfPeer: "esme01", DueAt: now.Add(time.Hour), FinalState: MessageStateDelivered})
+	store.MoveMessageToFinalState("msg01", MessageStateDelivered, now)
+	store.MoveMessageToFinalState("msg02", MessageStateDelivered, now)
+	store.MoveMessageToFinalState("msg03", MessageStateDelivered, now.Add(time.Minute))
+
+	evicted := store.EvictFinalMessages(now.Add(time.Minute))
+	if len(evicted) != 1 || evicted[0].MessageID != "msg02" {
+		t.Fatalf("Expected msg02 to be evicted past msg01, which has a pending receipt, got = (%+v)", evicted)
+	}
+
+	if _, isStored := store.Message("msg01"); !isStored {
+		t.Errorf("Expected msg01 to be kept for its pending receipt")
+	}
+
+	store.TakeDueDeliveryReceipts(now.Add(time.Hour), 0)
+
+	evicted = store.EvictFinalMessages(now.Add(time.Hour))
+	if len(evicted) != 2 || evicted[0].MessageID != "msg01" || evicted[1].MessageID != "msg03" {
+		t.Errorf("Expected msg01 to be evicted once its receipt is taken, then msg03, got = (%+v)", evicted)
+	}
+}
@@ -0,0 +1,498 @@
+package smppth
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsSessionKey identifies the session between a local agent and a remote peer
+type MetricsSessionKey struct {
+	AgentName string
+	PeerName  string
+}
+
+// MetricsPduKey identifies a PDU type on the session between a local agent and a remote peer
+type MetricsPduKey struct {
+	AgentName   string
+	PeerName    string
+	CommandName string
+}
+
+// MetricsErrorResponseKey identifies a response PDU type and non-zero command_status on the session between
+// a local agent and a remote peer.  Direction is either "sent" or "received".
+type MetricsErrorResponseKey struct {
+	AgentName     string
+	PeerName      string
+	CommandName   string
+	CommandStatus uint32
+	Direction     string
+}
+
+// MetricsAgentErrorKey identifies a type of error event raised by an agent.  ErrorType is "transport",
+// "application" or "protocol".
+type MetricsAgentErrorKey struct {
+	AgentName string
+	ErrorType string
+}
+
+// LatencyHistogram is a snapshot of a response latency histogram.  BucketUpperBounds are in seconds, in
+// increasing order.  BucketCounts are cumulative, so that BucketCounts[i] is the number of observations less
+// than or equal to BucketUpperBounds[i].  SumOfLatencies is also in seconds.
+type LatencyHistogram struct {
+	BucketUpperBounds []float64
+	BucketCounts      []uint64
+	Count             uint64
+	SumOfLatencies    float64
+}
+
+// AverageLatency returns the mean of all observed latencies, or 0 if there are no observations
+func (histogram *LatencyHistogram) AverageLatency() time.Duration {
+	if histogram.Count == 0 {
+		return 0
+	}
+
+	return time.Duration(histogram.SumOfLatencies / float64(histogram.Count) * float64(time.Second))
+}
+
+// MetricsSnapshot is a point-in-time copy of the values in a MetricsCollector.  ResponseLatencies are
+// keyed by the request command name.  SessionIsBound contains an entry for each session that has ever
+// completed a bind, and is true if the session is currently bound.
+type MetricsSnapshot struct {
+	PdusSent            map[MetricsPduKey]uint64
+	PdusReceived        map[MetricsPduKey]uint64
+	ErrorResponses      map[MetricsErrorResponseKey]uint64
+	AgentErrors         map[MetricsAgentErrorKey]uint64
+	Binds               map[MetricsSessionKey]uint64
+	Reconnects          map[MetricsSessionKey]uint64
+	SessionIsBound      map[MetricsSessionKey]bool
+	OutstandingRequests map[MetricsSessionKey]int
+	ResponseLatencies   map[MetricsPduKey]*LatencyHistogram
+}
+
+// ActiveSessionsForAgent returns the number of sessions currently bound by the named agent
+func (snapshot *MetricsSnapshot) ActiveSessionsForAgent(agentName string) int {
+	activeSessions := 0
+
+	for sessionKey, isBound := range snapshot.SessionIsBound {
+		if isBound && sessionKey.AgentName == agentName {
+			activeSessions++
+		}
+	}
+
+	return activeSessions
+}
+
+// Sessions returns every session for which the snapshot has a value, in order of agent name and then peer name.
+// Errors raised by an agent that are not associated with a peer are not included.
+func (snapshot *MetricsSnapshot) Sessions() []MetricsSessionKey {
+	sessions := make(map[MetricsSessionKey]bool)
+
+	for key := range snapshot.SessionIsBound {
+		sessions[key] = true
+	}
+	for key := range snapshot.OutstandingRequests {
+		sessions[key] = true
+	}
+	for key := range snapshot.PdusSent {
+		sessions[MetricsSessionKey{AgentName: key.AgentName, PeerName: key.PeerName}] = true
+	}
+	for key := range snapshot.PdusReceived {
+		sessions[MetricsSessionKey{AgentName: key.AgentName, PeerName: key.PeerName}] = true
+	}
+
+	return sortedSessionKeys(sessions)
+}
+
+var defaultLatencyBucketUpperBounds = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// OutstandingRequest describes a request sent by an agent to a peer for which no response has yet been received
+type OutstandingRequest struct {
+	SequenceNumber uint32
+	CommandName    string
+	SentAt         time.Time
+}
+
+// MetricsCollector accumulates counters, gauges and response latency histograms from the AgentEvent stream.
+// Each AgentEvent should be passed to ObserveAgentEvent().  The values can be retrieved with Snapshot(), or
+// served in the Prometheus text exposition format through ServeHTTP() (a MetricsCollector is an http.Handler)
+// or an endpoint launched by StartHTTPEndpoint().  A MetricsCollector is safe for concurrent use.
+type MetricsCollector struct {
+	lock                                   sync.Mutex
+	latencyBucketUpperBounds               []float64
+	pdusSent                               map[MetricsPduKey]uint64
+	pdusReceived                           map[MetricsPduKey]uint64
+	errorResponses                         map[MetricsErrorResponseKey]uint64
+	agentErrors                            map[MetricsAgentErrorKey]uint64
+	binds                                  map[MetricsSessionKey]uint64
+	reconnects                             map[MetricsSessionKey]uint64
+	sessionIsBound                         map[MetricsSessionKey]bool
+	outstandingRequestsBySequenceBySession map[MetricsSessionKey]map[uint32]*OutstandingRequest
+	responseLatencies                      map[MetricsPduKey]*LatencyHistogram
+}
+
+// NewMetricsCollector creates a MetricsCollector with no observations
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{
+		latencyBucketUpperBounds:               defaultLatencyBucketUpperBounds,
+		pdusSent:                               make(map[MetricsPduKey]uint64),
+		pdusReceived:                           make(map[MetricsPduKey]uint64),
+		errorResponses:                         make(map[MetricsErrorResponseKey]uint64),
+		agentErrors:                            make(map[MetricsAgentErrorKey]uint64),
+		binds:                                  make(map[MetricsSessionKey]uint64),
+		reconnects:                             make(map[MetricsSessionKey]uint64),
+		sessionIsBound:                         make(map[MetricsSessionKey]bool),
+		outstandingRequestsBySequenceBySession: make(map[MetricsSessionKey]map[uint32]*OutstandingRequest),
+		responseLatencies:                      make(map[MetricsPduKey]*LatencyHistogram),
+	}
+}
+
+// ObserveAgentEvent updates the metrics based on an AgentEvent.  A request sent to a peer is outstanding
+// until a response with the same sequence number is received from that peer, at which point the time
+// between the two is added to the latency histogram for the request type.  A CompletedBind for a session
+// that was previously bound counts as a reconnect.  When a peer transport closes, the session is no longer
+// bound and its outstanding requests are discarded.
+func (collector *MetricsCollector) ObserveAgentEvent(event *AgentEvent) {
+	if event == nil || event.SourceAgent == nil {
+		return
+	}
+
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	agentName := event.SourceAgent.Name()
+	sessionKey := MetricsSessionKey{AgentName: agentName, PeerName: event.RemotePeerName}
+
+	switch event.Type {
+	case SentPDU:
+		pduKey := MetricsPduKey{AgentName: agentName, PeerName: event.RemotePeerName, CommandName: event.SmppPDU.CommandName()}
+		collector.pdusSent[pduKey]++
+
+		if event.SmppPDU.IsRequest() {
+			collector.outstandingRequestsForSession(sessionKey)[event.SmppPDU.SequenceNumber] = &OutstandingRequest{SequenceNumber: event.SmppPDU.SequenceNumber, CommandName: pduKey.CommandName, SentAt: time.Now()}
+		} else if event.SmppPDU.CommandStatus != 0 {
+			collector.errorResponses[MetricsErrorResponseKey{agentName, event.RemotePeerName, pduKey.CommandName, event.SmppPDU.CommandStatus, "sent"}]++
+		}
+
+	case ReceivedPDU:
+		pduKey := MetricsPduKey{AgentName: agentName, PeerName: event.RemotePeerName, CommandName: event.SmppPDU.CommandName()}
+		collector.pdusReceived[pduKey]++
+
+		if !event.SmppPDU.IsRequest() {
+			if event.SmppPDU.CommandStatus != 0 {
+				collector.errorResponses[MetricsErrorResponseKey{agentName, event.RemotePeerName, pduKey.CommandName, event.SmppPDU.CommandStatus, "received"}]++
+			}
+
+			outstandingRequests := collector.outstandingRequestsForSession(sessionKey)
+			if request, isOutstanding := outstandingRequests[event.SmppPDU.SequenceNumber]; isOutstanding {
+				delete(outstandingRequests, event.SmppPDU.SequenceNumber)
+				collector.observeLatency(MetricsPduKey{AgentName: agentName, PeerName: event.RemotePeerName, CommandName: request.CommandName}, time.Since(request.SentAt))
+			}
+		}
+
+	case CompletedBind:
+		collector.binds[sessionKey]++
+		if _, wasPreviouslyBound := collector.sessionIsBound[sessionKey]; wasPreviouslyBound {
+			collector.reconnects[sessionKey]++
+		}
+		collector.sessionIsBound[sessionKey] = true
+
+	case PeerTransportClosed:
+		collector.closeSession(sessionKey)
+
+	case TransportError:
+		collector.agentErrors[MetricsAgentErrorKey{AgentName: agentName, ErrorType: "transport"}]++
+		if event.RemotePeerName != "" {
+			collector.closeSession(sessionKey)
+		}
+
+	case ApplicationError:
+		collector.agentErrors[MetricsAgentErrorKey{AgentName: agentName, ErrorType: "application"}]++
+
+	case ProtocolError:
+		collector.agentErrors[MetricsAgentErrorKey{AgentName: agentName, ErrorType: "protocol"}]++
+	}
+}
+
+func (collector *MetricsCollector) outstandingRequestsForSession(sessionKey MetricsSessionKey) map[uint32]*OutstandingRequest {
+	outstandingRequests, sessionIsKnown := collector.outstandingRequestsBySequenceBySession[sessionKey]
+	if !sessionIsKnown {
+		outstandingRequests = make(map[uint32]*OutstandingRequest)
+		collector.outstandingRequestsBySequenceBySession[sessionKey] = outstandingRequests
+	}
+
+	return outstandingRequests
+}
+
+func (collector *MetricsCollector) closeSession(sessionKey MetricsSessionKey) {
+	if _, wasBound := collector.sessionIsBound[sessionKey]; wasBound {
+		collector.sessionIsBound[sessionKey] = false
+	}
+
+	delete(collector.outstandingRequestsBySequenceBySession, sessionKey)
+}
+
+func (collector *MetricsCollector) observeLatency(pduKey MetricsPduKey, latency time.Duration) {
+	histogram, histogramExists := collector.responseLatencies[pduKey]
+	if !histogramExists {
+		histogram = &LatencyHistogram{
+			BucketUpperBounds: collector.latencyBucketUpperBounds,
+			BucketCounts:      make([]uint64, len(collector.latencyBucketUpperBounds)),
+		}
+		collector.responseLatencies[pduKey] = histogram
+	}
+
+	latencyInSeconds := latency.Seconds()
+	for i, upperBound := range histogram.BucketUpperBounds {
+		if latencyInSeconds <= upperBound {
+			histogram.BucketCounts[i]++
+		}
+	}
+
+	histogram.Count++
+	histogram.SumOfLatencies += latencyInSeconds
+}
+
+// Snapshot returns a copy of the current metric values
+func (collector *MetricsCollector) Snapshot() *MetricsSnapshot {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	snapshot := &MetricsSnapshot{
+		PdusSent:            make(map[MetricsPduKey]uint64),
+		PdusReceived:        make(map[MetricsPduKey]uint64),
+		ErrorResponses:      make(map[MetricsErrorResponseKey]uint64),
+		AgentErrors:         make(map[MetricsAgentErrorKey]uint64),
+		Binds:               make(map[MetricsSessionKey]uint64),
+		Reconnects:          make(map[MetricsSessionKey]uint64),
+		SessionIsBound:      make(map[MetricsSessionKey]bool),
+		OutstandingRequests: make(map[MetricsSessionKey]int),
+		ResponseLatencies:   make(map[MetricsPduKey]*LatencyHistogram),
+	}
+
+	for key, value := range collector.pdusSent {
+		snapshot.PdusSent[key] = value
+	}
+	for key, value := range collector.pdusReceived {
+		snapshot.PdusReceived[key] = value
+	}
+	for key, value := range collector.errorResponses {
+		snapshot.ErrorResponses[key] = value
+	}
+	for key, value := range collector.agentErrors {
+		snapshot.AgentErrors[key] = value
+	}
+	for key, value := range collector.binds {
+		snapshot.Binds[key] = value
+	}
+	for key, value := range collector.reconnects {
+		snapshot.Reconnects[key] = value
+	}
+	for key, value := range collector.sessionIsBound {
+		snapshot.SessionIsBound[key] = value
+	}
+	for key, outstandingRequests := range collector.outstandingRequestsBySequenceBySession {
+		snapshot.OutstandingRequests[key] = len(outstandingRequests)
+	}
+	for key, histogram := range collector.responseLatencies {
+		snapshot.ResponseLatencies[key] = &LatencyHistogram{
+			BucketUpperBounds: histogram.BucketUpperBounds,
+			BucketCounts:      append([]uint64{}, histogram.BucketCounts...),
+			Count:             histogram.Count,
+			SumOfLatencies:    histogram.SumOfLatencies,
+		}
+	}
+
+	return snapshot
+}
+
+// OutstandingRequestsForSession returns the requests sent by the named agent to the named peer that have not
+// been answered, in order of sequence number
+func (collector *MetricsCollector) OutstandingRequestsForSession(agentName string, peerName string) []*OutstandingRequest {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	outstandingRequests := make([]*OutstandingRequest, 0)
+	for _, request := range collector.outstandingRequestsBySequenceBySession[MetricsSessionKey{AgentName: agentName, PeerName: peerName}] {
+		requestCopy := *request
+		outstandingRequests = append(outstandingRequests, &requestCopy)
+	}
+
+	sort.Slice(outstandingRequests, func(i, j int) bool {
+		return outstandingRequests[i].SequenceNumber < outstandingRequests[j].SequenceNumber
+	})
+
+	return outstandingRequests
+}
+
+// ServeHTTP writes the current metric values in the Prometheus text exposition format
+func (collector *MetricsCollector) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	collector.WritePrometheusText(responseWriter)
+}
+
+// StartHTTPEndpoint listens on the provided address (e.g., "127.0.0.1:9400") and serves the metrics at
+// the path /metrics in the Prometheus text exposition format.  The endpoint is served in a separate go
+// routine.  The returned http.Server can be used to stop the endpoint.
+func (collector *MetricsCollector) StartHTTPEndpoint(listeningAddress string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", listeningAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	server := &http.Server{Handler: mux}
+
+	go server.Serve(listener)
+
+	return server, nil
+}
+
+// WritePrometheusText writes the current metric values to the writer in the Prometheus text exposition format
+func (collector *MetricsCollector) WritePrometheusText(writer io.Writer) error {
+	snapshot := collector.Snapshot()
+	exposition := new(strings.Builder)
+
+	writePrometheusMetricHeader(exposition, "smppth_pdus_sent_total", "counter", "Number of PDUs sent by an agent to a peer.")
+	for _, key := range sortedPduKeys(snapshot.PdusSent) {
+		fmt.Fprintf(exposition, "smppth_pdus_sent_total%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName), snapshot.PdusSent[key])
+	}
+
+	writePrometheusMetricHeader(exposition, "smppth_pdus_received_total", "counter", "Number of PDUs received by an agent from a peer.")
+	for _, key := range sortedPduKeys(snapshot.PdusReceived) {
+		fmt.Fprintf(exposition, "smppth_pdus_received_total%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName), snapshot.PdusReceived[key])
+	}
+
+	writePrometheusMetricHeader(exposition, "smppth_error_responses_total", "counter", "Number of responses with a non-zero command_status.")
+	errorResponseLines := make([]string, 0, len(snapshot.ErrorResponses))
+	for key, count := range snapshot.ErrorResponses {
+		errorResponseLines = append(errorResponseLines, fmt.Sprintf("smppth_error_responses_total%s %d\n",
+			prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName, "command_status", CommandStatusName(key.CommandStatus), "direction", key.Direction), count))
+	}
+	writeSortedLines(exposition, errorResponseLines)
+
+	writePrometheusMetricHeader(exposition, "smppth_agent_errors_total", "counter", "Number of transport, application and protocol errors raised by an agent.")
+	agentErrorLines := make([]string, 0, len(snapshot.AgentErrors))
+	for key, count := range snapshot.AgentErrors {
+		agentErrorLines = append(agentErrorLines, fmt.Sprintf("smppth_agent_errors_total%s %d\n", prometheusLabels("agent", key.AgentName, "type", key.ErrorType), count))
+	}
+	writeSortedLines(exposition, agentErrorLines)
+
+	writePrometheusMetricHeader(exposition, "smppth_binds_total", "counter", "Number of completed binds between an agent and a peer.")
+	for _, key := range sortedSessionKeys(snapshot.SessionIsBound) {
+		fmt.Fprintf(exposition, "smppth_binds_total%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName), snapshot.Binds[key])
+	}
+
+	writePrometheusMetricHeader(exposition, "smppth_reconnects_total", "counter", "Number of binds between an agent and a peer after the first.")
+	for _, key := range sortedSessionKeys(snapshot.SessionIsBound) {
+		fmt.Fprintf(exposition, "smppth_reconnects_total%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName), snapshot.Reconnects[key])
+	}
+
+	writePrometheusMetricHeader(exposition, "smppth_active_sessions", "gauge", "Number of currently bound sessions for an agent.")
+	activeSessionLines := make([]string, 0)
+	agentsWithSessions := make(map[string]bool)
+	for key := range snapshot.SessionIsBound {
+		if !agentsWithSessions[key.AgentName] {
+			agentsWithSessions[key.AgentName] = true
+			activeSessionLines = append(activeSessionLines, fmt.Sprintf("smppth_active_sessions%s %d\n", prometheusLabels("agent", key.AgentName), snapshot.ActiveSessionsForAgent(key.AgentName)))
+		}
+	}
+	writeSortedLines(exposition, activeSessionLines)
+
+	writePrometheusMetricHeader(exposition, "smppth_outstanding_requests", "gauge", "Number of requests sent by an agent to a peer that have not been answered.")
+	outstandingLines := make([]string, 0, len(snapshot.OutstandingRequests))
+	for key, outstanding := range snapshot.OutstandingRequests {
+		outstandingLines = append(outstandingLines, fmt.Sprintf("smppth_outstanding_requests%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName), outstanding))
+	}
+	writeSortedLines(exposition, outstandingLines)
+
+	writePrometheusMetricHeader(exposition, "smppth_response_latency_seconds", "histogram", "Time between sending a request and receiving its response.")
+	for _, key := range sortedPduKeysForHistograms(snapshot.ResponseLatencies) {
+		histogram := snapshot.ResponseLatencies[key]
+
+		for i, upperBound := range histogram.BucketUpperBounds {
+			fmt.Fprintf(exposition, "smppth_response_latency_seconds_bucket%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName, "le", fmt.Sprint(upperBound)), histogram.BucketCounts[i])
+		}
+
+		fmt.Fprintf(exposition, "smppth_response_latency_seconds_bucket%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName, "le", "+Inf"), histogram.Count)
+		fmt.Fprintf(exposition, "smppth_response_latency_seconds_sum%s %g\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName), histogram.SumOfLatencies)
+		fmt.Fprintf(exposition, "smppth_response_latency_seconds_count%s %d\n", prometheusLabels("agent", key.AgentName, "peer", key.PeerName, "command", key.CommandName), histogram.Count)
+	}
+
+	_, err := io.WriteString(writer, exposition.String())
+	return err
+}
+
+func writePrometheusMetricHeader(exposition *strings.Builder, metricName string, metricType string, help string) {
+	fmt.Fprintf(exposition, "# HELP %s %s\n# TYPE %s %s\n", metricName, help, metricName, metricType)
+}
+
+func writeSortedLines(exposition *strings.Builder, lines []string) {
+	sort.Strings(lines)
+	for _, line := range lines {
+		exposition.WriteString(line)
+	}
+}
+
+var prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabels(labelNamesAndValues ...string) string {
+	labels := make([]string, 0, len(labelNamesAndValues)/2)
+
+	for i := 0; i+1 < len(labelNamesAndValues); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, labelNamesAndValues[i], prometheusLabelValueEscaper.Replace(labelNamesAndValues[i+1])))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func lessPduKey(a MetricsPduKey, b MetricsPduKey) bool {
+	if a.AgentName != b.AgentName {
+		return a.AgentName < b.AgentName
+	}
+	if a.PeerName != b.PeerName {
+		return a.PeerName < b.PeerName
+	}
+	return a.CommandName < b.CommandName
+}
+
+func sortedPduKeys(counters map[MetricsPduKey]uint64) []MetricsPduKey {
+	keys := make([]MetricsPduKey, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return lessPduKey(keys[i], keys[j]) })
+	return keys
+}
+
+func sortedPduKeysForHistograms(histograms map[MetricsPduKey]*LatencyHistogram) []MetricsPduKey {
+	keys := make([]MetricsPduKey, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return lessPduKey(keys[i], keys[j]) })
+	return keys
+}
+
+func sortedSessionKeys(sessions map[MetricsSessionKey]bool) []MetricsSessionKey {
+	keys := make([]MetricsSessionKey, 0, len(sessions))
+	for key := range sessions {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].AgentName != keys[j].AgentName {
+			return keys[i].AgentName < keys[j].AgentName
+		}
+		return keys[i].PeerName < keys[j].PeerName
+	})
+	return keys
+}
@@ -0,0 +1,117 @@
+package smppth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/blorticus/smpp"
+)
+
+type metricsTestAgent struct {
+	name string
+}
+
+func (agent *metricsTestAgent) Name() string                               { return agent.name }
+func (agent *metricsTestAgent) StartEventLoop()                            {}
+func (agent *metricsTestAgent) SetAgentEventChannel(chan<- *AgentEvent)    {}
+func (agent *metricsTestAgent) SendMessageToPeer(*MessageDescriptor) error { return nil }
+
+func TestMetricsCollectorSnapshot(t *testing.T) {
+	esme := &metricsTestAgent{name: "esme01"}
+	collector := NewMetricsCollector()
+
+	submitSmResp := smpp.NewPDU(smpp.CommandSubmitSmResp, EsmeRinvdstadr, testSmppPDUSubmitSm01().SequenceNumber, []*smpp.Parameter{smpp.NewCOctetStringParameter("")}, []*smpp.Parameter{})
+	enquireLink := smpp.NewPDU(smpp.CommandEnquireLink, 0, 1000, []*smpp.Parameter{}, []*smpp.Parameter{})
+
+	for _, event := range []*AgentEvent{
+		{Type: CompletedBind, SourceAgent: esme, RemotePeerName: "smsc01"},
+		{Type: SentPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: testSmppPDUSubmitSm01()},
+		{Type: ReceivedPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: submitSmResp},
+		{Type: SentPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: enquireLink},
+		{Type: PeerTransportClosed, SourceAgent: esme, RemotePeerName: "smsc01"},
+		{Type: CompletedBind, SourceAgent: esme, RemotePeerName: "smsc01"},
+		{Type: SentPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: enquireLink},
+		{Type: TransportError, SourceAgent: esme},
+	} {
+		collector.ObserveAgentEvent(event)
+	}
+
+	snapshot := collector.Snapshot()
+	session := MetricsSessionKey{AgentName: "esme01", PeerName: "smsc01"}
+
+	if v := snapshot.PdusSent[MetricsPduKey{"esme01", "smsc01", "submit-sm"}]; v != 1 {
+		t.Errorf("Expected 1 submit-sm sent, got (%d)", v)
+	}
+	if v := snapshot.PdusReceived[MetricsPduKey{"esme01", "smsc01", "submit-sm-resp"}]; v != 1 {
+		t.Errorf("Expected 1 submit-sm-resp received, got (%d)", v)
+	}
+	if v := snapshot.ErrorResponses[MetricsErrorResponseKey{"esme01", "smsc01", "submit-sm-resp", EsmeRinvdstadr, "received"}]; v != 1 {
+		t.Errorf("Expected 1 received ESME_RINVDSTADR, got (%d)", v)
+	}
+	if snapshot.Binds[session] != 2 || snapshot.Reconnects[session] != 1 {
+		t.Errorf("Expected 2 binds and 1 reconnect, got (%d) and (%d)", snapshot.Binds[session], snapshot.Reconnects[session])
+	}
+	if snapshot.ActiveSessionsForAgent("esme01") != 1 {
+		t.Errorf("Expected 1 active session, got (%d)", snapshot.ActiveSessionsForAgent("esme01"))
+	}
+	if snapshot.OutstandingRequests[session] != 1 {
+		t.Errorf("Expected 1 outstanding request, got (%d)", snapshot.OutstandingRequests[session])
+	}
+	if snapshot.AgentErrors[MetricsAgentErrorKey{"esme01", "transport"}] != 1 {
+		t.Errorf("Expected 1 transport error, got (%d)", snapshot.AgentErrors[MetricsAgentErrorKey{"esme01", "transport"}])
+	}
+
+	if sessions := snapshot.Sessions(); len(sessions) != 1 || sessions[0] != session {
+		t.Errorf("Expected only session (%v), got (%v)", session, sessions)
+	}
+
+	outstandingRequests := collector.OutstandingRequestsForSession("esme01", "smsc01")
+	if len(outstandingRequests) != 1 || outstandingRequests[0].SequenceNumber != 1000 || outstandingRequests[0].CommandName != "enquire-link" {
+		t.Errorf("Expected one outstanding enquire-link with sequence number 1000, got (%v)", outstandingRequests)
+	}
+
+	histogram := snapshot.ResponseLatencies[MetricsPduKey{"esme01", "smsc01", "submit-sm"}]
+	if histogram == nil || histogram.Count != 1 || histogram.BucketCounts[len(histogram.BucketCounts)-1] != 1 {
+		t.Errorf("Expected submit-sm latency histogram with one observation, got (%v)", histogram)
+	}
+}
+
+func TestMetricsCollectorHTTPEndpoint(t *testing.T) {
+	esme := &metricsTestAgent{name: "esme\"01"}
+	collector := NewMetricsCollector()
+	collector.ObserveAgentEvent(&AgentEvent{Type: CompletedBind, SourceAgent: esme, RemotePeerName: "smsc01"})
+	collector.ObserveAgentEvent(&AgentEvent{Type: SentPDU, SourceAgent: esme, RemotePeerName: "smsc01", SmppPDU: testSmppPDUEnquireLink01()})
+
+	server, err := collector.StartHTTPEndpoint("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error on StartHTTPEndpoint, got = (%s)", err)
+	}
+	server.Close()
+
+	responseRecorder := &metricsResponseRecorder{header: make(http.Header)}
+	collector.ServeHTTP(responseRecorder, nil)
+	exposition := responseRecorder.body.String()
+
+	for _, expectedLine := range []string{
+		"# TYPE smppth_pdus_sent_total counter\n",
+		`smppth_pdus_sent_total{agent="esme\"01",peer="smsc01",command="enquire-link"} 1` + "\n",
+		`smppth_active_sessions{agent="esme\"01"} 1` + "\n",
+		`smppth_outstanding_requests{agent="esme\"01",peer="smsc01"} 1` + "\n",
+	} {
+		if !strings.Contains(exposition, expectedLine) {
+			t.Errorf("Expected exposition to contain (%q), got:\n%s", expectedLine, exposition)
+		}
+	}
+}
+
+type metricsResponseRecorder struct {
+	header http.Header
+	body   strings.Builder
+}
+
+func (recorder *metricsResponseRecorder) Header() http.Header { return recorder.header }
+func (recorder *metricsResponseRecorder) WriteHeader(int)     {}
+func (recorder *metricsResponseRecorder) Write(b []byte) (int, error) {
+	return recorder.body.Write(b)
+}
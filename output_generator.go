@@ -2,6 +2,9 @@ package smppth
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/blorticus/smpp"
 )
@@ -16,6 +19,22 @@ type OutputGenerator interface {
 	SayThatTheTransportForAPeerClosed(localAgentName string, remotePeerName string) string
 	SayThatATransportErrorWasThrown(localAgentName string, remotePeerName string, err error) string
 	SayThatAnApplicationErrorWasThrown(reportingAgentName string, err error) string
+	SayThatAProtocolErrorOccurred(localAgentName string, remotePeerName string, err error) string
+	SayThatACompleteMessageWasReceived(localAgentName string, remotePeerName string, message *ReassembledMessage) string
+	SayThatAnIncompleteMessageTimedOut(localAgentName string, remotePeerName string, message *ReassembledMessage) string
+	SayThatADeliveryReceiptWasReceived(localAgentName string, remotePeerName string, receipt *ReceivedDeliveryReceipt) string
+	SayThatARoutedMessageWasCompleted(nameOfSmsc string, message *StoredMessage) string
+	SayWhatHappenedToAQueuedDelivery(nameOfSmsc string, eventType AgentEventType, delivery *QueuedDelivery, queueDepth int) string
+	SayThatAResponseRuleWasApplied(localAgentName string, remotePeerName string, request *smpp.PDU, rule *ResponseRule) string
+	SayWhatTheResponseRulesAre(rules []*ResponseRule) string
+	SayWhatTheSubmitMultiFailuresAre(errorStatusCodeByDestinationAddress map[string]uint32) string
+	SayThatARequestIsPending(localAgentName string, remotePeerName string, request *smpp.PDU) string
+	SayWhatThePendingRequestsAre(localAgentName string, pendingRequests []*PendingRequest) string
+	SayWhatTheStoredMessagesAre(nameOfSmsc string, messages []*StoredMessage) string
+	SayWhatTheStatisticsAre(nameOfAgent string, snapshot *MetricsSnapshot) string
+	SayWhatTheSessionStatesAre(snapshot *MetricsSnapshot) string
+	SayWhatTheOutstandingRequestsAre(localAgentName string, remotePeerName string, outstandingRequests []*OutstandingRequest) string
+	SayWhatTheScenarioResultIs(report *ScenarioReport) string
 }
 
 // StandardOutputGenerator implements OutputGenerator, providing generic text responses for commands and events
@@ -27,17 +46,30 @@ func NewStandardOutputGenerator() *StandardOutputGenerator {
 	return &StandardOutputGenerator{}
 }
 
-// SayThatAPduWasReceivedByAnAgent produces output "$peer_name received $message_type from $agent_name"
+// SayThatAPduWasReceivedByAnAgent produces output "$peer_name received $message_type from $agent_name", followed
+// by significant parameters for the message type, and then each optional parameter as ", $tlv_name=($value)"
 func (generator *StandardOutputGenerator) SayThatAPduWasReceivedByAnAgent(sendingAgentName string, receivingPeerName string, receivedPDU *smpp.PDU) string {
+	returnString := generator.describeAPduReceivedByAnAgent(sendingAgentName, receivingPeerName, receivedPDU)
+
+	for _, parameter := range receivedPDU.OptionalParameters {
+		if tlv, isTlv := parameter.Value.(smpp.TLV); isTlv && tlv.Tag != tlvTagMessagePayload {
+			returnString = fmt.Sprintf("%s, %s=(%s)", returnString, TlvName(tlv.Tag), describeTlvValue(&tlv))
+		}
+	}
+
+	return returnString
+}
+
+func (generator *StandardOutputGenerator) describeAPduReceivedByAnAgent(sendingAgentName string, receivingPeerName string, receivedPDU *smpp.PDU) string {
 	switch receivedPDU.CommandID {
-	case smpp.CommandSubmitSm:
-		returnString := fmt.Sprintf("%s received submit-sm from %s", receivingPeerName, sendingAgentName)
+	case smpp.CommandSubmitSm, smpp.CommandDeliverSm:
+		returnString := fmt.Sprintf("%s received %s from %s", receivingPeerName, receivedPDU.CommandName(), sendingAgentName)
 
 		if receivedPDU.MandatoryParameters[6].Value.(string) != "" {
 			returnString = fmt.Sprintf("%s, dest_addr=(%s)", returnString, receivedPDU.MandatoryParameters[6].Value.(string))
 		}
 
-		return fmt.Sprintf("%s, short_message=(%s)", returnString, string(receivedPDU.MandatoryParameters[17].Value.([]byte)))
+		return fmt.Sprintf("%s, short_message=(%s)", returnString, ShortMessageText(receivedPDU))
 
 	case smpp.CommandSubmitSmResp:
 		return fmt.Sprintf("%s received submit-sm-resp from %s, message_id=(%s)",
@@ -46,7 +78,87 @@ func (generator *StandardOutputGenerator) SayThatAPduWasReceivedByAnAgent(sendin
 			receivedPDU.MandatoryParameters[0].Value.(string),
 		)
 
+	case smpp.CommandDataSm:
+		return fmt.Sprintf("%s received data-sm from %s, source_addr=(%s), dest_addr=(%s), message_payload=(%s)",
+			receivingPeerName,
+			sendingAgentName,
+			receivedPDU.MandatoryParameters[3].Value.(string),
+			receivedPDU.MandatoryParameters[6].Value.(string),
+			DecodeText([]byte(tlvValueAsString(findTlvParameter(receivedPDU, tlvTagMessagePayload))), TextEncodingForDataCoding(receivedPDU.MandatoryParameters[9].Value.(uint8))),
+		)
+
+	case smpp.CommandDataSmResp:
+		returnString := fmt.Sprintf("%s received data-sm-resp from %s", receivingPeerName, sendingAgentName)
+
+		if len(receivedPDU.MandatoryParameters) > 0 {
+			returnString = fmt.Sprintf("%s, message_id=(%s)", returnString, receivedPDU.MandatoryParameters[0].Value.(string))
+		}
+
+		return returnString
+
+	case smpp.CommandQuerySmResp:
+		if receivedPDU.CommandStatus != 0 || len(receivedPDU.MandatoryParameters) < 4 {
+			return fmt.Sprintf("%s received query-sm-resp from %s, command_status=(%s)", receivingPeerName, sendingAgentName, CommandStatusName(receivedPDU.CommandStatus))
+		}
+
+		return fmt.Sprintf("%s received query-sm-resp from %s, message_id=(%s), message_state=(%s), final_date=(%s), error_code=(%d)",
+			receivingPeerName,
+			sendingAgentName,
+			receivedPDU.MandatoryParameters[0].Value.(string),
+			MessageState(receivedPDU.MandatoryParameters[2].Value.(uint8)),
+			receivedPDU.MandatoryParameters[1].Value.(string),
+			receivedPDU.MandatoryParameters[3].Value.(uint8),
+		)
+
+	case smpp.CommandSubmitMulti:
+		destinations, err := SubmitMultiDestinations(receivedPDU)
+		if err != nil {
+			return fmt.Sprintf("%s received submit-multi from %s, %s", receivingPeerName, sendingAgentName, err)
+		}
+
+		describedDestinations := make([]string, 0, len(destinations))
+		for _, destination := range destinations {
+			if destination.IsDistributionList {
+				describedDestinations = append(describedDestinations, "dl:"+destination.DistributionListName)
+			} else {
+				describedDestinations = append(describedDestinations, destination.Address)
+			}
+		}
+
+		return fmt.Sprintf("%s received submit-multi from %s, dests=(%s), short_message=(%s)",
+			receivingPeerName,
+			sendingAgentName,
+			strings.Join(describedDestinations, ","),
+			submitMultiShortMessage(receivedPDU),
+		)
+
+	case smpp.CommandSubmitMultiResp:
+		if receivedPDU.CommandStatus != 0 || len(receivedPDU.MandatoryParameters) == 0 {
+			return fmt.Sprintf("%s received submit-multi-resp from %s, command_status=(%s)", receivingPeerName, sendingAgentName, CommandStatusName(receivedPDU.CommandStatus))
+		}
+
+		unsuccessfulDeliveries, err := SubmitMultiUnsuccessfulDeliveries(receivedPDU)
+		if err != nil {
+			return fmt.Sprintf("%s received submit-multi-resp from %s, %s", receivingPeerName, sendingAgentName, err)
+		}
+
+		describedFailures := make([]string, 0, len(unsuccessfulDeliveries))
+		for _, unsuccessfulDelivery := range unsuccessfulDeliveries {
+			describedFailures = append(describedFailures, fmt.Sprintf("%s:%s", unsuccessfulDelivery.Address, CommandStatusName(unsuccessfulDelivery.ErrorStatusCode)))
+		}
+
+		return fmt.Sprintf("%s received submit-multi-resp from %s, message_id=(%s), unsuccess_sme=(%s)",
+			receivingPeerName,
+			sendingAgentName,
+			receivedPDU.MandatoryParameters[0].Value.(string),
+			strings.Join(describedFailures, ","),
+		)
+
 	default:
+		if !receivedPDU.IsRequest() && receivedPDU.CommandStatus != 0 {
+			return fmt.Sprintf("%s received %s from %s, command_status=(%s)", receivingPeerName, receivedPDU.CommandName(), sendingAgentName, CommandStatusName(receivedPDU.CommandStatus))
+		}
+
 		return fmt.Sprintf("%s received %s from %s", receivingPeerName, receivedPDU.CommandName(), sendingAgentName)
 
 	}
@@ -76,3 +188,361 @@ func (generator *StandardOutputGenerator) SayThatATransportErrorWasThrown(localA
 func (generator *StandardOutputGenerator) SayThatAnApplicationErrorWasThrown(reportingAgentName string, err error) string {
 	return fmt.Sprintf("%s reports an application error: %s", reportingAgentName, err)
 }
+
+// SayThatAProtocolErrorOccurred produces output "$localAgentName reports a protocol error with $remotePeerName: $errString"
+func (generator *StandardOutputGenerator) SayThatAProtocolErrorOccurred(localAgentName string, remotePeerName string, err error) string {
+	return fmt.Sprintf("%s reports a protocol error with %s: %s", localAgentName, remotePeerName, err)
+}
+
+// SayThatACompleteMessageWasReceived produces output "$localAgentName received complete message from $remotePeerName:"
+// followed by the source_addr, destination_addr, segment count, reference number and reassembled text
+func (generator *StandardOutputGenerator) SayThatACompleteMessageWasReceived(localAgentName string, remotePeerName string, message *ReassembledMessage) string {
+	return fmt.Sprintf("%s received complete message from %s: source_addr = (%s), destination_addr = (%s), segments = (%d), reference = (%d), text = (%s)", localAgentName, remotePeerName, message.SourceAddr, message.DestinationAddr, message.TotalSegments, message.ReferenceNumber, message.Text)
+}
+
+// SayThatAnIncompleteMessageTimedOut produces output "$localAgentName timed out incomplete message from $remotePeerName:"
+// followed by the source_addr, reference number, and the number of segments received out of the total
+func (generator *StandardOutputGenerator) SayThatAnIncompleteMessageTimedOut(localAgentName string, remotePeerName string, message *ReassembledMessage) string {
+	return fmt.Sprintf("%s timed out incomplete message from %s: source_addr = (%s), reference = (%d), received (%d) of (%d) segments", localAgentName, remotePeerName, message.SourceAddr, message.ReferenceNumber, message.ReceivedSegments, message.TotalSegments)
+}
+
+// SayThatADeliveryReceiptWasReceived produces output "$localAgentName received delivery receipt from $remotePeerName:"
+// followed by the message_id, the state and error code, and either the latency since the message was submitted or
+// a note that the message is not tracked
+func (generator *StandardOutputGenerator) SayThatADeliveryReceiptWasReceived(localAgentName string, remotePeerName string, receipt *ReceivedDeliveryReceipt) string {
+	latency := "untracked message"
+	if receipt.TrackedMessage != nil {
+		latency = fmt.Sprintf("latency = (%s)", receipt.Latency)
+	}
+
+	return fmt.Sprintf("%s received delivery receipt from %s: message_id = (%s), stat = (%s), err = (%03d), %s", localAgentName, remotePeerName, receipt.MessageID, receipt.State.ReceiptStat(), receipt.ErrorCode, latency)
+}
+
+// SayWhatTheStatisticsAre produces, for each session of the named agent (or of all agents, if nameOfAgent is the
+// empty string), a line "$localAgentName -> $remotePeerName: $bindState", followed by indented lines listing the
+// PDUs sent and received by type, the error responses by type and command_status, and the average response
+// latency by request type.
+func (generator *StandardOutputGenerator) SayWhatTheStatisticsAre(nameOfAgent string, snapshot *MetricsSnapshot) string {
+	lines := make([]string, 0)
+
+	for _, session := range snapshot.Sessions() {
+		if nameOfAgent != "" && session.AgentName != nameOfAgent {
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%s -> %s: %s", session.AgentName, session.PeerName, describeBindState(snapshot, session)))
+		lines = append(lines, "  sent: "+describePduCounts(snapshot.PdusSent, session))
+		lines = append(lines, "  received: "+describePduCounts(snapshot.PdusReceived, session))
+
+		errorCounts := make([]string, 0)
+		for key, count := range snapshot.ErrorResponses {
+			if key.AgentName == session.AgentName && key.PeerName == session.PeerName {
+				errorCounts = append(errorCounts, fmt.Sprintf("%s %s %s=%d", key.Direction, key.CommandName, CommandStatusName(key.CommandStatus), count))
+			}
+		}
+		lines = append(lines, "  errors: "+joinSortedOrNone(errorCounts))
+
+		averageLatencies := make([]string, 0)
+		for key, histogram := range snapshot.ResponseLatencies {
+			if key.AgentName == session.AgentName && key.PeerName == session.PeerName {
+				averageLatencies = append(averageLatencies, fmt.Sprintf("%s=%s", key.CommandName, histogram.AverageLatency().Round(time.Microsecond)))
+			}
+		}
+		lines = append(lines, "  average response latency: "+joinSortedOrNone(averageLatencies))
+	}
+
+	if len(lines) == 0 {
+		if nameOfAgent != "" {
+			return fmt.Sprintf("no statistics for %s", nameOfAgent)
+		}
+		return "no statistics"
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// SayWhatTheSessionStatesAre produces, for each session, a line "$localAgentName -> $remotePeerName: $bindState
+// (binds=$binds, reconnects=$reconnects, outstanding=$outstanding)"
+func (generator *StandardOutputGenerator) SayWhatTheSessionStatesAre(snapshot *MetricsSnapshot) string {
+	lines := make([]string, 0)
+
+	for _, session := range snapshot.Sessions() {
+		lines = append(lines, fmt.Sprintf("%s -> %s: %s (binds=%d, reconnects=%d, outstanding=%d)",
+			session.AgentName,
+			session.PeerName,
+			describeBindState(snapshot, session),
+			snapshot.Binds[session],
+			snapshot.Reconnects[session],
+			snapshot.OutstandingRequests[session],
+		))
+	}
+
+	if len(lines) == 0 {
+		return "no sessions"
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// SayWhatTheOutstandingRequestsAre produces output "$localAgentName has $n outstanding requests to $remotePeerName",
+// followed by a line for each request "  seq=$sequence_number $message_type sent $age ago"
+func (generator *StandardOutputGenerator) SayWhatTheOutstandingRequestsAre(localAgentName string, remotePeerName string, outstandingRequests []*OutstandingRequest) string {
+	lines := []string{fmt.Sprintf("%s has %d outstanding requests to %s", localAgentName, len(outstandingRequests), remotePeerName)}
+
+	for _, request := range outstandingRequests {
+		lines = append(lines, fmt.Sprintf("  seq=%d %s sent %s ago", request.SequenceNumber, request.CommandName, time.Since(request.SentAt).Round(time.Millisecond)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// SayWhatTheScenarioResultIs produces output "scenario $name PASSED, $n steps in $duration" or "scenario $name
+// FAILED, $failed of $n steps failed in $duration", followed by an indented "PASS $step [$duration]" or "FAIL $step
+// [$duration]: $failure" line for each step that ran.  A passing step is followed by the PDUs that it sent, or the
+// event that it matched.  A failing step is followed by every event observed while it ran.  The steps run by a repeat
+// or parallel step are indented below it, with their iteration or branch.
+func (generator *StandardOutputGenerator) SayWhatTheScenarioResultIs(report *ScenarioReport) string {
+	lines := []string{fmt.Sprintf("scenario %s PASSED, %d steps in %s", report.NameOfScenario, report.NumberOfSteps(), report.Duration.Round(time.Millisecond))}
+	if !report.Passed() {
+		lines[0] = fmt.Sprintf("scenario %s FAILED, %d of %d steps failed in %s", report.NameOfScenario, report.NumberOfFailedSteps(), report.NumberOfSteps(), report.Duration.Round(time.Millisecond))
+	}
+
+	return strings.Join(generator.describeScenarioStepResults(report.StepResults, "  ", lines), "\n")
+}
+
+func (generator *StandardOutputGenerator) describeScenarioStepResults(results []*ScenarioStepResult, indent string, lines []string) []string {
+	for _, result := range results {
+		label := ""
+		if result.Branch > 0 {
+			label = fmt.Sprintf("%s[branch %d] ", label, result.Branch)
+		}
+		if result.Iteration > 0 {
+			label = fmt.Sprintf("%s[iteration %d] ", label, result.Iteration)
+		}
+
+		if result.Passed {
+			lines = append(lines, fmt.Sprintf("%sPASS %s%s [%s]", indent, label, result.Step, result.Duration.Round(time.Millisecond)))
+		} else {
+			lines = append(lines, fmt.Sprintf("%sFAIL %s%s [%s]: %s", indent, label, result.Step, result.Duration.Round(time.Millisecond), result.Failure))
+		}
+
+		switch {
+		case len(result.StepResults) > 0:
+			lines = generator.describeScenarioStepResults(result.StepResults, indent+"  ", lines)
+
+		case !result.Passed:
+			for _, event := range result.ObservedEvents {
+				lines = append(lines, fmt.Sprintf("%s  observed: %s", indent, generator.describeScenarioEvent(event)))
+			}
+
+		case result.MatchedEvent != nil:
+			lines = append(lines, fmt.Sprintf("%s  matched: %s", indent, generator.describeScenarioEvent(result.MatchedEvent)))
+
+		default:
+			for _, pdu := range result.SentPDUs {
+				lines = append(lines, fmt.Sprintf("%s  sent: %s seq=%d", indent, pdu.CommandName(), pdu.SequenceNumber))
+			}
+		}
+	}
+
+	return lines
+}
+
+func (generator *StandardOutputGenerator) describeScenarioEvent(event *AgentEvent) string {
+	nameOfAgent := ""
+	if event.SourceAgent != nil {
+		nameOfAgent = event.SourceAgent.Name()
+	}
+
+	switch {
+	case event.Type == ReceivedPDU && event.SmppPDU != nil:
+		return generator.SayThatAPduWasReceivedByAnAgent(event.RemotePeerName, nameOfAgent, event.SmppPDU)
+	case event.Type == SentPDU && event.SmppPDU != nil:
+		return generator.SayThatAPduWasSentByAnAgent(nameOfAgent, event.RemotePeerName, event.SmppPDU)
+	case event.Error != nil:
+		return fmt.Sprintf("%s %s with %s: %s", nameOfAgent, event.Type, event.RemotePeerName, event.Error)
+	}
+
+	return fmt.Sprintf("%s %s with %s", nameOfAgent, event.Type, event.RemotePeerName)
+}
+
+// SayThatARoutedMessageWasCompleted produces output "$nameOfSmsc routed message_id = ($id) from $peer to $peer:
+// $source_addr -> $destination_addr, state = ($state)", linking the submit-sm and deliver-sm legs of a routed message
+func (generator *StandardOutputGenerator) SayThatARoutedMessageWasCompleted(nameOfSmsc string, message *StoredMessage) string {
+	return fmt.Sprintf("%s routed message_id = (%s) from %s to %s: %s -> %s, state = (%s)", nameOfSmsc, message.MessageID, message.NameOfPeer, message.RoutedToPeer, message.SourceAddr, message.DestinationAddr, message.State)
+}
+
+// SayWhatHappenedToAQueuedDelivery produces output "$nameOfSmsc queued|retried|abandoned delivery to $peer:
+// message_id = ($id), attempts = ($n), queue depth = ($depth)", followed by the reason that the last attempt failed,
+// if it failed
+func (generator *StandardOutputGenerator) SayWhatHappenedToAQueuedDelivery(nameOfSmsc string, eventType AgentEventType, delivery *QueuedDelivery, queueDepth int) string {
+	action := "queued"
+	switch eventType {
+	case DeliveryRetried:
+		action = "retried"
+	case DeliveryAbandoned:
+		action = "abandoned"
+	}
+
+	kindOfDelivery := "delivery"
+	if delivery.IsDeliveryReceipt {
+		kindOfDelivery = "delivery receipt"
+	}
+
+	returnString := fmt.Sprintf("%s %s %s to %s: message_id = (%s), attempts = (%d), queue depth = (%d)", nameOfSmsc, action, kindOfDelivery, delivery.NameOfPeer, delivery.MessageID, delivery.Attempts, queueDepth)
+	if delivery.LastFailure != "" && eventType != DeliveryRetried {
+		returnString = fmt.Sprintf("%s, last failure = (%s)", returnString, delivery.LastFailure)
+	}
+
+	return returnString
+}
+
+// SayThatAResponseRuleWasApplied produces output "$localAgentName applied response rule $name to $message_type
+// seq=$sequence_number from $remotePeerName: $action", followed by the command_status for the respond and
+// generic-nack actions
+func (generator *StandardOutputGenerator) SayThatAResponseRuleWasApplied(localAgentName string, remotePeerName string, request *smpp.PDU, rule *ResponseRule) string {
+	returnString := fmt.Sprintf("%s applied response rule %s to %s seq=%d from %s: %s", localAgentName, rule.Name, request.CommandName(), request.SequenceNumber, remotePeerName, rule.Action)
+
+	if rule.Action == ResponseActionRespond || rule.Action == ResponseActionGenericNack {
+		returnString = fmt.Sprintf("%s, command_status = (%s)", returnString, CommandStatusName(rule.responseCommandStatus()))
+	}
+
+	return returnString
+}
+
+// SayWhatTheResponseRulesAre produces output "$count response rules", followed by an indented line for each rule,
+// in the order in which the rules are evaluated
+func (generator *StandardOutputGenerator) SayWhatTheResponseRulesAre(rules []*ResponseRule) string {
+	lines := []string{fmt.Sprintf("%d response rules", len(rules))}
+
+	for _, rule := range rules {
+		lines = append(lines, fmt.Sprintf("  %s", rule))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// SayWhatTheSubmitMultiFailuresAre produces output "$count submit-multi failures", followed by an indented line
+// "$destination_addr $status" for each destination, in destination order
+func (generator *StandardOutputGenerator) SayWhatTheSubmitMultiFailuresAre(errorStatusCodeByDestinationAddress map[string]uint32) string {
+	destinationAddresses := make([]string, 0, len(errorStatusCodeByDestinationAddress))
+	for destinationAddress := range errorStatusCodeByDestinationAddress {
+		destinationAddresses = append(destinationAddresses, destinationAddress)
+	}
+	sort.Strings(destinationAddresses)
+
+	lines := []string{fmt.Sprintf("%d submit-multi failures", len(destinationAddresses))}
+	for _, destinationAddress := range destinationAddresses {
+		lines = append(lines, fmt.Sprintf("  %s %s", destinationAddress, CommandStatusName(errorStatusCodeByDestinationAddress[destinationAddress])))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// SayThatARequestIsPending produces output "$localAgentName holds $message_type seq=$sequence_number from
+// $remotePeerName for a manual response"
+func (generator *StandardOutputGenerator) SayThatARequestIsPending(localAgentName string, remotePeerName string, request *smpp.PDU) string {
+	return fmt.Sprintf("%s holds %s seq=%d from %s for a manual response", localAgentName, request.CommandName(), request.SequenceNumber, remotePeerName)
+}
+
+// SayWhatThePendingRequestsAre produces output "$localAgentName has $n pending requests", followed by a line for
+// each request "  seq=$sequence_number $message_type from $remotePeerName received $age ago"
+func (generator *StandardOutputGenerator) SayWhatThePendingRequestsAre(localAgentName string, pendingRequests []*PendingRequest) string {
+	lines := []string{fmt.Sprintf("%s has %d pending requests", localAgentName, len(pendingRequests))}
+
+	for _, request := range pendingRequests {
+		lines = append(lines, fmt.Sprintf("  seq=%d %s from %s received %s ago", request.PDU.SequenceNumber, request.PDU.CommandName(), request.NameOfPeer, time.Since(request.ReceivedAt).Round(time.Millisecond)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// SayWhatTheStoredMessagesAre produces output "$nameOfSmsc has $count stored messages", followed by an indented line
+// for each message, with its message_id, the submitting peer, the addresses, the state and the text.  For a routed
+// message, the peer to which it was routed follows the submitting peer.
+func (generator *StandardOutputGenerator) SayWhatTheStoredMessagesAre(nameOfSmsc string, messages []*StoredMessage) string {
+	lines := []string{fmt.Sprintf("%s has %d stored messages", nameOfSmsc, len(messages))}
+
+	for _, message := range messages {
+		peer := message.NameOfPeer
+		if message.RoutedToPeer != "" {
+			peer = fmt.Sprintf("%s routed_to=%s", message.NameOfPeer, message.RoutedToPeer)
+		}
+
+		lines = append(lines, fmt.Sprintf("  message_id=%s peer=%s %s -> %s state=%s submitted=%s text=(%s)", message.MessageID, peer, message.SourceAddr, message.DestinationAddr, message.State, message.SubmitDate.Format(time.RFC3339), message.Text()))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// shortMessageFromPdu returns the short_message of a submit-sm or deliver-sm.  When sm_length is zero, a decoded
+// PDU has no short_message parameter at all.
+func shortMessageFromPdu(pdu *smpp.PDU) string {
+	if len(pdu.MandatoryParameters) < 18 {
+		return ""
+	}
+
+	return string(pdu.MandatoryParameters[17].Value.([]byte))
+}
+
+// findTlvParameter returns the first optional parameter in the PDU with the provided tag, or nil if there is none
+func findTlvParameter(pdu *smpp.PDU, tag uint16) *smpp.TLV {
+	for _, parameter := range pdu.OptionalParameters {
+		if tlv, isTlv := parameter.Value.(smpp.TLV); isTlv && tlv.Tag == tag {
+			return &tlv
+		}
+	}
+
+	return nil
+}
+
+// tlvValueAsString returns the value of a TLV as a string.  A decoded TLV value is a []byte, while one that was
+// created locally may be a string.  Integer values are formatted in decimal.  A nil TLV produces "".
+func tlvValueAsString(tlv *smpp.TLV) string {
+	if tlv == nil {
+		return ""
+	}
+
+	switch value := tlv.Value.(type) {
+	case []byte:
+		return string(value)
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func describeBindState(snapshot *MetricsSnapshot, session MetricsSessionKey) string {
+	isBound, hasBound := snapshot.SessionIsBound[session]
+
+	switch {
+	case !hasBound:
+		return "never bound"
+	case isBound:
+		return "bound"
+	default:
+		return "unbound"
+	}
+}
+
+func describePduCounts(counts map[MetricsPduKey]uint64, session MetricsSessionKey) string {
+	pduCounts := make([]string, 0)
+
+	for key, count := range counts {
+		if key.AgentName == session.AgentName && key.PeerName == session.PeerName {
+			pduCounts = append(pduCounts, fmt.Sprintf("%s=%d", key.CommandName, count))
+		}
+	}
+
+	return joinSortedOrNone(pduCounts)
+}
+
+func joinSortedOrNone(descriptions []string) string {
+	if len(descriptions) == 0 {
+		return "none"
+	}
+
+	sort.Strings(descriptions)
+	return strings.Join(descriptions, ", ")
+}
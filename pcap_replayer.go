@@ -0,0 +1,327 @@
+package smppth
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// CaptureSide identifies one side of a captured SMPP conversation
+type CaptureSide int
+
+const (
+	// EsmeSideOfCapture is the side of a captured conversation that initiated the bind
+	EsmeSideOfCapture CaptureSide = iota
+	// SmscSideOfCapture is the side of a captured conversation that accepted the bind
+	SmscSideOfCapture
+)
+
+// ReplayedExchange describes a single request replayed from a capture.  CapturedResponse is nil if
+// the capture contains no response for the request.  ReceivedResponse is nil if no response arrived
+// from the live peer before the response timeout.  Differences lists each way in which ReceivedResponse
+// differs from CapturedResponse, and is empty if they match (or if either is nil).
+type ReplayedExchange struct {
+	CapturedRequest  *CapturedPDU
+	ReplayedRequest  *smpp.PDU
+	CapturedResponse *CapturedPDU
+	ReceivedResponse *smpp.PDU
+	Differences      []string
+}
+
+// ResponsesMatch returns true if a response was received for the replayed request, and it matches
+// the captured response (or there was no captured response).
+func (exchange *ReplayedExchange) ResponsesMatch() bool {
+	return exchange.ReceivedResponse != nil && len(exchange.Differences) == 0
+}
+
+// ReplayReport is the result of a replay, containing one ReplayedExchange per replayed request, in the
+// order they were sent.
+type ReplayReport struct {
+	Exchanges []*ReplayedExchange
+}
+
+// NumberOfMismatchedExchanges returns the number of exchanges for which ResponsesMatch() is false.
+func (report *ReplayReport) NumberOfMismatchedExchanges() int {
+	mismatches := 0
+
+	for _, exchange := range report.Exchanges {
+		if !exchange.ResponsesMatch() {
+			mismatches++
+		}
+	}
+
+	return mismatches
+}
+
+// PcapReplayer replays the requests sent by one side of a captured SMPP conversation through a live Agent,
+// and compares the responses from the live peer to the responses in the capture.  Bind, unbind and outbind
+// requests are not replayed, because the Agent manages its own session.  Responses sent by the replayed side
+// are also not replayed, because they answer requests that the live peer will not necessarily send.
+//
+// When the Agent sends a replayed request, it rewrites the sequence number according to its own sequence.
+// The replayer tracks the rewritten sequence numbers and uses them to match each live response to the
+// captured request (and thus to the captured response).
+type PcapReplayer struct {
+	capture                *SmppCapture
+	replayedSide           CaptureSide
+	timingScale            float64
+	responseTimeout        time.Duration
+	forwardingEventChannel chan<- *AgentEvent
+}
+
+// NewPcapReplayer creates a replayer for the requests sent by replayedSide in the capture.  By default,
+// the original timing between requests is preserved, and the replayer waits up to 5 seconds after the last
+// request for outstanding responses.
+func NewPcapReplayer(capture *SmppCapture, replayedSide CaptureSide) *PcapReplayer {
+	return &PcapReplayer{
+		capture:         capture,
+		replayedSide:    replayedSide,
+		timingScale:     1.0,
+		responseTimeout: time.Second * 5,
+	}
+}
+
+// SetTimingScale scales the captured time between requests.  A scale of 1.0 preserves the original timing,
+// 0.5 replays twice as fast, and 0 sends the requests as quickly as possible.
+func (replayer *PcapReplayer) SetTimingScale(scale float64) *PcapReplayer {
+	if scale < 0 {
+		scale = 0
+	}
+
+	replayer.timingScale = scale
+	return replayer
+}
+
+// SetForwardingEventChannel sets a channel to which Replay forwards each event that it reads from the agent event
+// channel, but that is not a response from the live peer to the replaying agent.  This allows Replay to share an
+// agent event channel (e.g., the SharedAgentEventChannel of an AgentGroup) with another reader, which then reads
+// the other events from this channel instead.
+func (replayer *PcapReplayer) SetForwardingEventChannel(channel chan<- *AgentEvent) *PcapReplayer {
+	replayer.forwardingEventChannel = channel
+	return replayer
+}
+
+// SetResponseTimeout sets how long the replayer waits for outstanding responses after the last request
+// is sent.
+func (replayer *PcapReplayer) SetResponseTimeout(timeout time.Duration) *PcapReplayer {
+	replayer.responseTimeout = timeout
+	return replayer
+}
+
+// Replay sends the captured requests through agent to the peer named nameOfPeer, which must already be bound.
+// agentEventChannel must deliver the events generated by agent (e.g., a channel proxied by a StandardApplication).
+// While Replay runs, it is the only reader of agentEventChannel, so every other event read from it (e.g., for other
+// agents or peers) is forwarded to the channel set by SetForwardingEventChannel() or, if there is none, discarded.
+// The channel should be dedicated to the replay unless a forwarding channel is set.  Replay returns when every
+// replayed request has a response, or when the response timeout expires after the last request is sent.  An error
+// is returned only if a request cannot be sent.
+func (replayer *PcapReplayer) Replay(agent Agent, nameOfPeer string, agentEventChannel <-chan *AgentEvent) (*ReplayReport, error) {
+	requestsToReplay, capturedResponsesBySequenceNumber := replayer.partitionCapture()
+	report := &ReplayReport{Exchanges: make([]*ReplayedExchange, 0, len(requestsToReplay))}
+
+	if len(requestsToReplay) == 0 {
+		return report, nil
+	}
+
+	// the listener never waits for the replay loop, so that it keeps draining agentEventChannel; responses
+	// accumulate in receivedResponses until the loop takes them
+	var receivedResponsesLock sync.Mutex
+	receivedResponses := make([]*smpp.PDU, 0)
+	responsesAreReceived := make(chan bool, 1)
+	stopListeningChannel := make(chan bool)
+	defer close(stopListeningChannel)
+
+	go func() {
+		for {
+			select {
+			case event := <-agentEventChannel:
+				if event == nil {
+					continue
+				}
+
+				if event.Type == ReceivedPDU && event.SourceAgent == agent && event.RemotePeerName == nameOfPeer && !event.SmppPDU.IsRequest() {
+					receivedResponsesLock.Lock()
+					receivedResponses = append(receivedResponses, event.SmppPDU)
+					receivedResponsesLock.Unlock()
+
+					select {
+					case responsesAreReceived <- true:
+					default:
+					}
+					continue
+				}
+
+				if replayer.forwardingEventChannel != nil {
+					select {
+					case replayer.forwardingEventChannel <- event:
+					case <-stopListeningChannel:
+						return
+					}
+				}
+			case <-stopListeningChannel:
+				return
+			}
+		}
+	}()
+
+	takeReceivedResponses := func() []*smpp.PDU {
+		receivedResponsesLock.Lock()
+		defer receivedResponsesLock.Unlock()
+
+		responses := receivedResponses
+		receivedResponses = make([]*smpp.PDU, 0)
+		return responses
+	}
+
+	exchangeByReplayedSequenceNumber := make(map[uint32]*ReplayedExchange)
+	outstandingExchanges := 0
+	replayStartTime := time.Now()
+	firstCaptureTimestamp := requestsToReplay[0].Timestamp
+
+	receiveResponse := func(response *smpp.PDU) {
+		exchange, isReplayed := exchangeByReplayedSequenceNumber[response.SequenceNumber]
+		if !isReplayed || exchange.ReceivedResponse != nil {
+			return
+		}
+
+		exchange.ReceivedResponse = response
+		if exchange.CapturedResponse != nil {
+			exchange.Differences = describeDifferencesBetweenPdus(exchange.CapturedResponse.PDU, response)
+		}
+
+		outstandingExchanges--
+	}
+
+	for _, capturedRequest := range requestsToReplay {
+		sendTime := replayStartTime.Add(time.Duration(float64(capturedRequest.Timestamp.Sub(firstCaptureTimestamp)) * replayer.timingScale))
+
+		waitTimer := time.NewTimer(time.Until(sendTime))
+		for waitingToSend := true; waitingToSend; {
+			select {
+			case <-responsesAreReceived:
+				for _, response := range takeReceivedResponses() {
+					receiveResponse(response)
+				}
+			case <-waitTimer.C:
+				waitingToSend = false
+			}
+		}
+
+		replayedRequest := *capturedRequest.PDU
+		if err := agent.SendMessageToPeer(&MessageDescriptor{
+			NameOfSendingPeer:   agent.Name(),
+			NameOfReceivingPeer: nameOfPeer,
+			PDU:                 &replayedRequest,
+		}); err != nil {
+			return report, fmt.Errorf("Failed to replay %s captured at (%s): %s", capturedRequest.PDU.CommandName(), capturedRequest.Timestamp.Format(time.RFC3339Nano), err)
+		}
+
+		exchange := &ReplayedExchange{
+			CapturedRequest:  capturedRequest,
+			ReplayedRequest:  &replayedRequest,
+			CapturedResponse: capturedResponsesBySequenceNumber[capturedRequest.PDU.SequenceNumber],
+			Differences:      []string{},
+		}
+
+		report.Exchanges = append(report.Exchanges, exchange)
+		exchangeByReplayedSequenceNumber[replayedRequest.SequenceNumber] = exchange
+		outstandingExchanges++
+	}
+
+	responseTimeout := time.After(replayer.responseTimeout)
+	for outstandingExchanges > 0 {
+		select {
+		case <-responsesAreReceived:
+			for _, response := range takeReceivedResponses() {
+				receiveResponse(response)
+			}
+		case <-responseTimeout:
+			return report, nil
+		}
+	}
+
+	return report, nil
+}
+
+func (replayer *PcapReplayer) partitionCapture() (requestsToReplay []*CapturedPDU, capturedResponsesBySequenceNumber map[uint32]*CapturedPDU) {
+	replayedStream, peerStream := replayer.capture.EsmeToSmsc, replayer.capture.SmscToEsme
+	if replayer.replayedSide == SmscSideOfCapture {
+		replayedStream, peerStream = peerStream, replayedStream
+	}
+
+	requestsToReplay = make([]*CapturedPDU, 0, len(replayedStream))
+	for _, capturedPdu := range replayedStream {
+		if capturedPdu.PDU.IsRequest() && !isSessionManagementRequest(capturedPdu.PDU.CommandID) {
+			requestsToReplay = append(requestsToReplay, capturedPdu)
+		}
+	}
+
+	capturedResponsesBySequenceNumber = make(map[uint32]*CapturedPDU)
+	for _, capturedPdu := range peerStream {
+		if !capturedPdu.PDU.IsRequest() {
+			if _, alreadySeen := capturedResponsesBySequenceNumber[capturedPdu.PDU.SequenceNumber]; !alreadySeen {
+				capturedResponsesBySequenceNumber[capturedPdu.PDU.SequenceNumber] = capturedPdu
+			}
+		}
+	}
+
+	return requestsToReplay, capturedResponsesBySequenceNumber
+}
+
+func isSessionManagementRequest(commandID smpp.CommandIDType) bool {
+	switch commandID {
+	case smpp.CommandBindReceiver, smpp.CommandBindTransmitter, smpp.CommandBindTransceiver, smpp.CommandUnbind, smpp.CommandOutbind:
+		return true
+	}
+
+	return false
+}
+
+func describeDifferencesBetweenPdus(expected *smpp.PDU, got *smpp.PDU) []string {
+	differences := make([]string, 0)
+
+	if expected.CommandID != got.CommandID {
+		differences = append(differences, fmt.Sprintf("command_id: expected (%s), got (%s)", expected.CommandName(), got.CommandName()))
+		return differences
+	}
+
+	if expected.CommandStatus != got.CommandStatus {
+		differences = append(differences, fmt.Sprintf("command_status: expected (0x%08x), got (0x%08x)", expected.CommandStatus, got.CommandStatus))
+	}
+
+	differences = append(differences, describeDifferencesBetweenParameterLists("mandatory parameter", expected.MandatoryParameters, got.MandatoryParameters)...)
+	differences = append(differences, describeDifferencesBetweenParameterLists("optional parameter", expected.OptionalParameters, got.OptionalParameters)...)
+
+	return differences
+}
+
+func describeDifferencesBetweenParameterLists(listDescription string, expected []*smpp.Parameter, got []*smpp.Parameter) []string {
+	differences := make([]string, 0)
+
+	if len(expected) != len(got) {
+		differences = append(differences, fmt.Sprintf("%s count: expected (%d), got (%d)", listDescription, len(expected), len(got)))
+	}
+
+	for i := 0; i < len(expected) && i < len(got); i++ {
+		if !parameterValuesAreEqual(expected[i].Value, got[i].Value) {
+			differences = append(differences, fmt.Sprintf("%s %d: expected (%v), got (%v)", listDescription, i, expected[i].Value, got[i].Value))
+		}
+	}
+
+	return differences
+}
+
+func parameterValuesAreEqual(expected interface{}, got interface{}) bool {
+	expectedBytes, expectedIsBytes := expected.([]byte)
+	gotBytes, gotIsBytes := got.([]byte)
+
+	if expectedIsBytes && gotIsBytes {
+		return bytes.Equal(expectedBytes, gotBytes)
+	}
+
+	return reflect.DeepEqual(expected, got)
+}
@@ -0,0 +1,184 @@
+package smppth
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+type replayResponderAgent struct {
+	name                   string
+	nextSequenceNumber     uint32
+	submitSmRespMessageID  string
+	agentEventChannel      chan *AgentEvent
+	receivedRequestHistory []*smpp.PDU
+	copiesOfEachResponse   int
+	otherEventsPerRequest  int
+}
+
+func newReplayResponderAgent(name string, submitSmRespMessageID string) *replayResponderAgent {
+	return &replayResponderAgent{
+		name:                  name,
+		nextSequenceNumber:    100,
+		submitSmRespMessageID: submitSmRespMessageID,
+		agentEventChannel:     make(chan *AgentEvent, 10),
+		copiesOfEachResponse:  1,
+	}
+}
+
+func (agent *replayResponderAgent) Name() string                            { return agent.name }
+func (agent *replayResponderAgent) StartEventLoop()                         {}
+func (agent *replayResponderAgent) SetAgentEventChannel(chan<- *AgentEvent) {}
+
+func (agent *replayResponderAgent) SendMessageToPeer(message *MessageDescriptor) error {
+	message.PDU.SequenceNumber = agent.nextSequenceNumber
+	agent.nextSequenceNumber++
+	agent.receivedRequestHistory = append(agent.receivedRequestHistory, message.PDU)
+
+	var response *smpp.PDU
+	switch message.PDU.CommandID {
+	case smpp.CommandEnquireLink:
+		response = smpp.NewPDU(smpp.CommandEnquireLinkResp, 0, message.PDU.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+	case smpp.CommandSubmitSm:
+		response = smpp.NewPDU(smpp.CommandSubmitSmResp, 0, message.PDU.SequenceNumber, []*smpp.Parameter{smpp.NewCOctetStringParameter(agent.submitSmRespMessageID)}, []*smpp.Parameter{})
+	}
+
+	for i := 0; i < agent.otherEventsPerRequest; i++ {
+		agent.agentEventChannel <- &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "other-peer", SmppPDU: response}
+	}
+
+	for i := 0; i < agent.copiesOfEachResponse; i++ {
+		agent.agentEventChannel <- &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: message.NameOfReceivingPeer, SmppPDU: response}
+	}
+
+	return nil
+}
+
+func TestPcapReplayerWithMatchingResponses(t *testing.T) {
+	capture, err := ReadSmppCaptureFromPcap(bytes.NewReader(testPcapFromCaptureSegments(testCaptureSegmentsForEnquireLinkAndSubmitSm())), 2775)
+	if err != nil {
+		t.Fatalf("Failed to read test capture: %s", err)
+	}
+
+	agent := newReplayResponderAgent("esme01", "abc")
+	replayStartTime := time.Now()
+
+	report, err := NewPcapReplayer(capture, EsmeSideOfCapture).SetTimingScale(0.5).Replay(agent, "smsc01", agent.agentEventChannel)
+	if err != nil {
+		t.Fatalf("Expected no error on Replay, got = (%s)", err)
+	}
+
+	if elapsed := time.Since(replayStartTime); elapsed < time.Millisecond*100 {
+		t.Errorf("Expected replay at timing scale 0.5 to take at least 100ms, took (%s)", elapsed)
+	}
+
+	if len(report.Exchanges) != 2 {
+		t.Fatalf("Expected 2 replayed exchanges, got (%d)", len(report.Exchanges))
+	}
+
+	if report.NumberOfMismatchedExchanges() != 0 {
+		t.Errorf("Expected 0 mismatched exchanges, got (%d): %v, %v", report.NumberOfMismatchedExchanges(), report.Exchanges[0].Differences, report.Exchanges[1].Differences)
+	}
+
+	if report.Exchanges[1].ReplayedRequest.SequenceNumber != 101 {
+		t.Errorf("Expected replayed submit-sm to have agent sequence number (101), got (%d)", report.Exchanges[1].ReplayedRequest.SequenceNumber)
+	}
+
+	if report.Exchanges[1].CapturedRequest.PDU.SequenceNumber != 3 {
+		t.Errorf("Expected captured submit-sm sequence number to remain (3), got (%d)", report.Exchanges[1].CapturedRequest.PDU.SequenceNumber)
+	}
+}
+
+func TestPcapReplayerWithMismatchedResponse(t *testing.T) {
+	capture, err := ReadSmppCaptureFromPcap(bytes.NewReader(testPcapFromCaptureSegments(testCaptureSegmentsForEnquireLinkAndSubmitSm())), 2775)
+	if err != nil {
+		t.Fatalf("Failed to read test capture: %s", err)
+	}
+
+	agent := newReplayResponderAgent("esme01", "xyz")
+
+	report, err := NewPcapReplayer(capture, EsmeSideOfCapture).SetTimingScale(0).Replay(agent, "smsc01", agent.agentEventChannel)
+	if err != nil {
+		t.Fatalf("Expected no error on Replay, got = (%s)", err)
+	}
+
+	if report.NumberOfMismatchedExchanges() != 1 {
+		t.Fatalf("Expected 1 mismatched exchange, got (%d)", report.NumberOfMismatchedExchanges())
+	}
+
+	if report.Exchanges[1].ResponsesMatch() || len(report.Exchanges[1].Differences) != 1 {
+		t.Errorf("Expected submit-sm exchange to have exactly one difference, got = (%v)", report.Exchanges[1].Differences)
+	}
+}
+
+func TestPcapReplayerForSmscSideWithoutRequests(t *testing.T) {
+	capture, err := ReadSmppCaptureFromPcap(bytes.NewReader(testPcapFromCaptureSegments(testCaptureSegmentsForEnquireLinkAndSubmitSm())), 2775)
+	if err != nil {
+		t.Fatalf("Failed to read test capture: %s", err)
+	}
+
+	agent := newReplayResponderAgent("smsc01", "abc")
+
+	report, err := NewPcapReplayer(capture, SmscSideOfCapture).Replay(agent, "esme01", agent.agentEventChannel)
+	if err != nil {
+		t.Fatalf("Expected no error on Replay, got = (%s)", err)
+	}
+
+	if len(report.Exchanges) != 0 || len(agent.receivedRequestHistory) != 0 {
+		t.Errorf("Expected no replayed exchanges for SMSC side, got (%d)", len(report.Exchanges))
+	}
+}
+
+func TestPcapReplayerForwardsOtherEventsAndKeepsDraining(t *testing.T) {
+	capture, err := ReadSmppCaptureFromPcap(bytes.NewReader(testPcapFromCaptureSegments(testCaptureSegmentsForEnquireLinkAndSubmitSm())), 2775)
+	if err != nil {
+		t.Fatalf("Failed to read test capture: %s", err)
+	}
+
+	agent := newReplayResponderAgent("esme01", "abc")
+	agent.copiesOfEachResponse = 150
+	agent.otherEventsPerRequest = 3
+
+	forwardedEvents := make(chan *AgentEvent, 10)
+	replayFinished := make(chan bool)
+
+	var report *ReplayReport
+	go func() {
+		report, err = NewPcapReplayer(capture, EsmeSideOfCapture).SetTimingScale(0).SetForwardingEventChannel(forwardedEvents).Replay(agent, "smsc01", agent.agentEventChannel)
+		close(replayFinished)
+	}()
+
+	numberOfForwardedEvents := 0
+	for waiting := true; waiting; {
+		select {
+		case event := <-forwardedEvents:
+			if event.RemotePeerName != "other-peer" {
+				t.Errorf("Expected only events for other peers to be forwarded, got event for (%s)", event.RemotePeerName)
+			}
+			numberOfForwardedEvents++
+		case <-replayFinished:
+			waiting = false
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected replay to finish while the agent emits more than 100 responses per request")
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("Expected no error on Replay, got = (%s)", err)
+	}
+
+	if len(report.Exchanges) != 2 || report.NumberOfMismatchedExchanges() != 0 {
+		t.Errorf("Expected 2 matched exchanges, got (%d) with (%d) mismatched", len(report.Exchanges), report.NumberOfMismatchedExchanges())
+	}
+
+	for len(forwardedEvents) > 0 {
+		<-forwardedEvents
+		numberOfForwardedEvents++
+	}
+
+	if numberOfForwardedEvents != 6 {
+		t.Errorf("Expected the (6) events for other peers to be forwarded, got (%d)", numberOfForwardedEvents)
+	}
+}
@@ -1,9 +1,12 @@
 package smppth
 
 import (
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blorticus/smpp"
 )
@@ -15,12 +18,41 @@ type PduFactory interface {
 	CreateEnquireLinkRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU
 	CreateSubmitSm(parameters map[string]string) (*smpp.PDU, error)
 	CreateSubmitSmRespFromRequest(requestPDU *smpp.PDU, messageID string) *smpp.PDU
+	CreateSegmentedSubmitSm(parameters map[string]string) ([]*smpp.PDU, error)
+	CreateDeliverSm(parameters map[string]string) (*smpp.PDU, error)
+	CreateDeliverSmRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU
+	CreateDataSm(parameters map[string]string) (*smpp.PDU, error)
+	CreateDataSmRespFromRequest(requestPDU *smpp.PDU, messageID string) *smpp.PDU
+	CreateQuerySm(parameters map[string]string) (*smpp.PDU, error)
+	CreateQuerySmRespFromRequest(requestPDU *smpp.PDU, finalDate string, messageState MessageState, errorCode uint8) *smpp.PDU
+	CreateCancelSm(parameters map[string]string) (*smpp.PDU, error)
+	CreateCancelSmRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU
+	CreateReplaceSm(parameters map[string]string) (*smpp.PDU, error)
+	CreateReplaceSmRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU
+	CreateSubmitMulti(parameters map[string]string) (*smpp.PDU, error)
+	CreateSubmitMultiRespFromRequest(requestPDU *smpp.PDU, messageID string, unsuccessfulDeliveries []*UnsuccessfulDelivery) *smpp.PDU
 }
 
-// DefaultPduFactory produces a standard set of PDUs
+// DefaultPduFactory produces a standard set of PDUs.  Each method that accepts a parameter map also accepts optional
+// parameters in the map, either by SMPP 3.4 name (e.g., user_message_reference=7 or callback_num=15551234), with a
+// value coerced to the type of the optional parameter, or by tag as tlv:0xNNNN, with a value of hex octets (e.g.,
+// tlv:0x1400=0A0B).  A key that is a parameter for the PDU type (e.g., message_payload for a data-sm) is not treated
+// as an optional parameter.
+//
+// Integer parameter values may be decimal, hex (e.g., 0x40) or binary (e.g., 0b01000000).  A string parameter value
+// may be given as hex octets (e.g., hex:0500030A0201); for short_message, the octets are sent without encoding.
+// schedule_delivery_time and validity_period also accept time expressions (e.g., +1h30m, now+10m or an RFC 3339
+// time), which are converted to the SMPP time format.
 type DefaultPduFactory struct {
-	nextSequenceNumber        uint32
-	defaultSubmitSmParameters map[string]interface{}
+	nextSequenceNumber           uint32
+	nextConcatenationReference   uint16
+	defaultSubmitSmParameters    map[string]interface{}
+	defaultDeliverSmParameters   map[string]interface{}
+	defaultDataSmParameters      map[string]interface{}
+	defaultQuerySmParameters     map[string]interface{}
+	defaultCancelSmParameters    map[string]interface{}
+	defaultReplaceSmParameters   map[string]interface{}
+	defaultSubmitMultiParameters map[string]interface{}
 }
 
 // NewDefaultPduFactory constructs a new DefaultPduFactory.  The factory stores a monotonically incrementing
@@ -29,13 +61,102 @@ type DefaultPduFactory struct {
 // found in the Request.
 func NewDefaultPduFactory() *DefaultPduFactory {
 	return &DefaultPduFactory{
-		nextSequenceNumber: 2,
+		nextSequenceNumber:         2,
+		nextConcatenationReference: 1,
 		defaultSubmitSmParameters: map[string]interface{}{
+			"service_type":            "",
+			"source_addr_ton":         uint8(0),
+			"source_addr_npi":         uint8(0),
+			"source_addr":             "",
+			"dest_addr_ton":           uint8(0),
+			"dest_addr_npi":           uint8(0),
+			"destination_addr":        "",
+			"esm_class":               uint8(0),
+			"protocol_id":             uint8(0),
+			"priority_flag":           uint8(0),
+			"schedule_delivery_time":  "",
+			"validity_period":         "",
+			"registered_delivery":     uint8(0),
+			"replace_if_present_flag": uint8(0),
+			"data_coding":             uint8(0),
+			"sm_default_msg_id":       uint8(0),
+			"encoding":                "",
+			"short_message":           "This is a test short message",
+		},
+		defaultDeliverSmParameters: map[string]interface{}{
+			"service_type":            "",
+			"source_addr_ton":         uint8(0),
+			"source_addr_npi":         uint8(0),
+			"source_addr":             "",
+			"dest_addr_ton":           uint8(0),
+			"dest_addr_npi":           uint8(0),
+			"destination_addr":        "",
+			"esm_class":               uint8(0),
+			"protocol_id":             uint8(0),
+			"priority_flag":           uint8(0),
+			"schedule_delivery_time":  "",
+			"validity_period":         "",
+			"registered_delivery":     uint8(0),
+			"replace_if_present_flag": uint8(0),
+			"data_coding":             uint8(0),
+			"sm_default_msg_id":       uint8(0),
+			"encoding":                "",
+			"short_message":           "This is a test short message",
+		},
+		defaultDataSmParameters: map[string]interface{}{
+			"source_addr_npi":  uint8(0),
+			"source_addr":      "",
+			"dest_addr_npi":    uint8(0),
+			"destination_addr": "",
+			"message_payload":  "This is a test message payload",
+		},
+		defaultQuerySmParameters: map[string]interface{}{
+			"message_id":      "",
+			"source_addr_ton": uint8(0),
+			"source_addr_npi": uint8(0),
+			"source_addr":     "",
+		},
+		defaultCancelSmParameters: map[string]interface{}{
+			"service_type":     "",
+			"message_id":       "",
+			"source_addr_ton":  uint8(0),
 			"source_addr_npi":  uint8(0),
 			"source_addr":      "",
+			"dest_addr_ton":    uint8(0),
 			"dest_addr_npi":    uint8(0),
 			"destination_addr": "",
-			"short_message":    "This is a test short message",
+		},
+		defaultReplaceSmParameters: map[string]interface{}{
+			"message_id":             "",
+			"source_addr_ton":        uint8(0),
+			"source_addr_npi":        uint8(0),
+			"source_addr":            "",
+			"schedule_delivery_time": "",
+			"validity_period":        "",
+			"registered_delivery":    uint8(0),
+			"data_coding":            uint8(0),
+			"encoding":               "",
+			"short_message":          "This is a replacement short message",
+		},
+		defaultSubmitMultiParameters: map[string]interface{}{
+			"source_addr_ton":         uint8(0),
+			"source_addr_npi":         uint8(0),
+			"source_addr":             "",
+			"dest_addr_ton":           uint8(0),
+			"dest_addr_npi":           uint8(0),
+			"dest":                    "",
+			"dl_name":                 "",
+			"esm_class":               uint8(0),
+			"protocol_id":             uint8(0),
+			"priority_flag":           uint8(0),
+			"schedule_delivery_time":  "",
+			"validity_period":         "",
+			"registered_delivery":     uint8(0),
+			"replace_if_present_flag": uint8(0),
+			"data_coding":             uint8(0),
+			"sm_default_msg_id":       uint8(0),
+			"encoding":                "",
+			"short_message":           "This is a test short message",
 		},
 	}
 }
@@ -52,24 +173,466 @@ func (factory *DefaultPduFactory) CreateEnquireLinkRespFromRequest(requestPDU *s
 }
 
 // CreateSubmitSm creates a submit-sm.  The current supported parameter map keys that are supported are:
+//  service_type - string of no more than 5 characters (default "")
+//  source_addr_ton - uint8 from 0 to 6 (default 0)
+//  source_addr_npi - uint8, one of 0, 1, 3, 4, 6, 8, 9, 10, 14 or 18 (default 0)
+//  source_addr - string of no more than 20 characters (default "")
+//  dest_addr_ton - uint8 from 0 to 6 (default 0)
+//  dest_addr_npi - uint8, one of 0, 1, 3, 4, 6, 8, 9, 10, 14 or 18 (default 0)
+//  destination_addr - string of no more than 20 characters (default "")
+//  esm_class - uint8 with a defined messaging mode and message type (default 0)
+//  protocol_id - uint8 (default 0)
+//  priority_flag - uint8 from 0 to 3 (default 0)
+//  schedule_delivery_time - string in SMPP absolute or relative time format (default "")
+//  validity_period - string in SMPP absolute or relative time format (default "")
+//  registered_delivery - uint8 without reserved bits set (default 0)
+//  replace_if_present_flag - uint8, either 0 or 1 (default 0)
+//  data_coding - uint8 (default 0, or the value for encoding, if that is set)
+//  sm_default_msg_id - uint8 (default 0)
+//  encoding - one of gsm7, gsm7-packed, ascii, latin1, ucs2 or binary (default is based on data_coding; for gsm7, text
+//             with characters outside of the GSM 03.38 alphabet is passed through unchanged)
+//  short_message - string (default "This is a test short message")
+// If CreateSubmitSm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
+// will be returned.  An error is also returned if a value is not permitted for its parameter, if short_message
+// cannot be encoded, or if the encoded short_message is longer than 254 octets.  Use CreateSegmentedSubmitSm for
+// longer messages.
+func (factory *DefaultPduFactory) CreateSubmitSm(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultSubmitSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultSubmitSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateShortMessageParameters(usingParameters); err != nil {
+		return nil, err
+	}
+
+	encoding, err := factory.resolveTextEncoding(parameters, usingParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.createUnsegmentedShortMessagePdu(smpp.CommandSubmitSm, usingParameters, encoding, optionalParameters)
+}
+
+// CreateSegmentedSubmitSm creates one or more submit-sm messages carrying short_message.  It accepts the same
+// parameter map keys as CreateSubmitSm, along with:
+//  segmentation - one of udh, udh8, udh16, sar or payload (default udh)
+// A message that fits in a single submit-sm, according to its encoding, produces a single submit-sm without
+// segmentation information.  Otherwise, the message is split into segments that are identified either by a
+// concatenation UDH with an 8-bit (udh or udh8) or 16-bit (udh16) reference number, or by SAR TLVs (sar).  For
+// payload, there is a single submit-sm carrying the message in a message_payload TLV.  Each call that segments a
+// message uses the next reference number.
+func (factory *DefaultPduFactory) CreateSegmentedSubmitSm(parameters map[string]string) ([]*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultSubmitSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultSubmitSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateShortMessageParameters(usingParameters); err != nil {
+		return nil, err
+	}
+
+	segmentationMethod := SegmentationUdh8BitReference
+	if methodName, methodIsSet := parameters["segmentation"]; methodIsSet {
+		if segmentationMethod, err = SegmentationMethodFromString(methodName); err != nil {
+			return nil, err
+		}
+	}
+
+	encoding, err := factory.resolveTextEncoding(parameters, usingParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := segmentMessage(usingParameters["short_message"].(string), encoding, segmentationMethod, factory.nextConcatenationReference)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) > 1 {
+		factory.nextConcatenationReference++
+	}
+
+	esmClass := uint8(0)
+	if len(segments) > 1 && (segmentationMethod == SegmentationUdh8BitReference || segmentationMethod == SegmentationUdh16BitReference) {
+		esmClass = esmClassUdhIndicator
+	}
+
+	pdus := make([]*smpp.PDU, 0, len(segments))
+	for _, segment := range segments {
+		pdus = append(pdus, factory.createShortMessagePdu(smpp.CommandSubmitSm, usingParameters, esmClass, segment.shortMessage, append(segment.optionalParameters, optionalParameters...)))
+	}
+
+	return pdus, nil
+}
+
+// CreateSubmitSmRespFromRequest creates a submit-sm-resp.  The message-id will be set to the messageID value.
+func (factory *DefaultPduFactory) CreateSubmitSmRespFromRequest(requestPDU *smpp.PDU, messageID string) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandSubmitSmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(messageID),
+	}, []*smpp.Parameter{})
+}
+
+// CreateDeliverSm creates a deliver-sm.  The current supported parameter map keys that are supported are:
+//  service_type - string of no more than 5 characters (default "")
+//  source_addr_ton - uint8 from 0 to 6 (default 0)
+//  source_addr_npi - uint8, one of 0, 1, 3, 4, 6, 8, 9, 10, 14 or 18 (default 0)
+//  source_addr - string of no more than 20 characters (default "")
+//  dest_addr_ton - uint8 from 0 to 6 (default 0)
+//  dest_addr_npi - uint8, one of 0, 1, 3, 4, 6, 8, 9, 10, 14 or 18 (default 0)
+//  destination_addr - string of no more than 20 characters (default "")
+//  esm_class - uint8 with a defined messaging mode and message type (default 0)
+//  protocol_id - uint8 (default 0)
+//  priority_flag - uint8 from 0 to 3 (default 0)
+//  schedule_delivery_time - string in SMPP absolute or relative time format (default "")
+//  validity_period - string in SMPP absolute or relative time format (default "")
+//  registered_delivery - uint8 without reserved bits set (default 0)
+//  replace_if_present_flag - uint8, either 0 or 1 (default 0)
+//  data_coding - uint8 (default 0, or the value for encoding, if that is set)
+//  sm_default_msg_id - uint8 (default 0)
+//  encoding - one of gsm7, gsm7-packed, ascii, latin1, ucs2 or binary (default is based on data_coding; for gsm7, text
+//             with characters outside of the GSM 03.38 alphabet is passed through unchanged)
+//  short_message - string (default "This is a test short message")
+// If CreateDeliverSm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
+// will be returned.  An error is also returned if a value is not permitted for its parameter, if short_message
+// cannot be encoded, or if the encoded short_message is longer than 254 octets.
+func (factory *DefaultPduFactory) CreateDeliverSm(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultDeliverSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultDeliverSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateShortMessageParameters(usingParameters); err != nil {
+		return nil, err
+	}
+
+	encoding, err := factory.resolveTextEncoding(parameters, usingParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.createUnsegmentedShortMessagePdu(smpp.CommandDeliverSm, usingParameters, encoding, optionalParameters)
+}
+
+// CreateDeliverSmRespFromRequest creates a deliver-sm-resp.  The message-id is unused for deliver-sm-resp, so it is
+// set to the empty string.
+func (factory *DefaultPduFactory) CreateDeliverSmRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandDeliverSmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(""),
+	}, []*smpp.Parameter{})
+}
+
+// CreateDataSm creates a data-sm.  The message is carried in a message_payload TLV.  The current supported
+// parameter map keys that are supported are:
 //  source_addr_npi - uint8 (default 0)
 //  source_addr - string (default "")
 //  dest_addr_npi - uint8 (default 0)
 //  destination_address - string (default "")
-//  short_message - string (default "This is a test short message")
-// If CreateSubmitSm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
+//  message_payload - string (default "This is a test message payload")
+// If CreateDataSm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
 // will be returned.
-func (factory *DefaultPduFactory) CreateSubmitSm(parameters map[string]string) (*smpp.PDU, error) {
+func (factory *DefaultPduFactory) CreateDataSm(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultDataSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultDataSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return smpp.NewPDU(smpp.CommandDataSm, 0, 1, []*smpp.Parameter{
+		smpp.NewFLParameter(uint8(0)),                                               // service_type
+		smpp.NewFLParameter(uint8(0)),                                               // source_addr_ton
+		smpp.NewFLParameter(usingParameters["source_addr_npi"].(uint8)),             // source_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["source_addr"].(string)),      // source_addr
+		smpp.NewFLParameter(uint8(0)),                                               // dest_addr_ton
+		smpp.NewFLParameter(usingParameters["dest_addr_npi"].(uint8)),               // dest_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["destination_addr"].(string)), // destination_addr
+		smpp.NewFLParameter(uint8(0)),                                               // esm_class
+		smpp.NewFLParameter(uint8(0)),                                               // registered_delivery
+		smpp.NewFLParameter(uint8(0)),                                               // data_coding
+	}, append([]*smpp.Parameter{
+		smpp.NewTLVParameter(tlvTagMessagePayload, []byte(usingParameters["message_payload"].(string))),
+	}, optionalParameters...)), nil
+}
+
+// CreateDataSmRespFromRequest creates a data-sm-resp.  The message-id will be set to the messageID value.
+func (factory *DefaultPduFactory) CreateDataSmRespFromRequest(requestPDU *smpp.PDU, messageID string) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandDataSmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(messageID),
+	}, []*smpp.Parameter{})
+}
+
+// CreateQuerySm creates a query-sm.  The current supported parameter map keys that are supported are:
+//  message_id - string (default "")
+//  source_addr_ton - uint8 (default 0)
+//  source_addr_npi - uint8 (default 0)
+//  source_addr - string (default "")
+// If CreateQuerySm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
+// will be returned.
+func (factory *DefaultPduFactory) CreateQuerySm(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultQuerySmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultQuerySmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return smpp.NewPDU(smpp.CommandQuerySm, 0, 1, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(usingParameters["message_id"].(string)),  // message_id
+		smpp.NewFLParameter(usingParameters["source_addr_ton"].(uint8)),        // source_addr_ton
+		smpp.NewFLParameter(usingParameters["source_addr_npi"].(uint8)),        // source_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["source_addr"].(string)), // source_addr
+	}, optionalParameters), nil
+}
+
+// CreateQuerySmRespFromRequest creates a query-sm-resp.  The message-id is copied from the query-sm.  finalDate
+// should be empty unless the message is in a final state.
+func (factory *DefaultPduFactory) CreateQuerySmRespFromRequest(requestPDU *smpp.PDU, finalDate string, messageState MessageState, errorCode uint8) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandQuerySmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(mandatoryStringParameter(requestPDU, 0)), // message_id
+		smpp.NewCOctetStringParameter(finalDate),                               // final_date
+		smpp.NewFLParameter(uint8(messageState)),                               // message_state
+		smpp.NewFLParameter(errorCode),                                         // error_code
+	}, []*smpp.Parameter{})
+}
+
+// CreateCancelSm creates a cancel-sm.  The current supported parameter map keys that are supported are:
+//  service_type - string (default "")
+//  message_id - string (default "", meaning all messages from source_addr to destination_addr)
+//  source_addr_ton - uint8 (default 0)
+//  source_addr_npi - uint8 (default 0)
+//  source_addr - string (default "")
+//  dest_addr_ton - uint8 (default 0)
+//  dest_addr_npi - uint8 (default 0)
+//  destination_addr - string (default "")
+// If CreateCancelSm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
+// will be returned.
+func (factory *DefaultPduFactory) CreateCancelSm(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultCancelSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultCancelSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return smpp.NewPDU(smpp.CommandCancelSm, 0, 1, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(usingParameters["service_type"].(string)),     // service_type
+		smpp.NewCOctetStringParameter(usingParameters["message_id"].(string)),       // message_id
+		smpp.NewFLParameter(usingParameters["source_addr_ton"].(uint8)),             // source_addr_ton
+		smpp.NewFLParameter(usingParameters["source_addr_npi"].(uint8)),             // source_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["source_addr"].(string)),      // source_addr
+		smpp.NewFLParameter(usingParameters["dest_addr_ton"].(uint8)),               // dest_addr_ton
+		smpp.NewFLParameter(usingParameters["dest_addr_npi"].(uint8)),               // dest_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["destination_addr"].(string)), // destination_addr
+	}, optionalParameters), nil
+}
+
+// CreateCancelSmRespFromRequest creates a cancel-sm-resp, which has no parameters
+func (factory *DefaultPduFactory) CreateCancelSmRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandCancelSmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+}
+
+// CreateReplaceSm creates a replace-sm.  The current supported parameter map keys that are supported are:
+//  message_id - string (default "")
+//  source_addr_ton - uint8 (default 0)
+//  source_addr_npi - uint8 (default 0)
+//  source_addr - string (default "")
+//  schedule_delivery_time - string (default "")
+//  validity_period - string (default "")
+//  registered_delivery - uint8 (default 0)
+//  data_coding - uint8 (default 0, or the value for encoding, if that is set); replace-sm does not carry data_coding,
+//                so this only chooses the encoding, and should be the data_coding of the message being replaced
+//  encoding - one of gsm7, gsm7-packed, ascii, latin1, ucs2 or binary (default is based on data_coding)
+//  short_message - string (default "This is a replacement short message")
+// If CreateReplaceSm cannot coerce the string value for a parameter into its proper type (e.g., uint8), and error
+// will be returned.  An error is also returned if short_message cannot be encoded, or if the encoded short_message
+// is longer than 254 octets.
+func (factory *DefaultPduFactory) CreateReplaceSm(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultReplaceSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultReplaceSmParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding, err := factory.resolveTextEncoding(parameters, usingParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	shortMessage, err := encodeShortMessage(usingParameters, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return smpp.NewPDU(smpp.CommandReplaceSm, 0, 1, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(usingParameters["message_id"].(string)),             // message_id
+		smpp.NewFLParameter(usingParameters["source_addr_ton"].(uint8)),                   // source_addr_ton
+		smpp.NewFLParameter(usingParameters["source_addr_npi"].(uint8)),                   // source_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["source_addr"].(string)),            // source_addr
+		smpp.NewCOctetStringParameter(usingParameters["schedule_delivery_time"].(string)), // schedule_delivery_time
+		smpp.NewCOctetStringParameter(usingParameters["validity_period"].(string)),        // validity_period
+		smpp.NewFLParameter(usingParameters["registered_delivery"].(uint8)),               // registered_delivery
+		smpp.NewFLParameter(uint8(0)),                                                     // sm_default_msg_id
+		smpp.NewFLParameter(uint8(len(shortMessage))),
+		smpp.NewOctetStringFromString(string(shortMessage)),
+	}, optionalParameters), nil
+}
+
+// CreateReplaceSmRespFromRequest creates a replace-sm-resp, which has no parameters
+func (factory *DefaultPduFactory) CreateReplaceSmRespFromRequest(requestPDU *smpp.PDU) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandReplaceSmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+}
+
+// CreateSubmitMulti creates a submit-multi.  The current supported parameter map keys that are supported are:
+//  source_addr_ton - uint8 (default 0)
+//  source_addr_npi - uint8 (default 0)
+//  source_addr - string (default "")
+//  dest_addr_ton - uint8 (default 0), applied to each SME address in dest
+//  dest_addr_npi - uint8 (default 0), applied to each SME address in dest
+//  dest - comma separated list of SME addresses (default "")
+//  dl_name - comma separated list of distribution list names (default "")
+//  esm_class, protocol_id, priority_flag, schedule_delivery_time, validity_period, registered_delivery,
+//  replace_if_present_flag, data_coding, sm_default_msg_id and encoding - as for CreateSubmitSm
+//  short_message - string (default "This is a test short message")
+// There must be at least one destination, and no more than 254, counting both SME addresses and distribution
+// lists.  SME addresses precede distribution lists in the dest_address list.  If CreateSubmitMulti cannot
+// coerce the string value for a parameter into its proper type (e.g., uint8), an error will be returned.  An error
+// is also returned if a value is not permitted for its parameter, if short_message cannot be encoded, or if the
+// encoded short_message is longer than 254 octets.
+func (factory *DefaultPduFactory) CreateSubmitMulti(parameters map[string]string) (*smpp.PDU, error) {
+	usingParameters, err := factory.mergeParametersWithDefaults(parameters, factory.defaultSubmitMultiParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	optionalParameters, err := factory.optionalParametersFromMap(parameters, factory.defaultSubmitMultiParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateMessageFieldParameters(usingParameters); err != nil {
+		return nil, err
+	}
+
+	encoding, err := factory.resolveTextEncoding(parameters, usingParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	shortMessage, err := encodeShortMessage(usingParameters, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	smeAddresses := splitCommaSeparatedList(usingParameters["dest"].(string))
+	distributionListNames := splitCommaSeparatedList(usingParameters["dl_name"].(string))
+	numberOfDests := len(smeAddresses) + len(distributionListNames)
+
+	if numberOfDests == 0 {
+		return nil, fmt.Errorf("submit-multi requires at least one dest or dl_name")
+	}
+	if numberOfDests > 254 {
+		return nil, fmt.Errorf("submit-multi permits no more than 254 destinations, (%d) provided", numberOfDests)
+	}
+
+	mandatoryParameters := []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(""),                                      // service_type
+		smpp.NewFLParameter(usingParameters["source_addr_ton"].(uint8)),        // source_addr_ton
+		smpp.NewFLParameter(usingParameters["source_addr_npi"].(uint8)),        // source_addr_npi
+		smpp.NewCOctetStringParameter(usingParameters["source_addr"].(string)), // source_addr
+		smpp.NewFLParameter(uint8(numberOfDests)),                              // number_of_dests
+	}
+
+	for _, address := range smeAddresses {
+		mandatoryParameters = append(mandatoryParameters,
+			smpp.NewFLParameter(submitMultiDestFlagSmeAddress),
+			smpp.NewFLParameter(usingParameters["dest_addr_ton"].(uint8)),
+			smpp.NewFLParameter(usingParameters["dest_addr_npi"].(uint8)),
+			smpp.NewCOctetStringParameter(address),
+		)
+	}
+
+	for _, name := range distributionListNames {
+		mandatoryParameters = append(mandatoryParameters,
+			smpp.NewFLParameter(submitMultiDestFlagDistributionList),
+			smpp.NewCOctetStringParameter(name),
+		)
+	}
+
+	mandatoryParameters = append(mandatoryParameters, messageFieldParameters(usingParameters, 0, shortMessage)...)
+
+	return smpp.NewPDU(smpp.CommandSubmitMulti, 0, 1, mandatoryParameters, optionalParameters), nil
+}
+
+// CreateSubmitMultiRespFromRequest creates a submit-multi-resp.  The message-id will be set to the messageID
+// value, and there will be an unsuccess_sme entry for each of the unsuccessfulDeliveries.
+func (factory *DefaultPduFactory) CreateSubmitMultiRespFromRequest(requestPDU *smpp.PDU, messageID string, unsuccessfulDeliveries []*UnsuccessfulDelivery) *smpp.PDU {
+	mandatoryParameters := []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(messageID),                // message_id
+		smpp.NewFLParameter(uint8(len(unsuccessfulDeliveries))), // no_unsuccess
+	}
+
+	for _, unsuccessfulDelivery := range unsuccessfulDeliveries {
+		mandatoryParameters = append(mandatoryParameters,
+			smpp.NewFLParameter(unsuccessfulDelivery.AddrTon),
+			smpp.NewFLParameter(unsuccessfulDelivery.AddrNpi),
+			smpp.NewCOctetStringParameter(unsuccessfulDelivery.Address),
+			smpp.NewFLParameter(unsuccessfulDelivery.ErrorStatusCode),
+		)
+	}
+
+	return smpp.NewPDU(smpp.CommandSubmitMultiResp, 0, requestPDU.SequenceNumber, mandatoryParameters, []*smpp.Parameter{})
+}
+
+func (factory *DefaultPduFactory) mergeParametersWithDefaults(parameters map[string]string, defaultParameters map[string]interface{}) (map[string]interface{}, error) {
 	usingParameters := make(map[string]interface{})
 
-	for key, defaultValue := range factory.defaultSubmitSmParameters {
+	for key, defaultValue := range defaultParameters {
 		desiredValue, keyIsInOverrideMap := parameters[key]
 		if keyIsInOverrideMap {
+			if smppTimeParameterNames[key] {
+				smppTime, err := parseSmppTimeExpression(desiredValue, time.Now())
+				if err != nil {
+					return nil, fmt.Errorf("Unable to coerce parameter (%s) from (%s) to an SMPP time: %s", key, desiredValue, err)
+				}
+
+				usingParameters[key] = smppTime
+				continue
+			}
+
 			requiredTypeForValue := reflect.TypeOf(defaultValue).Kind().String()
-			coercedValue, ableToCoerceDesiredValue := factory.attemptCoersionFromStringToNamedType(desiredValue, requiredTypeForValue)
+			coercedValue, err := factory.attemptCoersionFromStringToNamedType(desiredValue, requiredTypeForValue)
 
-			if !ableToCoerceDesiredValue {
-				return nil, fmt.Errorf("Unable to coerce parameter (%s) from (%s) to type (%s)", key, desiredValue, requiredTypeForValue)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to coerce parameter (%s) from (%s) to type (%s): %s", key, desiredValue, requiredTypeForValue, err)
 			}
 
 			usingParameters[key] = coercedValue
@@ -78,50 +641,207 @@ func (factory *DefaultPduFactory) CreateSubmitSm(parameters map[string]string) (
 		}
 	}
 
-	shortMessage := usingParameters["short_message"].(string)
+	return usingParameters, nil
+}
 
-	return smpp.NewPDU(smpp.CommandSubmitSm, 0, 1, []*smpp.Parameter{
-		smpp.NewFLParameter(uint8(0)),                                               // service_type
-		smpp.NewFLParameter(uint8(0)),                                               // source_addr_ton
+// resolveTextEncoding returns the TextEncoding named by the encoding parameter or, if there is none, the one
+// for data_coding.  If encoding is set, but data_coding is not, data_coding is set to the value for the encoding.
+// A short_message given as hex: octets is used as it is, so its encoding is TextEncodingBinary.  So is a short_message
+// that cannot be encoded in GSM 03.38 when data_coding, rather than encoding, chose TextEncodingGsm7, so that such
+// text is passed through unchanged, as it was before the short_message was encoded.
+func (factory *DefaultPduFactory) resolveTextEncoding(parameters map[string]string, usingParameters map[string]interface{}) (TextEncoding, error) {
+	if strings.HasPrefix(parameters["short_message"], rawOctetsValuePrefix) {
+		return TextEncodingBinary, nil
+	}
+
+	encodingName := usingParameters["encoding"].(string)
+	if encodingName == "" {
+		encoding := TextEncodingForDataCoding(usingParameters["data_coding"].(uint8))
+		if encoding == TextEncodingGsm7 {
+			if _, err := encodeGsm7Septets(usingParameters["short_message"].(string)); err != nil {
+				return TextEncodingBinary, nil
+			}
+		}
+
+		return encoding, nil
+	}
+
+	encoding, err := TextEncodingFromString(encodingName)
+	if err != nil {
+		return encoding, err
+	}
+
+	if _, dataCodingIsSet := parameters["data_coding"]; !dataCodingIsSet {
+		usingParameters["data_coding"] = encoding.DataCoding()
+	}
+
+	return encoding, nil
+}
+
+// createUnsegmentedShortMessagePdu creates a submit-sm or deliver-sm with the entire short_message, encoded
+// using the provided TextEncoding
+func (factory *DefaultPduFactory) createUnsegmentedShortMessagePdu(commandID smpp.CommandIDType, usingParameters map[string]interface{}, encoding TextEncoding, optionalParameters []*smpp.Parameter) (*smpp.PDU, error) {
+	shortMessage, err := encodeShortMessage(usingParameters, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.createShortMessagePdu(commandID, usingParameters, 0, shortMessage, optionalParameters), nil
+}
+
+// encodeShortMessage returns the short_message parameter encoded using the provided TextEncoding, or an error if it
+// cannot be encoded or is longer than the short_message field permits
+func encodeShortMessage(usingParameters map[string]interface{}, encoding TextEncoding) ([]byte, error) {
+	shortMessage, err := EncodeText(usingParameters["short_message"].(string), encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(shortMessage) > maximumShortMessageOctets {
+		return nil, fmt.Errorf("short_message is (%d) octets, but may be no more than (%d); use segmentation for longer messages", len(shortMessage), maximumShortMessageOctets)
+	}
+
+	return shortMessage, nil
+}
+
+// createShortMessagePdu creates a submit-sm or deliver-sm, which share the same mandatory parameters.  esmClass
+// is combined with the esm_class parameter (e.g., to set UDHI for a segment).
+func (factory *DefaultPduFactory) createShortMessagePdu(commandID smpp.CommandIDType, usingParameters map[string]interface{}, esmClass uint8, shortMessage []byte, optionalParameters []*smpp.Parameter) *smpp.PDU {
+	mandatoryParameters := []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(usingParameters["service_type"].(string)),     // service_type
+		smpp.NewFLParameter(usingParameters["source_addr_ton"].(uint8)),             // source_addr_ton
 		smpp.NewFLParameter(usingParameters["source_addr_npi"].(uint8)),             // source_addr_npi
 		smpp.NewCOctetStringParameter(usingParameters["source_addr"].(string)),      // source_addr
-		smpp.NewFLParameter(uint8(0)),                                               // dest_addr_ton
+		smpp.NewFLParameter(usingParameters["dest_addr_ton"].(uint8)),               // dest_addr_ton
 		smpp.NewFLParameter(usingParameters["dest_addr_npi"].(uint8)),               // dest_addr_npi
 		smpp.NewCOctetStringParameter(usingParameters["destination_addr"].(string)), // destination_addr
-		smpp.NewFLParameter(uint8(0)),                                               // esm_class
-		smpp.NewFLParameter(uint8(0)),                                               // protocol_id
-		smpp.NewFLParameter(uint8(0)),                                               // priority_flag
-		smpp.NewFLParameter(uint8(0)),                                               // scheduled_delivery_time
-		smpp.NewFLParameter(uint8(0)),                                               // validity_period
-		smpp.NewFLParameter(uint8(0)),                                               // registered_delivery
-		smpp.NewFLParameter(uint8(0)),                                               // replace_if_present_flag
-		smpp.NewFLParameter(uint8(0)),                                               // data_coding
-		smpp.NewFLParameter(uint8(0)),                                               // sm_defalt_msg_id
-		smpp.NewFLParameter(uint8(len(shortMessage))),
-		smpp.NewOctetStringFromString(shortMessage),
-	}, []*smpp.Parameter{}), nil
+	}
+
+	return smpp.NewPDU(commandID, 0, 1, append(mandatoryParameters, messageFieldParameters(usingParameters, esmClass, shortMessage)...), optionalParameters)
 }
 
-// CreateSubmitSmRespFromRequest creates a submit-sm-resp.  The message-id will be set to the messageID value.
-func (factory *DefaultPduFactory) CreateSubmitSmRespFromRequest(requestPDU *smpp.PDU, messageID string) *smpp.PDU {
-	return smpp.NewPDU(smpp.CommandSubmitSmResp, 0, requestPDU.SequenceNumber, []*smpp.Parameter{
-		smpp.NewCOctetStringParameter(messageID),
-	}, []*smpp.Parameter{})
+// messageFieldParameters returns the mandatory parameters from esm_class through short_message, which follow the
+// addresses in a submit-sm, deliver-sm and submit-multi.  esmClass is combined with the esm_class parameter.
+func messageFieldParameters(usingParameters map[string]interface{}, esmClass uint8, shortMessage []byte) []*smpp.Parameter {
+	return []*smpp.Parameter{
+		smpp.NewFLParameter(usingParameters["esm_class"].(uint8) | esmClass),              // esm_class
+		smpp.NewFLParameter(usingParameters["protocol_id"].(uint8)),                       // protocol_id
+		smpp.NewFLParameter(usingParameters["priority_flag"].(uint8)),                     // priority_flag
+		smpp.NewCOctetStringParameter(usingParameters["schedule_delivery_time"].(string)), // schedule_delivery_time
+		smpp.NewCOctetStringParameter(usingParameters["validity_period"].(string)),        // validity_period
+		smpp.NewFLParameter(usingParameters["registered_delivery"].(uint8)),               // registered_delivery
+		smpp.NewFLParameter(usingParameters["replace_if_present_flag"].(uint8)),           // replace_if_present_flag
+		smpp.NewFLParameter(usingParameters["data_coding"].(uint8)),                       // data_coding
+		smpp.NewFLParameter(usingParameters["sm_default_msg_id"].(uint8)),                 // sm_default_msg_id
+		smpp.NewFLParameter(uint8(len(shortMessage))),
+		smpp.NewOctetStringFromString(string(shortMessage)),
+	}
 }
 
-func (factory *DefaultPduFactory) attemptCoersionFromStringToNamedType(value string, coercedType string) (interface{}, bool) {
+// rawOctetsValuePrefix starts a string parameter value that is given as hex octets (e.g., hex:0500030A0201)
+const rawOctetsValuePrefix = "hex:"
+
+// smppTimeParameterNames are the string parameters that are SMPP times, and so accept time expressions
+var smppTimeParameterNames = map[string]bool{"schedule_delivery_time": true, "validity_period": true}
+
+// attemptCoersionFromStringToNamedType converts value to the named type.  Integer types accept decimal, hex (0x40)
+// or binary (0b01000000) literals.  A string value starting with hex: is a sequence of hex octets.  If the value
+// cannot be converted, the returned error describes the format that is expected.
+func (factory *DefaultPduFactory) attemptCoersionFromStringToNamedType(value string, coercedType string) (interface{}, error) {
 	switch coercedType {
-	case "uint8":
-		coercedValue, err := strconv.ParseUint(value, 10, 8)
+	case "uint8", "uint16", "uint32":
+		bitSize := map[string]int{"uint8": 8, "uint16": 16, "uint32": 32}[coercedType]
+
+		digits, base := value, 10
+		switch {
+		case strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X"):
+			digits, base = value[2:], 16
+		case strings.HasPrefix(value, "0b") || strings.HasPrefix(value, "0B"):
+			digits, base = value[2:], 2
+		}
+
+		coercedValue, err := strconv.ParseUint(digits, base, bitSize)
 		if err != nil {
-			return uint8(0), false
+			return nil, fmt.Errorf("expected a decimal, hex (0x...) or binary (0b...) integer from 0 to %d", uint64(1)<<uint(bitSize)-1)
 		}
 
-		return uint8(coercedValue), true
+		switch coercedType {
+		case "uint8":
+			return uint8(coercedValue), nil
+		case "uint16":
+			return uint16(coercedValue), nil
+		default:
+			return uint32(coercedValue), nil
+		}
 
 	case "string":
-		return value, true
+		if !strings.HasPrefix(value, rawOctetsValuePrefix) {
+			return value, nil
+		}
+
+		octets, err := hex.DecodeString(strings.TrimPrefix(value, rawOctetsValuePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("expected an even number of hex digits after %s", rawOctetsValuePrefix)
+		}
+
+		return string(octets), nil
+	}
+
+	return nil, fmt.Errorf("type (%s) is not supported", coercedType)
+}
+
+var validNumberingPlanIndicators = map[uint8]bool{0: true, 1: true, 3: true, 4: true, 6: true, 8: true, 9: true, 10: true, 14: true, 18: true}
+
+var validEsmClassMessageTypes = map[uint8]bool{0x00: true, 0x04: true, 0x08: true, 0x10: true, 0x18: true, 0x20: true}
+
+// validateShortMessageParameters returns an error naming the first submit-sm or deliver-sm parameter with a
+// value that SMPP 3.4 does not permit
+func validateShortMessageParameters(usingParameters map[string]interface{}) error {
+	for parameterName, maximumLength := range map[string]int{"service_type": 5, "source_addr": 20, "destination_addr": 20} {
+		if value := usingParameters[parameterName].(string); len(value) > maximumLength {
+			return fmt.Errorf("%s (%s) may be no more than (%d) characters", parameterName, value, maximumLength)
+		}
+	}
+
+	for _, parameterName := range []string{"source_addr_ton", "dest_addr_ton"} {
+		if value := usingParameters[parameterName].(uint8); value > 6 {
+			return fmt.Errorf("%s (%d) must be from 0 to 6", parameterName, value)
+		}
+	}
+
+	for _, parameterName := range []string{"source_addr_npi", "dest_addr_npi"} {
+		if value := usingParameters[parameterName].(uint8); !validNumberingPlanIndicators[value] {
+			return fmt.Errorf("%s (%d) must be one of 0, 1, 3, 4, 6, 8, 9, 10, 14 or 18", parameterName, value)
+		}
+	}
+
+	return validateMessageFieldParameters(usingParameters)
+}
+
+// validateMessageFieldParameters returns an error naming the first parameter from esm_class through
+// sm_default_msg_id with a value that SMPP 3.4 does not permit
+func validateMessageFieldParameters(usingParameters map[string]interface{}) error {
+	if value := usingParameters["esm_class"].(uint8); !validEsmClassMessageTypes[value&0x3C] {
+		return fmt.Errorf("esm_class (0x%02X) has an undefined message type (bits 5 to 2)", value)
+	}
+
+	if value := usingParameters["priority_flag"].(uint8); value > 3 {
+		return fmt.Errorf("priority_flag (%d) must be from 0 to 3", value)
+	}
+
+	if value := usingParameters["registered_delivery"].(uint8); value&0x03 == 0x03 || value&0xE0 != 0 {
+		return fmt.Errorf("registered_delivery (0x%02X) has reserved bits set", value)
+	}
+
+	if value := usingParameters["replace_if_present_flag"].(uint8); value > 1 {
+		return fmt.Errorf("replace_if_present_flag (%d) must be 0 or 1", value)
+	}
+
+	for _, parameterName := range []string{"schedule_delivery_time", "validity_period"} {
+		if err := validateSmppTime(usingParameters[parameterName].(string)); err != nil {
+			return fmt.Errorf("%s %s", parameterName, err)
+		}
 	}
 
-	return value, false
+	return nil
 }
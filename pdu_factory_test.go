@@ -3,6 +3,7 @@ package smppth
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/blorticus/smpp"
@@ -51,7 +52,7 @@ func TestDefaultFactoryCreateSubmitSmNoParameters(t *testing.T) {
 	}
 
 	expectedSubmitSm := smpp.NewPDU(smpp.CommandSubmitSm, 0, 0, []*smpp.Parameter{
-		smpp.NewFLParameter(uint8(0)),     // service_type
+		smpp.NewCOctetStringParameter(""), // service_type
 		smpp.NewFLParameter(uint8(0)),     // source_addr_ton
 		smpp.NewFLParameter(uint8(0)),     // source_addr_npi
 		smpp.NewCOctetStringParameter(""), // source_addr
@@ -61,8 +62,8 @@ func TestDefaultFactoryCreateSubmitSmNoParameters(t *testing.T) {
 		smpp.NewFLParameter(uint8(0)),     // esm_class
 		smpp.NewFLParameter(uint8(0)),     // protocol_id
 		smpp.NewFLParameter(uint8(0)),     // priority_flag
-		smpp.NewFLParameter(uint8(0)),     // scheduled_delivery_time
-		smpp.NewFLParameter(uint8(0)),     // validity_period
+		smpp.NewCOctetStringParameter(""), // scheduled_delivery_time
+		smpp.NewCOctetStringParameter(""), // validity_period
 		smpp.NewFLParameter(uint8(0)),     // registered_delivery
 		smpp.NewFLParameter(uint8(0)),     // replace_if_present_flag
 		smpp.NewFLParameter(uint8(0)),     // data_coding
@@ -71,7 +72,7 @@ func TestDefaultFactoryCreateSubmitSmNoParameters(t *testing.T) {
 		smpp.NewOctetStringFromString("This is a test short message"),
 	}, []*smpp.Parameter{})
 
-	err = compareSubmitSmPDUs(expectedSubmitSm, factoryProducedPdu)
+	err = compareShortMessagePDUs(expectedSubmitSm, factoryProducedPdu)
 
 	if err != nil {
 		t.Errorf(err.Error())
@@ -85,7 +86,7 @@ func TestDefaultFactoryCreateSubmitSmWithParameters(t *testing.T) {
 		"foo":              "bar",
 		"source_addr_npi":  "1",
 		"source_addr":      "source addr",
-		"dest_addr_npi":    "2",
+		"dest_addr_npi":    "8",
 		"destination_addr": "dest addr",
 	})
 	if err != nil {
@@ -93,18 +94,18 @@ func TestDefaultFactoryCreateSubmitSmWithParameters(t *testing.T) {
 	}
 
 	expectedSubmitSm := smpp.NewPDU(smpp.CommandSubmitSm, 0, 0, []*smpp.Parameter{
-		smpp.NewFLParameter(uint8(0)),                // service_type
+		smpp.NewCOctetStringParameter(""),            // service_type
 		smpp.NewFLParameter(uint8(0)),                // source_addr_ton
 		smpp.NewFLParameter(uint8(1)),                // source_addr_npi
 		smpp.NewCOctetStringParameter("source addr"), // source_addr
 		smpp.NewFLParameter(uint8(0)),                // dest_addr_ton
-		smpp.NewFLParameter(uint8(2)),                // dest_addr_npi
+		smpp.NewFLParameter(uint8(8)),                // dest_addr_npi
 		smpp.NewCOctetStringParameter("dest addr"),   // destination_addr
 		smpp.NewFLParameter(uint8(0)),                // esm_class
 		smpp.NewFLParameter(uint8(0)),                // protocol_id
 		smpp.NewFLParameter(uint8(0)),                // priority_flag
-		smpp.NewFLParameter(uint8(0)),                // scheduled_delivery_time
-		smpp.NewFLParameter(uint8(0)),                // validity_period
+		smpp.NewCOctetStringParameter(""),            // scheduled_delivery_time
+		smpp.NewCOctetStringParameter(""),            // validity_period
 		smpp.NewFLParameter(uint8(0)),                // registered_delivery
 		smpp.NewFLParameter(uint8(0)),                // replace_if_present_flag
 		smpp.NewFLParameter(uint8(0)),                // data_coding
@@ -113,7 +114,7 @@ func TestDefaultFactoryCreateSubmitSmWithParameters(t *testing.T) {
 		smpp.NewOctetStringFromString("This is a test short message"),
 	}, []*smpp.Parameter{})
 
-	err = compareSubmitSmPDUs(expectedSubmitSm, factoryProducedPdu)
+	err = compareShortMessagePDUs(expectedSubmitSm, factoryProducedPdu)
 
 	if err != nil {
 		t.Errorf(err.Error())
@@ -138,7 +139,7 @@ func TestDefaultFactoryCreateSubmitSmWithImproperlyTypedParameter(t *testing.T)
 
 func TestDefaultFactoryCreateSubmitSmRespFromRequest(t *testing.T) {
 	submitSmPdu := smpp.NewPDU(smpp.CommandSubmitSm, 10, 0, []*smpp.Parameter{
-		smpp.NewFLParameter(uint8(0)),                // service_type
+		smpp.NewCOctetStringParameter(""),            // service_type
 		smpp.NewFLParameter(uint8(0)),                // source_addr_ton
 		smpp.NewFLParameter(uint8(1)),                // source_addr_npi
 		smpp.NewCOctetStringParameter("source addr"), // source_addr
@@ -148,8 +149,8 @@ func TestDefaultFactoryCreateSubmitSmRespFromRequest(t *testing.T) {
 		smpp.NewFLParameter(uint8(0)),                // esm_class
 		smpp.NewFLParameter(uint8(0)),                // protocol_id
 		smpp.NewFLParameter(uint8(0)),                // priority_flag
-		smpp.NewFLParameter(uint8(0)),                // scheduled_delivery_time
-		smpp.NewFLParameter(uint8(0)),                // validity_period
+		smpp.NewCOctetStringParameter(""),            // scheduled_delivery_time
+		smpp.NewCOctetStringParameter(""),            // validity_period
 		smpp.NewFLParameter(uint8(0)),                // registered_delivery
 		smpp.NewFLParameter(uint8(0)),                // replace_if_present_flag
 		smpp.NewFLParameter(uint8(0)),                // data_coding
@@ -187,13 +188,100 @@ func TestDefaultFactoryCreateSubmitSmRespFromRequest(t *testing.T) {
 	}
 }
 
-func compareSubmitSmPDUs(expected *smpp.PDU, got *smpp.PDU) error {
+func TestDefaultFactoryCreateDeliverSmWithParameters(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	factoryProducedPdu, err := f.CreateDeliverSm(map[string]string{
+		"source_addr":      "15551234",
+		"destination_addr": "2000",
+		"short_message":    "MO message",
+	})
+	if err != nil {
+		t.Errorf("Expected no error, got err = (%s)", err)
+	}
+
+	expectedDeliverSm := smpp.NewPDU(smpp.CommandDeliverSm, 0, 0, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(""),         // service_type
+		smpp.NewFLParameter(uint8(0)),             // source_addr_ton
+		smpp.NewFLParameter(uint8(0)),             // source_addr_npi
+		smpp.NewCOctetStringParameter("15551234"), // source_addr
+		smpp.NewFLParameter(uint8(0)),             // dest_addr_ton
+		smpp.NewFLParameter(uint8(0)),             // dest_addr_npi
+		smpp.NewCOctetStringParameter("2000"),     // destination_addr
+		smpp.NewFLParameter(uint8(0)),             // esm_class
+		smpp.NewFLParameter(uint8(0)),             // protocol_id
+		smpp.NewFLParameter(uint8(0)),             // priority_flag
+		smpp.NewCOctetStringParameter(""),         // scheduled_delivery_time
+		smpp.NewCOctetStringParameter(""),         // validity_period
+		smpp.NewFLParameter(uint8(0)),             // registered_delivery
+		smpp.NewFLParameter(uint8(0)),             // replace_if_present_flag
+		smpp.NewFLParameter(uint8(0)),             // data_coding
+		smpp.NewFLParameter(uint8(0)),             // sm_defalt_msg_id
+		smpp.NewFLParameter(uint8(10)),
+		smpp.NewOctetStringFromString("MO message"),
+	}, []*smpp.Parameter{})
+
+	if err = compareShortMessagePDUs(expectedDeliverSm, factoryProducedPdu); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestDefaultFactoryCreateDeliverSmRespFromRequest(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	deliverSm, _ := f.CreateDeliverSm(map[string]string{})
+	deliverSm.SequenceNumber = 20
+
+	deliverSmRespPdu := f.CreateDeliverSmRespFromRequest(deliverSm)
+
+	if deliverSmRespPdu.CommandID != smpp.CommandDeliverSmResp {
+		t.Errorf("Expected deliver-sm-resp command-id = (%d), got = (%d) [%s]", smpp.CommandDeliverSmResp, deliverSmRespPdu.CommandID, deliverSmRespPdu.CommandName())
+	}
+
+	if deliverSmRespPdu.SequenceNumber != 20 {
+		t.Errorf("Expected deliver-sm-resp sequence number = (20), but got (%d)", deliverSmRespPdu.SequenceNumber)
+	}
+
+	if len(deliverSmRespPdu.MandatoryParameters) != 1 || deliverSmRespPdu.MandatoryParameters[0].Value.(string) != "" {
+		t.Errorf("Expected deliver-sm-resp to have a single empty message_id")
+	}
+}
+
+func TestDefaultFactoryCreateDataSm(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	dataSm, err := f.CreateDataSm(map[string]string{"destination_addr": "2000", "message_payload": "a payload"})
+	if err != nil {
+		t.Fatalf("Expected no error, got err = (%s)", err)
+	}
+
+	encoded, _ := dataSm.Encode()
+	decoded, err := decodePDU(encoded)
+	if err != nil {
+		t.Fatalf("Expected no error decoding data-sm, got err = (%s)", err)
+	}
+
+	if decoded.CommandID != smpp.CommandDataSm || decoded.MandatoryParameters[6].Value.(string) != "2000" {
+		t.Errorf("Expected data-sm with destination_addr (2000)")
+	}
+
+	if payload := tlvValueAsString(findTlvParameter(decoded, tlvTagMessagePayload)); payload != "a payload" {
+		t.Errorf("Expected message_payload = (a payload), got = (%s)", payload)
+	}
+
+	dataSmResp := f.CreateDataSmRespFromRequest(decoded, "msg01")
+	if dataSmResp.CommandID != smpp.CommandDataSmResp || dataSmResp.SequenceNumber != decoded.SequenceNumber || dataSmResp.MandatoryParameters[0].Value.(string) != "msg01" {
+		t.Errorf("Expected data-sm-resp with matching sequence number and message_id (msg01)")
+	}
+}
+
+func compareShortMessagePDUs(expected *smpp.PDU, got *smpp.PDU) error {
 	if got == nil {
 		return fmt.Errorf("Expected PDU, got nil")
 	}
 
-	if got.CommandID != smpp.CommandSubmitSm {
-		return fmt.Errorf("Expected pdu.CommandID is [%d] (submit-sm), got = [%d] (%s)", smpp.CommandSubmitSm, got.CommandID, got.CommandName())
+	if got.CommandID != expected.CommandID {
+		return fmt.Errorf("Expected pdu.CommandID is [%d] (%s), got = [%d] (%s)", expected.CommandID, expected.CommandName(), got.CommandID, got.CommandName())
 	}
 
 	if len(got.MandatoryParameters) != len(expected.MandatoryParameters) {
@@ -226,3 +314,156 @@ func compareSubmitSmPDUs(expected *smpp.PDU, got *smpp.PDU) error {
 
 	return nil
 }
+
+func TestDefaultFactoryCreateSubmitSmWithEveryMandatoryParameter(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	factoryProducedPdu, err := f.CreateSubmitSm(map[string]string{
+		"service_type":            "CMT",
+		"source_addr_ton":         "1",
+		"source_addr_npi":         "1",
+		"source_addr":             "15551234",
+		"dest_addr_ton":           "5",
+		"dest_addr_npi":           "0",
+		"destination_addr":        "ShortCode",
+		"esm_class":               "3",
+		"protocol_id":             "127",
+		"priority_flag":           "2",
+		"schedule_delivery_time":  "000000010000000R",
+		"validity_period":         "251231235959012-",
+		"registered_delivery":     "17",
+		"replace_if_present_flag": "1",
+		"data_coding":             "0",
+		"sm_default_msg_id":       "7",
+		"short_message":           "all fields",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got err = (%s)", err)
+	}
+
+	expectedSubmitSm := smpp.NewPDU(smpp.CommandSubmitSm, 0, 0, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter("CMT"),              // service_type
+		smpp.NewFLParameter(uint8(1)),                     // source_addr_ton
+		smpp.NewFLParameter(uint8(1)),                     // source_addr_npi
+		smpp.NewCOctetStringParameter("15551234"),         // source_addr
+		smpp.NewFLParameter(uint8(5)),                     // dest_addr_ton
+		smpp.NewFLParameter(uint8(0)),                     // dest_addr_npi
+		smpp.NewCOctetStringParameter("ShortCode"),        // destination_addr
+		smpp.NewFLParameter(uint8(3)),                     // esm_class
+		smpp.NewFLParameter(uint8(127)),                   // protocol_id
+		smpp.NewFLParameter(uint8(2)),                     // priority_flag
+		smpp.NewCOctetStringParameter("000000010000000R"), // scheduled_delivery_time
+		smpp.NewCOctetStringParameter("251231235959012-"), // validity_period
+		smpp.NewFLParameter(uint8(17)),                    // registered_delivery
+		smpp.NewFLParameter(uint8(1)),                     // replace_if_present_flag
+		smpp.NewFLParameter(uint8(0)),                     // data_coding
+		smpp.NewFLParameter(uint8(7)),                     // sm_defalt_msg_id
+		smpp.NewFLParameter(uint8(10)),
+		smpp.NewOctetStringFromString("all fields"),
+	}, []*smpp.Parameter{})
+
+	if err = compareShortMessagePDUs(expectedSubmitSm, factoryProducedPdu); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestDefaultFactoryCreateSubmitSmRejectsInvalidValues(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	for _, invalidParameters := range []map[string]string{
+		{"service_type": "TOOLONG"},
+		{"source_addr_ton": "7"},
+		{"dest_addr_npi": "2"},
+		{"esm_class": "12"},
+		{"priority_flag": "4"},
+		{"registered_delivery": "3"},
+		{"registered_delivery": "32"},
+		{"replace_if_present_flag": "2"},
+		{"schedule_delivery_time": "2512312359590"},
+		{"schedule_delivery_time": "251331235959000+"},
+		{"validity_period": "000001000000100R"},
+		{"validity_period": "251231235959000X"},
+		{"destination_addr": "123456789012345678901"},
+	} {
+		if _, err := f.CreateSubmitSm(invalidParameters); err == nil {
+			t.Errorf("Expected error for parameters (%v), got none", invalidParameters)
+		}
+	}
+
+	pdus, err := f.CreateSegmentedSubmitSm(map[string]string{"esm_class": "2", "short_message": strings.Repeat("x", 200)})
+	if err != nil || pdus[0].MandatoryParameters[7].Value.(uint8) != 0x42 {
+		t.Errorf("Expected segment esm_class to combine the esm_class parameter with UDHI")
+	}
+}
+
+func TestDefaultFactoryCreateReplaceSmEncodesShortMessage(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	replaceSm, err := f.CreateReplaceSm(map[string]string{"message_id": "msg01", "encoding": "ucs2", "short_message": "hi"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateReplaceSm, got = (%s)", err)
+	}
+
+	if len(replaceSm.MandatoryParameters) != 10 {
+		t.Fatalf("Expected replace-sm to have (10) mandatory parameters, got (%d)", len(replaceSm.MandatoryParameters))
+	}
+	if sm := replaceSm.MandatoryParameters[9].Value.([]byte); replaceSm.MandatoryParameters[8].Value.(uint8) != 4 || !reflect.DeepEqual(sm, []byte{0, 'h', 0, 'i'}) {
+		t.Errorf("Expected UCS-2 short_message with sm_length (4), got sm_length (%d), short_message (%v)", replaceSm.MandatoryParameters[8].Value, sm)
+	}
+
+	if _, err := f.CreateReplaceSm(map[string]string{"short_message": strings.Repeat("x", 255)}); err == nil {
+		t.Errorf("Expected error on replace-sm with a short_message longer than 254 octets, got none")
+	}
+	if _, err := f.CreateReplaceSm(map[string]string{"encoding": "ucs2", "short_message": strings.Repeat("x", 128)}); err == nil {
+		t.Errorf("Expected error on replace-sm with a UCS-2 short_message longer than 254 octets, got none")
+	}
+}
+
+func TestDefaultFactoryCoercesRicherParameterValues(t *testing.T) {
+	f := NewDefaultPduFactory()
+
+	submitSm, err := f.CreateSubmitSm(map[string]string{
+		"esm_class":              "0x40",
+		"registered_delivery":    "0b00000001",
+		"user_message_reference": "0xFFFF",
+		"qos_time_to_live":       "86400",
+		"callback_num":           "hex:01020304",
+		"short_message":          "hex:0500030A0201FF",
+		"data_coding":            "0x04",
+		"validity_period":        "+1h30m",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got err = (%s)", err)
+	}
+
+	if submitSm.MandatoryParameters[7].Value.(uint8) != 0x40 || submitSm.MandatoryParameters[12].Value.(uint8) != 1 || submitSm.MandatoryParameters[14].Value.(uint8) != 4 {
+		t.Errorf("Expected esm_class (0x40), registered_delivery (1) and data_coding (4)")
+	}
+
+	if shortMessage := submitSm.MandatoryParameters[17].Value.([]byte); string(shortMessage) != "\x05\x00\x03\x0A\x02\x01\xFF" {
+		t.Errorf("Expected short_message to be the hex octets as they are, got = (%X)", shortMessage)
+	}
+
+	if validityPeriod := submitSm.MandatoryParameters[11].Value.(string); validityPeriod != "000000013000000R" {
+		t.Errorf("Expected validity_period = (000000013000000R), got = (%s)", validityPeriod)
+	}
+
+	if findTlvParameter(submitSm, 0x0204).Value != uint16(0xFFFF) || findTlvParameter(submitSm, 0x0017).Value != uint32(86400) || string(findTlvParameter(submitSm, 0x0381).Value.([]byte)) != "\x01\x02\x03\x04" {
+		t.Errorf("Expected user_message_reference (0xFFFF), qos_time_to_live (86400) and callback_num (01020304)")
+	}
+
+	for parameterName, invalidValue := range map[string]string{
+		"esm_class":              "0x100",
+		"priority_flag":          "0b2",
+		"user_message_reference": "65536",
+		"short_message":          "hex:ABC",
+		"schedule_delivery_time": "soon",
+	} {
+		_, err := f.CreateSubmitSm(map[string]string{parameterName: invalidValue})
+		if err == nil {
+			t.Errorf("Expected error for %s=(%s), got none", parameterName, invalidValue)
+		} else if !strings.Contains(err.Error(), parameterName) || !strings.Contains(err.Error(), "expected") {
+			t.Errorf("Expected error for %s=(%s) to name the parameter and expected format, got = (%s)", parameterName, invalidValue, err)
+		}
+	}
+}
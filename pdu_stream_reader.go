@@ -0,0 +1,245 @@
+package smppth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/blorticus/smpp"
+)
+
+const tlvTagMessagePayload uint16 = 0x0424
+
+// maximumPduLength is the largest command_length accepted from a peer.  It leaves room for a message_payload
+// of 64 KiB, which is the largest that a TLV can carry, and for the other parameters of the PDU.
+const maximumPduLength = 64*1024 + 1024
+
+// pduStreamReader reads an SMPP byte stream from a peer transport and breaks it into PDUs.  It is used in
+// place of smpp.NetworkStreamReader so that PDU types for which the smpp package definition is incomplete
+// (e.g., data_sm_resp) are decoded correctly.  PDUs that remain in the buffer after a decode error are
+// returned on the next read, rather than waiting for more data from the transport.  A command_length greater
+// than maximumPduLength is rejected as soon as the header arrives, rather than buffering the rest of the PDU.
+type pduStreamReader struct {
+	connectionFromWhichToRead net.Conn
+	readBuffer                []byte
+	pduBuffer                 []byte
+}
+
+func newPduStreamReader(fromConnection net.Conn) *pduStreamReader {
+	return &pduStreamReader{
+		connectionFromWhichToRead: fromConnection,
+		readBuffer:                make([]byte, 65536),
+		pduBuffer:                 make([]byte, 0, 65536),
+	}
+}
+
+// Read extracts any complete PDUs already in the buffer.  If there are none, it performs a single read of the
+// transport and then attempts the extraction.  If a PDU cannot be decoded, the PDUs extracted before it are
+// returned along with the error.
+func (reader *pduStreamReader) Read() ([]*smpp.PDU, error) {
+	if !reader.bufferHoldsACompletePdu() {
+		bytesRead, err := reader.connectionFromWhichToRead.Read(reader.readBuffer)
+		if err != nil {
+			return nil, err
+		}
+
+		reader.pduBuffer = append(reader.pduBuffer, reader.readBuffer[:bytesRead]...)
+	}
+
+	extractedPDUs := make([]*smpp.PDU, 0, 3)
+
+	for reader.bufferHoldsACompletePdu() {
+		pduLength := binary.BigEndian.Uint32(reader.pduBuffer[0:4])
+		if pduLength < 16 {
+			reader.pduBuffer = reader.pduBuffer[:0]
+			return extractedPDUs, fmt.Errorf("Stream length field value (%d) is less than minimum (16)", pduLength)
+		}
+
+		if pduLength > maximumPduLength {
+			commandID, sequenceNumber := smpp.CommandIDType(binary.BigEndian.Uint32(reader.pduBuffer[4:8])), binary.BigEndian.Uint32(reader.pduBuffer[12:16])
+			reader.pduBuffer = reader.pduBuffer[:0]
+			return extractedPDUs, &PduDecodeError{
+				CommandID:          commandID,
+				SequenceNumber:     sequenceNumber,
+				CommandStatus:      EsmeRinvcmdlen,
+				Err:                fmt.Errorf("Stream length field value (%d) is greater than maximum (%d)", pduLength, maximumPduLength),
+				TransportMustClose: true,
+			}
+		}
+
+		// smpp.DecodePDU returns octet string and TLV values that share the stream passed to it, so the PDU is
+		// decoded from a copy, rather than from pduBuffer, which is overwritten as later PDUs arrive
+		pdu, err := decodePDU(append([]byte{}, reader.pduBuffer[:pduLength]...))
+
+		reader.pduBuffer = reader.pduBuffer[:copy(reader.pduBuffer, reader.pduBuffer[pduLength:])]
+
+		if err != nil {
+			return extractedPDUs, err
+		}
+
+		extractedPDUs = append(extractedPDUs, pdu)
+	}
+
+	return extractedPDUs, nil
+}
+
+// ExtractNextPDUs repeatedly reads until there is at least one PDU or an error.  On a *PduDecodeError, the PDUs
+// extracted before the undecodable one are also returned, and the stream remains usable.
+func (reader *pduStreamReader) ExtractNextPDUs() ([]*smpp.PDU, error) {
+	for {
+		pdus, err := reader.Read()
+
+		if err != nil {
+			return pdus, err
+		}
+
+		if len(pdus) > 0 {
+			return pdus, nil
+		}
+	}
+}
+
+func (reader *pduStreamReader) bufferHoldsACompletePdu() bool {
+	if len(reader.pduBuffer) < 16 {
+		return false
+	}
+
+	pduLength := binary.BigEndian.Uint32(reader.pduBuffer[0:4])
+	return pduLength < 16 || pduLength > maximumPduLength || uint32(len(reader.pduBuffer)) >= pduLength
+}
+
+// PduDecodeError is returned when a PDU with a complete header cannot be decoded.  CommandStatus is the
+// command_status to use in the generic-nack sent in response: ESME_RINVCMDID if the command_id is unknown,
+// or ESME_RINVCMDLEN if the body does not match the command_id.  TransportMustClose is true if the rest of the
+// stream cannot be decoded (e.g., because command_length exceeds the maximum), in which case the transport is
+// closed after the generic-nack is sent.
+type PduDecodeError struct {
+	CommandID          smpp.CommandIDType
+	SequenceNumber     uint32
+	CommandStatus      uint32
+	Err                error
+	TransportMustClose bool
+}
+
+func (err *PduDecodeError) Error() string {
+	return err.Err.Error()
+}
+
+// decodePDU decodes a single PDU.  If the PDU has a complete header, any error is a *PduDecodeError.
+func decodePDU(stream []byte) (*smpp.PDU, error) {
+	if len(stream) < 16 {
+		return nil, fmt.Errorf("Incoming stream invalid length, is (%d) octets", len(stream))
+	}
+
+	commandID := smpp.CommandIDType(binary.BigEndian.Uint32(stream[4:8]))
+	sequenceNumber := binary.BigEndian.Uint32(stream[12:16])
+
+	if smpp.CommandName(commandID) == "" {
+		return nil, &PduDecodeError{commandID, sequenceNumber, EsmeRinvcmdid, fmt.Errorf("Stream command-id (%08x) not known", uint32(commandID)), false}
+	}
+
+	pdu, err := decodePduWithKnownCommandID(stream)
+	if err != nil {
+		return nil, &PduDecodeError{commandID, sequenceNumber, EsmeRinvcmdlen, err, false}
+	}
+
+	return pdu, nil
+}
+
+// decodePduWithKnownCommandID decodes a single PDU.  PDU types that the smpp package cannot decode correctly are
+// decoded here; all others are passed to smpp.DecodePDU.  smpp.DecodePDU panics on some malformed PDUs (e.g., a
+// TLV length that runs past the end of the PDU), so that is converted to an error.
+func decodePduWithKnownCommandID(stream []byte) (pdu *smpp.PDU, err error) {
+	commandID := smpp.CommandIDType(binary.BigEndian.Uint32(stream[4:8]))
+	commandStatus := binary.BigEndian.Uint32(stream[8:12])
+	sequenceNumber := binary.BigEndian.Uint32(stream[12:16])
+
+	switch commandID {
+	case smpp.CommandDataSmResp:
+		return decodePduWithMandatoryLayout(commandID, commandStatus, sequenceNumber, stream[16:], []smpp.ParameterType{smpp.TypeCOctetString})
+
+	case smpp.CommandQuerySmResp:
+		return decodePduWithMandatoryLayout(commandID, commandStatus, sequenceNumber, stream[16:], []smpp.ParameterType{smpp.TypeCOctetString, smpp.TypeCOctetString, smpp.TypeUint8, smpp.TypeUint8})
+
+	case smpp.CommandSubmitMulti:
+		return decodeSubmitMulti(commandStatus, sequenceNumber, stream[16:])
+
+	case smpp.CommandSubmitMultiResp:
+		return decodeSubmitMultiResp(commandStatus, sequenceNumber, stream[16:])
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			pdu, err = nil, fmt.Errorf("Unable to decode %s with sequence number (%d): %v", smpp.CommandName(commandID), sequenceNumber, r)
+		}
+	}()
+
+	return smpp.DecodePDU(stream)
+}
+
+// decodePduWithMandatoryLayout decodes a PDU body consisting of mandatory parameters of the types in layout,
+// followed by optional TLVs.  Only TypeUint8 and TypeCOctetString are supported in the layout.  As with
+// smpp.DecodePDU, an error response may omit the body entirely.
+func decodePduWithMandatoryLayout(commandID smpp.CommandIDType, commandStatus uint32, sequenceNumber uint32, body []byte, layout []smpp.ParameterType) (*smpp.PDU, error) {
+	if len(body) == 0 {
+		return smpp.NewPDU(commandID, commandStatus, sequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{}), nil
+	}
+
+	mandatoryParameters := make([]*smpp.Parameter, 0, len(layout))
+	offset := 0
+
+	for i, parameterType := range layout {
+		if offset >= len(body) {
+			return nil, fmt.Errorf("In %s with sequence number (%d), mandatory parameter (%d) is missing", smpp.CommandName(commandID), sequenceNumber, i)
+		}
+
+		switch parameterType {
+		case smpp.TypeUint8:
+			mandatoryParameters = append(mandatoryParameters, smpp.NewFLParameter(body[offset]))
+			offset++
+
+		case smpp.TypeCOctetString:
+			nullOffset := bytes.IndexByte(body[offset:], 0)
+			if nullOffset < 0 {
+				return nil, fmt.Errorf("In %s with sequence number (%d), mandatory parameter (%d) has no null terminator", smpp.CommandName(commandID), sequenceNumber, i)
+			}
+
+			mandatoryParameters = append(mandatoryParameters, smpp.NewCOctetStringParameter(string(body[offset:offset+nullOffset])))
+			offset += nullOffset + 1
+		}
+	}
+
+	optionalParameters, err := decodeTlvParameters(body[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("In %s with sequence number (%d), %s", smpp.CommandName(commandID), sequenceNumber, err)
+	}
+
+	return smpp.NewPDU(commandID, commandStatus, sequenceNumber, mandatoryParameters, optionalParameters), nil
+}
+
+// decodeTlvParameters decodes a sequence of TLVs.  As with smpp.DecodePDU, each value is a []byte.
+func decodeTlvParameters(stream []byte) ([]*smpp.Parameter, error) {
+	parameters := make([]*smpp.Parameter, 0)
+
+	for offset := 0; offset < len(stream); {
+		if len(stream)-offset < 4 {
+			return nil, fmt.Errorf("TLV at offset (%d) is truncated", offset)
+		}
+
+		tag := binary.BigEndian.Uint16(stream[offset : offset+2])
+		valueLength := int(binary.BigEndian.Uint16(stream[offset+2 : offset+4]))
+
+		if len(stream)-offset-4 < valueLength {
+			return nil, fmt.Errorf("TLV (0x%04x) length (%d) exceeds remaining data (%d)", tag, valueLength, len(stream)-offset-4)
+		}
+
+		value := make([]byte, valueLength)
+		copy(value, stream[offset+4:offset+4+valueLength])
+		parameters = append(parameters, smpp.NewTLVParameter(tag, value))
+
+		offset += 4 + valueLength
+	}
+
+	return parameters, nil
+}
@@ -0,0 +1,115 @@
+package smppth
+
+import (
+	"io"
+	"testing"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestPduStreamReaderDecodesDataSmResp(t *testing.T) {
+	dataSmResp, _ := smpp.NewPDU(smpp.CommandDataSmResp, 0, 7, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter("msg01"),
+	}, []*smpp.Parameter{
+		smpp.NewTLVParameter(0x0425, uint8(2)), // delivery_failure_reason
+	}).Encode()
+	enquireLink := testSmppMsgEnquireLink01()
+
+	stream := append(append([]byte{}, dataSmResp...), enquireLink...)
+	reader := newPduStreamReader(&capturedStreamConn{remainingChunks: []*tcpStreamChunk{{data: stream[:10]}, {data: stream[10:]}}})
+
+	pdus, err := reader.ExtractNextPDUs()
+	if err != nil {
+		t.Fatalf("Expected no error on ExtractNextPDUs, got = (%s)", err)
+	}
+
+	if len(pdus) != 2 || pdus[0].CommandID != smpp.CommandDataSmResp || pdus[1].CommandID != smpp.CommandEnquireLink {
+		t.Fatalf("Expected data-sm-resp and enquire-link, got (%d) PDUs", len(pdus))
+	}
+
+	if len(pdus[0].MandatoryParameters) != 1 || pdus[0].MandatoryParameters[0].Value.(string) != "msg01" {
+		t.Errorf("Expected data-sm-resp message_id = (msg01)")
+	}
+
+	if len(pdus[0].OptionalParameters) != 1 || pdus[0].OptionalParameters[0].Value.(smpp.TLV).Tag != 0x0425 {
+		t.Errorf("Expected data-sm-resp to have one delivery_failure_reason TLV")
+	}
+
+	if _, err := reader.ExtractNextPDUs(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got = (%v)", err)
+	}
+}
+
+func TestPduStreamReaderDoesNotShareBufferWithDecodedPdus(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	firstSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"short_message": "hi"})
+	secondSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"short_message": "a much longer second message"})
+
+	encodedFirstSubmitSm, _ := firstSubmitSm.Encode()
+	encodedSecondSubmitSm, _ := secondSubmitSm.Encode()
+
+	stream := append(append([]byte{}, encodedFirstSubmitSm...), encodedSecondSubmitSm...)
+	reader := newPduStreamReader(&capturedStreamConn{remainingChunks: []*tcpStreamChunk{{data: stream}}})
+
+	pdus, err := reader.ExtractNextPDUs()
+	if err != nil || len(pdus) != 2 {
+		t.Fatalf("Expected two submit-sm PDUs, got (%d) PDUs and error = (%v)", len(pdus), err)
+	}
+
+	if text := shortMessageFromPdu(pdus[0]); text != "hi" {
+		t.Errorf("Expected first short_message = (hi), got = (%s)", text)
+	}
+
+	if text := shortMessageFromPdu(pdus[1]); text != "a much longer second message" {
+		t.Errorf("Expected second short_message = (a much longer second message), got = (%s)", text)
+	}
+}
+
+func TestPduStreamReaderRetainsPdusAfterDecodeError(t *testing.T) {
+	malformedDataSmResp := []byte{0, 0, 0, 0x18, 0x80, 0, 0x01, 0x03, 0, 0, 0, 0, 0, 0, 0, 3, 'a', 0, 0x04, 0x25, 0, 0x10, 0, 0}
+	stream := append(append(append([]byte{}, testSmppMsgEnquireLink01()...), malformedDataSmResp...), testSmppMsgEnquireLink01()...)
+	reader := newPduStreamReader(&capturedStreamConn{remainingChunks: []*tcpStreamChunk{{data: stream}}})
+
+	pdus, err := reader.Read()
+	if err == nil || len(pdus) != 1 {
+		t.Fatalf("Expected one PDU and a decode error, got (%d) PDUs and error = (%v)", len(pdus), err)
+	}
+
+	pdus, err = reader.Read()
+	if err != nil || len(pdus) != 1 || pdus[0].CommandID != smpp.CommandEnquireLink {
+		t.Errorf("Expected enquire-link following the malformed PDU, got (%d) PDUs and error = (%v)", len(pdus), err)
+	}
+}
+
+func TestDecodePduReturnsPduDecodeError(t *testing.T) {
+	unknownCommandID := []byte{0, 0, 0, 0x10, 0, 0, 0x01, 0x99, 0, 0, 0, 0, 0, 0, 0, 5}
+	_, err := decodePDU(unknownCommandID)
+	if decodeError, isDecodeError := err.(*PduDecodeError); !isDecodeError || decodeError.CommandStatus != EsmeRinvcmdid || decodeError.SequenceNumber != 5 {
+		t.Errorf("Expected *PduDecodeError with ESME_RINVCMDID and sequence number (5), got = (%v)", err)
+	}
+
+	truncatedDataSmResp := []byte{0, 0, 0, 0x12, 0x80, 0, 0x01, 0x03, 0, 0, 0, 0, 0, 0, 0, 6, 'a', 'b'}
+	_, err = decodePDU(truncatedDataSmResp)
+	if decodeError, isDecodeError := err.(*PduDecodeError); !isDecodeError || decodeError.CommandStatus != EsmeRinvcmdlen || decodeError.CommandID != smpp.CommandDataSmResp {
+		t.Errorf("Expected *PduDecodeError with ESME_RINVCMDLEN for data-sm-resp, got = (%v)", err)
+	}
+}
+
+func TestPduStreamReaderRejectsOversizedPdu(t *testing.T) {
+	oversizedHeader := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0x04, 0, 0, 0, 0, 0, 0, 0, 0x09}
+	reader := newPduStreamReader(&capturedStreamConn{remainingChunks: []*tcpStreamChunk{{data: oversizedHeader}}})
+
+	pdus, err := reader.Read()
+	decodeError, isDecodeError := err.(*PduDecodeError)
+	if len(pdus) != 0 || !isDecodeError {
+		t.Fatalf("Expected *PduDecodeError without waiting for the rest of the PDU, got (%d) PDUs and error = (%v)", len(pdus), err)
+	}
+
+	if !decodeError.TransportMustClose || decodeError.CommandStatus != EsmeRinvcmdlen || decodeError.CommandID != smpp.CommandSubmitSm || decodeError.SequenceNumber != 9 {
+		t.Errorf("Expected ESME_RINVCMDLEN for submit-sm with sequence number (9) that closes the transport, got = (%+v)", decodeError)
+	}
+
+	if len(reader.pduBuffer) != 0 {
+		t.Errorf("Expected oversized PDU to be discarded, but (%d) octets remain buffered", len(reader.pduBuffer))
+	}
+}
@@ -0,0 +1,224 @@
+package smppth
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+const (
+	// DefaultMaximumAgeOfPendingRequest is how long, by default, a request is held in a PendingRequestQueue
+	DefaultMaximumAgeOfPendingRequest = 5 * time.Minute
+
+	// DefaultMaximumNumberOfPendingRequests is the most requests, by default, held in a PendingRequestQueue
+	DefaultMaximumNumberOfPendingRequests = 10000
+)
+
+// PendingRequest is a request PDU received by the agent named NameOfAgent from the peer named NameOfPeer, which is
+// waiting for a manual response
+type PendingRequest struct {
+	NameOfAgent string
+	NameOfPeer  string
+	PDU         *smpp.PDU
+	ReceivedAt  time.Time
+}
+
+// pendingRequestSessionKey identifies the session between an agent and a peer on which requests are pending
+type pendingRequestSessionKey struct {
+	nameOfAgent string
+	nameOfPeer  string
+}
+
+// PendingRequestQueue holds, for each session between an agent and a peer, the requests that are waiting to be
+// answered by hand, because manual responses are enabled or because a ResponseRule holds them.  Requests are
+// identified by their sequence_number, which a response must carry.  A request is discarded once it has been held
+// longer than the maximum age, and the oldest request is discarded when more than the maximum number are held, so a
+// peer whose requests are never answered cannot grow the queue.  A PendingRequestQueue is safe for concurrent use.
+type PendingRequestQueue struct {
+	lock                    sync.Mutex
+	requestsBySession       map[pendingRequestSessionKey][]*PendingRequest
+	numberOfPendingRequests int
+	maximumAge              time.Duration
+	maximumNumberOfRequests int
+}
+
+// NewPendingRequestQueue creates an empty PendingRequestQueue, with DefaultMaximumAgeOfPendingRequest and
+// DefaultMaximumNumberOfPendingRequests as its limits
+func NewPendingRequestQueue() *PendingRequestQueue {
+	return &PendingRequestQueue{
+		requestsBySession:       make(map[pendingRequestSessionKey][]*PendingRequest),
+		maximumAge:              DefaultMaximumAgeOfPendingRequest,
+		maximumNumberOfRequests: DefaultMaximumNumberOfPendingRequests,
+	}
+}
+
+// SetLimits sets how long a request is held, and the most requests that are held across all sessions.  A value of 0
+// removes the corresponding limit.  Requests beyond the new limits are discarded when the next request is held or
+// when ExpireRequests() is next called.
+func (queue *PendingRequestQueue) SetLimits(maximumAge time.Duration, maximumNumberOfRequests int) *PendingRequestQueue {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.maximumAge = maximumAge
+	queue.maximumNumberOfRequests = maximumNumberOfRequests
+
+	return queue
+}
+
+// PendingRequests returns the requests pending for the named agent from the named peer, or from all of its peers if
+// nameOfPeer is the empty string, in the order in which they arrived
+func (queue *PendingRequestQueue) PendingRequests(nameOfAgent string, nameOfPeer string) []*PendingRequest {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	pendingRequests := make([]*PendingRequest, 0)
+	for session, requests := range queue.requestsBySession {
+		if session.nameOfAgent == nameOfAgent && (nameOfPeer == "" || session.nameOfPeer == nameOfPeer) {
+			pendingRequests = append(pendingRequests, requests...)
+		}
+	}
+
+	sort.SliceStable(pendingRequests, func(i, j int) bool {
+		return pendingRequests[i].ReceivedAt.Before(pendingRequests[j].ReceivedAt)
+	})
+
+	return pendingRequests
+}
+
+// Take removes and returns the request with the provided sequence_number that is pending for the named agent from
+// the named peer, or nil if there is none
+func (queue *PendingRequestQueue) Take(nameOfAgent string, nameOfPeer string, sequenceNumber uint32) *PendingRequest {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	session := pendingRequestSessionKey{nameOfAgent, nameOfPeer}
+	requests := queue.requestsBySession[session]
+
+	for i, request := range requests {
+		if request.PDU.SequenceNumber == sequenceNumber {
+			queue.removeRequestAt(session, i)
+			return request
+		}
+	}
+
+	return nil
+}
+
+// ExpireRequests discards the requests that have been held longer than the maximum age, and returns them
+func (queue *PendingRequestQueue) ExpireRequests(now time.Time) []*PendingRequest {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	expiredRequests := make([]*PendingRequest, 0)
+	if queue.maximumAge <= 0 {
+		return expiredRequests
+	}
+
+	for session, requests := range queue.requestsBySession {
+		numberExpired := 0
+		for numberExpired < len(requests) && now.Sub(requests[numberExpired].ReceivedAt) > queue.maximumAge {
+			numberExpired++
+		}
+
+		if numberExpired == 0 {
+			continue
+		}
+
+		expiredRequests = append(expiredRequests, requests[:numberExpired]...)
+		queue.numberOfPendingRequests -= numberExpired
+
+		if numberExpired == len(requests) {
+			delete(queue.requestsBySession, session)
+		} else {
+			queue.requestsBySession[session] = requests[numberExpired:]
+		}
+	}
+
+	return expiredRequests
+}
+
+// find returns the request with the provided sequence_number that is pending for the named agent from the named
+// peer, leaving it in the queue, or nil if there is none
+func (queue *PendingRequestQueue) find(nameOfAgent string, nameOfPeer string, sequenceNumber uint32) *PendingRequest {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	for _, request := range queue.requestsBySession[pendingRequestSessionKey{nameOfAgent, nameOfPeer}] {
+		if request.PDU.SequenceNumber == sequenceNumber {
+			return request
+		}
+	}
+
+	return nil
+}
+
+// hold adds a request received by the named agent from the named peer.  A request already held on the session with
+// the same sequence_number is replaced.  If more than the maximum number of requests are then held, the oldest are
+// discarded.
+func (queue *PendingRequestQueue) hold(nameOfAgent string, nameOfPeer string, request *smpp.PDU, now time.Time) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	session := pendingRequestSessionKey{nameOfAgent, nameOfPeer}
+	for i, heldRequest := range queue.requestsBySession[session] {
+		if heldRequest.PDU.SequenceNumber == request.SequenceNumber {
+			queue.removeRequestAt(session, i)
+			break
+		}
+	}
+
+	queue.requestsBySession[session] = append(queue.requestsBySession[session], &PendingRequest{
+		NameOfAgent: nameOfAgent,
+		NameOfPeer:  nameOfPeer,
+		PDU:         request,
+		ReceivedAt:  now,
+	})
+	queue.numberOfPendingRequests++
+
+	for queue.maximumNumberOfRequests > 0 && queue.numberOfPendingRequests > queue.maximumNumberOfRequests {
+		queue.removeOldestRequest()
+	}
+}
+
+// removeRequestAt removes the request at the provided index in the list for the session.  The queue lock must be held.
+func (queue *PendingRequestQueue) removeRequestAt(session pendingRequestSessionKey, index int) {
+	requests := queue.requestsBySession[session]
+	queue.requestsBySession[session] = append(requests[:index:index], requests[index+1:]...)
+	queue.numberOfPendingRequests--
+
+	if len(queue.requestsBySession[session]) == 0 {
+		delete(queue.requestsBySession, session)
+	}
+}
+
+// removeOldestRequest removes the request that has been held longest on any session.  The requests for each session
+// are in the order they arrived, so it is the first request of one of the sessions.  The queue lock must be held.
+func (queue *PendingRequestQueue) removeOldestRequest() {
+	var sessionWithOldestRequest *pendingRequestSessionKey
+	for session, requests := range queue.requestsBySession {
+		if sessionWithOldestRequest == nil || requests[0].ReceivedAt.Before(queue.requestsBySession[*sessionWithOldestRequest][0].ReceivedAt) {
+			session := session
+			sessionWithOldestRequest = &session
+		}
+	}
+
+	if sessionWithOldestRequest != nil {
+		queue.removeRequestAt(*sessionWithOldestRequest, 0)
+	}
+}
+
+// discardSession removes every request pending for the named agent from the named peer (e.g., because the
+// transport to the peer closed, so the requests can no longer be answered), and returns the number removed
+func (queue *PendingRequestQueue) discardSession(nameOfAgent string, nameOfPeer string) int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	session := pendingRequestSessionKey{nameOfAgent, nameOfPeer}
+	numberDiscarded := len(queue.requestsBySession[session])
+	delete(queue.requestsBySession, session)
+	queue.numberOfPendingRequests -= numberDiscarded
+
+	return numberDiscarded
+}
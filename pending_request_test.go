@@ -0,0 +1,86 @@
+package smppth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestPendingRequestQueue(t *testing.T) {
+	queue := NewPendingRequestQueue()
+	now := time.Now()
+
+	queue.hold("smsc01", "esme02", smpp.NewPDU(smpp.CommandEnquireLink, 0, 3, []*smpp.Parameter{}, []*smpp.Parameter{}), now.Add(2*time.Second))
+	queue.hold("smsc01", "esme01", smpp.NewPDU(smpp.CommandSubmitSm, 0, 1, []*smpp.Parameter{}, []*smpp.Parameter{}), now)
+	queue.hold("smsc01", "esme01", smpp.NewPDU(smpp.CommandQuerySm, 0, 2, []*smpp.Parameter{}, []*smpp.Parameter{}), now.Add(time.Second))
+	queue.hold("smsc02", "esme01", smpp.NewPDU(smpp.CommandSubmitSm, 0, 1, []*smpp.Parameter{}, []*smpp.Parameter{}), now)
+
+	pending := queue.PendingRequests("smsc01", "")
+	if len(pending) != 3 || pending[0].PDU.SequenceNumber != 1 || pending[1].PDU.SequenceNumber != 2 || pending[2].NameOfPeer != "esme02" {
+		t.Fatalf("Expected three requests pending for smsc01 in the order they arrived, got = (%+v)", pending)
+	}
+
+	if pending := queue.PendingRequests("smsc01", "esme01"); len(pending) != 2 {
+		t.Errorf("Expected two requests pending for smsc01 from esme01, got (%d)", len(pending))
+	}
+
+	if request := queue.find("smsc01", "esme01", 2); request == nil || len(queue.PendingRequests("smsc01", "esme01")) != 2 {
+		t.Errorf("Expected find() to return seq 2 without removing it")
+	}
+
+	if request := queue.Take("smsc01", "esme02", 1); request != nil {
+		t.Errorf("Expected no request with seq 1 pending from esme02, got = (%+v)", request)
+	}
+
+	if request := queue.Take("smsc01", "esme01", 1); request == nil || request.PDU.CommandID != smpp.CommandSubmitSm {
+		t.Errorf("Expected Take() to return the submit-sm with seq 1, got = (%+v)", request)
+	}
+
+	if request := queue.Take("smsc01", "esme01", 1); request != nil {
+		t.Errorf("Expected a request to be taken only once")
+	}
+
+	if discarded := queue.discardSession("smsc01", "esme01"); discarded != 1 {
+		t.Errorf("Expected one request discarded for smsc01 and esme01, got (%d)", discarded)
+	}
+
+	if len(queue.PendingRequests("smsc01", "")) != 1 || len(queue.PendingRequests("smsc02", "")) != 1 {
+		t.Errorf("Expected requests pending for other sessions to remain")
+	}
+}
+
+func TestPendingRequestQueueLimits(t *testing.T) {
+	queue := NewPendingRequestQueue().SetLimits(time.Minute, 3)
+	now := time.Now()
+
+	queue.hold("smsc01", "esme01", smpp.NewPDU(smpp.CommandSubmitSm, 0, 1, []*smpp.Parameter{}, []*smpp.Parameter{}), now)
+	queue.hold("smsc01", "esme02", smpp.NewPDU(smpp.CommandSubmitSm, 0, 1, []*smpp.Parameter{}, []*smpp.Parameter{}), now.Add(time.Second))
+	queue.hold("smsc01", "esme01", smpp.NewPDU(smpp.CommandSubmitSm, 0, 2, []*smpp.Parameter{}, []*smpp.Parameter{}), now.Add(2*time.Second))
+	queue.hold("smsc01", "esme02", smpp.NewPDU(smpp.CommandSubmitSm, 0, 2, []*smpp.Parameter{}, []*smpp.Parameter{}), now.Add(3*time.Second))
+
+	if pending := queue.PendingRequests("smsc01", "esme01"); len(pending) != 1 || pending[0].PDU.SequenceNumber != 2 {
+		t.Errorf("Expected the oldest request to be discarded when a fourth is held, got = (%+v)", pending)
+	}
+
+	queue.hold("smsc01", "esme02", smpp.NewPDU(smpp.CommandQuerySm, 0, 2, []*smpp.Parameter{}, []*smpp.Parameter{}), now.Add(4*time.Second))
+	if pending := queue.PendingRequests("smsc01", ""); len(pending) != 3 || pending[2].PDU.CommandID != smpp.CommandQuerySm {
+		t.Errorf("Expected a request with a held sequence_number to replace it, got = (%+v)", pending)
+	}
+
+	if expired := queue.ExpireRequests(now.Add(62 * time.Second)); len(expired) != 1 || expired[0].NameOfPeer != "esme02" || expired[0].PDU.SequenceNumber != 1 {
+		t.Errorf("Expected only the request held longer than a minute to expire, got = (%+v)", expired)
+	}
+
+	if expired := queue.ExpireRequests(now.Add(time.Hour)); len(expired) != 2 || len(queue.PendingRequests("smsc01", "")) != 0 {
+		t.Errorf("Expected every remaining request to expire after an hour, got (%d)", len(expired))
+	}
+
+	queue.SetLimits(0, 0)
+	for i := 0; i < 5; i++ {
+		queue.hold("smsc01", "esme01", smpp.NewPDU(smpp.CommandSubmitSm, 0, uint32(i), []*smpp.Parameter{}, []*smpp.Parameter{}), now)
+	}
+	if expired := queue.ExpireRequests(now.Add(time.Hour)); len(expired) != 0 || len(queue.PendingRequests("smsc01", "")) != 5 {
+		t.Errorf("Expected no limits on a queue with limits of 0")
+	}
+}
@@ -0,0 +1,255 @@
+package smppth
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// ReassembledMessage is a concatenated message assembled from its segments.  SegmentPDUs has an entry for each
+// segment, in order, which is nil for a segment that was not received.  Text is the decoded text of the received
+// segments, according to DataCoding.  For an incomplete message, the missing segments are simply absent from Text.
+type ReassembledMessage struct {
+	SourceAddr       string
+	DestinationAddr  string
+	ReferenceNumber  uint16
+	TotalSegments    uint8
+	ReceivedSegments uint8
+	DataCoding       uint8
+	Text             string
+	SegmentPDUs      []*smpp.PDU
+}
+
+// IsComplete returns true if every segment of the message was received
+func (message *ReassembledMessage) IsComplete() bool {
+	return message.ReceivedSegments == message.TotalSegments
+}
+
+// reassemblyKey identifies the segments of a single concatenated message.  The total number of segments is part
+// of the key so that a reused reference number with a different segment count starts a new message.
+type reassemblyKey struct {
+	agentName       string
+	peerName        string
+	sourceAddr      string
+	referenceNumber uint16
+	totalSegments   uint8
+}
+
+type partialMessage struct {
+	firstSegmentReceivedAt time.Time
+	sourceAgent            Agent
+	lastSegmentPDU         *smpp.PDU
+	segmentPDUs            []*smpp.PDU
+	segmentTexts           [][]byte
+	receivedSegments       uint8
+}
+
+// MessageReassembler collects the segments of concatenated submit-sm and deliver-sm messages received from peers.
+// Segments are identified either by a concatenation UDH (IEI 0x00 or 0x08) when esm_class has UDHI set, or by
+// sar_msg_ref_num, sar_total_segments and sar_segment_seqnum TLVs.  Segments are grouped by the receiving agent,
+// the peer, source_addr and the reference number.  Each ReceivedPDU AgentEvent should be passed to
+// ObserveAgentEvent(), and ExpireIncompleteMessages() should be called periodically.  A MessageReassembler is
+// safe for concurrent use.
+type MessageReassembler struct {
+	lock                     sync.Mutex
+	incompleteMessageTimeout time.Duration
+	partialMessages          map[reassemblyKey]*partialMessage
+}
+
+// NewMessageReassembler creates a MessageReassembler.  A message whose segments have not all arrived within
+// incompleteMessageTimeout of the first segment is reported by ExpireIncompleteMessages().
+func NewMessageReassembler(incompleteMessageTimeout time.Duration) *MessageReassembler {
+	return &MessageReassembler{
+		incompleteMessageTimeout: incompleteMessageTimeout,
+		partialMessages:          make(map[reassemblyKey]*partialMessage),
+	}
+}
+
+// ObserveAgentEvent accepts an AgentEvent.  If it is a ReceivedPDU event for the last missing segment of a
+// concatenated message, a ReceivedCompleteMessage event is returned.  Otherwise, nil is returned.
+func (reassembler *MessageReassembler) ObserveAgentEvent(event *AgentEvent) *AgentEvent {
+	if event == nil || event.Type != ReceivedPDU || event.SmppPDU == nil || event.SourceAgent == nil {
+		return nil
+	}
+
+	pdu := event.SmppPDU
+	if pdu.CommandID != smpp.CommandSubmitSm && pdu.CommandID != smpp.CommandDeliverSm {
+		return nil
+	}
+
+	referenceNumber, totalSegments, segmentSeqnum, segmentText, isSegment := extractSegmentInformation(pdu)
+	if !isSegment {
+		return nil
+	}
+
+	key := reassemblyKey{
+		agentName:       event.SourceAgent.Name(),
+		peerName:        event.RemotePeerName,
+		sourceAddr:      mandatoryStringParameter(pdu, 3),
+		referenceNumber: referenceNumber,
+		totalSegments:   totalSegments,
+	}
+
+	reassembler.lock.Lock()
+	defer reassembler.lock.Unlock()
+
+	partial, isKnown := reassembler.partialMessages[key]
+	if !isKnown {
+		partial = &partialMessage{
+			firstSegmentReceivedAt: time.Now(),
+			segmentPDUs:            make([]*smpp.PDU, totalSegments),
+			segmentTexts:           make([][]byte, totalSegments),
+		}
+		reassembler.partialMessages[key] = partial
+	}
+
+	if partial.segmentPDUs[segmentSeqnum-1] == nil {
+		partial.receivedSegments++
+	}
+
+	partial.sourceAgent = event.SourceAgent
+	partial.lastSegmentPDU = pdu
+	partial.segmentPDUs[segmentSeqnum-1] = pdu
+	partial.segmentTexts[segmentSeqnum-1] = segmentText
+
+	if partial.receivedSegments < totalSegments {
+		return nil
+	}
+
+	delete(reassembler.partialMessages, key)
+
+	return partial.toAgentEvent(ReceivedCompleteMessage, key)
+}
+
+// ExpireIncompleteMessages discards each incomplete message whose first segment was received more than the timeout
+// before now, returning an IncompleteMessageTimedOut event for each
+func (reassembler *MessageReassembler) ExpireIncompleteMessages(now time.Time) []*AgentEvent {
+	reassembler.lock.Lock()
+	defer reassembler.lock.Unlock()
+
+	expiredMessageEvents := make([]*AgentEvent, 0)
+	for key, partial := range reassembler.partialMessages {
+		if now.Sub(partial.firstSegmentReceivedAt) > reassembler.incompleteMessageTimeout {
+			expiredMessageEvents = append(expiredMessageEvents, partial.toAgentEvent(IncompleteMessageTimedOut, key))
+			delete(reassembler.partialMessages, key)
+		}
+	}
+
+	sort.Slice(expiredMessageEvents, func(i, j int) bool {
+		return expiredMessageEvents[i].ReassembledMessage.ReferenceNumber < expiredMessageEvents[j].ReassembledMessage.ReferenceNumber
+	})
+
+	return expiredMessageEvents
+}
+
+func (partial *partialMessage) toAgentEvent(eventType AgentEventType, key reassemblyKey) *AgentEvent {
+	joinedText := make([]byte, 0, 160*len(partial.segmentTexts))
+	for _, segmentText := range partial.segmentTexts {
+		joinedText = append(joinedText, segmentText...)
+	}
+
+	dataCoding, _ := partial.lastSegmentPDU.MandatoryParameters[14].Value.(uint8)
+
+	return &AgentEvent{
+		Type:           eventType,
+		SourceAgent:    partial.sourceAgent,
+		RemotePeerName: key.peerName,
+		SmppPDU:        partial.lastSegmentPDU,
+		ReassembledMessage: &ReassembledMessage{
+			SourceAddr:       key.sourceAddr,
+			DestinationAddr:  mandatoryStringParameter(partial.lastSegmentPDU, 6),
+			ReferenceNumber:  key.referenceNumber,
+			TotalSegments:    key.totalSegments,
+			ReceivedSegments: partial.receivedSegments,
+			DataCoding:       dataCoding,
+			Text:             DecodeText(joinedText, TextEncodingForDataCoding(dataCoding)),
+			SegmentPDUs:      partial.segmentPDUs,
+		},
+	}
+}
+
+// extractSegmentInformation returns the concatenation details for a submit-sm or deliver-sm that is a segment of a
+// longer message, along with the part of short_message that follows any UDH.  isSegment is false if the PDU is not
+// a segment, or if the segment information is not valid.
+func extractSegmentInformation(pdu *smpp.PDU) (referenceNumber uint16, totalSegments uint8, segmentSeqnum uint8, segmentText []byte, isSegment bool) {
+	if len(pdu.MandatoryParameters) < 17 {
+		return 0, 0, 0, nil, false
+	}
+
+	shortMessage := []byte{}
+	if len(pdu.MandatoryParameters) > 17 {
+		shortMessage, _ = pdu.MandatoryParameters[17].Value.([]byte)
+	}
+
+	if esmClass, _ := pdu.MandatoryParameters[7].Value.(uint8); esmClass&esmClassUdhIndicator != 0 {
+		referenceNumber, totalSegments, segmentSeqnum, segmentText, isSegment = extractSegmentInformationFromUdh(shortMessage)
+	} else {
+		referenceTlv, totalTlv, seqnumTlv := findTlvParameter(pdu, tlvTagSarMsgRefNum), findTlvParameter(pdu, tlvTagSarTotalSegments), findTlvParameter(pdu, tlvTagSarSegmentSeqnum)
+		if referenceTlv == nil || totalTlv == nil || seqnumTlv == nil {
+			return 0, 0, 0, nil, false
+		}
+
+		referenceNumber, totalSegments, segmentSeqnum, segmentText, isSegment = uint16(tlvValueAsUint(referenceTlv)), uint8(tlvValueAsUint(totalTlv)), uint8(tlvValueAsUint(seqnumTlv)), shortMessage, true
+	}
+
+	if !isSegment || totalSegments == 0 || segmentSeqnum == 0 || segmentSeqnum > totalSegments {
+		return 0, 0, 0, nil, false
+	}
+
+	return referenceNumber, totalSegments, segmentSeqnum, segmentText, true
+}
+
+// extractSegmentInformationFromUdh finds a concatenation information element in the UDH at the start of
+// shortMessage, returning the text that follows the UDH
+func extractSegmentInformationFromUdh(shortMessage []byte) (referenceNumber uint16, totalSegments uint8, segmentSeqnum uint8, segmentText []byte, isSegment bool) {
+	if len(shortMessage) < 1 || len(shortMessage) < int(shortMessage[0])+1 {
+		return 0, 0, 0, nil, false
+	}
+
+	udh := shortMessage[1 : int(shortMessage[0])+1]
+	segmentText = shortMessage[int(shortMessage[0])+1:]
+
+	for offset := 0; offset+1 < len(udh); {
+		iei, ieLength := udh[offset], int(udh[offset+1])
+		if offset+2+ieLength > len(udh) {
+			break
+		}
+
+		ieData := udh[offset+2 : offset+2+ieLength]
+
+		switch {
+		case iei == 0x00 && ieLength == 3:
+			return uint16(ieData[0]), ieData[1], ieData[2], segmentText, true
+		case iei == 0x08 && ieLength == 4:
+			return binary.BigEndian.Uint16(ieData[0:2]), ieData[2], ieData[3], segmentText, true
+		}
+
+		offset += 2 + ieLength
+	}
+
+	return 0, 0, 0, nil, false
+}
+
+// tlvValueAsUint returns the value of an integer TLV.  A decoded TLV value is a big-endian []byte, while one that
+// was created locally is a uint8, uint16 or uint32.
+func tlvValueAsUint(tlv *smpp.TLV) uint32 {
+	switch value := tlv.Value.(type) {
+	case uint8:
+		return uint32(value)
+	case uint16:
+		return uint32(value)
+	case uint32:
+		return value
+	case []byte:
+		var asUint uint32
+		for _, octet := range value {
+			asUint = asUint<<8 | uint32(octet)
+		}
+		return asUint
+	}
+
+	return 0
+}
@@ -0,0 +1,127 @@
+package smppth
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func receivedPduEventFromWire(t *testing.T, agent Agent, peerName string, pdu *smpp.PDU) *AgentEvent {
+	encoded, err := pdu.Encode()
+	if err != nil {
+		t.Fatalf("Expected no error on Encode, got = (%s)", err)
+	}
+
+	decoded, err := decodePDU(encoded)
+	if err != nil {
+		t.Fatalf("Expected no error on decodePDU, got = (%s)", err)
+	}
+
+	return &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: peerName, SmppPDU: decoded}
+}
+
+func TestMessageReassemblerWithUdhSegmentsOutOfOrder(t *testing.T) {
+	smsc := NewSMSC("smsc01", "smsc01", net.ParseIP("127.0.0.1"), 2775)
+	reassembler := NewMessageReassembler(time.Minute)
+	longMessage := strings.Repeat("abcdefghij", 40)
+
+	pdus, err := NewDefaultPduFactory().CreateSegmentedSubmitSm(map[string]string{"short_message": longMessage, "source_addr": "1001", "segmentation": "udh16"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSegmentedSubmitSm, got = (%s)", err)
+	}
+
+	for _, i := range []int{2, 0} {
+		if event := reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, smsc, "esme01", pdus[i])); event != nil {
+			t.Fatalf("Expected no event after segment (%d), got (%s)", i+1, eventTypeToString(event.Type))
+		}
+	}
+
+	if event := reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, smsc, "esme02", pdus[1])); event != nil {
+		t.Fatalf("Expected no event for segment from a different peer, got (%s)", eventTypeToString(event.Type))
+	}
+
+	event := reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, smsc, "esme01", pdus[1]))
+	if event == nil || event.Type != ReceivedCompleteMessage {
+		t.Fatalf("Expected ReceivedCompleteMessage after final segment, got = (%v)", event)
+	}
+
+	message := event.ReassembledMessage
+	if message.Text != longMessage {
+		t.Errorf("Expected reassembled text to match original message, got = (%s)", message.Text)
+	}
+
+	if message.SourceAddr != "1001" || message.TotalSegments != 3 || message.ReceivedSegments != 3 || !message.IsComplete() {
+		t.Errorf("Expected complete message from (1001) with 3 segments, got source_addr = (%s), segments = (%d/%d)", message.SourceAddr, message.ReceivedSegments, message.TotalSegments)
+	}
+
+	if event.SourceAgent.Name() != "smsc01" || event.RemotePeerName != "esme01" {
+		t.Errorf("Expected event for smsc01 from esme01, got (%s) from (%s)", event.SourceAgent.Name(), event.RemotePeerName)
+	}
+
+	if event := reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, smsc, "esme01", pdus[1])); event != nil {
+		t.Errorf("Expected no event for a repeated segment after completion, got (%s)", eventTypeToString(event.Type))
+	}
+}
+
+func TestMessageReassemblerWithSarAndUcs2(t *testing.T) {
+	esme := NewEsme("esme01", net.ParseIP("127.0.0.1"), 2775)
+	reassembler := NewMessageReassembler(time.Minute)
+	longMessage := strings.Repeat("é\U0001F600", 50)
+
+	pdus, err := NewDefaultPduFactory().CreateSegmentedSubmitSm(map[string]string{"short_message": longMessage, "segmentation": "sar", "data_coding": "8"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSegmentedSubmitSm, got = (%s)", err)
+	}
+
+	var event *AgentEvent
+	for _, pdu := range pdus {
+		event = reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", pdu))
+	}
+
+	if event == nil || event.Type != ReceivedCompleteMessage {
+		t.Fatalf("Expected ReceivedCompleteMessage after final segment, got = (%v)", event)
+	}
+
+	if event.ReassembledMessage.Text != longMessage || event.ReassembledMessage.DataCoding != 8 {
+		t.Errorf("Expected reassembled UCS2 text to match original message, got = (%s)", event.ReassembledMessage.Text)
+	}
+
+	unsegmented, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"short_message": "hello"})
+	if event := reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, esme, "smsc01", unsegmented)); event != nil {
+		t.Errorf("Expected no event for an unsegmented submit-sm, got (%s)", eventTypeToString(event.Type))
+	}
+}
+
+func TestMessageReassemblerExpiresIncompleteMessages(t *testing.T) {
+	smsc := NewSMSC("smsc01", "smsc01", net.ParseIP("127.0.0.1"), 2775)
+	reassembler := NewMessageReassembler(10 * time.Second)
+
+	pdus, _ := NewDefaultPduFactory().CreateSegmentedSubmitSm(map[string]string{"short_message": strings.Repeat("x", 400), "segmentation": "udh"})
+	reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, smsc, "esme01", pdus[0]))
+	reassembler.ObserveAgentEvent(receivedPduEventFromWire(t, smsc, "esme01", pdus[2]))
+
+	if events := reassembler.ExpireIncompleteMessages(time.Now()); len(events) != 0 {
+		t.Fatalf("Expected no expired messages before timeout, got (%d)", len(events))
+	}
+
+	events := reassembler.ExpireIncompleteMessages(time.Now().Add(11 * time.Second))
+	if len(events) != 1 || events[0].Type != IncompleteMessageTimedOut {
+		t.Fatalf("Expected one IncompleteMessageTimedOut event after timeout, got (%d)", len(events))
+	}
+
+	message := events[0].ReassembledMessage
+	if message.IsComplete() || message.ReceivedSegments != 2 || message.TotalSegments != 3 || message.SegmentPDUs[1] != nil {
+		t.Errorf("Expected 2 of 3 segments with the second missing, got (%d) of (%d)", message.ReceivedSegments, message.TotalSegments)
+	}
+
+	if message.Text != strings.Repeat("x", 153+94) {
+		t.Errorf("Expected text of the received segments, got (%d) characters", len(message.Text))
+	}
+
+	if events := reassembler.ExpireIncompleteMessages(time.Now().Add(time.Minute)); len(events) != 0 {
+		t.Errorf("Expected expired message to be discarded, got (%d) events", len(events))
+	}
+}
@@ -0,0 +1,378 @@
+package smppth
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// ResponseAction is what a StandardApplication does with a request PDU that matches a ResponseRule
+type ResponseAction int
+
+const (
+	// ResponseActionRespond answers the request with its usual automatic response, but with the CommandStatus of the rule
+	ResponseActionRespond ResponseAction = iota
+	// ResponseActionDrop silently ignores the request
+	ResponseActionDrop
+	// ResponseActionGenericNack answers the request with a generic-nack
+	ResponseActionGenericNack
+	// ResponseActionClose closes the transport toward the peer that sent the request
+	ResponseActionClose
+	// ResponseActionHold keeps the request in the PendingRequestQueue, to be answered by hand
+	ResponseActionHold
+)
+
+var responseActionNames = map[ResponseAction]string{
+	ResponseActionRespond:     "respond",
+	ResponseActionDrop:        "drop",
+	ResponseActionGenericNack: "generic-nack",
+	ResponseActionClose:       "close",
+	ResponseActionHold:        "hold",
+}
+
+// String returns the name of the action (e.g., "generic-nack")
+func (action ResponseAction) String() string {
+	if name, isDefined := responseActionNames[action]; isDefined {
+		return name
+	}
+
+	return fmt.Sprintf("ResponseAction(%d)", int(action))
+}
+
+// ResponseActionFromString converts the name of an action (respond, drop, generic-nack, close or hold) to a
+// ResponseAction
+func ResponseActionFromString(actionName string) (ResponseAction, error) {
+	for action, name := range responseActionNames {
+		if name == strings.ToLower(actionName) {
+			return action, nil
+		}
+	}
+
+	return 0, fmt.Errorf("response action (%s) must be one of respond, drop, generic-nack, close or hold", actionName)
+}
+
+// peerTransportCloser is implemented by the agents that can close the transport toward a single peer, for
+// ResponseActionClose
+type peerTransportCloser interface {
+	ClosePeerTransport(nameOfPeer string) error
+}
+
+// responseRuleFieldIndexes locates the fields of a submit-sm, deliver-sm or data-sm that a ResponseRule can match.
+// The three PDUs share the layout of their first eight mandatory parameters.
+var responseRuleFieldIndexes = map[string]int{
+	"service_type":     0,
+	"source_addr_ton":  1,
+	"source_addr_npi":  2,
+	"source_addr":      3,
+	"dest_addr_ton":    4,
+	"dest_addr_npi":    5,
+	"destination_addr": 6,
+	"esm_class":        7,
+}
+
+// ResponseRule changes how a StandardApplication answers the request PDUs that match it.  A request matches if it
+// was received by the agent named NameOfAgent from the peer named NameOfPeer, its command_id is CommandID, and, for
+// each entry in FieldPatterns, the named field matches the regular expression.  An empty name, a zero CommandID or
+// an empty FieldPatterns matches any request.  A field is one of service_type, source_addr_ton, source_addr_npi,
+// source_addr, dest_addr_ton, dest_addr_npi, destination_addr, esm_class or short_message, which are present only in
+// a submit-sm, deliver-sm or data-sm (and, for short_message, not in a data-sm).
+//
+// Action is applied to a matching request.  CommandStatus is the command_status of the response for
+// ResponseActionRespond, or of the generic-nack for ResponseActionGenericNack (ESME_RSYSERR, if it is zero).  The
+// action is applied after Delay or, if MaximumDelay is greater than Delay, after a random delay between the two.
+// Probability is the chance, between 0 and 1, that the rule applies to a request that it matches.  If it does not
+// apply, the request is evaluated against the rules that follow.  A Probability of zero is treated as 1.  So, for
+// example, a request is answered only half of the time by a rule with the respond action and a Probability of 0.5,
+// followed by a rule with the drop action.
+type ResponseRule struct {
+	Name          string
+	NameOfAgent   string
+	NameOfPeer    string
+	CommandID     smpp.CommandIDType
+	FieldPatterns map[string]*regexp.Regexp
+	Action        ResponseAction
+	CommandStatus uint32
+	Delay         time.Duration
+	MaximumDelay  time.Duration
+	Probability   float64
+}
+
+func (rule *ResponseRule) matches(nameOfAgent string, nameOfPeer string, request *smpp.PDU) bool {
+	if (rule.NameOfAgent != "" && rule.NameOfAgent != nameOfAgent) || (rule.NameOfPeer != "" && rule.NameOfPeer != nameOfPeer) {
+		return false
+	}
+
+	if rule.CommandID != 0 && rule.CommandID != request.CommandID {
+		return false
+	}
+
+	for fieldName, pattern := range rule.FieldPatterns {
+		value, fieldIsPresent := responseRuleFieldValue(request, fieldName)
+		if !fieldIsPresent || !pattern.MatchString(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String describes the rule in the syntax of the text command that adds it
+func (rule *ResponseRule) String() string {
+	parts := []string{fmt.Sprintf("name=%s", rule.Name)}
+
+	if rule.NameOfAgent != "" {
+		parts = append(parts, fmt.Sprintf("agent=%s", rule.NameOfAgent))
+	}
+	if rule.NameOfPeer != "" {
+		parts = append(parts, fmt.Sprintf("peer=%s", rule.NameOfPeer))
+	}
+	if rule.CommandID != 0 {
+		parts = append(parts, fmt.Sprintf("command=%s", smpp.CommandName(rule.CommandID)))
+	}
+
+	fieldNames := make([]string, 0, len(rule.FieldPatterns))
+	for fieldName := range rule.FieldPatterns {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		parts = append(parts, fmt.Sprintf("match:%s=%s", fieldName, rule.FieldPatterns[fieldName]))
+	}
+
+	parts = append(parts, fmt.Sprintf("action=%s", rule.Action))
+
+	if rule.Action == ResponseActionRespond || rule.Action == ResponseActionGenericNack {
+		parts = append(parts, fmt.Sprintf("status=%s", CommandStatusName(rule.responseCommandStatus())))
+	}
+	if rule.Delay > 0 {
+		parts = append(parts, fmt.Sprintf("delay=%s", rule.Delay))
+	}
+	if rule.MaximumDelay > rule.Delay {
+		parts = append(parts, fmt.Sprintf("max_delay=%s", rule.MaximumDelay))
+	}
+	if rule.Probability > 0 && rule.Probability < 1 {
+		parts = append(parts, fmt.Sprintf("probability=%s", strconv.FormatFloat(rule.Probability, 'g', -1, 64)))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// responseCommandStatus returns the command_status of the response or generic-nack sent by the rule
+func (rule *ResponseRule) responseCommandStatus() uint32 {
+	if rule.Action == ResponseActionGenericNack && rule.CommandStatus == EsmeRok {
+		return EsmeRsyserr
+	}
+
+	return rule.CommandStatus
+}
+
+func responseRuleFieldValue(request *smpp.PDU, fieldName string) (string, bool) {
+	switch request.CommandID {
+	case smpp.CommandSubmitSm, smpp.CommandDeliverSm, smpp.CommandDataSm:
+	default:
+		return "", false
+	}
+
+	if fieldName == "short_message" {
+		return ShortMessageText(request), request.CommandID != smpp.CommandDataSm
+	}
+
+	index, fieldIsKnown := responseRuleFieldIndexes[fieldName]
+	if !fieldIsKnown || index >= len(request.MandatoryParameters) {
+		return "", false
+	}
+
+	return fmt.Sprint(request.MandatoryParameters[index].Value), true
+}
+
+// ParseResponseRule creates a ResponseRule from a map of $name=$value parameters, as provided in the text command
+// that adds a rule.  The names are name, agent, peer, command (e.g., submit-sm), match:$field (a regular expression
+// for the field), action, status (a command_status mnemonic or integer), delay and max_delay (Go durations), and
+// probability.  If there is no action, it is respond.
+func ParseResponseRule(parameters map[string]string) (*ResponseRule, error) {
+	rule := &ResponseRule{FieldPatterns: make(map[string]*regexp.Regexp)}
+
+	for name, value := range parameters {
+		var err error
+
+		switch name {
+		case "name":
+			rule.Name = value
+		case "agent":
+			rule.NameOfAgent = value
+		case "peer":
+			rule.NameOfPeer = value
+		case "command":
+			commandID, isKnownCommand := smpp.CommandIDFromString(value)
+			if !isKnownCommand {
+				return nil, fmt.Errorf("command (%s) is not a known smpp PDU type name", value)
+			}
+			rule.CommandID = commandID
+		case "action":
+			rule.Action, err = ResponseActionFromString(value)
+		case "status":
+			rule.CommandStatus, err = CommandStatusFromString(value)
+		case "delay":
+			rule.Delay, err = time.ParseDuration(value)
+		case "max_delay":
+			rule.MaximumDelay, err = time.ParseDuration(value)
+		case "probability":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		default:
+			if !strings.HasPrefix(name, "match:") {
+				return nil, fmt.Errorf("response rule parameter (%s) is not known", name)
+			}
+
+			fieldName := strings.TrimPrefix(name, "match:")
+			if rule.FieldPatterns[fieldName], err = regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("match:%s value (%s) is not a valid regular expression", fieldName, value)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("response rule parameter (%s) value (%s) is not valid: %s", name, value, err)
+		}
+	}
+
+	return rule, nil
+}
+
+// ResponsePolicy is the ordered set of ResponseRules that a StandardApplication applies to the request PDUs that it
+// answers automatically.  A request that matches no rule is answered normally.  Rules can be added and removed while
+// the application runs, so a ResponsePolicy is safe for concurrent use.
+type ResponsePolicy struct {
+	lock                   sync.Mutex
+	rules                  []*ResponseRule
+	numberOfRulesEverAdded int
+	random                 *rand.Rand
+}
+
+// NewResponsePolicy creates a ResponsePolicy with no rules
+func NewResponsePolicy() *ResponsePolicy {
+	return &ResponsePolicy{
+		rules:  make([]*ResponseRule, 0),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetRandomSource replaces the source of the random numbers used for rule probabilities and random delays, so that a
+// test can make them repeatable
+func (policy *ResponsePolicy) SetRandomSource(source rand.Source) *ResponsePolicy {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	policy.random = rand.New(source)
+	return policy
+}
+
+// AddRule appends a rule.  Rules are evaluated in the order in which they are added.  If the rule has no Name, it is
+// named rule-$n.  An error is returned if another rule has the same Name, if Probability is not between 0 and 1, if
+// Delay is negative, if MaximumDelay is set but less than Delay, or if a field in FieldPatterns cannot be matched.
+func (policy *ResponsePolicy) AddRule(rule *ResponseRule) error {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return fmt.Errorf("response rule probability (%g) must be between 0 and 1", rule.Probability)
+	}
+
+	if rule.Delay < 0 || (rule.MaximumDelay != 0 && rule.MaximumDelay < rule.Delay) {
+		return fmt.Errorf("response rule delay (%s) must not be negative, and max_delay (%s) must not be less than delay", rule.Delay, rule.MaximumDelay)
+	}
+
+	for fieldName := range rule.FieldPatterns {
+		if _, fieldIsKnown := responseRuleFieldIndexes[fieldName]; !fieldIsKnown && fieldName != "short_message" {
+			return fmt.Errorf("response rule cannot match field (%s)", fieldName)
+		}
+	}
+
+	if rule.Name == "" {
+		policy.numberOfRulesEverAdded++
+		rule.Name = fmt.Sprintf("rule-%d", policy.numberOfRulesEverAdded)
+	}
+
+	if policy.indexOfRule(rule.Name) >= 0 {
+		return fmt.Errorf("a response rule named (%s) already exists", rule.Name)
+	}
+
+	policy.rules = append(policy.rules, rule)
+	return nil
+}
+
+// RemoveRule removes the rule with the provided name.  It returns false if there is no such rule.
+func (policy *ResponsePolicy) RemoveRule(name string) bool {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	index := policy.indexOfRule(name)
+	if index < 0 {
+		return false
+	}
+
+	policy.rules = append(policy.rules[:index], policy.rules[index+1:]...)
+	return true
+}
+
+// RemoveAllRules removes every rule, so that every request is answered normally
+func (policy *ResponsePolicy) RemoveAllRules() {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	policy.rules = make([]*ResponseRule, 0)
+}
+
+// Rules returns the rules in the order in which they are evaluated
+func (policy *ResponsePolicy) Rules() []*ResponseRule {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	return append([]*ResponseRule{}, policy.rules...)
+}
+
+// RuleForRequest returns the first rule that matches a request received by the named agent from the named peer, and
+// that applies according to its Probability, or nil if there is none
+func (policy *ResponsePolicy) RuleForRequest(nameOfAgent string, nameOfPeer string, request *smpp.PDU) *ResponseRule {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	for _, rule := range policy.rules {
+		if !rule.matches(nameOfAgent, nameOfPeer, request) {
+			continue
+		}
+
+		if rule.Probability == 0 || rule.Probability >= 1 || policy.random.Float64() < rule.Probability {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// delayFor returns the time to wait before the action of the rule is applied
+func (policy *ResponsePolicy) delayFor(rule *ResponseRule) time.Duration {
+	if rule.MaximumDelay <= rule.Delay {
+		return rule.Delay
+	}
+
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	return rule.Delay + time.Duration(policy.random.Int63n(int64(rule.MaximumDelay-rule.Delay)+1))
+}
+
+func (policy *ResponsePolicy) indexOfRule(name string) int {
+	for i, rule := range policy.rules {
+		if rule.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,233 @@
+package smppth
+
+import (
+	"bytes"
+	"math/rand"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestResponsePolicyRuleForRequest(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	policy := NewResponsePolicy()
+	for _, rule := range []*ResponseRule{
+		{Name: "throttle-uk", NameOfAgent: "smsc01", CommandID: smpp.CommandSubmitSm, FieldPatterns: map[string]*regexp.Regexp{"destination_addr": regexp.MustCompile(`^44`)}, CommandStatus: EsmeRthrottled},
+		{NameOfPeer: "esme02", CommandID: smpp.CommandEnquireLink, Action: ResponseActionDrop},
+		{Name: "nack-text", FieldPatterns: map[string]*regexp.Regexp{"short_message": regexp.MustCompile(`nack`)}, Action: ResponseActionGenericNack},
+	} {
+		if err := policy.AddRule(rule); err != nil {
+			t.Fatalf("Expected no error on AddRule(), got = (%s)", err)
+		}
+	}
+
+	if rules := policy.Rules(); len(rules) != 3 || rules[1].Name != "rule-1" {
+		t.Errorf("Expected three rules, with the unnamed rule named rule-1, got = (%v)", rules)
+	}
+
+	for _, invalidRule := range []*ResponseRule{
+		{Name: "throttle-uk"},
+		{Probability: 1.5},
+		{Delay: 2 * time.Second, MaximumDelay: time.Second},
+		{FieldPatterns: map[string]*regexp.Regexp{"message_id": regexp.MustCompile(`.`)}},
+	} {
+		if err := policy.AddRule(invalidRule); err == nil {
+			t.Errorf("Expected error on AddRule() for (%+v), got none", invalidRule)
+		}
+	}
+
+	ukSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"destination_addr": "447700900123", "short_message": "nack me"})
+	usSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"destination_addr": "15551234567", "short_message": "nack me"})
+	plainSubmitSm, _ := factory.CreateSubmitSm(map[string]string{"destination_addr": "15551234567", "short_message": "hello"})
+	enquireLink := factory.CreateEnquireLink()
+
+	for _, testCase := range []struct {
+		nameOfAgent      string
+		nameOfPeer       string
+		request          *smpp.PDU
+		expectedRuleName string
+	}{
+		{"smsc01", "esme01", ukSubmitSm, "throttle-uk"},
+		{"smsc02", "esme01", ukSubmitSm, "nack-text"},
+		{"smsc01", "esme01", usSubmitSm, "nack-text"},
+		{"smsc01", "esme01", plainSubmitSm, ""},
+		{"smsc01", "esme02", enquireLink, "rule-1"},
+		{"smsc01", "esme01", enquireLink, ""},
+	} {
+		rule := policy.RuleForRequest(testCase.nameOfAgent, testCase.nameOfPeer, testCase.request)
+		if testCase.expectedRuleName == "" {
+			if rule != nil {
+				t.Errorf("For %s from (%s) to (%s) expected no rule, got (%s)", testCase.request.CommandName(), testCase.nameOfPeer, testCase.nameOfAgent, rule.Name)
+			}
+		} else if rule == nil || rule.Name != testCase.expectedRuleName {
+			t.Errorf("For %s from (%s) to (%s) expected rule (%s), got = (%v)", testCase.request.CommandName(), testCase.nameOfPeer, testCase.nameOfAgent, testCase.expectedRuleName, rule)
+		}
+	}
+
+	if !policy.RemoveRule("throttle-uk") || policy.RemoveRule("throttle-uk") {
+		t.Errorf("Expected RemoveRule() to remove the rule exactly once")
+	}
+
+	if rule := policy.RuleForRequest("smsc01", "esme01", ukSubmitSm); rule == nil || rule.Name != "nack-text" {
+		t.Errorf("Expected nack-text to match once throttle-uk is removed, got = (%v)", rule)
+	}
+
+	policy.RemoveAllRules()
+	if len(policy.Rules()) != 0 {
+		t.Errorf("Expected no rules after RemoveAllRules()")
+	}
+}
+
+func TestResponsePolicyProbabilityAndDelay(t *testing.T) {
+	policy := NewResponsePolicy().SetRandomSource(rand.NewSource(1))
+	policy.AddRule(&ResponseRule{Name: "sometimes", Probability: 0.25, Delay: time.Second, MaximumDelay: 3 * time.Second})
+	policy.AddRule(&ResponseRule{Name: "otherwise", Action: ResponseActionDrop})
+
+	enquireLink := NewDefaultPduFactory().CreateEnquireLink()
+
+	timesApplied := 0
+	for i := 0; i < 1000; i++ {
+		rule := policy.RuleForRequest("smsc01", "esme01", enquireLink)
+		if rule.Name == "sometimes" {
+			timesApplied++
+
+			if delay := policy.delayFor(rule); delay < time.Second || delay > 3*time.Second {
+				t.Errorf("Expected delay between 1s and 3s, got (%s)", delay)
+			}
+		}
+	}
+
+	if timesApplied < 200 || timesApplied > 300 {
+		t.Errorf("Expected rule with probability 0.25 to apply about 250 times in 1000, got (%d)", timesApplied)
+	}
+}
+
+func TestParseResponseRule(t *testing.T) {
+	rule, err := ParseResponseRule(map[string]string{
+		"name":                   "slow-uk",
+		"agent":                  "smsc01",
+		"command":                "submit-sm",
+		"match:destination_addr": "^44",
+		"action":                 "respond",
+		"status":                 "ESME_RTHROTTLED",
+		"delay":                  "100ms",
+		"max_delay":              "2s",
+		"probability":            "0.5",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error on ParseResponseRule(), got = (%s)", err)
+	}
+
+	expected := "name=slow-uk agent=smsc01 command=submit-sm match:destination_addr=^44 action=respond status=ESME_RTHROTTLED delay=100ms max_delay=2s probability=0.5"
+	if rule.String() != expected {
+		t.Errorf("Expected rule = (%s), got = (%s)", expected, rule.String())
+	}
+
+	if rule, _ := ParseResponseRule(map[string]string{"action": "generic-nack"}); rule == nil || rule.String() != "name= action=generic-nack status=ESME_RSYSERR" {
+		t.Errorf("Expected generic-nack rule with default status ESME_RSYSERR, got = (%v)", rule)
+	}
+
+	if rule, err := ParseResponseRule(map[string]string{"command": "submit-sm", "action": "hold"}); err != nil || rule.Action != ResponseActionHold {
+		t.Errorf("Expected rule with hold action, got = (%v), error = (%v)", rule, err)
+	}
+
+	for _, parameters := range []map[string]string{
+		{"action": "explode"},
+		{"action": "drop", "command": "submit-something"},
+		{"action": "respond", "status": "ESME_RNOPE"},
+		{"action": "drop", "delay": "soon"},
+		{"action": "drop", "match:destination_addr": "("},
+		{"action": "drop", "colour": "blue"},
+	} {
+		if _, err := ParseResponseRule(parameters); err == nil {
+			t.Errorf("Expected error on ParseResponseRule(%v), got none", parameters)
+		}
+	}
+}
+
+// closingRecordingAgent is a recordingAgent that also records each peer toward which it is asked to close the transport
+type closingRecordingAgent struct {
+	*recordingAgent
+	namesOfClosedPeers []string
+}
+
+func (agent *closingRecordingAgent) ClosePeerTransport(nameOfPeer string) error {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	agent.namesOfClosedPeers = append(agent.namesOfClosedPeers, nameOfPeer)
+
+	return nil
+}
+
+func TestStandardApplicationAppliesResponseRuleActions(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	for _, testCase := range []struct {
+		rule                  *ResponseRule
+		expectedCommandID     smpp.CommandIDType
+		expectedCommandStatus uint32
+		expectedClose         bool
+	}{
+		{&ResponseRule{CommandStatus: EsmeRthrottled}, smpp.CommandSubmitSmResp, EsmeRthrottled, false},
+		{&ResponseRule{Action: ResponseActionGenericNack}, smpp.CommandGenericNack, EsmeRsyserr, false},
+		{&ResponseRule{Action: ResponseActionGenericNack, CommandStatus: EsmeRinvcmdid}, smpp.CommandGenericNack, EsmeRinvcmdid, false},
+		{&ResponseRule{Action: ResponseActionDrop}, 0, 0, false},
+		{&ResponseRule{Action: ResponseActionClose}, 0, 0, true},
+	} {
+		agent := &closingRecordingAgent{recordingAgent: newRecordingAgent("smsc01", "esme01")}
+		app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{agent})).SetEventOutputWriter(new(bytes.Buffer))
+		app.ResponsePolicy().AddRule(testCase.rule)
+
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"short_message": "hello"})
+		submitSm.SequenceNumber = 7
+		app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme01", SmppPDU: submitSm})
+
+		sentPDUs := agent.sentPDUs()
+		if testCase.expectedCommandID == 0 {
+			if len(sentPDUs) != 0 {
+				t.Errorf("For action (%s) expected no PDU to be sent, got (%d)", testCase.rule.Action, len(sentPDUs))
+			}
+		} else if len(sentPDUs) != 1 || sentPDUs[0].CommandID != testCase.expectedCommandID || sentPDUs[0].CommandStatus != testCase.expectedCommandStatus || sentPDUs[0].SequenceNumber != 7 {
+			t.Errorf("For action (%s) expected one %s with status (%d) and seq 7, got = (%v)", testCase.rule.Action, smpp.CommandName(testCase.expectedCommandID), testCase.expectedCommandStatus, sentPDUs)
+		}
+
+		if closed := len(agent.namesOfClosedPeers) == 1 && agent.namesOfClosedPeers[0] == "esme01"; closed != testCase.expectedClose {
+			t.Errorf("For action (%s) expected transport closed = (%t), got closes = (%v)", testCase.rule.Action, testCase.expectedClose, agent.namesOfClosedPeers)
+		}
+	}
+}
+
+func TestStandardApplicationSendsDelayedResponse(t *testing.T) {
+	agent := newRecordingAgent("smsc01", "esme01")
+	agentEvents := make(chan *AgentEvent)
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{agent})).SetEventOutputWriter(new(bytes.Buffer)).DisableAgentEventProxying()
+	app.ResponsePolicy().AddRule(&ResponseRule{Delay: 100 * time.Millisecond, CommandStatus: EsmeRthrottled})
+
+	// a timer that fires before Start() runs must not block, and its response is sent once Start() runs
+	app.addDueDelayedResponse(&delayedResponse{&ResponseRule{}, &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme01", SmppPDU: NewDefaultPduFactory().CreateEnquireLink()}})
+
+	app.AttachEventChannel(agentEvents)
+	go app.Start()
+
+	enquireLink := NewDefaultPduFactory().CreateEnquireLink()
+	enquireLink.SequenceNumber = 9
+	receivedAt := time.Now()
+	agentEvents <- &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme01", SmppPDU: enquireLink}
+
+	for deadline := time.Now().Add(5 * time.Second); len(agent.sentPDUs()) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected two enquire-link-resp to be sent, got (%d)", len(agent.sentPDUs()))
+		}
+	}
+
+	if elapsed := time.Since(receivedAt); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected delayed response to be sent after at least 100ms, sent after (%s)", elapsed)
+	}
+
+	if delayedResponse := agent.sentPDUs()[1]; delayedResponse.CommandID != smpp.CommandEnquireLinkResp || delayedResponse.CommandStatus != EsmeRthrottled || delayedResponse.SequenceNumber != 9 {
+		t.Errorf("Expected enquire-link-resp with status ESME_RTHROTTLED and seq 9, got = (%+v)", delayedResponse)
+	}
+}
@@ -0,0 +1,148 @@
+package smppth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/blorticus/smpp"
+)
+
+// RoutingRule sends the messages that match it to the bound peer named NameOfPeer.  A message matches if its
+// destination_addr starts with DestinationAddrPrefix and matches DestinationAddrPattern, its dest_addr_ton and
+// dest_addr_npi are DestAddrTon and DestAddrNpi, and its service_type is ServiceType.  An empty prefix or
+// service_type, a nil pattern, or a nil TON or NPI matches any message.
+type RoutingRule struct {
+	NameOfPeer             string
+	DestinationAddrPrefix  string
+	DestinationAddrPattern *regexp.Regexp
+	DestAddrTon            *uint8
+	DestAddrNpi            *uint8
+	ServiceType            string
+}
+
+func (rule *RoutingRule) matches(submitSm *smpp.PDU) bool {
+	destinationAddr := mandatoryStringParameter(submitSm, 6)
+
+	if !strings.HasPrefix(destinationAddr, rule.DestinationAddrPrefix) {
+		return false
+	}
+
+	if rule.DestinationAddrPattern != nil && !rule.DestinationAddrPattern.MatchString(destinationAddr) {
+		return false
+	}
+
+	if rule.ServiceType != "" && rule.ServiceType != mandatoryStringParameter(submitSm, 0) {
+		return false
+	}
+
+	return uint8ParameterMatches(submitSm, 4, rule.DestAddrTon) && uint8ParameterMatches(submitSm, 5, rule.DestAddrNpi)
+}
+
+func uint8ParameterMatches(pdu *smpp.PDU, index int, expectedValue *uint8) bool {
+	if expectedValue == nil {
+		return true
+	}
+
+	if index >= len(pdu.MandatoryParameters) {
+		return false
+	}
+
+	value, isUint8 := pdu.MandatoryParameters[index].Value.(uint8)
+	return isUint8 && value == *expectedValue
+}
+
+// RoutingTable puts an SMSC in routing mode.  Rather than simply accepting each submit-sm, the SMSC forwards it as a
+// deliver-sm to the peer named by the first rule that the message matches.  A submit-sm that matches no rule is
+// answered with the unroutable command_status, which is ESME_RINVDSTADR by default.
+type RoutingTable struct {
+	rules                   []*RoutingRule
+	unroutableCommandStatus uint32
+}
+
+// NewRoutingTable creates a RoutingTable with no rules
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{
+		rules:                   make([]*RoutingRule, 0),
+		unroutableCommandStatus: EsmeRinvdstadr,
+	}
+}
+
+// SetUnroutableCommandStatus sets the command_status of the submit-sm-resp for a submit-sm that matches no rule
+func (table *RoutingTable) SetUnroutableCommandStatus(commandStatus uint32) *RoutingTable {
+	table.unroutableCommandStatus = commandStatus
+	return table
+}
+
+// UnroutableCommandStatus returns the command_status of the submit-sm-resp for a submit-sm that matches no rule
+func (table *RoutingTable) UnroutableCommandStatus() uint32 {
+	return table.unroutableCommandStatus
+}
+
+// AddRule appends a rule.  Rules are evaluated in the order in which they are added.  An error is returned if the
+// rule has no NameOfPeer.
+func (table *RoutingTable) AddRule(rule *RoutingRule) error {
+	if rule.NameOfPeer == "" {
+		return fmt.Errorf("routing rule must name the peer to which messages are routed")
+	}
+
+	table.rules = append(table.rules, rule)
+	return nil
+}
+
+// RouteForSubmitSm returns the first rule that the submit-sm matches, or nil if it matches none
+func (table *RoutingTable) RouteForSubmitSm(submitSm *smpp.PDU) *RoutingRule {
+	for _, rule := range table.rules {
+		if rule.matches(submitSm) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// createDeliverSmFromSubmitSm creates the deliver-sm that carries a routed submit-sm to its destination.  The
+// mandatory parameters of the two PDUs are laid out the same way, so they are copied, except that
+// schedule_delivery_time and validity_period must be empty in a deliver-sm.  The optional parameters are copied
+// as well.
+func createDeliverSmFromSubmitSm(submitSm *smpp.PDU) *smpp.PDU {
+	mandatoryParameters := make([]*smpp.Parameter, len(submitSm.MandatoryParameters))
+	copy(mandatoryParameters, submitSm.MandatoryParameters)
+
+	for _, index := range []int{10, 11} {
+		if index < len(mandatoryParameters) {
+			mandatoryParameters[index] = smpp.NewCOctetStringParameter("")
+		}
+	}
+
+	optionalParameters := make([]*smpp.Parameter, len(submitSm.OptionalParameters))
+	copy(optionalParameters, submitSm.OptionalParameters)
+
+	return smpp.NewPDU(smpp.CommandDeliverSm, 0, 0, mandatoryParameters, optionalParameters)
+}
+
+// createDeliverSmFromStoredMessage creates the deliver-sm that carries a routed message to its destination when the
+// submit-sm is no longer available (e.g., after the message was replayed from a message journal).  The parameters
+// that the MessageStore does not keep, including the optional parameters, are not carried.
+func createDeliverSmFromStoredMessage(message *StoredMessage) *smpp.PDU {
+	return smpp.NewPDU(smpp.CommandDeliverSm, 0, 0, []*smpp.Parameter{
+		smpp.NewCOctetStringParameter(message.ServiceType),     // service_type
+		smpp.NewFLParameter(message.SourceAddrTon),             // source_addr_ton
+		smpp.NewFLParameter(message.SourceAddrNpi),             // source_addr_npi
+		smpp.NewCOctetStringParameter(message.SourceAddr),      // source_addr
+		smpp.NewFLParameter(message.DestAddrTon),               // dest_addr_ton
+		smpp.NewFLParameter(message.DestAddrNpi),               // dest_addr_npi
+		smpp.NewCOctetStringParameter(message.DestinationAddr), // destination_addr
+		smpp.NewFLParameter(message.EsmClass),                  // esm_class
+		smpp.NewFLParameter(uint8(0)),                          // protocol_id
+		smpp.NewFLParameter(uint8(0)),                          // priority_flag
+		smpp.NewCOctetStringParameter(""),                      // schedule_delivery_time
+		smpp.NewCOctetStringParameter(""),                      // validity_period
+		smpp.NewFLParameter(message.RegisteredDelivery),        // registered_delivery
+		smpp.NewFLParameter(uint8(0)),                          // replace_if_present_flag
+		smpp.NewFLParameter(message.DataCoding),                // data_coding
+		smpp.NewFLParameter(uint8(0)),                          // sm_default_msg_id
+		smpp.NewFLParameter(uint8(len(message.ShortMessage))),
+		smpp.NewOctetStringFromString(string(message.ShortMessage)),
+	}, []*smpp.Parameter{})
+}
@@ -0,0 +1,90 @@
+package smppth
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRoutingTableRouteForSubmitSm(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	international := uint8(1)
+
+	table := NewRoutingTable()
+	for _, rule := range []*RoutingRule{
+		{NameOfPeer: "esme-wap", ServiceType: "WAP"},
+		{NameOfPeer: "esme-intl", DestinationAddrPrefix: "44", DestAddrTon: &international},
+		{NameOfPeer: "esme-us", DestinationAddrPattern: regexp.MustCompile(`^1\d{10}$`)},
+	} {
+		if err := table.AddRule(rule); err != nil {
+			t.Fatalf("Expected no error on AddRule(), got = (%s)", err)
+		}
+	}
+
+	if err := table.AddRule(&RoutingRule{DestinationAddrPrefix: "1"}); err == nil {
+		t.Errorf("Expected error on AddRule() with no NameOfPeer, got none")
+	}
+
+	for _, testCase := range []struct {
+		parameters   map[string]string
+		expectedPeer string
+	}{
+		{map[string]string{"service_type": "WAP", "destination_addr": "15551234567"}, "esme-wap"},
+		{map[string]string{"dest_addr_ton": "1", "destination_addr": "447700900123"}, "esme-intl"},
+		{map[string]string{"dest_addr_ton": "0", "destination_addr": "447700900123"}, ""},
+		{map[string]string{"destination_addr": "15551234567"}, "esme-us"},
+		{map[string]string{"destination_addr": "1555123"}, ""},
+	} {
+		submitSm, _ := factory.CreateSubmitSm(testCase.parameters)
+
+		route := table.RouteForSubmitSm(submitSm)
+		if testCase.expectedPeer == "" {
+			if route != nil {
+				t.Errorf("For submit-sm (%v) expected no route, got route to (%s)", testCase.parameters, route.NameOfPeer)
+			}
+		} else if route == nil || route.NameOfPeer != testCase.expectedPeer {
+			t.Errorf("For submit-sm (%v) expected route to (%s), got = (%v)", testCase.parameters, testCase.expectedPeer, route)
+		}
+	}
+
+	if status := table.UnroutableCommandStatus(); status != EsmeRinvdstadr {
+		t.Errorf("Expected default unroutable status ESME_RINVDSTADR, got (%s)", CommandStatusName(status))
+	}
+
+	if status := table.SetUnroutableCommandStatus(EsmeRsyserr).UnroutableCommandStatus(); status != EsmeRsyserr {
+		t.Errorf("Expected unroutable status ESME_RSYSERR, got (%s)", CommandStatusName(status))
+	}
+}
+
+func TestCreateDeliverSmFromSubmitSm(t *testing.T) {
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{
+		"service_type":           "CMT",
+		"source_addr":            "1000",
+		"destination_addr":       "2000",
+		"registered_delivery":    "1",
+		"validity_period":        "000000000010000R",
+		"short_message":          "routed",
+		"user_message_reference": "42",
+	})
+
+	encodedDeliverSm, err := createDeliverSmFromSubmitSm(submitSm).Encode()
+	if err != nil {
+		t.Fatalf("Expected no error encoding deliver-sm, got = (%s)", err)
+	}
+
+	deliverSm, err := decodePDU(encodedDeliverSm)
+	if err != nil {
+		t.Fatalf("Expected no error decoding deliver-sm, got = (%s)", err)
+	}
+
+	if deliverSm.CommandName() != "deliver-sm" || mandatoryStringParameter(deliverSm, 0) != "CMT" || mandatoryStringParameter(deliverSm, 3) != "1000" || mandatoryStringParameter(deliverSm, 6) != "2000" || ShortMessageText(deliverSm) != "routed" {
+		t.Errorf("Expected deliver-sm with the submit-sm addresses and short_message, got = (%v)", deliverSm)
+	}
+
+	if mandatoryStringParameter(deliverSm, 11) != "" {
+		t.Errorf("Expected empty validity_period in deliver-sm, got = (%s)", mandatoryStringParameter(deliverSm, 11))
+	}
+
+	if len(deliverSm.OptionalParameters) != 1 {
+		t.Errorf("Expected optional parameters to be copied to deliver-sm, got (%d)", len(deliverSm.OptionalParameters))
+	}
+}
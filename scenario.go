@@ -0,0 +1,638 @@
+package smppth
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blorticus/smpp"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ScenarioStepType is the type of a ScenarioStep
+type ScenarioStepType int
+
+const (
+	// ScenarioSend sends a PDU from an agent to one of its peers
+	ScenarioSend ScenarioStepType = iota
+	// ScenarioExpect waits for an AgentEvent that matches
+	ScenarioExpect
+	// ScenarioWait pauses for a fixed time
+	ScenarioWait
+	// ScenarioRepeat runs a sequence of steps a number of times
+	ScenarioRepeat
+	// ScenarioParallel runs several sequences of steps at the same time
+	ScenarioParallel
+	// ScenarioAssert checks the fields of an event matched by an earlier ScenarioExpect step, or a counter
+	ScenarioAssert
+)
+
+var scenarioStepTypeNames = map[ScenarioStepType]string{
+	ScenarioSend:     "send",
+	ScenarioExpect:   "expect",
+	ScenarioWait:     "wait",
+	ScenarioRepeat:   "repeat",
+	ScenarioParallel: "parallel",
+	ScenarioAssert:   "assert",
+}
+
+// String returns the name of the step type (e.g., "expect")
+func (stepType ScenarioStepType) String() string {
+	if name, isKnown := scenarioStepTypeNames[stepType]; isKnown {
+		return name
+	}
+
+	return fmt.Sprintf("ScenarioStepType(%d)", int(stepType))
+}
+
+// The counters that a ScenarioAssert step can check, which are taken from a MetricsSnapshot
+const (
+	ScenarioCounterPdusSent            = "pdus_sent"
+	ScenarioCounterPdusReceived        = "pdus_received"
+	ScenarioCounterErrorResponses      = "error_responses"
+	ScenarioCounterBinds               = "binds"
+	ScenarioCounterReconnects          = "reconnects"
+	ScenarioCounterOutstandingRequests = "outstanding_requests"
+)
+
+var scenarioCounterNames = []string{
+	ScenarioCounterPdusSent,
+	ScenarioCounterPdusReceived,
+	ScenarioCounterErrorResponses,
+	ScenarioCounterBinds,
+	ScenarioCounterReconnects,
+	ScenarioCounterOutstandingRequests,
+}
+
+// Scenario is a sequence of steps run by a ScenarioRunner against the agents in an AgentGroup.  Variables are the
+// initial values for the {name} templates in the steps.  DefaultTimeout is the timeout for a ScenarioExpect step
+// that does not set its own.
+type Scenario struct {
+	Name           string
+	DefaultTimeout time.Duration
+	Variables      map[string]string
+	Steps          []*ScenarioStep
+}
+
+// ScenarioStep is a single step in a Scenario.  Name is optional, and is used in reports (and, for a ScenarioExpect
+// step, to refer to the matched event in a ScenarioAssert step).  When Type is ScenarioSend, Details must be of type
+// SendPduDetails.  When Type is ScenarioExpect, Details must be of type ScenarioExpectDetails.  When Type is
+// ScenarioWait, Details must be of type ScenarioWaitDetails.  When Type is ScenarioRepeat, Details must be of type
+// ScenarioRepeatDetails.  When Type is ScenarioParallel, Details must be of type ScenarioParallelDetails.  When Type
+// is ScenarioAssert, Details must be of type ScenarioAssertDetails.
+type ScenarioStep struct {
+	Type    ScenarioStepType
+	Name    string
+	Details interface{}
+}
+
+// ScenarioExpectDetails describes the AgentEvent for which a ScenarioExpect step waits.  NameOfAgent and NameOfPeer
+// are ignored if they are empty, as are CommandID if it is zero and CommandStatus if it is nil.  FieldPatterns maps
+// a field name (e.g., message_id) to a regular expression that the field value must match.  Timeout is how long to
+// wait, or zero for the Scenario DefaultTimeout.  Captures maps a variable name to a field of the matched event,
+// whose value is assigned to the variable.
+type ScenarioExpectDetails struct {
+	NameOfAgent   string
+	NameOfPeer    string
+	EventType     AgentEventType
+	CommandID     smpp.CommandIDType
+	CommandStatus *uint32
+	FieldPatterns map[string]string
+	Timeout       time.Duration
+	Captures      map[string]string
+}
+
+// ScenarioWaitDetails is the time for which a ScenarioWait step pauses
+type ScenarioWaitDetails struct {
+	Duration time.Duration
+}
+
+// ScenarioRepeatDetails is the sequence of steps run by a ScenarioRepeat step, and the number of times to run it
+type ScenarioRepeatDetails struct {
+	Times int
+	Steps []*ScenarioStep
+}
+
+// ScenarioParallelDetails is the set of step sequences run at the same time by a ScenarioParallel step
+type ScenarioParallelDetails struct {
+	Branches [][]*ScenarioStep
+}
+
+// ScenarioAssertDetails describes what a ScenarioAssert step checks.  If Counter is nil, the step checks the event
+// matched by the ScenarioExpect step named NameOfExpectStep or, if that is empty, by the most recent ScenarioExpect
+// step in the same sequence.  FieldPatterns maps a field name to a regular expression that the field value must
+// match, and CommandStatus, if it is not nil, is the command_status that the event PDU must have.
+type ScenarioAssertDetails struct {
+	NameOfExpectStep string
+	FieldPatterns    map[string]string
+	CommandStatus    *uint32
+	Counter          *ScenarioCounterAssertion
+}
+
+// ScenarioCounterAssertion checks a counter (e.g., pdus_received), summed over the sessions of NameOfAgent and
+// NameOfPeer and, for the PDU counters, over the PDUs of type CommandName.  Each is ignored if it is empty.  The sum
+// must be at least Minimum (if it is not nil) and at most Maximum (if it is not nil).
+type ScenarioCounterAssertion struct {
+	Counter     string
+	NameOfAgent string
+	NameOfPeer  string
+	CommandName string
+	Minimum     *uint64
+	Maximum     *uint64
+}
+
+// String describes the step (e.g., "expect ReceivedPDU submit-sm-resp at esme01 from smsc01")
+func (step *ScenarioStep) String() string {
+	var description string
+
+	switch details := step.Details.(type) {
+	case *SendPduDetails:
+		description = fmt.Sprintf("send %s from %s to %s", smpp.CommandName(details.TypeOfSmppPDU), details.NameOfAgentThatWillSendPdu, details.NameOfPeerThatShouldReceivePdu)
+
+	case *ScenarioExpectDetails:
+		description = fmt.Sprintf("expect %s", details.EventType)
+		if details.CommandID != 0 {
+			description = fmt.Sprintf("%s %s", description, smpp.CommandName(details.CommandID))
+		}
+		if details.CommandStatus != nil {
+			description = fmt.Sprintf("%s status=%s", description, CommandStatusName(*details.CommandStatus))
+		}
+		if details.NameOfAgent != "" {
+			description = fmt.Sprintf("%s at %s", description, details.NameOfAgent)
+		}
+		if details.NameOfPeer != "" {
+			description = fmt.Sprintf("%s from %s", description, details.NameOfPeer)
+		}
+		description += describeScenarioFieldPatterns(details.FieldPatterns)
+
+	case *ScenarioWaitDetails:
+		description = fmt.Sprintf("wait %s", details.Duration)
+
+	case *ScenarioRepeatDetails:
+		description = fmt.Sprintf("repeat %d times", details.Times)
+
+	case *ScenarioParallelDetails:
+		description = fmt.Sprintf("parallel with %d branches", len(details.Branches))
+
+	case *ScenarioAssertDetails:
+		if counter := details.Counter; counter != nil {
+			description = fmt.Sprintf("assert %s", counter.Counter)
+			for _, filter := range []string{counter.NameOfAgent, counter.NameOfPeer, counter.CommandName} {
+				if filter != "" {
+					description = fmt.Sprintf("%s %s", description, filter)
+				}
+			}
+			if counter.Minimum != nil {
+				description = fmt.Sprintf("%s >= %d", description, *counter.Minimum)
+			}
+			if counter.Maximum != nil {
+				description = fmt.Sprintf("%s <= %d", description, *counter.Maximum)
+			}
+			break
+		}
+
+		description = "assert last matched event"
+		if details.NameOfExpectStep != "" {
+			description = fmt.Sprintf("assert event matched by %s", details.NameOfExpectStep)
+		}
+		if details.CommandStatus != nil {
+			description = fmt.Sprintf("%s status=%s", description, CommandStatusName(*details.CommandStatus))
+		}
+		description += describeScenarioFieldPatterns(details.FieldPatterns)
+
+	default:
+		description = step.Type.String()
+	}
+
+	if step.Name != "" {
+		return fmt.Sprintf("%s: %s", step.Name, description)
+	}
+
+	return description
+}
+
+func describeScenarioFieldPatterns(patterns map[string]string) string {
+	fields := make([]string, 0, len(patterns))
+	for field := range patterns {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	description := ""
+	for _, field := range fields {
+		description = fmt.Sprintf("%s %s=~%s", description, field, patterns[field])
+	}
+
+	return description
+}
+
+type scenarioYaml struct {
+	Name      string             `yaml:"Name"`
+	Timeout   string             `yaml:"Timeout"`
+	Variables map[string]string  `yaml:"Variables"`
+	Steps     []scenarioStepYaml `yaml:"Steps"`
+}
+
+type scenarioStepYaml struct {
+	Name     string               `yaml:"Name"`
+	Send     *scenarioSendYaml    `yaml:"Send"`
+	Expect   *scenarioExpectYaml  `yaml:"Expect"`
+	Wait     string               `yaml:"Wait"`
+	Repeat   *scenarioRepeatYaml  `yaml:"Repeat"`
+	Parallel []scenarioBranchYaml `yaml:"Parallel"`
+	Assert   *scenarioAssertYaml  `yaml:"Assert"`
+}
+
+type scenarioSendYaml struct {
+	Agent      string            `yaml:"Agent"`
+	Peer       string            `yaml:"Peer"`
+	Command    string            `yaml:"Command"`
+	Parameters map[string]string `yaml:"Parameters"`
+}
+
+type scenarioExpectYaml struct {
+	Agent   string            `yaml:"Agent"`
+	Peer    string            `yaml:"Peer"`
+	Event   string            `yaml:"Event"`
+	Command string            `yaml:"Command"`
+	Status  string            `yaml:"Status"`
+	Match   map[string]string `yaml:"Match"`
+	Timeout string            `yaml:"Timeout"`
+	Capture map[string]string `yaml:"Capture"`
+}
+
+type scenarioRepeatYaml struct {
+	Times int                `yaml:"Times"`
+	Steps []scenarioStepYaml `yaml:"Steps"`
+}
+
+type scenarioBranchYaml struct {
+	Steps []scenarioStepYaml `yaml:"Steps"`
+}
+
+type scenarioAssertYaml struct {
+	Event   string               `yaml:"Event"`
+	Status  string               `yaml:"Status"`
+	Fields  map[string]string    `yaml:"Fields"`
+	Counter *scenarioCounterYaml `yaml:"Counter"`
+}
+
+type scenarioCounterYaml struct {
+	Name    string  `yaml:"Name"`
+	Agent   string  `yaml:"Agent"`
+	Peer    string  `yaml:"Peer"`
+	Command string  `yaml:"Command"`
+	Equals  *uint64 `yaml:"Equals"`
+	AtLeast *uint64 `yaml:"AtLeast"`
+	AtMost  *uint64 `yaml:"AtMost"`
+}
+
+// ReadScenarioFromYamlFile opens a file and treats its contents as a scenario YAML document.  See
+// ReadScenarioFromYaml.
+func ReadScenarioFromYamlFile(fileName string) (*Scenario, error) {
+	yamlFileHandle, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer yamlFileHandle.Close()
+
+	return ReadScenarioFromYaml(yamlFileHandle)
+}
+
+// ReadScenarioFromYaml reads a scenario YAML document.  It has a Name, an optional Timeout (a Go duration, by
+// default 5s) for Expect steps, optional Variables (a map of name to initial value) and a list of Steps.  Each step
+// has an optional Name and exactly one of:
+//   - Send, with the Agent that sends, the Peer to which it sends, the Command (e.g., submit-sm) and a map of
+//     Parameters, as accepted by the text send command;
+//   - Expect, with an optional Agent, Peer, Event (an AgentEventType, by default ReceivedPDU), Command, Status,
+//     Match (a map of field name to regular expression), Timeout and Capture (a map of variable name to field name);
+//   - Wait, a Go duration;
+//   - Repeat, with the number of Times to run its Steps;
+//   - Parallel, a list of branches, each with Steps, that run at the same time;
+//   - Assert, with either the Fields (a map of field name to regular expression) and Status that the event matched
+//     by the Expect step named Event (or, by default, by the most recent Expect step) must have, or a Counter with
+//     its Name (pdus_sent, pdus_received, error_responses, binds, reconnects or outstanding_requests), optional Agent,
+//     Peer and Command, and Equals, AtLeast or AtMost.
+//
+// In the Send Parameters, and in the Match and Fields regular expressions, {name} is replaced by the value of the
+// variable name, if there is one.  {iteration} is the iteration (from 1) of the innermost Repeat, and
+// {sequence_number} is the sequence_number of the most recent PDU sent in the same sequence of steps.
+func ReadScenarioFromYaml(reader io.Reader) (*Scenario, error) {
+	var definition scenarioYaml
+	if err := yaml.NewDecoder(reader).Decode(&definition); err != nil {
+		return nil, err
+	}
+
+	scenario := &Scenario{
+		Name:           definition.Name,
+		DefaultTimeout: 5 * time.Second,
+		Variables:      make(map[string]string),
+	}
+
+	if definition.Timeout != "" {
+		timeout, err := time.ParseDuration(definition.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid Timeout [%s] for scenario", definition.Timeout)
+		}
+		scenario.DefaultTimeout = timeout
+	}
+
+	for name, value := range definition.Variables {
+		scenario.Variables[name] = value
+	}
+
+	steps, err := scenarioStepsFromYaml(definition.Steps, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("Scenario [%s] has no Steps", definition.Name)
+	}
+
+	scenario.Steps = steps
+
+	return scenario, nil
+}
+
+func scenarioStepsFromYaml(definitions []scenarioStepYaml, positionOfParent string) ([]*ScenarioStep, error) {
+	steps := make([]*ScenarioStep, 0, len(definitions))
+
+	for i, definition := range definitions {
+		position := fmt.Sprintf("%s%d", positionOfParent, i+1)
+
+		step, err := scenarioStepFromYaml(&definition, position)
+		if err != nil {
+			nameOfStep := position
+			if definition.Name != "" {
+				nameOfStep = fmt.Sprintf("%s (%s)", position, definition.Name)
+			}
+
+			return nil, fmt.Errorf("Invalid Step [%s]: %s", nameOfStep, err)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+func scenarioStepFromYaml(definition *scenarioStepYaml, position string) (*ScenarioStep, error) {
+	numberOfActions := 0
+	for _, actionIsSet := range []bool{definition.Send != nil, definition.Expect != nil, definition.Wait != "", definition.Repeat != nil, definition.Parallel != nil, definition.Assert != nil} {
+		if actionIsSet {
+			numberOfActions++
+		}
+	}
+
+	if numberOfActions != 1 {
+		return nil, fmt.Errorf("must have exactly one of Send, Expect, Wait, Repeat, Parallel or Assert")
+	}
+
+	step := &ScenarioStep{Name: definition.Name}
+
+	switch {
+	case definition.Send != nil:
+		commandID, isKnownCommand := smpp.CommandIDFromString(definition.Send.Command)
+		if !isKnownCommand {
+			return nil, fmt.Errorf("Command (%s) is not a known smpp PDU type name", definition.Send.Command)
+		}
+
+		if definition.Send.Agent == "" || definition.Send.Peer == "" {
+			return nil, fmt.Errorf("Send must have an Agent and a Peer")
+		}
+
+		parameters := make(map[string]string)
+		for name, value := range definition.Send.Parameters {
+			parameters[name] = value
+		}
+
+		step.Type = ScenarioSend
+		step.Details = &SendPduDetails{
+			NameOfAgentThatWillSendPdu:     definition.Send.Agent,
+			NameOfPeerThatShouldReceivePdu: definition.Send.Peer,
+			TypeOfSmppPDU:                  commandID,
+			StringParametersMap:            parameters,
+		}
+
+	case definition.Expect != nil:
+		details, err := scenarioExpectDetailsFromYaml(definition.Expect)
+		if err != nil {
+			return nil, err
+		}
+
+		step.Type = ScenarioExpect
+		step.Details = details
+
+	case definition.Wait != "":
+		duration, err := time.ParseDuration(definition.Wait)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("Wait (%s) is not a valid duration", definition.Wait)
+		}
+
+		step.Type = ScenarioWait
+		step.Details = &ScenarioWaitDetails{Duration: duration}
+
+	case definition.Repeat != nil:
+		if definition.Repeat.Times < 1 {
+			return nil, fmt.Errorf("Repeat must have Times of at least 1")
+		}
+
+		steps, err := scenarioStepsFromYaml(definition.Repeat.Steps, position+".")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("Repeat has no Steps")
+		}
+
+		step.Type = ScenarioRepeat
+		step.Details = &ScenarioRepeatDetails{Times: definition.Repeat.Times, Steps: steps}
+
+	case definition.Parallel != nil:
+		if len(definition.Parallel) == 0 {
+			return nil, fmt.Errorf("Parallel has no branches")
+		}
+
+		branches := make([][]*ScenarioStep, 0, len(definition.Parallel))
+
+		for i, branchDefinition := range definition.Parallel {
+			steps, err := scenarioStepsFromYaml(branchDefinition.Steps, fmt.Sprintf("%s.%d.", position, i+1))
+			if err != nil {
+				return nil, err
+			}
+
+			if len(steps) == 0 {
+				return nil, fmt.Errorf("Parallel branch %d has no Steps", i+1)
+			}
+
+			branches = append(branches, steps)
+		}
+
+		step.Type = ScenarioParallel
+		step.Details = &ScenarioParallelDetails{Branches: branches}
+
+	case definition.Assert != nil:
+		details, err := scenarioAssertDetailsFromYaml(definition.Assert)
+		if err != nil {
+			return nil, err
+		}
+
+		step.Type = ScenarioAssert
+		step.Details = details
+	}
+
+	return step, nil
+}
+
+func scenarioExpectDetailsFromYaml(definition *scenarioExpectYaml) (*ScenarioExpectDetails, error) {
+	details := &ScenarioExpectDetails{
+		NameOfAgent:   definition.Agent,
+		NameOfPeer:    definition.Peer,
+		EventType:     ReceivedPDU,
+		FieldPatterns: make(map[string]string),
+		Captures:      make(map[string]string),
+	}
+
+	if definition.Event != "" {
+		eventType, err := AgentEventTypeFromString(definition.Event)
+		if err != nil {
+			return nil, err
+		}
+		details.EventType = eventType
+	}
+
+	if definition.Command != "" {
+		commandID, isKnownCommand := smpp.CommandIDFromString(definition.Command)
+		if !isKnownCommand {
+			return nil, fmt.Errorf("Command (%s) is not a known smpp PDU type name", definition.Command)
+		}
+		details.CommandID = commandID
+	}
+
+	if definition.Status != "" {
+		commandStatus, err := CommandStatusFromString(definition.Status)
+		if err != nil {
+			return nil, err
+		}
+		details.CommandStatus = &commandStatus
+	}
+
+	if definition.Timeout != "" {
+		timeout, err := time.ParseDuration(definition.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Timeout (%s) is not a valid duration", definition.Timeout)
+		}
+		details.Timeout = timeout
+	}
+
+	if err := copyScenarioFieldPatterns(details.FieldPatterns, definition.Match); err != nil {
+		return nil, err
+	}
+
+	for variable, field := range definition.Capture {
+		details.Captures[variable] = field
+	}
+
+	return details, nil
+}
+
+func scenarioAssertDetailsFromYaml(definition *scenarioAssertYaml) (*ScenarioAssertDetails, error) {
+	details := &ScenarioAssertDetails{
+		NameOfExpectStep: definition.Event,
+		FieldPatterns:    make(map[string]string),
+	}
+
+	if definition.Counter != nil {
+		if definition.Event != "" || definition.Status != "" || len(definition.Fields) > 0 {
+			return nil, fmt.Errorf("Assert must have either a Counter, or an Event, Status and Fields, but not both")
+		}
+
+		counter, err := scenarioCounterAssertionFromYaml(definition.Counter)
+		if err != nil {
+			return nil, err
+		}
+
+		details.Counter = counter
+		return details, nil
+	}
+
+	if definition.Status == "" && len(definition.Fields) == 0 {
+		return nil, fmt.Errorf("Assert must have a Counter, a Status or Fields")
+	}
+
+	if definition.Status != "" {
+		commandStatus, err := CommandStatusFromString(definition.Status)
+		if err != nil {
+			return nil, err
+		}
+		details.CommandStatus = &commandStatus
+	}
+
+	if err := copyScenarioFieldPatterns(details.FieldPatterns, definition.Fields); err != nil {
+		return nil, err
+	}
+
+	return details, nil
+}
+
+func scenarioCounterAssertionFromYaml(definition *scenarioCounterYaml) (*ScenarioCounterAssertion, error) {
+	counterIsKnown := false
+	for _, name := range scenarioCounterNames {
+		if definition.Name == name {
+			counterIsKnown = true
+		}
+	}
+
+	if !counterIsKnown {
+		return nil, fmt.Errorf("Counter Name (%s) must be one of %s", definition.Name, strings.Join(scenarioCounterNames, ", "))
+	}
+
+	assertion := &ScenarioCounterAssertion{
+		Counter:     definition.Name,
+		NameOfAgent: definition.Agent,
+		NameOfPeer:  definition.Peer,
+		Minimum:     definition.AtLeast,
+		Maximum:     definition.AtMost,
+	}
+
+	if definition.Command != "" {
+		commandID, isKnownCommand := smpp.CommandIDFromString(definition.Command)
+		if !isKnownCommand {
+			return nil, fmt.Errorf("Command (%s) is not a known smpp PDU type name", definition.Command)
+		}
+		assertion.CommandName = smpp.CommandName(commandID)
+	}
+
+	if definition.Equals != nil {
+		if definition.AtLeast != nil || definition.AtMost != nil {
+			return nil, fmt.Errorf("Counter must have either Equals, or AtLeast and AtMost, but not both")
+		}
+
+		assertion.Minimum, assertion.Maximum = definition.Equals, definition.Equals
+	}
+
+	if assertion.Minimum == nil && assertion.Maximum == nil {
+		return nil, fmt.Errorf("Counter must have Equals, AtLeast or AtMost")
+	}
+
+	return assertion, nil
+}
+
+// copyScenarioFieldPatterns copies field patterns from a definition, making sure that each is a valid regular
+// expression before its {name} templates are replaced
+func copyScenarioFieldPatterns(patterns map[string]string, definition map[string]string) error {
+	for field, pattern := range definition {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("pattern for field (%s) is not a valid regular expression: %s", field, err)
+		}
+		patterns[field] = pattern
+	}
+
+	return nil
+}
@@ -0,0 +1,740 @@
+package smppth
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// ScenarioStepResult is the outcome of running a ScenarioStep.  Iteration is the iteration of the innermost
+// ScenarioRepeat step (from 1), or 0 if the step is not repeated, and Branch is the branch of the innermost
+// ScenarioParallel step (from 1), or 0 if the step is not in one.  Failure explains why the step did not pass.
+// SentPDUs are the PDUs sent by a ScenarioSend step, and MatchedEvent is the event matched by a ScenarioExpect step
+// or checked by a ScenarioAssert step.  ObservedEvents are all of the AgentEvents that arrived while the step ran.
+// StepResults are the results of the steps run by a ScenarioRepeat or ScenarioParallel step.
+type ScenarioStepResult struct {
+	Step           *ScenarioStep
+	Iteration      int
+	Branch         int
+	Passed         bool
+	Failure        string
+	StartedAt      time.Time
+	Duration       time.Duration
+	SentPDUs       []*smpp.PDU
+	MatchedEvent   *AgentEvent
+	ObservedEvents []*AgentEvent
+	StepResults    []*ScenarioStepResult
+}
+
+// ScenarioReport is the result of running a Scenario, with a ScenarioStepResult for each step that ran.  A sequence
+// of steps stops at the first step that fails, so the steps after it have no result.
+type ScenarioReport struct {
+	NameOfScenario string
+	StartedAt      time.Time
+	Duration       time.Duration
+	StepResults    []*ScenarioStepResult
+}
+
+// Passed returns true if every step in the scenario ran and passed
+func (report *ScenarioReport) Passed() bool {
+	for _, result := range report.StepResults {
+		if !result.Passed {
+			return false
+		}
+	}
+
+	return len(report.StepResults) > 0
+}
+
+// NumberOfSteps returns the number of steps that ran, not counting ScenarioRepeat and ScenarioParallel steps
+// themselves, but counting each step that they ran
+func (report *ScenarioReport) NumberOfSteps() int {
+	return countScenarioStepResults(report.StepResults, func(*ScenarioStepResult) bool { return true })
+}
+
+// NumberOfFailedSteps returns the number of steps that failed, counted as for NumberOfSteps()
+func (report *ScenarioReport) NumberOfFailedSteps() int {
+	return countScenarioStepResults(report.StepResults, func(result *ScenarioStepResult) bool { return !result.Passed })
+}
+
+func countScenarioStepResults(results []*ScenarioStepResult, shouldCount func(*ScenarioStepResult) bool) int {
+	count := 0
+
+	for _, result := range results {
+		switch result.Step.Type {
+		case ScenarioRepeat, ScenarioParallel:
+			count += countScenarioStepResults(result.StepResults, shouldCount)
+		default:
+			if shouldCount(result) {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// ScenarioRunner runs a Scenario against the agents in an AgentGroup.  PDUs are generated by a PduFactory, exactly
+// as they are for the text send command.  Counters are read from a MetricsCollector which, by default, is a new one
+// for each run that observes only the events that arrive during the run.
+type ScenarioRunner struct {
+	agentGroup       *AgentGroup
+	pduFactory       PduFactory
+	metricsCollector *MetricsCollector
+}
+
+// NewScenarioRunner creates a runner for scenarios against the agents in the AgentGroup.  Generally, the AgentGroup
+// is built from the agents returned by ApplicationConfigYamlReader.ParseFile().
+func NewScenarioRunner(group *AgentGroup) *ScenarioRunner {
+	return &ScenarioRunner{
+		agentGroup: group,
+		pduFactory: NewDefaultPduFactory(),
+	}
+}
+
+// SetPduFactory sets the PduFactory used to generate the PDUs for ScenarioSend steps
+func (runner *ScenarioRunner) SetPduFactory(factory PduFactory) *ScenarioRunner {
+	runner.pduFactory = factory
+	return runner
+}
+
+// SetMetricsCollector sets the MetricsCollector from which counters are read for ScenarioAssert steps (e.g., the
+// collector of a StandardApplication).  The runner does not feed it, so it must be fed elsewhere, and its counters
+// include the events from before the run.
+func (runner *ScenarioRunner) SetMetricsCollector(collector *MetricsCollector) *ScenarioRunner {
+	runner.metricsCollector = collector
+	return runner
+}
+
+// Run runs the scenario, and returns a report with the result of each step.  agentEventChannel must deliver the
+// events generated by the agents (e.g., the channel proxied by a StandardApplication, which also answers the requests
+// that the scenario sends).  The agents must already be started.  Events that arrive before the run starts are not
+// observed.
+func (runner *ScenarioRunner) Run(scenario *Scenario, agentEventChannel <-chan *AgentEvent) *ScenarioReport {
+	run := &scenarioRun{
+		runner:                  runner,
+		scenario:                scenario,
+		events:                  newScenarioEventLog(),
+		metricsCollector:        runner.metricsCollector,
+		variables:               make(map[string]string),
+		eventsMatchedByStepName: make(map[string]*AgentEvent),
+	}
+
+	feedMetricsCollector := run.metricsCollector == nil
+	if feedMetricsCollector {
+		run.metricsCollector = NewMetricsCollector()
+	}
+
+	for name, value := range scenario.Variables {
+		run.variables[name] = value
+	}
+
+	stopListeningChannel := make(chan bool)
+	defer close(stopListeningChannel)
+
+	go func() {
+		for {
+			select {
+			case event, channelIsOpen := <-agentEventChannel:
+				if !channelIsOpen {
+					return
+				}
+				if event == nil {
+					continue
+				}
+				if feedMetricsCollector {
+					run.metricsCollector.ObserveAgentEvent(event)
+				}
+				run.events.add(event)
+			case <-stopListeningChannel:
+				return
+			}
+		}
+	}()
+
+	report := &ScenarioReport{NameOfScenario: scenario.Name, StartedAt: time.Now()}
+	report.StepResults = run.runSequence(scenario.Steps, &scenarioSequence{})
+	report.Duration = time.Since(report.StartedAt)
+
+	return report
+}
+
+// scenarioEventLog holds every event observed during a run.  A ScenarioExpect step consumes the event that it
+// matches, so that the same event cannot satisfy two steps.  arrival is closed (and replaced) when an event is added.
+type scenarioEventLog struct {
+	lock     sync.Mutex
+	events   []*AgentEvent
+	consumed []bool
+	arrival  chan bool
+}
+
+func newScenarioEventLog() *scenarioEventLog {
+	return &scenarioEventLog{
+		events:   make([]*AgentEvent, 0),
+		consumed: make([]bool, 0),
+		arrival:  make(chan bool),
+	}
+}
+
+func (log *scenarioEventLog) add(event *AgentEvent) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	log.events = append(log.events, event)
+	log.consumed = append(log.consumed, false)
+
+	close(log.arrival)
+	log.arrival = make(chan bool)
+}
+
+func (log *scenarioEventLog) length() int {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return len(log.events)
+}
+
+func (log *scenarioEventLog) eventsSince(index int) []*AgentEvent {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return append([]*AgentEvent{}, log.events[index:]...)
+}
+
+// takeFirstMatching consumes and returns the earliest event that has not been consumed and that matches.  If there
+// is none, it returns nil and a channel that is closed when the next event arrives.
+func (log *scenarioEventLog) takeFirstMatching(matches func(*AgentEvent) bool) (*AgentEvent, <-chan bool) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	for i, event := range log.events {
+		if !log.consumed[i] && matches(event) {
+			log.consumed[i] = true
+			return event, nil
+		}
+	}
+
+	return nil, log.arrival
+}
+
+// scenarioRun is the state shared by all of the steps in a single run of a Scenario
+type scenarioRun struct {
+	runner                  *ScenarioRunner
+	scenario                *Scenario
+	events                  *scenarioEventLog
+	metricsCollector        *MetricsCollector
+	lock                    sync.Mutex
+	variables               map[string]string
+	eventsMatchedByStepName map[string]*AgentEvent
+}
+
+// scenarioSequence is the state of a single sequence of steps (the scenario itself, or a branch of a
+// ScenarioParallel step)
+type scenarioSequence struct {
+	iteration        int
+	branch           int
+	sequenceNumber   string
+	lastMatchedEvent *AgentEvent
+}
+
+var scenarioTemplateMatcher = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandTemplate replaces each {name} in the template with the value of the variable name, if there is one.  If
+// valuesAreLiteral is true (because the template is a regular expression), the values are quoted.
+func (run *scenarioRun) expandTemplate(template string, sequence *scenarioSequence, valuesAreLiteral bool) string {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+
+	return scenarioTemplateMatcher.ReplaceAllStringFunc(template, func(reference string) string {
+		name := reference[1 : len(reference)-1]
+
+		value, isKnown := run.variables[name]
+		switch {
+		case name == "iteration":
+			value, isKnown = strconv.Itoa(sequence.iteration), true
+			if sequence.iteration == 0 {
+				value = "1"
+			}
+		case name == "sequence_number" && sequence.sequenceNumber != "":
+			value, isKnown = sequence.sequenceNumber, true
+		}
+
+		if !isKnown {
+			return reference
+		}
+
+		if valuesAreLiteral {
+			return regexp.QuoteMeta(value)
+		}
+
+		return value
+	})
+}
+
+func (run *scenarioRun) runSequence(steps []*ScenarioStep, sequence *scenarioSequence) []*ScenarioStepResult {
+	results := make([]*ScenarioStepResult, 0, len(steps))
+
+	for _, step := range steps {
+		result := run.runStep(step, sequence)
+		results = append(results, result)
+
+		if !result.Passed {
+			break
+		}
+	}
+
+	return results
+}
+
+func (run *scenarioRun) runStep(step *ScenarioStep, sequence *scenarioSequence) *ScenarioStepResult {
+	result := &ScenarioStepResult{
+		Step:      step,
+		Iteration: sequence.iteration,
+		Branch:    sequence.branch,
+		StartedAt: time.Now(),
+	}
+
+	indexOfFirstObservedEvent := run.events.length()
+
+	switch details := step.Details.(type) {
+	case *SendPduDetails:
+		run.send(details, sequence, result)
+
+	case *ScenarioExpectDetails:
+		run.expect(step, details, sequence, result)
+
+	case *ScenarioWaitDetails:
+		time.Sleep(details.Duration)
+		result.Passed = true
+
+	case *ScenarioRepeatDetails:
+		run.repeat(details, sequence, result)
+
+	case *ScenarioParallelDetails:
+		run.runBranches(details, sequence, result)
+
+	case *ScenarioAssertDetails:
+		run.assert(details, sequence, result)
+
+	default:
+		result.Failure = fmt.Sprintf("step details of type %T are not supported", step.Details)
+	}
+
+	result.Duration = time.Since(result.StartedAt)
+	result.ObservedEvents = run.events.eventsSince(indexOfFirstObservedEvent)
+
+	return result
+}
+
+func (run *scenarioRun) send(details *SendPduDetails, sequence *scenarioSequence, result *ScenarioStepResult) {
+	parameters := make(map[string]string)
+	for name, value := range details.StringParametersMap {
+		parameters[name] = run.expandTemplate(value, sequence, false)
+	}
+
+	pdus, err := tryToGeneratePDUsFromUserCommandDetails(run.runner.pduFactory, &SendPduDetails{
+		NameOfAgentThatWillSendPdu:     details.NameOfAgentThatWillSendPdu,
+		NameOfPeerThatShouldReceivePdu: details.NameOfPeerThatShouldReceivePdu,
+		TypeOfSmppPDU:                  details.TypeOfSmppPDU,
+		StringParametersMap:            parameters,
+	})
+
+	if err != nil {
+		result.Failure = fmt.Sprintf("unable to generate %s: %s", smpp.CommandName(details.TypeOfSmppPDU), err)
+		return
+	}
+
+	for _, pdu := range pdus {
+		if err := run.runner.agentGroup.RoutePduToAgentForSending(details.NameOfAgentThatWillSendPdu, details.NameOfPeerThatShouldReceivePdu, pdu); err != nil {
+			result.Failure = fmt.Sprintf("unable to send %s: %s", pdu.CommandName(), err)
+			return
+		}
+
+		result.SentPDUs = append(result.SentPDUs, pdu)
+		sequence.sequenceNumber = strconv.FormatUint(uint64(pdu.SequenceNumber), 10)
+	}
+
+	result.Passed = true
+}
+
+func (run *scenarioRun) expect(step *ScenarioStep, details *ScenarioExpectDetails, sequence *scenarioSequence, result *ScenarioStepResult) {
+	fieldPatterns, err := run.compileFieldPatterns(details.FieldPatterns, sequence)
+	if err != nil {
+		result.Failure = err.Error()
+		return
+	}
+
+	timeout := details.Timeout
+	if timeout == 0 {
+		timeout = run.scenario.DefaultTimeout
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		event, arrival := run.events.takeFirstMatching(func(event *AgentEvent) bool {
+			return scenarioEventMatchesExpectation(event, details, fieldPatterns)
+		})
+
+		if event != nil {
+			result.MatchedEvent = event
+			sequence.lastMatchedEvent = event
+			break
+		}
+
+		select {
+		case <-arrival:
+		case <-deadline.C:
+			result.Failure = fmt.Sprintf("no matching event within %s", timeout)
+			return
+		}
+	}
+
+	run.lock.Lock()
+	defer run.lock.Unlock()
+
+	if step.Name != "" {
+		run.eventsMatchedByStepName[step.Name] = result.MatchedEvent
+	}
+
+	for variable, field := range details.Captures {
+		value, fieldIsSet := scenarioEventFieldValue(result.MatchedEvent, field)
+		if !fieldIsSet {
+			result.Failure = fmt.Sprintf("matched event has no field (%s) to capture in (%s)", field, variable)
+			return
+		}
+
+		run.variables[variable] = value
+	}
+
+	result.Passed = true
+}
+
+func (run *scenarioRun) repeat(details *ScenarioRepeatDetails, sequence *scenarioSequence, result *ScenarioStepResult) {
+	// a scenario built in code, rather than read from YAML, may have a repeat with no steps
+	if len(details.Steps) == 0 {
+		result.Failure = "repeat has no steps"
+		return
+	}
+
+	iterationOfParent := sequence.iteration
+	defer func() { sequence.iteration = iterationOfParent }()
+
+	for iteration := 1; iteration <= details.Times; iteration++ {
+		sequence.iteration = iteration
+
+		iterationResults := run.runSequence(details.Steps, sequence)
+		result.StepResults = append(result.StepResults, iterationResults...)
+
+		if !iterationResults[len(iterationResults)-1].Passed {
+			result.Failure = fmt.Sprintf("iteration %d failed", iteration)
+			return
+		}
+	}
+
+	result.Passed = true
+}
+
+func (run *scenarioRun) runBranches(details *ScenarioParallelDetails, sequence *scenarioSequence, result *ScenarioStepResult) {
+	// a scenario built in code, rather than read from YAML, may have a parallel step with no branches, or a branch
+	// with no steps
+	if len(details.Branches) == 0 {
+		result.Failure = "parallel has no branches"
+		return
+	}
+
+	for i, steps := range details.Branches {
+		if len(steps) == 0 {
+			result.Failure = fmt.Sprintf("branch %d has no steps", i+1)
+			return
+		}
+	}
+
+	resultsByBranch := make([][]*ScenarioStepResult, len(details.Branches))
+
+	var waitGroup sync.WaitGroup
+	for i, steps := range details.Branches {
+		waitGroup.Add(1)
+
+		branchSequence := &scenarioSequence{
+			iteration:        sequence.iteration,
+			branch:           i + 1,
+			sequenceNumber:   sequence.sequenceNumber,
+			lastMatchedEvent: sequence.lastMatchedEvent,
+		}
+
+		go func(i int, steps []*ScenarioStep) {
+			defer waitGroup.Done()
+			resultsByBranch[i] = run.runSequence(steps, branchSequence)
+		}(i, steps)
+	}
+
+	waitGroup.Wait()
+
+	failedBranches := make([]string, 0)
+	for i, branchResults := range resultsByBranch {
+		result.StepResults = append(result.StepResults, branchResults...)
+
+		if !branchResults[len(branchResults)-1].Passed {
+			failedBranches = append(failedBranches, strconv.Itoa(i+1))
+		}
+	}
+
+	if len(failedBranches) > 0 {
+		result.Failure = fmt.Sprintf("branches failed: %s", strings.Join(failedBranches, ", "))
+		return
+	}
+
+	result.Passed = true
+}
+
+func (run *scenarioRun) assert(details *ScenarioAssertDetails, sequence *scenarioSequence, result *ScenarioStepResult) {
+	if details.Counter != nil {
+		value := scenarioCounterValue(run.metricsCollector.Snapshot(), details.Counter)
+
+		switch {
+		case details.Counter.Minimum != nil && value < *details.Counter.Minimum:
+			result.Failure = fmt.Sprintf("%s is %d, expected at least %d", details.Counter.Counter, value, *details.Counter.Minimum)
+		case details.Counter.Maximum != nil && value > *details.Counter.Maximum:
+			result.Failure = fmt.Sprintf("%s is %d, expected at most %d", details.Counter.Counter, value, *details.Counter.Maximum)
+		default:
+			result.Passed = true
+		}
+
+		return
+	}
+
+	event := sequence.lastMatchedEvent
+	if details.NameOfExpectStep != "" {
+		run.lock.Lock()
+		event = run.eventsMatchedByStepName[details.NameOfExpectStep]
+		run.lock.Unlock()
+	}
+
+	if event == nil {
+		result.Failure = "no event has been matched by an expect step"
+		if details.NameOfExpectStep != "" {
+			result.Failure = fmt.Sprintf("no event has been matched by the expect step (%s)", details.NameOfExpectStep)
+		}
+		return
+	}
+
+	result.MatchedEvent = event
+
+	fieldPatterns, err := run.compileFieldPatterns(details.FieldPatterns, sequence)
+	if err != nil {
+		result.Failure = err.Error()
+		return
+	}
+
+	failures := make([]string, 0)
+
+	if details.CommandStatus != nil && (event.SmppPDU == nil || event.SmppPDU.CommandStatus != *details.CommandStatus) {
+		actualStatus := "none"
+		if event.SmppPDU != nil {
+			actualStatus = CommandStatusName(event.SmppPDU.CommandStatus)
+		}
+		failures = append(failures, fmt.Sprintf("command_status is (%s), expected (%s)", actualStatus, CommandStatusName(*details.CommandStatus)))
+	}
+
+	for field, pattern := range fieldPatterns {
+		value, fieldIsSet := scenarioEventFieldValue(event, field)
+		if !fieldIsSet {
+			failures = append(failures, fmt.Sprintf("%s is not set", field))
+		} else if !pattern.MatchString(value) {
+			failures = append(failures, fmt.Sprintf("%s is (%s), expected a match for (%s)", field, value, pattern))
+		}
+	}
+
+	if len(failures) > 0 {
+		result.Failure = strings.Join(failures, "; ")
+		return
+	}
+
+	result.Passed = true
+}
+
+func (run *scenarioRun) compileFieldPatterns(templates map[string]string, sequence *scenarioSequence) (map[string]*regexp.Regexp, error) {
+	patterns := make(map[string]*regexp.Regexp)
+
+	for field, template := range templates {
+		pattern, err := regexp.Compile(run.expandTemplate(template, sequence, true))
+		if err != nil {
+			return nil, fmt.Errorf("pattern for field (%s) is not a valid regular expression: %s", field, err)
+		}
+		patterns[field] = pattern
+	}
+
+	return patterns, nil
+}
+
+func scenarioEventMatchesExpectation(event *AgentEvent, details *ScenarioExpectDetails, fieldPatterns map[string]*regexp.Regexp) bool {
+	if event.Type != details.EventType {
+		return false
+	}
+
+	if details.NameOfAgent != "" && (event.SourceAgent == nil || event.SourceAgent.Name() != details.NameOfAgent) {
+		return false
+	}
+
+	if details.NameOfPeer != "" && event.RemotePeerName != details.NameOfPeer {
+		return false
+	}
+
+	if details.CommandID != 0 && (event.SmppPDU == nil || event.SmppPDU.CommandID != details.CommandID) {
+		return false
+	}
+
+	if details.CommandStatus != nil && (event.SmppPDU == nil || event.SmppPDU.CommandStatus != *details.CommandStatus) {
+		return false
+	}
+
+	for field, pattern := range fieldPatterns {
+		value, fieldIsSet := scenarioEventFieldValue(event, field)
+		if !fieldIsSet || !pattern.MatchString(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scenarioEventFieldValue returns the value of a field of an event, for matching, assertions and captures.  The
+// fields are agent, peer, event and error; command, command_status and sequence_number for the event PDU; the
+// fields that a ResponseRule can match for submit-sm, deliver-sm and data-sm; message_id for the PDUs that carry
+// one; final_date, message_state and error_code for query-sm-resp; and any optional parameter, by name.  A
+// message_state, mandatory or optional, is named (e.g., DELIVERED).
+func scenarioEventFieldValue(event *AgentEvent, field string) (string, bool) {
+	switch field {
+	case "agent":
+		if event.SourceAgent == nil {
+			return "", false
+		}
+		return event.SourceAgent.Name(), true
+	case "peer":
+		return event.RemotePeerName, true
+	case "event":
+		return event.Type.String(), true
+	case "error":
+		if event.Error == nil {
+			return "", false
+		}
+		return event.Error.Error(), true
+	}
+
+	pdu := event.SmppPDU
+	if pdu == nil {
+		return "", false
+	}
+
+	switch field {
+	case "command":
+		return pdu.CommandName(), true
+	case "command_status":
+		return CommandStatusName(pdu.CommandStatus), true
+	case "sequence_number":
+		return strconv.FormatUint(uint64(pdu.SequenceNumber), 10), true
+	}
+
+	if value, fieldIsSet := responseRuleFieldValue(pdu, field); fieldIsSet {
+		return value, true
+	}
+
+	indexOfField := -1
+	switch pdu.CommandID {
+	case smpp.CommandSubmitSmResp, smpp.CommandDataSmResp, smpp.CommandSubmitMultiResp, smpp.CommandQuerySm, smpp.CommandReplaceSm:
+		if field == "message_id" {
+			indexOfField = 0
+		}
+	case smpp.CommandCancelSm:
+		if field == "message_id" {
+			indexOfField = 1
+		}
+	case smpp.CommandQuerySmResp:
+		switch field {
+		case "message_id", "final_date", "error_code":
+			indexOfField = map[string]int{"message_id": 0, "final_date": 1, "error_code": 3}[field]
+		case "message_state":
+			if len(pdu.MandatoryParameters) > 2 {
+				return MessageState(pdu.MandatoryParameters[2].Value.(uint8)).String(), true
+			}
+		}
+	}
+
+	if indexOfField >= 0 && indexOfField < len(pdu.MandatoryParameters) {
+		return fmt.Sprint(pdu.MandatoryParameters[indexOfField].Value), true
+	}
+
+	for _, parameter := range pdu.OptionalParameters {
+		if tlv, isTlv := parameter.Value.(smpp.TLV); isTlv && TlvName(tlv.Tag) == field {
+			if tlv.Tag == tlvTagMessageState {
+				return MessageState(tlvValueAsUint(&tlv)).String(), true
+			}
+			return describeTlvValue(&tlv), true
+		}
+	}
+
+	return "", false
+}
+
+// scenarioCounterValue returns the value of the counter in the snapshot, summed over the sessions (and PDU types)
+// that the assertion selects
+func scenarioCounterValue(snapshot *MetricsSnapshot, assertion *ScenarioCounterAssertion) uint64 {
+	sessionIsSelected := func(nameOfAgent string, nameOfPeer string) bool {
+		return (assertion.NameOfAgent == "" || assertion.NameOfAgent == nameOfAgent) && (assertion.NameOfPeer == "" || assertion.NameOfPeer == nameOfPeer)
+	}
+
+	commandIsSelected := func(commandName string) bool {
+		return assertion.CommandName == "" || assertion.CommandName == commandName
+	}
+
+	sum := uint64(0)
+
+	switch assertion.Counter {
+	case ScenarioCounterPdusSent, ScenarioCounterPdusReceived:
+		counters := snapshot.PdusSent
+		if assertion.Counter == ScenarioCounterPdusReceived {
+			counters = snapshot.PdusReceived
+		}
+
+		for key, count := range counters {
+			if sessionIsSelected(key.AgentName, key.PeerName) && commandIsSelected(key.CommandName) {
+				sum += count
+			}
+		}
+
+	case ScenarioCounterErrorResponses:
+		for key, count := range snapshot.ErrorResponses {
+			if sessionIsSelected(key.AgentName, key.PeerName) && commandIsSelected(key.CommandName) {
+				sum += count
+			}
+		}
+
+	case ScenarioCounterBinds, ScenarioCounterReconnects:
+		counters := snapshot.Binds
+		if assertion.Counter == ScenarioCounterReconnects {
+			counters = snapshot.Reconnects
+		}
+
+		for key, count := range counters {
+			if sessionIsSelected(key.AgentName, key.PeerName) {
+				sum += count
+			}
+		}
+
+	case ScenarioCounterOutstandingRequests:
+		for key, count := range snapshot.OutstandingRequests {
+			if sessionIsSelected(key.AgentName, key.PeerName) {
+				sum += uint64(count)
+			}
+		}
+	}
+
+	return sum
+}
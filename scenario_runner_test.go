@@ -0,0 +1,294 @@
+package smppth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// scenarioResponderAgent answers each request it sends as if its peer did so immediately.  A submit-sm to a
+// destination_addr starting with 99 is rejected with ESME_RINVDSTADR.
+type scenarioResponderAgent struct {
+	name               string
+	lock               sync.Mutex
+	nextSequenceNumber uint32
+	agentEventChannel  chan *AgentEvent
+}
+
+func newScenarioResponderAgent(name string) *scenarioResponderAgent {
+	return &scenarioResponderAgent{
+		name:               name,
+		nextSequenceNumber: 1,
+		agentEventChannel:  make(chan *AgentEvent, 100),
+	}
+}
+
+func (agent *scenarioResponderAgent) Name() string                            { return agent.name }
+func (agent *scenarioResponderAgent) StartEventLoop()                         {}
+func (agent *scenarioResponderAgent) SetAgentEventChannel(chan<- *AgentEvent) {}
+
+func (agent *scenarioResponderAgent) SendMessageToPeer(message *MessageDescriptor) error {
+	if message.NameOfReceivingPeer != "smsc01" {
+		return fmt.Errorf("No such SMSC peer named (%s) is known to this ESME", message.NameOfReceivingPeer)
+	}
+
+	agent.lock.Lock()
+	message.PDU.SequenceNumber = agent.nextSequenceNumber
+	agent.nextSequenceNumber++
+	agent.lock.Unlock()
+
+	var response *smpp.PDU
+	switch message.PDU.CommandID {
+	case smpp.CommandEnquireLink:
+		response = smpp.NewPDU(smpp.CommandEnquireLinkResp, 0, message.PDU.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{})
+	case smpp.CommandSubmitSm:
+		response = smpp.NewPDU(smpp.CommandSubmitSmResp, 0, message.PDU.SequenceNumber, []*smpp.Parameter{smpp.NewCOctetStringParameter(fmt.Sprintf("msg-%d", message.PDU.SequenceNumber))}, []*smpp.Parameter{})
+		if strings.HasPrefix(message.PDU.MandatoryParameters[6].Value.(string), "99") {
+			response = smpp.NewPDU(smpp.CommandSubmitSmResp, EsmeRinvdstadr, message.PDU.SequenceNumber, []*smpp.Parameter{smpp.NewCOctetStringParameter("")}, []*smpp.Parameter{})
+		}
+	}
+
+	agent.agentEventChannel <- &AgentEvent{Type: SentPDU, SourceAgent: agent, RemotePeerName: message.NameOfReceivingPeer, SmppPDU: message.PDU}
+	agent.agentEventChannel <- &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: message.NameOfReceivingPeer, SmppPDU: response}
+
+	return nil
+}
+
+func TestScenarioRunnerWithPassingScenario(t *testing.T) {
+	scenario, err := ReadScenarioFromYaml(strings.NewReader(`
+Name: submit-repeat-parallel
+Timeout: 1s
+Variables:
+  destination: "447700900123"
+Steps:
+  - Send:
+      Agent: esme01
+      Peer: smsc01
+      Command: submit-sm
+      Parameters: {destination_addr: "{destination}", short_message: "first"}
+  - Name: first-resp
+    Expect:
+      Agent: esme01
+      Command: submit-sm-resp
+      Match: {sequence_number: "^{sequence_number}$"}
+      Capture: {first_id: message_id}
+  - Repeat:
+      Times: 3
+      Steps:
+        - Send:
+            Agent: esme01
+            Peer: smsc01
+            Command: submit-sm
+            Parameters: {destination_addr: "{destination}", short_message: "hello {iteration} after {first_id}"}
+        - Expect:
+            Command: submit-sm-resp
+            Match: {sequence_number: "^{sequence_number}$"}
+        - Assert:
+            Status: ESME_ROK
+            Fields: {message_id: "^msg-[0-9]+$"}
+  - Parallel:
+      - Steps:
+          - Send: {Agent: esme01, Peer: smsc01, Command: enquire-link}
+          - Expect: {Command: enquire-link-resp, Match: {sequence_number: "^{sequence_number}$"}}
+      - Steps:
+          - Wait: 10ms
+          - Send: {Agent: esme01, Peer: smsc01, Command: submit-sm, Parameters: {destination_addr: "99"}}
+          - Expect: {Command: submit-sm-resp, Status: ESME_RINVDSTADR}
+  - Assert:
+      Event: first-resp
+      Fields: {message_id: "^{first_id}$", peer: "^smsc01$"}
+  - Assert:
+      Counter: {Name: pdus_received, Agent: esme01, Command: submit-sm-resp, Equals: 5}
+  - Assert:
+      Counter: {Name: error_responses, AtLeast: 1, AtMost: 1}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error on ReadScenarioFromYaml(), got = (%s)", err)
+	}
+
+	agent := newScenarioResponderAgent("esme01")
+	report := NewScenarioRunner(NewAgentGroup([]Agent{agent})).Run(scenario, agent.agentEventChannel)
+
+	if !report.Passed() || report.NumberOfSteps() != 19 || report.NumberOfFailedSteps() != 0 {
+		t.Fatalf("Expected all 19 steps to pass, got report:\n%s", NewStandardOutputGenerator().SayWhatTheScenarioResultIs(report))
+	}
+
+	repeatedSend := report.StepResults[2].StepResults[3]
+	if repeatedSend.Iteration != 2 || len(repeatedSend.SentPDUs) != 1 || ShortMessageText(repeatedSend.SentPDUs[0]) != "hello 2 after msg-1" {
+		t.Errorf("Expected second iteration to send templated short_message, got = (%+v)", repeatedSend)
+	}
+
+	if branchResult := report.StepResults[3].StepResults[2]; branchResult.Branch != 2 || branchResult.Step.Type != ScenarioWait {
+		t.Errorf("Expected third result of parallel step to be the wait in branch 2, got = (%+v)", branchResult)
+	}
+
+	if matched := report.StepResults[1].MatchedEvent; matched == nil || matched.SmppPDU.CommandID != smpp.CommandSubmitSmResp {
+		t.Errorf("Expected expect step to report the matched submit-sm-resp, got = (%+v)", matched)
+	}
+}
+
+func TestScenarioRunnerReportsFailures(t *testing.T) {
+	scenario, err := ReadScenarioFromYaml(strings.NewReader(`
+Name: failures
+Steps:
+  - Send: {Agent: esme01, Peer: smsc01, Command: submit-sm, Parameters: {destination_addr: "99"}}
+  - Expect: {Command: submit-sm-resp}
+  - Assert: {Status: ESME_ROK, Fields: {message_id: "^msg-"}}
+  - Send: {Agent: esme01, Peer: smsc01, Command: enquire-link}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error on ReadScenarioFromYaml(), got = (%s)", err)
+	}
+
+	agent := newScenarioResponderAgent("esme01")
+	runner := NewScenarioRunner(NewAgentGroup([]Agent{agent}))
+
+	report := runner.Run(scenario, agent.agentEventChannel)
+	if report.Passed() || len(report.StepResults) != 3 || report.NumberOfFailedSteps() != 1 {
+		t.Fatalf("Expected scenario to stop at the failed assert, got report:\n%s", NewStandardOutputGenerator().SayWhatTheScenarioResultIs(report))
+	}
+
+	if failure := report.StepResults[2].Failure; failure != "command_status is (ESME_RINVDSTADR), expected (ESME_ROK); message_id is (), expected a match for (^msg-)" {
+		t.Errorf("Unexpected failure for assert = (%s)", failure)
+	}
+
+	scenario, _ = ReadScenarioFromYaml(strings.NewReader(`
+Name: timeout
+Steps:
+  - Send: {Agent: esme01, Peer: smsc01, Command: enquire-link}
+  - Expect: {Command: enquire-link-resp, Timeout: 50ms, Match: {sequence_number: "^0$"}}
+`))
+
+	report = runner.Run(scenario, agent.agentEventChannel)
+	if report.Passed() || report.StepResults[1].Failure != "no matching event within 50ms" {
+		t.Errorf("Expected expect to time out, got report:\n%s", NewStandardOutputGenerator().SayWhatTheScenarioResultIs(report))
+	}
+
+	output := NewStandardOutputGenerator().SayWhatTheScenarioResultIs(report)
+	if !strings.HasPrefix(output, "scenario timeout FAILED, 1 of 2 steps failed") || !strings.Contains(output, "  FAIL expect ReceivedPDU enquire-link-resp sequence_number=~^0$") {
+		t.Errorf("Unexpected report output:\n%s", output)
+	}
+
+	scenario, _ = ReadScenarioFromYaml(strings.NewReader(`
+Name: unknown-peer
+Steps:
+  - Send: {Agent: esme01, Peer: smsc02, Command: enquire-link}
+`))
+
+	if report = runner.Run(scenario, agent.agentEventChannel); report.Passed() || !strings.Contains(report.StepResults[0].Failure, "smsc02") {
+		t.Errorf("Expected send to an unknown peer to fail, got = (%s)", report.StepResults[0].Failure)
+	}
+
+	enquireLink := &ScenarioStep{Type: ScenarioSend, Details: &SendPduDetails{NameOfAgentThatWillSendPdu: "esme01", NameOfPeerThatShouldReceivePdu: "smsc01", TypeOfSmppPDU: smpp.CommandEnquireLink, StringParametersMap: map[string]string{}}}
+	for _, testCase := range []struct {
+		step            *ScenarioStep
+		expectedFailure string
+	}{
+		{&ScenarioStep{Type: ScenarioRepeat, Details: &ScenarioRepeatDetails{Times: 2}}, "repeat has no steps"},
+		{&ScenarioStep{Type: ScenarioParallel, Details: &ScenarioParallelDetails{}}, "parallel has no branches"},
+		{&ScenarioStep{Type: ScenarioParallel, Details: &ScenarioParallelDetails{Branches: [][]*ScenarioStep{{enquireLink}, {}}}}, "branch 2 has no steps"},
+	} {
+		report = runner.Run(&Scenario{Name: "built-in-code", Steps: []*ScenarioStep{testCase.step}}, agent.agentEventChannel)
+		if report.Passed() || len(report.StepResults) != 1 || report.StepResults[0].Failure != testCase.expectedFailure {
+			t.Errorf("Expected step to fail with (%s), got report:\n%s", testCase.expectedFailure, NewStandardOutputGenerator().SayWhatTheScenarioResultIs(report))
+		}
+	}
+}
+
+// TestScenarioRunnerWithParallelBranchesAgainstRealAgents sends submit-sm from an ESME and deliver-sm from an SMSC,
+// bound to each other, from several branches at once.  Nothing answers the requests, so the branches send as fast as
+// they can.  Each request must reach the peer with a distinct sequence_number.  Run it with -race to check that the
+// agents can be used from several goroutines.
+func TestScenarioRunnerWithParallelBranchesAgainstRealAgents(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	smsc := NewSMSC("smsc01", "smsc01", net.ParseIP("127.0.0.1"), uint16(port))
+	esme := NewEsme("esme01", net.ParseIP("127.0.0.1"), 0)
+	esme.peerBinds = []smppBindInfo{{remoteIP: net.ParseIP("127.0.0.1"), remotePort: uint16(port), smscName: "smsc01", password: "password", systemID: "esme01", systemType: "generic"}}
+
+	agentEvents := make(chan *AgentEvent, 1000)
+	smsc.SetAgentEventChannel(agentEvents)
+	esme.SetAgentEventChannel(agentEvents)
+
+	go smsc.StartEventLoop()
+	for attempt := 0; attempt < 50; attempt++ {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	go esme.StartEventLoop()
+
+	for event := range agentEvents {
+		if event.Type == CompletedBind && event.SourceAgent == esme {
+			break
+		}
+	}
+
+	// the sequence numbers of the requests that arrive at each agent are recorded before the events reach the runner
+	var lock sync.Mutex
+	sequenceNumbersReceivedByAgent := map[string]map[uint32]bool{"smsc01": {}, "esme01": {}}
+	numberOfRequestsReceived := 0
+	eventsForRunner := make(chan *AgentEvent, 1000)
+	go func() {
+		for event := range agentEvents {
+			if event.Type == ReceivedPDU && event.SmppPDU.IsRequest() {
+				lock.Lock()
+				sequenceNumbersReceivedByAgent[event.SourceAgent.Name()][event.SmppPDU.SequenceNumber] = true
+				numberOfRequestsReceived++
+				lock.Unlock()
+			}
+			eventsForRunner <- event
+		}
+	}()
+
+	scenario, err := ReadScenarioFromYaml(strings.NewReader(`
+Name: parallel-against-real-agents
+Timeout: 5s
+Steps:
+  - Parallel:` + strings.Repeat(`
+      - Steps:
+          - Repeat: {Times: 50, Steps: [Send: {Agent: esme01, Peer: smsc01, Command: submit-sm, Parameters: {short_message: "{iteration}"}}]}`, 4) + strings.Repeat(`
+      - Steps:
+          - Repeat: {Times: 50, Steps: [Send: {Agent: smsc01, Peer: esme01, Command: deliver-sm, Parameters: {short_message: "{iteration}"}}]}`, 4) + `
+`))
+	if err != nil {
+		t.Fatalf("Expected no error on ReadScenarioFromYaml(), got = (%s)", err)
+	}
+
+	if report := NewScenarioRunner(NewAgentGroup([]Agent{smsc, esme})).Run(scenario, eventsForRunner); !report.Passed() {
+		t.Fatalf("Expected all steps to pass, got report:\n%s", NewStandardOutputGenerator().SayWhatTheScenarioResultIs(report))
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		lock.Lock()
+		received := numberOfRequestsReceived
+		lock.Unlock()
+
+		if received == 400 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 400 requests to be received, got (%d)", received)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for nameOfAgent, sequenceNumbers := range sequenceNumbersReceivedByAgent {
+		if len(sequenceNumbers) != 200 {
+			t.Errorf("Expected (%s) to receive 200 requests with distinct sequence numbers, got (%d) distinct", nameOfAgent, len(sequenceNumbers))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package smppth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestReadScenarioFromYaml(t *testing.T) {
+	scenario, err := ReadScenarioFromYaml(strings.NewReader(`
+Name: submit-and-query
+Timeout: 2s
+Variables:
+  destination: "447700900123"
+Steps:
+  - Name: submit
+    Send:
+      Agent: esme01
+      Peer: smsc01
+      Command: submit-sm
+      Parameters:
+        destination_addr: "{destination}"
+        registered_delivery: 1
+  - Name: submit-resp
+    Expect:
+      Agent: esme01
+      Command: submit-sm-resp
+      Status: ESME_ROK
+      Match:
+        sequence_number: "^{sequence_number}$"
+      Capture:
+        id: message_id
+      Timeout: 500ms
+  - Wait: 100ms
+  - Repeat:
+      Times: 3
+      Steps:
+        - Send: {Agent: esme01, Peer: smsc01, Command: enquire-link}
+  - Parallel:
+      - Steps:
+          - Wait: 10ms
+      - Steps:
+          - Expect: {Event: CompletedBind}
+  - Assert:
+      Event: submit-resp
+      Fields:
+        message_id: "^{id}$"
+  - Assert:
+      Counter: {Name: pdus_received, Agent: esme01, Command: submit-sm-resp, AtLeast: 1, AtMost: 2}
+`))
+
+	if err != nil {
+		t.Fatalf("Expected no error on ReadScenarioFromYaml(), got = (%s)", err)
+	}
+
+	if scenario.Name != "submit-and-query" || scenario.DefaultTimeout != 2*time.Second || scenario.Variables["destination"] != "447700900123" || len(scenario.Steps) != 7 {
+		t.Fatalf("Expected scenario with 7 steps and the declared timeout and variables, got = (%+v)", scenario)
+	}
+
+	send := scenario.Steps[0].Details.(*SendPduDetails)
+	if scenario.Steps[0].Type != ScenarioSend || send.TypeOfSmppPDU != smpp.CommandSubmitSm || send.StringParametersMap["registered_delivery"] != "1" {
+		t.Errorf("Expected send of submit-sm with registered_delivery=1, got = (%+v)", send)
+	}
+
+	expect := scenario.Steps[1].Details.(*ScenarioExpectDetails)
+	if expect.EventType != ReceivedPDU || expect.CommandID != smpp.CommandSubmitSmResp || expect.CommandStatus == nil || *expect.CommandStatus != EsmeRok || expect.Timeout != 500*time.Millisecond || expect.Captures["id"] != "message_id" {
+		t.Errorf("Expected expect for submit-sm-resp capturing message_id, got = (%+v)", expect)
+	}
+
+	if repeat := scenario.Steps[3].Details.(*ScenarioRepeatDetails); repeat.Times != 3 || len(repeat.Steps) != 1 {
+		t.Errorf("Expected repeat of one step three times, got = (%+v)", repeat)
+	}
+
+	parallel := scenario.Steps[4].Details.(*ScenarioParallelDetails)
+	if len(parallel.Branches) != 2 || parallel.Branches[1][0].Details.(*ScenarioExpectDetails).EventType != CompletedBind {
+		t.Errorf("Expected two parallel branches, the second expecting CompletedBind, got = (%+v)", parallel)
+	}
+
+	counter := scenario.Steps[6].Details.(*ScenarioAssertDetails).Counter
+	if counter == nil || counter.CommandName != "submit-sm-resp" || *counter.Minimum != 1 || *counter.Maximum != 2 {
+		t.Errorf("Expected counter assertion on submit-sm-resp between 1 and 2, got = (%+v)", counter)
+	}
+
+	if description := scenario.Steps[1].String(); description != "submit-resp: expect ReceivedPDU submit-sm-resp status=ESME_ROK at esme01 sequence_number=~^{sequence_number}$" {
+		t.Errorf("Unexpected description for expect step = (%s)", description)
+	}
+
+	for _, invalidScenario := range []string{
+		"Name: empty\n",
+		"Steps:\n  - Wait: soon\n",
+		"Steps:\n  - Wait: 1s\n    Send: {Agent: a, Peer: b, Command: enquire-link}\n",
+		"Steps:\n  - Send: {Agent: a, Peer: b, Command: enquire-links}\n",
+		"Steps:\n  - Send: {Agent: a, Command: enquire-link}\n",
+		"Steps:\n  - Expect: {Event: Received}\n",
+		"Steps:\n  - Expect: {Match: {message_id: \"(\"}}\n",
+		"Steps:\n  - Repeat: {Times: 0, Steps: [{Wait: 1s}]}\n",
+		"Steps:\n  - Repeat: {Times: 2, Steps: [{Wait: later}]}\n",
+		"Steps:\n  - Parallel: [{Steps: []}]\n",
+		"Steps:\n  - Assert: {Event: submit}\n",
+		"Steps:\n  - Assert: {Counter: {Name: pdus_lost, Equals: 1}}\n",
+		"Steps:\n  - Assert: {Counter: {Name: binds}}\n",
+		"Steps:\n  - Assert: {Counter: {Name: binds, Equals: 1, AtMost: 2}}\n",
+	} {
+		if _, err := ReadScenarioFromYaml(strings.NewReader(invalidScenario)); err == nil {
+			t.Errorf("Expected error on ReadScenarioFromYaml() for (%s), got none", invalidScenario)
+		}
+	}
+}
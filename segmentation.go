@@ -0,0 +1,197 @@
+package smppth
+
+import (
+	"fmt"
+
+	"github.com/blorticus/smpp"
+)
+
+// SegmentationMethod is the way in which a message too long for a single short_message is split across
+// multiple PDUs
+type SegmentationMethod int
+
+const (
+	// SegmentationUdh8BitReference splits a message into segments, each with a concatenation User Data
+	// Header (IEI 0x00) in the short_message, and sets UDHI in esm_class
+	SegmentationUdh8BitReference SegmentationMethod = iota
+	// SegmentationUdh16BitReference is SegmentationUdh8BitReference, using IEI 0x08, which carries a 16-bit
+	// reference number
+	SegmentationUdh16BitReference
+	// SegmentationSar splits a message into segments, each with sar_msg_ref_num, sar_total_segments and
+	// sar_segment_seqnum TLVs
+	SegmentationSar
+	// SegmentationPayload does not split the message, but instead carries it in a message_payload TLV
+	SegmentationPayload
+)
+
+var segmentationMethodByName = map[string]SegmentationMethod{
+	"udh":     SegmentationUdh8BitReference,
+	"udh8":    SegmentationUdh8BitReference,
+	"udh16":   SegmentationUdh16BitReference,
+	"sar":     SegmentationSar,
+	"payload": SegmentationPayload,
+}
+
+// SegmentationMethodFromString returns the SegmentationMethod for one of the names "udh" (or "udh8"), "udh16",
+// "sar" or "payload"
+func SegmentationMethodFromString(name string) (SegmentationMethod, error) {
+	method, isKnown := segmentationMethodByName[name]
+	if !isKnown {
+		return SegmentationUdh8BitReference, fmt.Errorf("segmentation must be one of udh, udh8, udh16, sar or payload, not (%s)", name)
+	}
+
+	return method, nil
+}
+
+const (
+	tlvTagSarMsgRefNum        uint16 = 0x020C
+	tlvTagSarTotalSegments    uint16 = 0x020E
+	tlvTagSarSegmentSeqnum    uint16 = 0x020F
+	esmClassUdhIndicator      uint8  = 0x40
+	maximumShortMessageOctets        = 254
+	maximumNumberOfSegments          = 255
+)
+
+// shortMessageSegment is a single part of a message, along with the optional parameters that identify the
+// part when SAR TLVs are used
+type shortMessageSegment struct {
+	shortMessage       []byte
+	optionalParameters []*smpp.Parameter
+}
+
+// segmentMessage encodes the message using the provided TextEncoding and splits it into segments using the
+// provided method.  A message that fits in a single short_message is not split, and has neither a UDH nor SAR TLVs.
+// A message is never split within a character.
+func segmentMessage(message string, encoding TextEncoding, method SegmentationMethod, referenceNumber uint16) ([]*shortMessageSegment, error) {
+	encodedMessage, err := EncodeText(message, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	if method == SegmentationPayload {
+		return []*shortMessageSegment{{
+			shortMessage:       []byte{},
+			optionalParameters: []*smpp.Parameter{smpp.NewTLVParameter(tlvTagMessagePayload, encodedMessage)},
+		}}, nil
+	}
+
+	if encodedMessageLength(message, encodedMessage, encoding) <= maximumSegmentLength(encoding, 0) {
+		return []*shortMessageSegment{{shortMessage: encodedMessage, optionalParameters: []*smpp.Parameter{}}}, nil
+	}
+
+	udhLength := 0
+	switch method {
+	case SegmentationUdh8BitReference:
+		udhLength = 6
+	case SegmentationUdh16BitReference:
+		udhLength = 7
+	}
+
+	parts, err := splitEncodedTextIntoParts(message, encoding, maximumSegmentLength(encoding, udhLength))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) > maximumNumberOfSegments {
+		return nil, fmt.Errorf("message requires (%d) segments, but no more than (%d) are permitted", len(parts), maximumNumberOfSegments)
+	}
+
+	if encoding == TextEncodingGsm7Packed {
+		fillBits := (7 - (udhLength*8)%7) % 7
+		for i, part := range parts {
+			parts[i] = packSeptets(part, fillBits)
+		}
+	}
+
+	segments := make([]*shortMessageSegment, len(parts))
+	for i, part := range parts {
+		totalSegments, segmentSeqnum := uint8(len(parts)), uint8(i+1)
+
+		switch method {
+		case SegmentationUdh8BitReference:
+			segments[i] = &shortMessageSegment{
+				shortMessage:       append([]byte{0x05, 0x00, 0x03, uint8(referenceNumber), totalSegments, segmentSeqnum}, part...),
+				optionalParameters: []*smpp.Parameter{},
+			}
+
+		case SegmentationUdh16BitReference:
+			segments[i] = &shortMessageSegment{
+				shortMessage:       append([]byte{0x06, 0x08, 0x04, uint8(referenceNumber >> 8), uint8(referenceNumber), totalSegments, segmentSeqnum}, part...),
+				optionalParameters: []*smpp.Parameter{},
+			}
+
+		case SegmentationSar:
+			segments[i] = &shortMessageSegment{
+				shortMessage: part,
+				optionalParameters: []*smpp.Parameter{
+					smpp.NewTLVParameter(tlvTagSarMsgRefNum, referenceNumber),
+					smpp.NewTLVParameter(tlvTagSarTotalSegments, totalSegments),
+					smpp.NewTLVParameter(tlvTagSarSegmentSeqnum, segmentSeqnum),
+				},
+			}
+		}
+	}
+
+	return segments, nil
+}
+
+// maximumSegmentLength returns the length of the text that fits in a single short_message with a UDH of the
+// provided length.  For the GSM 03.38 default alphabet, the length is in septets: a message may have 160 septets,
+// of which the UDH occupies a whole number.  For all other encodings, the length is in octets, and a message may
+// have 140 octets.
+func maximumSegmentLength(encoding TextEncoding, udhLength int) int {
+	if encoding == TextEncodingGsm7 || encoding == TextEncodingGsm7Packed {
+		return 160 - (udhLength*8+6)/7
+	}
+
+	return 140 - udhLength
+}
+
+// encodedMessageLength returns the length of an encoded message in the units used by maximumSegmentLength
+func encodedMessageLength(message string, encodedMessage []byte, encoding TextEncoding) int {
+	if encoding == TextEncodingGsm7Packed {
+		septets, _ := encodeGsm7Septets(message)
+		return len(septets)
+	}
+
+	return len(encodedMessage)
+}
+
+// splitEncodedTextIntoParts encodes the message one character at a time, starting a new part whenever the next
+// character would cause the current one to exceed maximumLengthPerPart.  For TextEncodingGsm7Packed, the parts
+// are unpacked septets, which must be packed once the UDH length is known.  For TextEncodingBinary, the message
+// is split on octets, since it need not be valid text.
+func splitEncodedTextIntoParts(message string, encoding TextEncoding, maximumLengthPerPart int) ([][]byte, error) {
+	if encoding == TextEncodingGsm7Packed {
+		encoding = TextEncodingGsm7
+	}
+
+	parts := make([][]byte, 0, 2)
+
+	if encoding == TextEncodingBinary {
+		for len(message) > maximumLengthPerPart {
+			parts = append(parts, []byte(message[:maximumLengthPerPart]))
+			message = message[maximumLengthPerPart:]
+		}
+
+		return append(parts, []byte(message)), nil
+	}
+
+	currentPart := make([]byte, 0, maximumLengthPerPart)
+
+	for _, character := range message {
+		encodedCharacter, err := EncodeText(string(character), encoding)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(currentPart)+len(encodedCharacter) > maximumLengthPerPart {
+			parts = append(parts, currentPart)
+			currentPart = make([]byte, 0, maximumLengthPerPart)
+		}
+
+		currentPart = append(currentPart, encodedCharacter...)
+	}
+
+	return append(parts, currentPart), nil
+}
@@ -0,0 +1,137 @@
+package smppth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestSegmentedSubmitSmWithUdh(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	longMessage := strings.Repeat("abcdefghij", 40)
+
+	pdus, err := factory.CreateSegmentedSubmitSm(map[string]string{"short_message": longMessage, "segmentation": "udh"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSegmentedSubmitSm, got = (%s)", err)
+	}
+
+	if len(pdus) != 3 {
+		t.Fatalf("Expected 3 segments for 400 characters with data_coding 0, got (%d)", len(pdus))
+	}
+
+	reassembled := make([]byte, 0, len(longMessage))
+	for i, pdu := range pdus {
+		encoded, err := pdu.Encode()
+		if err != nil {
+			t.Fatalf("Expected no error on Encode of segment (%d), got = (%s)", i, err)
+		}
+
+		decoded, err := decodePDU(encoded)
+		if err != nil {
+			t.Fatalf("Expected no error on decodePDU of segment (%d), got = (%s)", i, err)
+		}
+
+		if decoded.MandatoryParameters[7].Value.(uint8) != esmClassUdhIndicator {
+			t.Errorf("Expected segment (%d) esm_class to have UDHI set", i)
+		}
+
+		shortMessage := decoded.MandatoryParameters[17].Value.([]byte)
+		expectedUdh := []byte{0x05, 0x00, 0x03, 1, 3, uint8(i + 1)}
+		if !bytes.Equal(shortMessage[:6], expectedUdh) {
+			t.Errorf("Expected segment (%d) UDH = (%v), got = (%v)", i, expectedUdh, shortMessage[:6])
+		}
+
+		if i < 2 && len(shortMessage) != 6+153 {
+			t.Errorf("Expected segment (%d) to have 153 characters, got (%d)", i, len(shortMessage)-6)
+		}
+
+		reassembled = append(reassembled, shortMessage[6:]...)
+	}
+
+	if string(reassembled) != longMessage {
+		t.Errorf("Reassembled segments do not match original message")
+	}
+
+	pdus, _ = factory.CreateSegmentedSubmitSm(map[string]string{"short_message": longMessage, "segmentation": "udh16"})
+	shortMessage := pdus[0].MandatoryParameters[17].Value.([]byte)
+	if !bytes.Equal(shortMessage[:7], []byte{0x06, 0x08, 0x04, 0, 2, 3, 1}) || len(shortMessage) != 7+152 {
+		t.Errorf("Expected first udh16 segment with reference (2) and 152 characters, got UDH = (%v) and length (%d)", shortMessage[:7], len(shortMessage))
+	}
+}
+
+func TestSegmentedSubmitSmWithSarAndUcs2(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	longMessage := strings.Repeat("é\U0001F600", 50)
+
+	pdus, err := factory.CreateSegmentedSubmitSm(map[string]string{"short_message": longMessage, "segmentation": "sar", "data_coding": "8"})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSegmentedSubmitSm, got = (%s)", err)
+	}
+
+	if len(pdus) != 3 {
+		t.Fatalf("Expected 3 segments for 150 UCS2 code units, got (%d)", len(pdus))
+	}
+
+	reassembled := make([]byte, 0, 300)
+	for i, pdu := range pdus {
+		if pdu.MandatoryParameters[7].Value.(uint8) != 0 || pdu.MandatoryParameters[14].Value.(uint8) != 8 {
+			t.Errorf("Expected segment (%d) to have esm_class 0 and data_coding 8", i)
+		}
+
+		shortMessage := pdu.MandatoryParameters[17].Value.([]byte)
+		if len(shortMessage) > 140 || len(shortMessage)%2 != 0 {
+			t.Errorf("Expected segment (%d) to have an even number of octets, no more than 140, got (%d)", i, len(shortMessage))
+		}
+
+		if findTlvParameter(pdu, tlvTagSarSegmentSeqnum).Value.(uint8) != uint8(i+1) {
+			t.Errorf("Expected segment (%d) sar_segment_seqnum = (%d)", i, i+1)
+		}
+
+		if findTlvParameter(pdu, tlvTagSarTotalSegments).Value.(uint8) != 3 || findTlvParameter(pdu, tlvTagSarMsgRefNum).Value.(uint16) != 1 {
+			t.Errorf("Expected segment (%d) sar_total_segments = (3) and sar_msg_ref_num = (1)", i)
+		}
+
+		reassembled = append(reassembled, shortMessage...)
+	}
+
+	if encoded, _ := EncodeText(longMessage, TextEncodingUcs2); !bytes.Equal(reassembled, encoded) {
+		t.Errorf("Reassembled segments do not match the UCS2 encoding of the original message")
+	}
+}
+
+func TestSegmentedSubmitSmWithPayloadOrShortMessage(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	longMessage := strings.Repeat("x", 300)
+
+	if _, err := factory.CreateSubmitSm(map[string]string{"short_message": longMessage}); err == nil {
+		t.Errorf("Expected error on CreateSubmitSm with 300 octet short_message, got none")
+	}
+
+	if _, err := factory.CreateSegmentedSubmitSm(map[string]string{"segmentation": "bogus"}); err == nil {
+		t.Errorf("Expected error on CreateSegmentedSubmitSm with unknown segmentation, got none")
+	}
+
+	pdus, err := factory.CreateSegmentedSubmitSm(map[string]string{"short_message": longMessage, "segmentation": "payload"})
+	if err != nil || len(pdus) != 1 {
+		t.Fatalf("Expected a single submit-sm for payload, got (%d) with error = (%v)", len(pdus), err)
+	}
+
+	if len(pdus[0].MandatoryParameters[17].Value.([]byte)) != 0 || tlvValueAsString(findTlvParameter(pdus[0], tlvTagMessagePayload)) != longMessage {
+		t.Errorf("Expected empty short_message and message_payload with the entire message")
+	}
+
+	pdus, err = factory.CreateSegmentedSubmitSm(map[string]string{"short_message": "short enough", "segmentation": "udh"})
+	if err != nil || len(pdus) != 1 {
+		t.Fatalf("Expected a single submit-sm for a short message, got (%d) with error = (%v)", len(pdus), err)
+	}
+
+	if pdus[0].MandatoryParameters[7].Value.(uint8) != 0 || string(pdus[0].MandatoryParameters[17].Value.([]byte)) != "short enough" {
+		t.Errorf("Expected short message without UDH")
+	}
+
+	if pdus[0].CommandID != smpp.CommandSubmitSm {
+		t.Errorf("Expected submit-sm, got (%s)", pdus[0].CommandName())
+	}
+}
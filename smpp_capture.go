@@ -0,0 +1,608 @@
+package smppth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// CapturedPDU is an SMPP PDU extracted from a packet capture, along with the capture timestamp of
+// the TCP segment that completed it.
+type CapturedPDU struct {
+	Timestamp time.Time
+	PDU       *smpp.PDU
+}
+
+// SmppCapture is a single SMPP conversation extracted from a packet capture.  EsmeToSmsc contains
+// the PDUs sent by the ESME (the side that initiated the bind), and SmscToEsme contains the PDUs sent
+// by the SMSC.  Each list is in stream order.  DecodeErrors contains errors produced while extracting
+// PDUs from either stream; PDUs that could not be decoded are not present in either list.
+type SmppCapture struct {
+	EsmeToSmsc   []*CapturedPDU
+	SmscToEsme   []*CapturedPDU
+	DecodeErrors []error
+}
+
+// ReadSmppCaptureFromPcapFile opens a pcap or pcapng file and extracts the first SMPP conversation
+// in it.  See ReadSmppCaptureFromPcap.
+func ReadSmppCaptureFromPcapFile(fileName string, smscPort uint16) (*SmppCapture, error) {
+	fileHandle, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fileHandle.Close()
+
+	return ReadSmppCaptureFromPcap(fileHandle, smscPort)
+}
+
+// ReadSmppCaptureFromPcap reads a pcap or pcapng stream, reassembles the first TCP conversation in which
+// one of the endpoints uses smscPort, and extracts the SMPP PDUs flowing in each direction.  If smscPort is 0,
+// the first TCP conversation carrying data is used, and the side that sent the first data is treated as the
+// ESME.  Supported link types are Ethernet (including 802.1Q tags), Linux cooked capture (v1 and v2), BSD
+// loopback and raw IP.
+func ReadSmppCaptureFromPcap(reader io.Reader, smscPort uint16) (*SmppCapture, error) {
+	captureContents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	packets, err := extractPacketsFromCapture(captureContents)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := newTCPConversationAssembler(smscPort)
+	for _, packet := range packets {
+		segment, isTCP := decodeTCPSegmentFromLinkLayer(packet.linkType, packet.data)
+		if isTCP {
+			segment.timestamp = packet.timestamp
+			conversation.addSegment(segment)
+		}
+	}
+
+	if !conversation.hasSelectedFlow() {
+		return nil, fmt.Errorf("No TCP conversation carrying data was found in the capture")
+	}
+
+	capture := &SmppCapture{}
+	capture.EsmeToSmsc, capture.DecodeErrors = extractCapturedPdusFromStreamChunks(conversation.towardSmsc.reassembledChunks())
+
+	smscToEsmePdus, smscToEsmeErrors := extractCapturedPdusFromStreamChunks(conversation.towardEsme.reassembledChunks())
+	capture.SmscToEsme = smscToEsmePdus
+	capture.DecodeErrors = append(capture.DecodeErrors, smscToEsmeErrors...)
+
+	return capture, nil
+}
+
+type capturedPacket struct {
+	timestamp time.Time
+	linkType  uint32
+	data      []byte
+}
+
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngSimplePacketBlock         = 0x00000003
+	pcapngEnhancedPacketBlock       = 0x00000006
+
+	linkTypeNull       = 0
+	linkTypeEthernet   = 1
+	linkTypeRaw        = 101
+	linkTypeLoop       = 108
+	linkTypeLinuxSll   = 113
+	linkTypeIPv4       = 228
+	linkTypeIPv6       = 229
+	linkTypeLinuxSll2  = 276
+	linkTypeOpenBsdRaw = 12
+)
+
+func extractPacketsFromCapture(captureContents []byte) ([]*capturedPacket, error) {
+	if len(captureContents) < 4 {
+		return nil, fmt.Errorf("Capture is too short to contain a pcap or pcapng header")
+	}
+
+	if binary.LittleEndian.Uint32(captureContents[0:4]) == pcapngSectionHeader {
+		return extractPacketsFromPcapng(captureContents)
+	}
+
+	return extractPacketsFromPcap(captureContents)
+}
+
+func extractPacketsFromPcap(captureContents []byte) ([]*capturedPacket, error) {
+	if len(captureContents) < 24 {
+		return nil, fmt.Errorf("Capture is too short to contain a pcap global header")
+	}
+
+	var byteOrder binary.ByteOrder
+	var fractionalUnit time.Duration
+
+	switch {
+	case binary.LittleEndian.Uint32(captureContents[0:4]) == pcapMagicMicroseconds:
+		byteOrder, fractionalUnit = binary.LittleEndian, time.Microsecond
+	case binary.BigEndian.Uint32(captureContents[0:4]) == pcapMagicMicroseconds:
+		byteOrder, fractionalUnit = binary.BigEndian, time.Microsecond
+	case binary.LittleEndian.Uint32(captureContents[0:4]) == pcapMagicNanoseconds:
+		byteOrder, fractionalUnit = binary.LittleEndian, time.Nanosecond
+	case binary.BigEndian.Uint32(captureContents[0:4]) == pcapMagicNanoseconds:
+		byteOrder, fractionalUnit = binary.BigEndian, time.Nanosecond
+	default:
+		return nil, fmt.Errorf("Capture does not start with a pcap or pcapng magic number")
+	}
+
+	linkType := byteOrder.Uint32(captureContents[20:24]) & 0x0fffffff
+	packets := make([]*capturedPacket, 0, 100)
+
+	for offset := 24; offset < len(captureContents); {
+		if offset+16 > len(captureContents) {
+			return nil, fmt.Errorf("Truncated pcap record header at offset (%d)", offset)
+		}
+
+		seconds := byteOrder.Uint32(captureContents[offset : offset+4])
+		fraction := byteOrder.Uint32(captureContents[offset+4 : offset+8])
+		includedLength := int(byteOrder.Uint32(captureContents[offset+8 : offset+12]))
+		offset += 16
+
+		if offset+includedLength > len(captureContents) {
+			return nil, fmt.Errorf("Truncated pcap record data at offset (%d)", offset)
+		}
+
+		packets = append(packets, &capturedPacket{
+			timestamp: time.Unix(int64(seconds), int64(fraction)*int64(fractionalUnit)),
+			linkType:  linkType,
+			data:      captureContents[offset : offset+includedLength],
+		})
+
+		offset += includedLength
+	}
+
+	return packets, nil
+}
+
+type pcapngInterface struct {
+	linkType           uint32
+	timestampUnitsPerS uint64
+}
+
+func extractPacketsFromPcapng(captureContents []byte) ([]*capturedPacket, error) {
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	interfaces := make([]*pcapngInterface, 0, 2)
+	packets := make([]*capturedPacket, 0, 100)
+
+	for offset := 0; offset < len(captureContents); {
+		if offset+12 > len(captureContents) {
+			return nil, fmt.Errorf("Truncated pcapng block header at offset (%d)", offset)
+		}
+
+		blockType := binary.LittleEndian.Uint32(captureContents[offset : offset+4])
+
+		if blockType == pcapngSectionHeader {
+			switch {
+			case binary.LittleEndian.Uint32(captureContents[offset+8:offset+12]) == pcapngByteOrderMagic:
+				byteOrder = binary.LittleEndian
+			case binary.BigEndian.Uint32(captureContents[offset+8:offset+12]) == pcapngByteOrderMagic:
+				byteOrder = binary.BigEndian
+			default:
+				return nil, fmt.Errorf("Invalid pcapng byte-order magic at offset (%d)", offset)
+			}
+
+			interfaces = interfaces[:0]
+		} else {
+			blockType = byteOrder.Uint32(captureContents[offset : offset+4])
+		}
+
+		blockLength := int(byteOrder.Uint32(captureContents[offset+4 : offset+8]))
+		if blockLength < 12 || offset+blockLength > len(captureContents) {
+			return nil, fmt.Errorf("Invalid pcapng block length (%d) at offset (%d)", blockLength, offset)
+		}
+
+		blockBody := captureContents[offset+8 : offset+blockLength-4]
+
+		switch blockType {
+		case pcapngInterfaceDescriptionBlock:
+			if len(blockBody) < 8 {
+				return nil, fmt.Errorf("Truncated pcapng interface description block at offset (%d)", offset)
+			}
+
+			interfaces = append(interfaces, &pcapngInterface{
+				linkType:           uint32(byteOrder.Uint16(blockBody[0:2])),
+				timestampUnitsPerS: pcapngTimestampResolutionFromOptions(blockBody[8:], byteOrder),
+			})
+
+		case pcapngEnhancedPacketBlock:
+			if len(blockBody) < 20 {
+				return nil, fmt.Errorf("Truncated pcapng enhanced packet block at offset (%d)", offset)
+			}
+
+			interfaceID := int(byteOrder.Uint32(blockBody[0:4]))
+			if interfaceID >= len(interfaces) {
+				return nil, fmt.Errorf("pcapng enhanced packet block at offset (%d) refers to undefined interface (%d)", offset, interfaceID)
+			}
+
+			timestampUnits := uint64(byteOrder.Uint32(blockBody[4:8]))<<32 | uint64(byteOrder.Uint32(blockBody[8:12]))
+			capturedLength := int(byteOrder.Uint32(blockBody[12:16]))
+			if 20+capturedLength > len(blockBody) {
+				return nil, fmt.Errorf("Truncated pcapng enhanced packet data at offset (%d)", offset)
+			}
+
+			unitsPerSecond := interfaces[interfaceID].timestampUnitsPerS
+			packets = append(packets, &capturedPacket{
+				timestamp: time.Unix(int64(timestampUnits/unitsPerSecond), int64(timestampUnits%unitsPerSecond)*int64(time.Second)/int64(unitsPerSecond)),
+				linkType:  interfaces[interfaceID].linkType,
+				data:      blockBody[20 : 20+capturedLength],
+			})
+
+		case pcapngSimplePacketBlock:
+			if len(interfaces) == 0 || len(blockBody) < 4 {
+				return nil, fmt.Errorf("Invalid pcapng simple packet block at offset (%d)", offset)
+			}
+
+			packets = append(packets, &capturedPacket{
+				timestamp: time.Unix(0, 0),
+				linkType:  interfaces[0].linkType,
+				data:      blockBody[4:],
+			})
+		}
+
+		offset += blockLength
+	}
+
+	return packets, nil
+}
+
+func pcapngTimestampResolutionFromOptions(options []byte, byteOrder binary.ByteOrder) uint64 {
+	for len(options) >= 4 {
+		optionCode := byteOrder.Uint16(options[0:2])
+		optionLength := int(byteOrder.Uint16(options[2:4]))
+
+		if optionCode == 0 || 4+optionLength > len(options) {
+			break
+		}
+
+		if optionCode == 9 && optionLength >= 1 {
+			resolution := options[4]
+			unitsPerSecond := uint64(1)
+
+			if resolution&0x80 != 0 {
+				for i := uint8(0); i < resolution&0x7f; i++ {
+					unitsPerSecond *= 2
+				}
+			} else {
+				for i := uint8(0); i < resolution; i++ {
+					unitsPerSecond *= 10
+				}
+			}
+
+			return unitsPerSecond
+		}
+
+		options = options[4+(optionLength+3)/4*4:]
+	}
+
+	return 1000000
+}
+
+type tcpSegment struct {
+	timestamp       time.Time
+	sourceIP        net.IP
+	destinationIP   net.IP
+	sourcePort      uint16
+	destinationPort uint16
+	sequenceNumber  uint32
+	isSyn           bool
+	payload         []byte
+}
+
+func decodeTCPSegmentFromLinkLayer(linkType uint32, frame []byte) (*tcpSegment, bool) {
+	var ipPacket []byte
+
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(frame) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+
+		ipPacket = frame
+
+	case linkTypeLinuxSll:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		ipPacket = frame[16:]
+
+	case linkTypeLinuxSll2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		ipPacket = frame[20:]
+
+	case linkTypeNull, linkTypeLoop:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		ipPacket = frame[4:]
+
+	case linkTypeRaw, linkTypeOpenBsdRaw, linkTypeIPv4, linkTypeIPv6:
+		ipPacket = frame
+
+	default:
+		return nil, false
+	}
+
+	return decodeTCPSegmentFromIPPacket(ipPacket)
+}
+
+func decodeTCPSegmentFromIPPacket(ipPacket []byte) (*tcpSegment, bool) {
+	if len(ipPacket) < 1 {
+		return nil, false
+	}
+
+	var sourceIP, destinationIP net.IP
+	var tcpHeaderAndPayload []byte
+
+	switch ipPacket[0] >> 4 {
+	case 4:
+		if len(ipPacket) < 20 || ipPacket[9] != 6 {
+			return nil, false
+		}
+
+		headerLength := int(ipPacket[0]&0x0f) * 4
+		totalLength := int(binary.BigEndian.Uint16(ipPacket[2:4]))
+		if totalLength > len(ipPacket) || totalLength == 0 {
+			totalLength = len(ipPacket)
+		}
+		if headerLength < 20 || headerLength > totalLength {
+			return nil, false
+		}
+
+		sourceIP, destinationIP = net.IP(ipPacket[12:16]), net.IP(ipPacket[16:20])
+		tcpHeaderAndPayload = ipPacket[headerLength:totalLength]
+
+	case 6:
+		if len(ipPacket) < 40 || ipPacket[6] != 6 {
+			return nil, false
+		}
+
+		payloadLength := int(binary.BigEndian.Uint16(ipPacket[4:6]))
+		if 40+payloadLength > len(ipPacket) {
+			payloadLength = len(ipPacket) - 40
+		}
+
+		sourceIP, destinationIP = net.IP(ipPacket[8:24]), net.IP(ipPacket[24:40])
+		tcpHeaderAndPayload = ipPacket[40 : 40+payloadLength]
+
+	default:
+		return nil, false
+	}
+
+	if len(tcpHeaderAndPayload) < 20 {
+		return nil, false
+	}
+
+	dataOffset := int(tcpHeaderAndPayload[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcpHeaderAndPayload) {
+		return nil, false
+	}
+
+	return &tcpSegment{
+		sourceIP:        sourceIP,
+		destinationIP:   destinationIP,
+		sourcePort:      binary.BigEndian.Uint16(tcpHeaderAndPayload[0:2]),
+		destinationPort: binary.BigEndian.Uint16(tcpHeaderAndPayload[2:4]),
+		sequenceNumber:  binary.BigEndian.Uint32(tcpHeaderAndPayload[4:8]),
+		isSyn:           tcpHeaderAndPayload[13]&0x02 != 0,
+		payload:         tcpHeaderAndPayload[dataOffset:],
+	}, true
+}
+
+type tcpStreamChunk struct {
+	timestamp time.Time
+	data      []byte
+}
+
+// tcpStreamAssembler reassembles one direction of a TCP flow.  Retransmitted data are discarded, and
+// segments that arrive ahead of a gap are held until the gap is filled.
+type tcpStreamAssembler struct {
+	nextExpectedSequence    uint32
+	sequenceIsKnown         bool
+	chunks                  []*tcpStreamChunk
+	segmentsAwaitingGapFill map[uint32]*tcpSegment
+}
+
+func newTCPStreamAssembler() *tcpStreamAssembler {
+	return &tcpStreamAssembler{
+		chunks:                  make([]*tcpStreamChunk, 0, 50),
+		segmentsAwaitingGapFill: make(map[uint32]*tcpSegment),
+	}
+}
+
+func (assembler *tcpStreamAssembler) addSegment(segment *tcpSegment) {
+	if segment.isSyn {
+		assembler.nextExpectedSequence = segment.sequenceNumber + 1
+		assembler.sequenceIsKnown = true
+		return
+	}
+
+	if len(segment.payload) == 0 {
+		return
+	}
+
+	if !assembler.sequenceIsKnown {
+		assembler.nextExpectedSequence = segment.sequenceNumber
+		assembler.sequenceIsKnown = true
+	}
+
+	offsetFromExpected := int32(segment.sequenceNumber - assembler.nextExpectedSequence)
+
+	if offsetFromExpected > 0 {
+		assembler.segmentsAwaitingGapFill[segment.sequenceNumber] = segment
+		return
+	}
+
+	if int(-offsetFromExpected) >= len(segment.payload) {
+		return
+	}
+
+	assembler.appendChunk(segment.timestamp, segment.payload[-offsetFromExpected:])
+
+	for {
+		heldSegment, isHeld := assembler.segmentsAwaitingGapFill[assembler.nextExpectedSequence]
+		if !isHeld {
+			break
+		}
+
+		delete(assembler.segmentsAwaitingGapFill, assembler.nextExpectedSequence)
+		assembler.appendChunk(heldSegment.timestamp, heldSegment.payload)
+	}
+}
+
+func (assembler *tcpStreamAssembler) appendChunk(timestamp time.Time, data []byte) {
+	assembler.chunks = append(assembler.chunks, &tcpStreamChunk{timestamp: timestamp, data: data})
+	assembler.nextExpectedSequence += uint32(len(data))
+}
+
+func (assembler *tcpStreamAssembler) reassembledChunks() []*tcpStreamChunk {
+	return assembler.chunks
+}
+
+// tcpConversationAssembler selects a single TCP flow from a capture and reassembles both directions.
+type tcpConversationAssembler struct {
+	smscPort       uint16
+	esmeEndpoint   string
+	smscEndpoint   string
+	flowIsSelected bool
+	towardSmsc     *tcpStreamAssembler
+	towardEsme     *tcpStreamAssembler
+}
+
+func newTCPConversationAssembler(smscPort uint16) *tcpConversationAssembler {
+	return &tcpConversationAssembler{
+		smscPort:   smscPort,
+		towardSmsc: newTCPStreamAssembler(),
+		towardEsme: newTCPStreamAssembler(),
+	}
+}
+
+func (conversation *tcpConversationAssembler) hasSelectedFlow() bool {
+	return conversation.flowIsSelected
+}
+
+func (conversation *tcpConversationAssembler) addSegment(segment *tcpSegment) {
+	sourceEndpoint := net.JoinHostPort(segment.sourceIP.String(), fmt.Sprint(segment.sourcePort))
+	destinationEndpoint := net.JoinHostPort(segment.destinationIP.String(), fmt.Sprint(segment.destinationPort))
+
+	if !conversation.flowIsSelected {
+		switch {
+		case conversation.smscPort != 0 && segment.destinationPort == conversation.smscPort:
+			conversation.esmeEndpoint, conversation.smscEndpoint = sourceEndpoint, destinationEndpoint
+		case conversation.smscPort != 0 && segment.sourcePort == conversation.smscPort:
+			conversation.esmeEndpoint, conversation.smscEndpoint = destinationEndpoint, sourceEndpoint
+		case conversation.smscPort == 0 && len(segment.payload) > 0:
+			conversation.esmeEndpoint, conversation.smscEndpoint = sourceEndpoint, destinationEndpoint
+		default:
+			return
+		}
+
+		conversation.flowIsSelected = true
+	}
+
+	switch {
+	case sourceEndpoint == conversation.esmeEndpoint && destinationEndpoint == conversation.smscEndpoint:
+		conversation.towardSmsc.addSegment(segment)
+	case sourceEndpoint == conversation.smscEndpoint && destinationEndpoint == conversation.esmeEndpoint:
+		conversation.towardEsme.addSegment(segment)
+	}
+}
+
+// capturedStreamConn is a net.Conn that returns reassembled TCP stream chunks on successive Read()s, so
+// that a pduStreamReader can extract PDUs from a captured stream.  It returns io.EOF after the
+// last chunk.
+type capturedStreamConn struct {
+	fakeNetConnAddressing
+	remainingChunks     []*tcpStreamChunk
+	timestampOfLastRead time.Time
+}
+
+func (conn *capturedStreamConn) Read(b []byte) (int, error) {
+	if len(conn.remainingChunks) == 0 {
+		return 0, io.EOF
+	}
+
+	nextChunk := conn.remainingChunks[0]
+	conn.timestampOfLastRead = nextChunk.timestamp
+
+	bytesCopied := copy(b, nextChunk.data)
+	if bytesCopied < len(nextChunk.data) {
+		conn.remainingChunks[0] = &tcpStreamChunk{timestamp: nextChunk.timestamp, data: nextChunk.data[bytesCopied:]}
+	} else {
+		conn.remainingChunks = conn.remainingChunks[1:]
+	}
+
+	return bytesCopied, nil
+}
+
+func (conn *capturedStreamConn) Write(b []byte) (int, error) {
+	return 0, fmt.Errorf("Captured streams are read-only")
+}
+
+// fakeNetConnAddressing provides the net.Conn methods that do not involve reading or writing, for net.Conn
+// implementations that are not backed by a socket.
+type fakeNetConnAddressing struct{}
+
+func (fakeNetConnAddressing) Close() error                       { return nil }
+func (fakeNetConnAddressing) LocalAddr() net.Addr                { return nil }
+func (fakeNetConnAddressing) RemoteAddr() net.Addr               { return nil }
+func (fakeNetConnAddressing) SetDeadline(t time.Time) error      { return nil }
+func (fakeNetConnAddressing) SetReadDeadline(t time.Time) error  { return nil }
+func (fakeNetConnAddressing) SetWriteDeadline(t time.Time) error { return nil }
+
+func extractCapturedPdusFromStreamChunks(chunks []*tcpStreamChunk) ([]*CapturedPDU, []error) {
+	conn := &capturedStreamConn{remainingChunks: chunks}
+	streamReader := newPduStreamReader(conn)
+
+	capturedPdus := make([]*CapturedPDU, 0, len(chunks))
+	decodeErrors := make([]error, 0)
+
+	for {
+		pdus, err := streamReader.Read()
+
+		for _, pdu := range pdus {
+			capturedPdus = append(capturedPdus, &CapturedPDU{Timestamp: conn.timestampOfLastRead, PDU: pdu})
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			decodeErrors = append(decodeErrors, fmt.Errorf("At capture time (%s): %s", conn.timestampOfLastRead.Format(time.RFC3339Nano), err))
+		}
+	}
+
+	return capturedPdus, decodeErrors
+}
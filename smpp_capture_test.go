@@ -0,0 +1,193 @@
+package smppth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+type testCaptureSegment struct {
+	fromEsme       bool
+	sequenceOffset uint32
+	payload        []byte
+	timestamp      time.Time
+}
+
+func testCaptureSegmentsForEnquireLinkAndSubmitSm() []*testCaptureSegment {
+	baseTime := time.Unix(1600000000, 0)
+	submitSm := testSmppMsgSubmitSm01()
+	enquireLinkResp, _ := smpp.NewPDU(smpp.CommandEnquireLinkResp, 0, 2, []*smpp.Parameter{}, []*smpp.Parameter{}).Encode()
+	submitSmResp, _ := smpp.NewPDU(smpp.CommandSubmitSmResp, 0, 3, []*smpp.Parameter{smpp.NewCOctetStringParameter("abc")}, []*smpp.Parameter{}).Encode()
+
+	return []*testCaptureSegment{
+		{fromEsme: true, sequenceOffset: 0, payload: testSmppMsgEnquireLink01(), timestamp: baseTime},
+		{fromEsme: false, sequenceOffset: 0, payload: enquireLinkResp, timestamp: baseTime.Add(time.Millisecond * 10)},
+		{fromEsme: true, sequenceOffset: 16, payload: submitSm[:20], timestamp: baseTime.Add(time.Millisecond * 200)},
+		{fromEsme: true, sequenceOffset: 16, payload: submitSm[:20], timestamp: baseTime.Add(time.Millisecond * 210)}, // retransmission
+		{fromEsme: true, sequenceOffset: 36, payload: submitSm[20:], timestamp: baseTime.Add(time.Millisecond * 220)},
+		{fromEsme: false, sequenceOffset: 16, payload: submitSmResp, timestamp: baseTime.Add(time.Millisecond * 230)},
+	}
+}
+
+func testEthernetFrameForCaptureSegment(segment *testCaptureSegment) []byte {
+	esmeIP, smscIP := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()
+	esmePort, smscPort := uint16(40000), uint16(2775)
+	esmeInitialSequence, smscInitialSequence := uint32(1000), uint32(5000)
+
+	sourceIP, destinationIP, sourcePort, destinationPort, sequenceNumber := esmeIP, smscIP, esmePort, smscPort, esmeInitialSequence+segment.sequenceOffset
+	if !segment.fromEsme {
+		sourceIP, destinationIP, sourcePort, destinationPort, sequenceNumber = smscIP, esmeIP, smscPort, esmePort, smscInitialSequence+segment.sequenceOffset
+	}
+
+	tcpHeader := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcpHeader[0:2], sourcePort)
+	binary.BigEndian.PutUint16(tcpHeader[2:4], destinationPort)
+	binary.BigEndian.PutUint32(tcpHeader[4:8], sequenceNumber)
+	tcpHeader[12] = 5 << 4
+	tcpHeader[13] = 0x18
+
+	ipHeader := make([]byte, 20)
+	ipHeader[0] = 0x45
+	binary.BigEndian.PutUint16(ipHeader[2:4], uint16(20+20+len(segment.payload)))
+	ipHeader[8] = 64
+	ipHeader[9] = 6
+	copy(ipHeader[12:16], sourceIP)
+	copy(ipHeader[16:20], destinationIP)
+
+	ethernetHeader := make([]byte, 14)
+	binary.BigEndian.PutUint16(ethernetHeader[12:14], 0x0800)
+
+	frame := append(ethernetHeader, ipHeader...)
+	frame = append(frame, tcpHeader...)
+	return append(frame, segment.payload...)
+}
+
+func testPcapFromCaptureSegments(segments []*testCaptureSegment) []byte {
+	capture := new(bytes.Buffer)
+
+	globalHeader := make([]byte, 24)
+	binary.LittleEndian.PutUint32(globalHeader[0:4], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(globalHeader[4:6], 2)
+	binary.LittleEndian.PutUint16(globalHeader[6:8], 4)
+	binary.LittleEndian.PutUint32(globalHeader[16:20], 65535)
+	binary.LittleEndian.PutUint32(globalHeader[20:24], linkTypeEthernet)
+	capture.Write(globalHeader)
+
+	for _, segment := range segments {
+		frame := testEthernetFrameForCaptureSegment(segment)
+		recordHeader := make([]byte, 16)
+		binary.LittleEndian.PutUint32(recordHeader[0:4], uint32(segment.timestamp.Unix()))
+		binary.LittleEndian.PutUint32(recordHeader[4:8], uint32(segment.timestamp.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(recordHeader[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(recordHeader[12:16], uint32(len(frame)))
+		capture.Write(recordHeader)
+		capture.Write(frame)
+	}
+
+	return capture.Bytes()
+}
+
+func testPcapngBlock(blockType uint32, body []byte) []byte {
+	paddedBody := append(body, make([]byte, (4-len(body)%4)%4)...)
+	block := make([]byte, 8, 12+len(paddedBody))
+	binary.BigEndian.PutUint32(block[0:4], blockType)
+	binary.BigEndian.PutUint32(block[4:8], uint32(12+len(paddedBody)))
+	block = append(block, paddedBody...)
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, uint32(12+len(paddedBody)))
+	return append(block, trailer...)
+}
+
+func testPcapngFromCaptureSegments(segments []*testCaptureSegment) []byte {
+	capture := new(bytes.Buffer)
+
+	sectionHeaderBody := make([]byte, 16)
+	binary.BigEndian.PutUint32(sectionHeaderBody[0:4], pcapngByteOrderMagic)
+	binary.BigEndian.PutUint16(sectionHeaderBody[4:6], 1)
+	binary.BigEndian.PutUint64(sectionHeaderBody[8:16], 0xffffffffffffffff)
+	capture.Write(testPcapngBlock(pcapngSectionHeader, sectionHeaderBody))
+
+	interfaceBody := make([]byte, 8)
+	binary.BigEndian.PutUint16(interfaceBody[0:2], linkTypeEthernet)
+	interfaceBody = append(interfaceBody, 0, 9, 0, 1, 9, 0, 0, 0) // if_tsresol = 10^-9
+	interfaceBody = append(interfaceBody, 0, 0, 0, 0)             // opt_endofopt
+	capture.Write(testPcapngBlock(pcapngInterfaceDescriptionBlock, interfaceBody))
+
+	for _, segment := range segments {
+		frame := testEthernetFrameForCaptureSegment(segment)
+		timestamp := uint64(segment.timestamp.UnixNano())
+
+		packetBody := make([]byte, 20)
+		binary.BigEndian.PutUint32(packetBody[4:8], uint32(timestamp>>32))
+		binary.BigEndian.PutUint32(packetBody[8:12], uint32(timestamp))
+		binary.BigEndian.PutUint32(packetBody[12:16], uint32(len(frame)))
+		binary.BigEndian.PutUint32(packetBody[16:20], uint32(len(frame)))
+		capture.Write(testPcapngBlock(pcapngEnhancedPacketBlock, append(packetBody, frame...)))
+	}
+
+	return capture.Bytes()
+}
+
+func TestReadSmppCaptureFromPcap(t *testing.T) {
+	segments := testCaptureSegmentsForEnquireLinkAndSubmitSm()
+
+	for captureFormat, captureContents := range map[string][]byte{
+		"pcap":   testPcapFromCaptureSegments(segments),
+		"pcapng": testPcapngFromCaptureSegments(segments),
+	} {
+		capture, err := ReadSmppCaptureFromPcap(bytes.NewReader(captureContents), 2775)
+		if err != nil {
+			t.Errorf("[%s] Expected no error on ReadSmppCaptureFromPcap, got = (%s)", captureFormat, err)
+			continue
+		}
+
+		if len(capture.DecodeErrors) != 0 {
+			t.Errorf("[%s] Expected no decode errors, got = (%v)", captureFormat, capture.DecodeErrors)
+		}
+
+		if err := compareCapturedPduCommands(capture.EsmeToSmsc, []smpp.CommandIDType{smpp.CommandEnquireLink, smpp.CommandSubmitSm}); err != nil {
+			t.Errorf("[%s] For EsmeToSmsc, %s", captureFormat, err)
+		} else if !capture.EsmeToSmsc[1].Timestamp.Equal(segments[4].timestamp) {
+			t.Errorf("[%s] Expected submit-sm timestamp = (%s), got = (%s)", captureFormat, segments[4].timestamp, capture.EsmeToSmsc[1].Timestamp)
+		}
+
+		if err := compareCapturedPduCommands(capture.SmscToEsme, []smpp.CommandIDType{smpp.CommandEnquireLinkResp, smpp.CommandSubmitSmResp}); err != nil {
+			t.Errorf("[%s] For SmscToEsme, %s", captureFormat, err)
+		}
+	}
+}
+
+func TestReadSmppCaptureFromPcapWithNoMatchingPort(t *testing.T) {
+	_, err := ReadSmppCaptureFromPcap(bytes.NewReader(testPcapFromCaptureSegments(testCaptureSegmentsForEnquireLinkAndSubmitSm())), 9999)
+
+	if err == nil {
+		t.Errorf("Expected error when no conversation uses the SMSC port, got nil")
+	}
+}
+
+func TestReadSmppCaptureFromPcapWithInvalidMagic(t *testing.T) {
+	_, err := ReadSmppCaptureFromPcap(bytes.NewReader(make([]byte, 40)), 2775)
+
+	if err == nil {
+		t.Errorf("Expected error on capture with invalid magic number, got nil")
+	}
+}
+
+func compareCapturedPduCommands(captured []*CapturedPDU, expectedCommands []smpp.CommandIDType) error {
+	if len(captured) != len(expectedCommands) {
+		return fmt.Errorf("expected (%d) PDUs, got (%d)", len(expectedCommands), len(captured))
+	}
+
+	for i, expectedCommand := range expectedCommands {
+		if captured[i].PDU.CommandID != expectedCommand {
+			return fmt.Errorf("for PDU (%d) expected (%s), got (%s)", i, smpp.CommandName(expectedCommand), captured[i].PDU.CommandName())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package smppth
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formatSmppAbsoluteTime formats a time in the SMPP absolute time format (YYMMDDhhmmsstnnp), in UTC
+func formatSmppAbsoluteTime(t time.Time) string {
+	utc := t.UTC()
+	return fmt.Sprintf("%s%d00+", utc.Format("060102150405"), utc.Nanosecond()/100000000)
+}
+
+// validateSmppTime returns an error if value is neither empty nor a time in the SMPP absolute (YYMMDDhhmmsstnn+
+// or YYMMDDhhmmsstnn-) or relative (YYMMDDhhmmss000R) time format
+func validateSmppTime(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if len(value) != 16 {
+		return fmt.Errorf("(%s) is not 16 characters in the form YYMMDDhhmmsstnnp", value)
+	}
+
+	for i := 0; i < 15; i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return fmt.Errorf("(%s) must have only digits before the final character", value)
+		}
+	}
+
+	field := func(offset int) int { return int(value[offset]-'0')*10 + int(value[offset+1]-'0') }
+
+	switch value[15] {
+	case 'R':
+		if value[12:15] != "000" {
+			return fmt.Errorf("(%s) is a relative time, so tnn must be 000", value)
+		}
+
+	case '+', '-':
+		if month, day := field(2), field(4); month < 1 || month > 12 || day < 1 || day > 31 {
+			return fmt.Errorf("(%s) has an invalid month or day", value)
+		}
+		if field(6) > 23 || field(8) > 59 || field(10) > 59 {
+			return fmt.Errorf("(%s) has an invalid hour, minute or second", value)
+		}
+		if field(13) > 48 {
+			return fmt.Errorf("(%s) has a UTC offset of more than 48 quarter hours", value)
+		}
+
+	default:
+		return fmt.Errorf("(%s) must end with +, - or R", value)
+	}
+
+	return nil
+}
+
+// parseSmppTime converts a time in the SMPP absolute or relative time format into a time.  A relative time is
+// added to reference.  isSet is false if value is empty.
+func parseSmppTime(value string, reference time.Time) (parsedTime time.Time, isSet bool, err error) {
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	if err := validateSmppTime(value); err != nil {
+		return time.Time{}, false, err
+	}
+
+	field := func(offset int) int { return int(value[offset]-'0')*10 + int(value[offset+1]-'0') }
+
+	if value[15] == 'R' {
+		return reference.AddDate(field(0), field(2), field(4)).Add(time.Duration(field(6))*time.Hour + time.Duration(field(8))*time.Minute + time.Duration(field(10))*time.Second), true, nil
+	}
+
+	offset := time.Duration(field(13)) * 15 * time.Minute
+	if value[15] == '-' {
+		offset = -offset
+	}
+
+	localTime := time.Date(2000+field(0), time.Month(field(2)), field(4), field(6), field(8), field(10), int(value[12]-'0')*100000000, time.UTC)
+
+	return localTime.Add(-offset), true, nil
+}
+
+var durationWithDaysMatcher = regexp.MustCompile(`^(\d+)d(.*)$`)
+
+// parseSmppTimeExpression converts a time expression into the SMPP time format.  An empty expression, or one that
+// is already in SMPP absolute or relative time format, is returned as it is.  +$duration (e.g., +1h30m or +2d) is
+// a relative time.  now, now+$duration and now-$duration are absolute times relative to the provided now, as is an
+// RFC 3339 time (e.g., 2030-01-02T15:04:05Z).  A $duration is a Go duration (e.g., 1h30m10s), optionally preceded
+// by a number of days (e.g., 2d12h).
+func parseSmppTimeExpression(expression string, now time.Time) (string, error) {
+	switch {
+	case expression == "" || len(expression) == 16 && validateSmppTime(expression) == nil:
+		return expression, nil
+
+	case strings.HasPrefix(expression, "+"):
+		duration, err := parseDurationWithDays(expression[1:])
+		if err != nil {
+			return "", err
+		}
+		return formatSmppRelativeTime(duration)
+
+	case expression == "now":
+		return formatSmppAbsoluteTime(now), nil
+
+	case strings.HasPrefix(expression, "now+") || strings.HasPrefix(expression, "now-"):
+		duration, err := parseDurationWithDays(expression[4:])
+		if err != nil {
+			return "", err
+		}
+		if expression[3] == '-' {
+			duration = -duration
+		}
+		return formatSmppAbsoluteTime(now.Add(duration)), nil
+	}
+
+	if absoluteTime, err := time.Parse(time.RFC3339, expression); err == nil {
+		return formatSmppAbsoluteTime(absoluteTime), nil
+	}
+
+	return "", fmt.Errorf("expected YYMMDDhhmmsstnnp, +$duration (e.g., +1h30m), now[+|-$duration] or an RFC 3339 time")
+}
+
+// parseDurationWithDays parses a Go duration that may be preceded by a number of days (e.g., 2d12h)
+func parseDurationWithDays(expression string) (time.Duration, error) {
+	days := 0
+	if groups := durationWithDaysMatcher.FindStringSubmatch(expression); groups != nil {
+		days, _ = strconv.Atoi(groups[1])
+		if expression = groups[2]; expression == "" {
+			expression = "0s"
+		}
+	}
+
+	duration, err := time.ParseDuration(expression)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("(%s) is not a duration (e.g., 1h30m or 2d12h)", expression)
+	}
+
+	return time.Duration(days)*24*time.Hour + duration, nil
+}
+
+// formatSmppRelativeTime formats a duration in the SMPP relative time format (YYMMDDhhmmss000R).  A year is
+// treated as 365 days, and a month as 30 days.
+func formatSmppRelativeTime(duration time.Duration) (string, error) {
+	totalSeconds := int64(duration / time.Second)
+	seconds, minutes, hours := totalSeconds%60, totalSeconds/60%60, totalSeconds/3600%24
+	days := totalSeconds / 86400
+	years, months := days/365, days%365/30
+	days = days % 365 % 30
+
+	if years > 99 {
+		return "", fmt.Errorf("relative time may be no more than 99 years")
+	}
+
+	return fmt.Sprintf("%02d%02d%02d%02d%02d%02d000R", years, months, days, hours, minutes, seconds), nil
+}
@@ -0,0 +1,60 @@
+package smppth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSmppTimeExpression(t *testing.T) {
+	now := time.Date(2025, 3, 4, 5, 6, 7, 800000000, time.UTC)
+
+	for expression, expected := range map[string]string{
+		"":                          "",
+		"250304050607800+":          "250304050607800+",
+		"000001000000000R":          "000001000000000R",
+		"+1h30m":                    "000000013000000R",
+		"+2d12h5s":                  "000002120005000R",
+		"+400d":                     "010105000000000R",
+		"now":                       "250304050607800+",
+		"now+1h":                    "250304060607800+",
+		"now-2d":                    "250302050607800+",
+		"2030-01-02T15:04:05+02:00": "300102130405000+",
+	} {
+		smppTime, err := parseSmppTimeExpression(expression, now)
+		if err != nil {
+			t.Errorf("For (%s) expected no error, got = (%s)", expression, err)
+		} else if smppTime != expected {
+			t.Errorf("For (%s) expected (%s), got (%s)", expression, expected, smppTime)
+		}
+	}
+
+	for _, expression := range []string{"tomorrow", "+1y", "+-1h", "now+", "2030-01-02", "+40000d"} {
+		if _, err := parseSmppTimeExpression(expression, now); err == nil {
+			t.Errorf("For (%s) expected error, got none", expression)
+		}
+	}
+}
+
+func TestParseSmppTime(t *testing.T) {
+	reference := time.Date(2030, 1, 31, 12, 0, 0, 0, time.UTC)
+
+	for value, expectedTime := range map[string]time.Time{
+		"300102150405012+": time.Date(2030, 1, 2, 12, 4, 5, 0, time.UTC),
+		"300102150405304-": time.Date(2030, 1, 2, 16, 4, 5, 300000000, time.UTC),
+		"000001020304000R": reference.AddDate(0, 0, 1).Add(2*time.Hour + 3*time.Minute + 4*time.Second),
+		"010100000000000R": reference.AddDate(1, 1, 0),
+	} {
+		parsedTime, isSet, err := parseSmppTime(value, reference)
+		if err != nil || !isSet || !parsedTime.Equal(expectedTime) {
+			t.Errorf("Expected (%s) to be (%s), got (%s), error = (%v)", value, expectedTime, parsedTime, err)
+		}
+	}
+
+	if _, isSet, err := parseSmppTime("", reference); isSet || err != nil {
+		t.Errorf("Expected empty time to be unset without error")
+	}
+
+	if _, _, err := parseSmppTime("301302150405000+", reference); err == nil {
+		t.Errorf("Expected error on invalid SMPP time, got none")
+	}
+}
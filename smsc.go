@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/blorticus/smpp"
 )
@@ -20,6 +21,13 @@ type SMSC struct {
 	agentEventChannel                         chan<- *AgentEvent
 	incomingPeerTransportListener             net.Listener
 	isStopped                                 bool
+	isStoppedLock                             sync.Mutex
+	wireTraceAttachments                      *wireTraceAttachments
+	deliveryReceiptPolicy                     *DeliveryReceiptPolicy
+	messageIDGenerator                        MessageIDGenerator
+	messageStore                              *MessageStore
+	routingTable                              *RoutingTable
+	deliveryQueue                             *DeliveryQueue
 }
 
 // NewSMSC creates a new SMSC agent.
@@ -36,6 +44,11 @@ func NewSMSC(smscName string, smscBindSystemID string, listeningIP net.IP, liste
 		agentEventChannel:             nil,
 		incomingPeerTransportListener: nil,
 		isStopped:                     true,
+		wireTraceAttachments:          newWireTraceAttachments(),
+		deliveryReceiptPolicy:         NewDeliveryReceiptPolicy(),
+		messageIDGenerator:            newDefaultMessageIDGenerator(),
+		messageStore:                  NewMessageStore(),
+		deliveryQueue:                 NewDeliveryQueue(),
 	}
 }
 
@@ -49,6 +62,118 @@ func (smsc *SMSC) SetAgentEventChannel(agentEventChannel chan<- *AgentEvent) {
 	smsc.agentEventChannel = agentEventChannel
 }
 
+// AttachWireTraceWriter enables wire tracing for the sessions with all peers, writing the trace to the
+// provided writer.  It replaces any tracer previously attached for all peers, but a tracer attached for a
+// specific peer with AttachWireTraceWriterForPeer takes precedence for that peer.
+func (smsc *SMSC) AttachWireTraceWriter(writer io.Writer) {
+	smsc.wireTraceAttachments.attachForAllPeers(NewWireTracer(writer))
+	smsc.applyWireTracersToPeerSessions()
+}
+
+// AttachWireTraceWriterForPeer enables wire tracing for the session with the named peer, writing the
+// trace to the provided writer.  Because the SMSC learns the name of a peer from its bind, the bind
+// itself is traced only by a tracer attached for all peers.
+func (smsc *SMSC) AttachWireTraceWriterForPeer(nameOfPeer string, writer io.Writer) {
+	smsc.wireTraceAttachments.attachForPeer(nameOfPeer, NewWireTracer(writer))
+	smsc.applyWireTracersToPeerSessions()
+}
+
+// SetDeliveryReceiptPolicy replaces the policy that determines when a StandardApplication sends a delivery
+// receipt on behalf of this SMSC for an accepted submit-sm, and what it reports.  By default, the SMSC uses a
+// DeliveryReceiptPolicy with no rules.
+func (smsc *SMSC) SetDeliveryReceiptPolicy(policy *DeliveryReceiptPolicy) {
+	smsc.deliveryReceiptPolicy = policy
+}
+
+// DeliveryReceiptPolicy returns the delivery receipt policy for this SMSC
+func (smsc *SMSC) DeliveryReceiptPolicy() *DeliveryReceiptPolicy {
+	return smsc.deliveryReceiptPolicy
+}
+
+// SetMessageIDGenerator replaces the generator for the message_id of each message accepted on behalf of this
+// SMSC (e.g., in an automatic submit-sm-resp).  By default, the SMSC uses a TemplateMessageIDGenerator with the
+// template {agent}-{seq}, so that its message_ids (e.g., smsc01-1) differ from those of any other SMSC.  This is the
+// only generator used for the SMSC; StandardApplication.SetMessageIDGenerator() does not change it.
+func (smsc *SMSC) SetMessageIDGenerator(generator MessageIDGenerator) {
+	smsc.messageIDGenerator = generator
+}
+
+// NextMessageID returns the next message_id from the message ID generator for this SMSC, skipping any message_id
+// that is already in its MessageStore (e.g., one loaded from its message journal after a restart)
+func (smsc *SMSC) NextMessageID() string {
+	return nextMessageIDNotInStore(smsc.messageIDGenerator, smsc.name, smsc.messageStore)
+}
+
+// evictFinalMessages removes the messages that the MessageStore no longer keeps in a final state, and releases their
+// message_ids in the message ID generator
+func (smsc *SMSC) evictFinalMessages(now time.Time) {
+	for _, message := range smsc.messageStore.EvictFinalMessages(now) {
+		forgetMessageID(smsc.messageIDGenerator, message.MessageID)
+	}
+}
+
+// replayMessageJournal loads the messages in the attached message journal, if there is one, into the message store.
+// The DeliveryQueue is not journaled, so each routed message that has not reached a final state is held in it again,
+// unless it is already there, to be retried when its peer binds.
+func (smsc *SMSC) replayMessageJournal(now time.Time) error {
+	if !smsc.messageStore.hasJournal() {
+		return nil
+	}
+
+	if err := smsc.messageStore.ReplayJournal(); err != nil {
+		return err
+	}
+
+	for _, message := range smsc.messageStore.Messages(nil) {
+		if message.RoutedToPeer == "" || message.State.IsFinal() || smsc.deliveryQueue.hasDeliveryOfMessage(message.MessageID) {
+			continue
+		}
+
+		smsc.deliveryQueue.hold(&QueuedDelivery{
+			NameOfPeer: message.RoutedToPeer,
+			MessageID:  message.MessageID,
+			PDU:        createDeliverSmFromStoredMessage(message),
+			ExpiresAt:  message.ExpiresAt,
+		}, "message replayed from the message journal", now)
+	}
+
+	return nil
+}
+
+// MessageStore returns the store of messages accepted on behalf of this SMSC (e.g., by a StandardApplication,
+// in an automatic submit-sm-resp), which also tracks the state of each message
+func (smsc *SMSC) MessageStore() *MessageStore {
+	return smsc.messageStore
+}
+
+// SetRoutingTable puts this SMSC in routing mode, in which a StandardApplication forwards each submit-sm received
+// by the SMSC as a deliver-sm to the bound peer chosen by the RoutingTable.  By default, the SMSC has no RoutingTable,
+// and simply accepts each submit-sm.  Setting a nil RoutingTable leaves routing mode.
+func (smsc *SMSC) SetRoutingTable(table *RoutingTable) {
+	smsc.routingTable = table
+}
+
+// RoutingTable returns the routing table for this SMSC, or nil if it is not in routing mode
+func (smsc *SMSC) RoutingTable() *RoutingTable {
+	return smsc.routingTable
+}
+
+// DeliveryQueue returns the queue in which a StandardApplication holds the deliver-sm PDUs (routed messages and
+// delivery receipts) that this SMSC could not deliver, until they can be retried
+func (smsc *SMSC) DeliveryQueue() *DeliveryQueue {
+	return smsc.deliveryQueue
+}
+
+// AttachMessageJournal makes the message store of this SMSC persistent: every change to a stored message is written
+// to the journal, and the messages in the journal are loaded into the store when StartEventLoop() is called.  A
+// routed message that was not yet delivered is held again in the DeliveryQueue.  If writing to the journal fails,
+// an ApplicationError event is emitted.
+func (smsc *SMSC) AttachMessageJournal(journal *MessageJournal) {
+	smsc.messageStore.AttachJournal(journal, func(err error) {
+		go smsc.sendApplicationErrorEvent(err, nil)
+	})
+}
+
 // SendMessageToPeer instructs this SMSC agent to send a message to the peer identified in the
 // MessageDescriptor.  No effort is made to validate that the MessageDescriptor SourceAgentName
 // matches this agent's name.
@@ -64,16 +189,21 @@ func (smsc *SMSC) SendMessageToPeer(message *MessageDescriptor) error {
 
 // StartEventLoop instructs this SMSC agent to start listening for incoming transport connections,
 // to respond to binds, to emit AgentEvents to the agentEventChannel, and accept
-// messages for remote delivery via SendMessageToPeer().
+// messages for remote delivery via SendMessageToPeer().  If a message journal is attached, the
+// messages in it are first loaded into the message store.
 func (smsc *SMSC) StartEventLoop() {
+	if err := smsc.replayMessageJournal(time.Now()); err != nil {
+		smsc.sendApplicationErrorEvent(fmt.Errorf("Failed to replay message journal: %s", err), nil)
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", smsc.ip.String(), smsc.port))
 	if smsc.sendTransportErrorEventAndStopAllWhenErrorDefined(err, "") {
 		return
 	}
 
-	smsc.isStopped = false
+	smsc.setStopped(false)
 
-	for smsc.isStopped == false {
+	for !smsc.stopped() {
 		incomingTransport, err := listener.Accept()
 		if smsc.sendTransportErrorEventAndStopAllWhenErrorDefined(err, "") {
 			return
@@ -87,7 +217,7 @@ func (smsc *SMSC) StartEventLoop() {
 // StopAndUnbindAll instructs this SMSC agent to stop listening for incoming transport connections,
 // and to both unbind all outstanding peer connections, and close their corresponding transports.
 func (smsc *SMSC) StopAndUnbindAll() {
-	smsc.isStopped = true
+	smsc.setStopped(true)
 
 	if smsc.incomingPeerTransportListener != nil {
 		if listenerCloseErr := smsc.incomingPeerTransportListener.Close(); listenerCloseErr != nil {
@@ -107,6 +237,40 @@ func (smsc *SMSC) StopAndUnbindAll() {
 	})
 }
 
+// setStopped and stopped guard isStopped, which StopAndUnbindAll() sets from a peer handler goroutine while the
+// StartEventLoop() goroutine reads it
+func (smsc *SMSC) setStopped(isStopped bool) {
+	smsc.isStoppedLock.Lock()
+	defer smsc.isStoppedLock.Unlock()
+	smsc.isStopped = isStopped
+}
+
+func (smsc *SMSC) stopped() bool {
+	smsc.isStoppedLock.Lock()
+	defer smsc.isStoppedLock.Unlock()
+	return smsc.isStopped
+}
+
+// ClosePeerTransport closes the transport toward the named ESME peer (that is, the bind system_id) without unbinding,
+// as if the connection were lost.  A PeerTransportClosed AgentEvent is raised once the transport is closed.  An error
+// is returned if no such peer has bound to this SMSC.
+func (smsc *SMSC) ClosePeerTransport(nameOfPeer string) error {
+	peerHandler, peerIsKnown := smsc.mapOfHandlerForRemotePeerByRemotePeerName.Load(nameOfPeer)
+	if !peerIsKnown {
+		return fmt.Errorf("No such ESME peer named (%s) is known to this SMSC", nameOfPeer)
+	}
+
+	peerHandler.(*smscPeerMessageHandler).close()
+	return nil
+}
+
+func (smsc *SMSC) applyWireTracersToPeerSessions() {
+	smsc.mapOfHandlerForRemotePeerByRemotePeerName.Range(func(peerName interface{}, peerHandler interface{}) bool {
+		peerHandler.(*smscPeerMessageHandler).connectionToPeer.setTracer(smsc.wireTraceAttachments.tracerForPeer(peerName.(string)))
+		return true
+	})
+}
+
 func (smsc *SMSC) sendApplicationErrorEvent(err error, pduRelatedToErrorOrNilIfNone *smpp.PDU) {
 	smsc.sendEventIfChannelDefined(&AgentEvent{
 		Type:           ApplicationError,
@@ -167,22 +331,30 @@ func (smsc *SMSC) notifySmscOfThisHandlersPeerName(peerNameAssertedInBindRequest
 }
 
 type smscPeerMessageHandler struct {
-	connectionToPeer                     net.Conn
-	streamReader                         *smpp.NetworkStreamReader
+	connectionToPeer                     *wireTracingConn
+	streamReader                         *pduStreamReader
 	parentSMSC                           *SMSC
 	nameOfRemotePeer                     string
 	nextGeneratedSmppRequestPduSeqNumber uint32
+	sendLock                             sync.Mutex
+	sentRequests                         *sentRequestTracker
 	stopChannel                          chan bool
+	closeChannel                         chan bool
 }
 
 func newSmscPeerMessageHandler(parentSmsc *SMSC, transportConnectionToPeer net.Conn) *smscPeerMessageHandler {
+	tracingConnectionToPeer := newWireTracingConn(transportConnectionToPeer, wireTraceSessionID(parentSmsc.Name(), remoteAddressOfConnection(transportConnectionToPeer)))
+	tracingConnectionToPeer.setTracer(parentSmsc.wireTraceAttachments.tracerForPeer(""))
+
 	return &smscPeerMessageHandler{
-		connectionToPeer:                     transportConnectionToPeer,
-		streamReader:                         smpp.NewNetworkStreamReader(transportConnectionToPeer),
+		connectionToPeer:                     tracingConnectionToPeer,
+		streamReader:                         newPduStreamReader(tracingConnectionToPeer),
 		parentSMSC:                           parentSmsc,
 		nameOfRemotePeer:                     "",
 		nextGeneratedSmppRequestPduSeqNumber: 1,
+		sentRequests:                         newSentRequestTracker(),
 		stopChannel:                          make(chan bool),
+		closeChannel:                         make(chan bool, 1),
 	}
 }
 
@@ -203,6 +375,8 @@ func (handler *smscPeerMessageHandler) startHandlingPeerConnection() {
 	}
 
 	handler.nameOfRemotePeer = handler.extractPeerNameFromTransceiverBind(pdus[0])
+	handler.connectionToPeer.setSessionID(wireTraceSessionID(handler.parentSMSC.Name(), handler.nameOfRemotePeer))
+	handler.connectionToPeer.setTracer(handler.parentSMSC.wireTraceAttachments.tracerForPeer(handler.nameOfRemotePeer))
 	handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
 		RemotePeerName: handler.nameOfRemotePeer,
 		SourceAgent:    handler.parentSMSC,
@@ -232,12 +406,7 @@ func (handler *smscPeerMessageHandler) startHandlingPeerConnection() {
 	})
 
 	for i := 1; i < len(pdus); i++ {
-		handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
-			Type:           ReceivedPDU,
-			SmppPDU:        pdus[i],
-			RemotePeerName: handler.nameOfRemotePeer,
-			SourceAgent:    handler.parentSMSC,
-		})
+		handler.processPduReceivedFromPeer(pdus[i])
 	}
 
 	streamReaderReceiptChannel := make(chan *peerHandlerStreamReaderOutput)
@@ -252,17 +421,25 @@ func (handler *smscPeerMessageHandler) startHandlingPeerConnection() {
 	for {
 		select {
 		case incomingStreamReaderResults := <-streamReaderReceiptChannel:
-			if handler.parentSMSC.sendTransportErrorEventAndStopAllWhenErrorDefined(incomingStreamReaderResults.err, handler.nameOfRemotePeer) {
-				return
+			for _, pdu := range incomingStreamReaderResults.pdus {
+				handler.processPduReceivedFromPeer(pdu)
 			}
 
-			for _, pdu := range incomingStreamReaderResults.pdus {
-				handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
-					Type:           ReceivedPDU,
-					SmppPDU:        pdu,
-					RemotePeerName: handler.nameOfRemotePeer,
-					SourceAgent:    handler.parentSMSC,
-				})
+			if decodeError, isDecodeError := incomingStreamReaderResults.err.(*PduDecodeError); isDecodeError {
+				if handler.parentSMSC.sendTransportErrorEventAndStopAllWhenErrorDefined(handler.answerUndecodablePduWithGenericNack(decodeError), handler.nameOfRemotePeer) {
+					return
+				}
+
+				if decodeError.TransportMustClose {
+					handler.closePeerTransport()
+					return
+				}
+
+				continue
+			}
+
+			if handler.parentSMSC.sendTransportErrorEventAndStopAllWhenErrorDefined(incomingStreamReaderResults.err, handler.nameOfRemotePeer) {
+				return
 			}
 
 		case <-handler.stopChannel:
@@ -271,14 +448,49 @@ func (handler *smscPeerMessageHandler) startHandlingPeerConnection() {
 			}
 
 			return
+
+		case <-handler.closeChannel:
+			handler.closePeerTransport()
+			return
 		}
 	}
 }
 
+// closePeerTransport closes the transport without unbinding, then emits a PeerTransportClosed event
+func (handler *smscPeerMessageHandler) closePeerTransport() {
+	if err := handler.connectionToPeer.Close(); err != nil {
+		handler.parentSMSC.sendTransportErrorEvent(fmt.Errorf("On local connection close: %s", err), handler.nameOfRemotePeer)
+		return
+	}
+
+	handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
+		Type:           PeerTransportClosed,
+		SourceAgent:    handler.parentSMSC,
+		RemotePeerName: handler.nameOfRemotePeer,
+	})
+}
+
+func remoteAddressOfConnection(connection net.Conn) string {
+	if remoteAddress := connection.RemoteAddr(); remoteAddress != nil {
+		return remoteAddress.String()
+	}
+
+	return "unknown-peer"
+}
+
 func (handler *smscPeerMessageHandler) stop() {
 	handler.stopChannel <- true
 }
 
+// close asks the handler to close the transport without unbinding.  It does not block, and does nothing if a close
+// has already been requested.
+func (handler *smscPeerMessageHandler) close() {
+	select {
+	case handler.closeChannel <- true:
+	default:
+	}
+}
+
 func (handler *smscPeerMessageHandler) extractPeerNameFromTransceiverBind(pdu *smpp.PDU) string {
 	return pdu.MandatoryParameters[0].Value.(string)
 }
@@ -307,18 +519,56 @@ func (handler *smscPeerMessageHandler) makeNameShortEnoughForSmppSystemIDField(n
 	return name
 }
 
-func (handler *smscPeerMessageHandler) sendSmppPduToPeer(pdu *smpp.PDU) error {
+// processPduReceivedFromPeer emits a ReceivedPDU event for the PDU.  If it is a generic-nack that rejects a
+// request sent on this session, a ProtocolError event is also emitted.
+func (handler *smscPeerMessageHandler) processPduReceivedFromPeer(pdu *smpp.PDU) {
+	handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
+		Type:           ReceivedPDU,
+		SmppPDU:        pdu,
+		RemotePeerName: handler.nameOfRemotePeer,
+		SourceAgent:    handler.parentSMSC,
+	})
+
 	if pdu.IsRequest() {
-		handler.resetSmppRequestPduSequenceNumberToLocalSequence(pdu)
+		return
 	}
 
-	encodedPDU, err := pdu.Encode()
-	if err != nil {
+	if rejectedRequest := handler.sentRequests.removeRequestMatchingResponse(pdu); rejectedRequest != nil && pdu.CommandID == smpp.CommandGenericNack {
+		handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
+			Type:           ProtocolError,
+			SmppPDU:        rejectedRequest,
+			RemotePeerName: handler.nameOfRemotePeer,
+			SourceAgent:    handler.parentSMSC,
+			Error:          genericNackRejectionError(pdu, rejectedRequest),
+		})
+	}
+}
+
+// answerUndecodablePduWithGenericNack sends a generic-nack for a PDU that could not be decoded, then emits
+// a ProtocolError event.  An error is returned only if the generic-nack could not be sent.
+func (handler *smscPeerMessageHandler) answerUndecodablePduWithGenericNack(decodeError *PduDecodeError) error {
+	genericNack := generateGenericNackForDecodeError(decodeError)
+
+	if err := handler.sendSmppPduToPeer(genericNack); err != nil {
 		return err
 	}
 
-	_, err = handler.connectionToPeer.Write(encodedPDU)
-	if err != nil {
+	handler.parentSMSC.sendEventIfChannelDefined(&AgentEvent{
+		Type:           ProtocolError,
+		SmppPDU:        genericNack,
+		RemotePeerName: handler.nameOfRemotePeer,
+		SourceAgent:    handler.parentSMSC,
+		Error:          decodeError,
+	})
+
+	return nil
+}
+
+// sendSmppPduToPeer writes a PDU to the peer, then emits a SentPDU event.  A request is given the next local
+// sequence_number.  As with the ESME, the sequence_number is assigned, and the PDU is written, with the send lock
+// held, because PDUs may be sent to the same peer from several goroutines at once.
+func (handler *smscPeerMessageHandler) sendSmppPduToPeer(pdu *smpp.PDU) error {
+	if err := handler.writeSmppPduToPeer(pdu); err != nil {
 		return err
 	}
 
@@ -332,6 +582,31 @@ func (handler *smscPeerMessageHandler) sendSmppPduToPeer(pdu *smpp.PDU) error {
 	return nil
 }
 
+func (handler *smscPeerMessageHandler) writeSmppPduToPeer(pdu *smpp.PDU) error {
+	handler.sendLock.Lock()
+	defer handler.sendLock.Unlock()
+
+	if pdu.IsRequest() {
+		handler.resetSmppRequestPduSequenceNumberToLocalSequence(pdu)
+	}
+
+	encodedPDU, err := pdu.Encode()
+	if err != nil {
+		return err
+	}
+
+	if pdu.IsRequest() {
+		handler.sentRequests.add(pdu, time.Now())
+	}
+
+	if _, err = handler.connectionToPeer.Write(encodedPDU); err != nil {
+		handler.sentRequests.removeRequestMatchingResponse(pdu)
+		return err
+	}
+
+	return nil
+}
+
 func (handler *smscPeerMessageHandler) resetSmppRequestPduSequenceNumberToLocalSequence(requestPdu *smpp.PDU) {
 	requestPdu.SequenceNumber = handler.nextGeneratedSmppRequestPduSeqNumber
 	handler.nextGeneratedSmppRequestPduSeqNumber++
@@ -63,3 +63,50 @@ func TestSmscPeerMessageHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestSmscClosePeerTransport(t *testing.T) {
+	smsc := NewSMSC("testSmsc", "testSmsc", net.ParseIP("127.0.0.1"), 2772)
+	localConn, remoteConn := net.Pipe()
+	handler := newSmscPeerMessageHandler(smsc, localConn)
+
+	eventMsgChannel := make(chan *AgentEvent, 10)
+	smsc.SetAgentEventChannel(eventMsgChannel)
+
+	go handler.startHandlingPeerConnection()
+
+	if _, err := remoteConn.Write(testSmppMsgBindTransceiver01()); err != nil {
+		t.Fatalf("Unable to write bind-transceiver to handler: %s", err)
+	}
+	if _, err := remoteConn.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("Unable to read bind-transceiver-resp from handler: %s", err)
+	}
+	if _, err := eventChannelTypeCheck(eventMsgChannel, ReceivedPDU); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eventChannelTypeCheck(eventMsgChannel, SentPDU); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eventChannelTypeCheck(eventMsgChannel, CompletedBind); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := smsc.ClosePeerTransport("bar"); err == nil {
+		t.Errorf("Expected error on ClosePeerTransport() for unknown peer, got none")
+	}
+
+	if err := smsc.ClosePeerTransport("foo"); err != nil {
+		t.Fatalf("Expected no error on ClosePeerTransport(), got = (%s)", err)
+	}
+
+	event, err := eventChannelTypeCheck(eventMsgChannel, PeerTransportClosed)
+	if err != nil {
+		t.Fatalf("On ClosePeerTransport(), %s", err)
+	}
+	if event.RemotePeerName != "foo" {
+		t.Errorf("Expected PeerTransportClosed for (foo), got (%s)", event.RemotePeerName)
+	}
+
+	if _, err := remoteConn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected transport to be closed without an unbind, but read from it succeeded")
+	}
+}
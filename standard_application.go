@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/blorticus/smpp"
@@ -37,9 +39,31 @@ type StandardApplication struct {
 	incomingSharedEventChannel  <-chan *AgentEvent
 	proxiedOutgoingEventChannel chan *AgentEvent
 	automaticResponsesEnabled   bool
+	manualResponsesEnabled      bool
 	debugLogger                 *log.Logger
 	shouldProxyAgentEvents      bool
 	quitCommandCallback         func()
+	metricsCollector            *MetricsCollector
+	messageStoresByNameOfAgent  map[string]*MessageStore
+	messageStoresLock           sync.Mutex
+	submitMultiFailures         map[string]uint32
+	submitMultiFailuresLock     sync.Mutex
+	messageReassembler          *MessageReassembler
+	dueDeliveryReceipts         chan *SMSC
+	queuedDeliveriesMayBeDue    bool
+	deliveryReceiptTracker      *DeliveryReceiptTracker
+	messageIDGenerator          MessageIDGenerator
+	responsePolicy              *ResponsePolicy
+	delayedResponses            []*delayedResponse
+	delayedResponsesLock        sync.Mutex
+	delayedResponsesAreDue      chan bool
+	pendingRequests             *PendingRequestQueue
+}
+
+// delayedResponse is a request whose ResponseRule action is applied once the rule delay has passed
+type delayedResponse struct {
+	rule    *ResponseRule
+	request *AgentEvent
 }
 
 // NewStandardApplication creates a new StandardApplication
@@ -55,6 +79,17 @@ func NewStandardApplication() *StandardApplication {
 		debugLogger:                 log.New(ioutil.Discard, "", 0),
 		shouldProxyAgentEvents:      true,
 		quitCommandCallback:         func() {},
+		metricsCollector:            NewMetricsCollector(),
+		messageStoresByNameOfAgent:  make(map[string]*MessageStore),
+		submitMultiFailures:         make(map[string]uint32),
+		messageReassembler:          NewMessageReassembler(30 * time.Second),
+		dueDeliveryReceipts:         make(chan *SMSC, 1),
+		deliveryReceiptTracker:      NewDeliveryReceiptTracker(),
+		messageIDGenerator:          newDefaultMessageIDGenerator(),
+		responsePolicy:              NewResponsePolicy(),
+		delayedResponses:            make([]*delayedResponse, 0),
+		delayedResponsesAreDue:      make(chan bool, 1),
+		pendingRequests:             NewPendingRequestQueue(),
 	}
 }
 
@@ -66,6 +101,15 @@ func (app *StandardApplication) DisableAutomaticResponsesToRequestPdus() *Standa
 	return app
 }
 
+// EnableManualResponses disables automatic responses to incoming PDUs, and instead holds each request that would
+// have been answered automatically in the PendingRequestQueue, where it can be answered with a Respond UserCommand.
+// A held request is removed from the queue when any response with its sequence_number is sent on its session.
+func (app *StandardApplication) EnableManualResponses() *StandardApplication {
+	app.automaticResponsesEnabled = false
+	app.manualResponsesEnabled = true
+	return app
+}
+
 // SetOutputGenerator adds something implementing the OutputGenerator interface, which is then used
 // by the StandardApplication to generate output message (written to the EventOutputWriter).  If this
 // option isn't applied, the default is to use a StandardOutputGenerator.
@@ -100,6 +144,124 @@ func (app *StandardApplication) OnQuit(quitCommandCallback func()) *StandardAppl
 	return app
 }
 
+// SetMetricsCollector replaces the MetricsCollector that is fed every AgentEvent arriving on the attached
+// event channel.  By default, the application creates its own MetricsCollector.  If collector is nil, metrics
+// are not collected, and the stats, sessions and outstanding commands say so.
+func (app *StandardApplication) SetMetricsCollector(collector *MetricsCollector) *StandardApplication {
+	app.metricsCollector = collector
+	return app
+}
+
+// MetricsCollector returns the MetricsCollector fed by the application, or nil if metrics collection is disabled.
+// Its StartHTTPEndpoint() method can be used to serve the metrics in the Prometheus text exposition format.
+func (app *StandardApplication) MetricsCollector() *MetricsCollector {
+	return app.metricsCollector
+}
+
+// SetSubmitMultiFailureForDestination causes automatic submit-multi-resp messages to include an unsuccess_sme
+// entry with the provided error_status_code (e.g., EsmeRdeliveryfailure) whenever destinationAddress is one
+// of the SME addresses in the submit-multi.  Destinations without a configured failure are successful.  It is safe
+// to call while the application is running.
+func (app *StandardApplication) SetSubmitMultiFailureForDestination(destinationAddress string, errorStatusCode uint32) *StandardApplication {
+	app.submitMultiFailuresLock.Lock()
+	defer app.submitMultiFailuresLock.Unlock()
+
+	app.submitMultiFailures[destinationAddress] = errorStatusCode
+	return app
+}
+
+// SetSubmitMultiFailures replaces every failure set by SetSubmitMultiFailureForDestination() with the provided map
+// from destination address to error_status_code (e.g., the one returned by
+// ApplicationConfigYamlReader.SubmitMultiFailures()).
+func (app *StandardApplication) SetSubmitMultiFailures(errorStatusCodeByDestinationAddress map[string]uint32) *StandardApplication {
+	app.submitMultiFailuresLock.Lock()
+	defer app.submitMultiFailuresLock.Unlock()
+
+	app.submitMultiFailures = make(map[string]uint32)
+	for destinationAddress, errorStatusCode := range errorStatusCodeByDestinationAddress {
+		app.submitMultiFailures[destinationAddress] = errorStatusCode
+	}
+
+	return app
+}
+
+// RemoveSubmitMultiFailureForDestination removes the failure set for destinationAddress, so that it is successful
+// in automatic submit-multi-resp messages.  It returns false if no failure was set for destinationAddress.
+func (app *StandardApplication) RemoveSubmitMultiFailureForDestination(destinationAddress string) bool {
+	app.submitMultiFailuresLock.Lock()
+	defer app.submitMultiFailuresLock.Unlock()
+
+	_, failureWasSet := app.submitMultiFailures[destinationAddress]
+	delete(app.submitMultiFailures, destinationAddress)
+
+	return failureWasSet
+}
+
+// SubmitMultiFailures returns a copy of the map from destination address to the error_status_code used for it in
+// automatic submit-multi-resp messages
+func (app *StandardApplication) SubmitMultiFailures() map[string]uint32 {
+	app.submitMultiFailuresLock.Lock()
+	defer app.submitMultiFailuresLock.Unlock()
+
+	errorStatusCodeByDestinationAddress := make(map[string]uint32)
+	for destinationAddress, errorStatusCode := range app.submitMultiFailures {
+		errorStatusCodeByDestinationAddress[destinationAddress] = errorStatusCode
+	}
+
+	return errorStatusCodeByDestinationAddress
+}
+
+// SetMessageReassembler replaces the MessageReassembler that is fed every received submit-sm and deliver-sm.
+// When all segments of a concatenated message arrive, a ReceivedCompleteMessage AgentEvent is handled (and proxied)
+// as if it arrived on the event channel, and likewise for IncompleteMessageTimedOut.  By default, the application
+// creates its own MessageReassembler with an incomplete message timeout of 30 seconds.  If reassembler is nil,
+// messages are not reassembled.
+func (app *StandardApplication) SetMessageReassembler(reassembler *MessageReassembler) *StandardApplication {
+	app.messageReassembler = reassembler
+	return app
+}
+
+// SetMessageIDGenerator replaces the generator for the message_id in responses sent by an agent that is not an SMSC.
+// It does not apply to an SMSC, which always uses its own generator (see SMSC.SetMessageIDGenerator()).  By default,
+// the application uses a TemplateMessageIDGenerator with the template {agent}-{seq}, as an SMSC does.
+func (app *StandardApplication) SetMessageIDGenerator(generator MessageIDGenerator) *StandardApplication {
+	app.messageIDGenerator = generator
+	return app
+}
+
+// SetDeliveryReceiptTracker replaces the DeliveryReceiptTracker that is fed every AgentEvent arriving on the
+// attached event channel.  When a delivery receipt arrives, a DeliveryReceiptReceived AgentEvent is handled (and
+// proxied) as if it arrived on the event channel.  By default, the application creates its own tracker.
+func (app *StandardApplication) SetDeliveryReceiptTracker(tracker *DeliveryReceiptTracker) *StandardApplication {
+	app.deliveryReceiptTracker = tracker
+	return app
+}
+
+// DeliveryReceiptTracker returns the DeliveryReceiptTracker fed by the application.  Its MessagesAwaitingReceipts()
+// method lists the submitted messages for which no delivery receipt has arrived.
+func (app *StandardApplication) DeliveryReceiptTracker() *DeliveryReceiptTracker {
+	return app.deliveryReceiptTracker
+}
+
+// SetResponsePolicy replaces the ResponsePolicy that changes how automatic responses are sent to the requests that
+// match its rules (e.g., to respond with an error, after a delay, or not at all).  By default, the application has
+// a ResponsePolicy with no rules.
+func (app *StandardApplication) SetResponsePolicy(policy *ResponsePolicy) *StandardApplication {
+	app.responsePolicy = policy
+	return app
+}
+
+// ResponsePolicy returns the ResponsePolicy applied to automatic responses.  Rules may be added to it or removed
+// from it while the application runs.
+func (app *StandardApplication) ResponsePolicy() *ResponsePolicy {
+	return app.responsePolicy
+}
+
+// PendingRequests returns the queue of requests waiting for a manual response
+func (app *StandardApplication) PendingRequests() *PendingRequestQueue {
+	return app.pendingRequests
+}
+
 // AttachEventChannel attaches a shared AgentEvent channel, generally the one used by the associated AgentGroup.
 // An AgentEvent channel is returned.  Any message that arrives on incoming AgentEvent channel is copied to the
 // proxy channel.  If DisableAgentEventProxying() is called, then nothing is written to the proxy channel.  Otherwise,
@@ -146,52 +308,166 @@ func (app *StandardApplication) Start() {
 		}
 	}
 
+	incompleteMessageExpiryTicker := time.NewTicker(time.Second)
+	defer incompleteMessageExpiryTicker.Stop()
+
 	for {
-		nextAgentEvent := <-app.incomingSharedEventChannel
+		select {
+		case nextAgentEvent := <-app.incomingSharedEventChannel:
+			app.processAgentEvent(nextAgentEvent)
+
+			if app.messageReassembler != nil {
+				if completeMessageEvent := app.messageReassembler.ObserveAgentEvent(nextAgentEvent); completeMessageEvent != nil {
+					app.processAgentEvent(completeMessageEvent)
+				}
+			}
 
-		switch nextAgentEvent.Type {
-		case ReceivedPDU:
-			app.respondToReceivedPduEvent(nextAgentEvent)
+			if deliveryReceiptEvent := app.deliveryReceiptTracker.ObserveAgentEvent(nextAgentEvent); deliveryReceiptEvent != nil {
+				app.processAgentEvent(deliveryReceiptEvent)
+			}
 
-		case SentPDU:
-			app.respondToSentPduEvent(nextAgentEvent)
+		case now := <-incompleteMessageExpiryTicker.C:
+			if app.messageReassembler != nil {
+				for _, timedOutMessageEvent := range app.messageReassembler.ExpireIncompleteMessages(now) {
+					app.processAgentEvent(timedOutMessageEvent)
+				}
+			}
 
-		case CompletedBind:
-			app.respondToCompletedBindEvent(nextAgentEvent)
+			for _, store := range app.messageStoresOfAgentsOtherThanSmscs() {
+				store.ExpireMessages(now)
+				for _, message := range store.EvictFinalMessages(now) {
+					forgetMessageID(app.messageIDGenerator, message.MessageID)
+				}
+			}
 
-		case PeerTransportClosed:
-			app.respondToPeerTransportClosedEvent(nextAgentEvent)
+			for _, agent := range app.agentGroup.SetOfManagedAgents() {
+				if smsc, agentIsAnSmsc := agent.(*SMSC); agentIsAnSmsc {
+					app.abandonExpiredDeliveries(smsc, now)
+					smsc.MessageStore().ExpireMessages(now)
+					smsc.evictFinalMessages(now)
+				}
+			}
 
-		case TransportError:
-			app.respondToTransportErrorEvent(nextAgentEvent)
+			app.pendingRequests.ExpireRequests(now)
+			app.queuedDeliveriesMayBeDue = true
+
+		case <-app.dueDeliveryReceipts:
+			app.queuedDeliveriesMayBeDue = true
+
+		case <-app.delayedResponsesAreDue:
+			for _, response := range app.takeDueDelayedResponses() {
+				app.applyResponseRule(response.rule, response.request)
+			}
+		}
 
-		case ApplicationError:
-			app.respondToApplicationErrorEvent(nextAgentEvent)
+		if app.queuedDeliveriesMayBeDue {
+			app.sendQueuedDeliveries(time.Now())
 		}
+	}
+}
+
+// maximumQueuedDeliveriesPerPass is the most held deliveries and delivery receipts that sendQueuedDeliveries() sends
+// at once when the agent event channel is unbuffered
+const maximumQueuedDeliveriesPerPass = 50
 
-		if app.shouldProxyAgentEvents {
-			go app.writeToProxiedEventChannelWithoutBlockingThisFunction(nextAgentEvent)
+// sendQueuedDeliveries sends the held deliveries and the delivery receipts that are due for every SMSC.  Each
+// deliver-sm sent produces a SentPDU event on the agent event channel, which only the Start() loop reads, so no more
+// are sent at once than fit in half of the room left in the channel.  If that limit is reached, the rest are sent on
+// the next pass through the Start() loop, after it has read more events.
+func (app *StandardApplication) sendQueuedDeliveries(now time.Time) {
+	maximumNumberOfSends := maximumQueuedDeliveriesPerPass
+	if capacity := cap(app.incomingSharedEventChannel); capacity > 0 {
+		maximumNumberOfSends = (capacity - len(app.incomingSharedEventChannel)) / 2
+	}
+
+	numberOfSends := 0
+	for _, agent := range app.agentGroup.SetOfManagedAgents() {
+		if smsc, agentIsAnSmsc := agent.(*SMSC); agentIsAnSmsc && numberOfSends < maximumNumberOfSends {
+			numberOfSends += app.retryQueuedDeliveries(smsc, now, maximumNumberOfSends-numberOfSends)
 		}
 	}
+
+	for _, agent := range app.agentGroup.SetOfManagedAgents() {
+		if smsc, agentIsAnSmsc := agent.(*SMSC); agentIsAnSmsc && numberOfSends < maximumNumberOfSends {
+			numberOfSends += app.sendDueDeliveryReceipts(smsc, now, maximumNumberOfSends-numberOfSends)
+		}
+	}
+
+	app.queuedDeliveriesMayBeDue = numberOfSends >= maximumNumberOfSends
+}
+
+func (app *StandardApplication) processAgentEvent(nextAgentEvent *AgentEvent) {
+	if app.metricsCollector != nil {
+		app.metricsCollector.ObserveAgentEvent(nextAgentEvent)
+	}
+
+	switch nextAgentEvent.Type {
+	case ReceivedPDU:
+		app.respondToReceivedPduEvent(nextAgentEvent)
+
+	case SentPDU:
+		app.respondToSentPduEvent(nextAgentEvent)
+
+	case CompletedBind:
+		app.respondToCompletedBindEvent(nextAgentEvent)
+
+	case PeerTransportClosed:
+		app.respondToPeerTransportClosedEvent(nextAgentEvent)
+
+	case TransportError:
+		app.respondToTransportErrorEvent(nextAgentEvent)
+
+	case ApplicationError:
+		app.respondToApplicationErrorEvent(nextAgentEvent)
+
+	case ProtocolError:
+		app.respondToProtocolErrorEvent(nextAgentEvent)
+
+	case ReceivedCompleteMessage:
+		app.respondToReceivedCompleteMessageEvent(nextAgentEvent)
+
+	case IncompleteMessageTimedOut:
+		app.respondToIncompleteMessageTimedOutEvent(nextAgentEvent)
+
+	case DeliveryReceiptReceived:
+		app.respondToDeliveryReceiptReceivedEvent(nextAgentEvent)
+
+	case DeliveryQueued, DeliveryRetried, DeliveryAbandoned:
+		app.respondToDeliveryQueueEvent(nextAgentEvent)
+	}
+
+	if app.shouldProxyAgentEvents {
+		go app.writeToProxiedEventChannelWithoutBlockingThisFunction(nextAgentEvent)
+	}
 }
 
 // ReceiveNextCommand sends a structured UserCommand to the StandardApplication.  If the type is SendPDU,
 // and the Details in the UserCommand are for a PDU type known to the StandardApplication, then the identified
 // agent sends the message to the identified peer.  If there is an error (e.g., if the identified sending agent
 // is not under management by the associated AgentGroup), the error text is written to the EventOutputWriter.
+// If the type is Stats, Sessions or Outstanding, the values in the application MetricsCollector are written
+// to the EventOutputWriter.  If the type is Messages, the matching messages in the MessageStore of the named SMSC
+// are written to the EventOutputWriter.  If the type is Responses, the ResponsePolicy is changed as described, and
+// its rules are written to the EventOutputWriter.  If the type is Pending, the requests in the PendingRequestQueue
+// for the named agent are written to the EventOutputWriter.  If the type is Respond, the identified pending request
+// is answered.
 func (app *StandardApplication) ReceiveNextCommand(command *UserCommand) {
 	switch command.Type {
 	case SendPDU:
 		commandDetails := command.Details.(*SendPduDetails)
-		generatedPDU, err := app.tryToGeneratePDUFromUserCommandDetails(commandDetails)
+		generatedPDUs, err := tryToGeneratePDUsFromUserCommandDetails(app.pduFactory, commandDetails)
 
 		if err != nil {
 			fmt.Fprintf(app.eventOutputWriter, err.Error())
+			return
 		}
 
-		err = app.agentGroup.RoutePduToAgentForSending(commandDetails.NameOfAgentThatWillSendPdu, commandDetails.NameOfPeerThatShouldReceivePdu, generatedPDU)
-		if err != nil {
-			fmt.Fprintf(app.eventOutputWriter, "Unable to send pdu (%s) from (%s) to (%s): %s", generatedPDU.CommandName(), commandDetails.NameOfAgentThatWillSendPdu, commandDetails.NameOfPeerThatShouldReceivePdu, err)
+		for _, generatedPDU := range generatedPDUs {
+			err = app.agentGroup.RoutePduToAgentForSending(commandDetails.NameOfAgentThatWillSendPdu, commandDetails.NameOfPeerThatShouldReceivePdu, generatedPDU)
+			if err != nil {
+				fmt.Fprintf(app.eventOutputWriter, "Unable to send pdu (%s) from (%s) to (%s): %s", generatedPDU.CommandName(), commandDetails.NameOfAgentThatWillSendPdu, commandDetails.NameOfPeerThatShouldReceivePdu, err)
+				return
+			}
 		}
 
 	case Help:
@@ -199,42 +475,793 @@ func (app *StandardApplication) ReceiveNextCommand(command *UserCommand) {
 
 	case Quit:
 		app.quitCommandCallback()
+
+	case Stats:
+		if !app.metricsAreCollected() {
+			return
+		}
+
+		commandDetails := command.Details.(*StatsDetails)
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatTheStatisticsAre(commandDetails.NameOfAgent, app.metricsCollector.Snapshot()))
+
+	case Sessions:
+		if !app.metricsAreCollected() {
+			return
+		}
+
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatTheSessionStatesAre(app.metricsCollector.Snapshot()))
+
+	case Outstanding:
+		if !app.metricsAreCollected() {
+			return
+		}
+
+		commandDetails := command.Details.(*OutstandingDetails)
+		outstandingRequests := app.metricsCollector.OutstandingRequestsForSession(commandDetails.NameOfAgent, commandDetails.NameOfPeer)
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatTheOutstandingRequestsAre(commandDetails.NameOfAgent, commandDetails.NameOfPeer, outstandingRequests))
+
+	case Messages:
+		commandDetails := command.Details.(*MessagesDetails)
+		smsc := app.findManagedSmsc(commandDetails.NameOfSmsc)
+		if smsc == nil {
+			fmt.Fprintf(app.eventOutputWriter, "No SMSC named (%s) is managed by this application", commandDetails.NameOfSmsc)
+			return
+		}
+
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatTheStoredMessagesAre(smsc.Name(), smsc.MessageStore().Messages(commandDetails.Filter)))
+
+	case Responses:
+		commandDetails := command.Details.(*ResponsesDetails)
+
+		switch {
+		case commandDetails.RuleToAdd != nil:
+			if err := app.responsePolicy.AddRule(commandDetails.RuleToAdd); err != nil {
+				fmt.Fprintf(app.eventOutputWriter, "Unable to add response rule: %s", err)
+				return
+			}
+
+		case commandDetails.NameOfRuleToRemove != "":
+			if !app.responsePolicy.RemoveRule(commandDetails.NameOfRuleToRemove) {
+				fmt.Fprintf(app.eventOutputWriter, "No response rule named (%s)", commandDetails.NameOfRuleToRemove)
+				return
+			}
+
+		case commandDetails.RemoveAllRules:
+			app.responsePolicy.RemoveAllRules()
+		}
+
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatTheResponseRulesAre(app.responsePolicy.Rules()))
+
+	case SubmitMultiFailures:
+		commandDetails := command.Details.(*SubmitMultiFailuresDetails)
+
+		switch {
+		case commandDetails.DestinationToFail != "":
+			app.SetSubmitMultiFailureForDestination(commandDetails.DestinationToFail, commandDetails.ErrorStatusCode)
+
+		case commandDetails.DestinationToClear != "":
+			if !app.RemoveSubmitMultiFailureForDestination(commandDetails.DestinationToClear) {
+				fmt.Fprintf(app.eventOutputWriter, "No submit-multi failure is set for destination (%s)\n", commandDetails.DestinationToClear)
+				return
+			}
+
+		case commandDetails.ClearAll:
+			app.SetSubmitMultiFailures(map[string]uint32{})
+		}
+
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatTheSubmitMultiFailuresAre(app.SubmitMultiFailures()))
+
+	case Pending:
+		commandDetails := command.Details.(*PendingDetails)
+		pendingRequests := app.pendingRequests.PendingRequests(commandDetails.NameOfAgent, commandDetails.NameOfPeer)
+		fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatThePendingRequestsAre(commandDetails.NameOfAgent, pendingRequests))
+
+	case Respond:
+		app.respondToPendingRequest(command.Details.(*RespondDetails))
+	}
+}
+
+// metricsAreCollected returns true if the application has a MetricsCollector.  If it does not, that is written
+// to the event output writer.
+func (app *StandardApplication) metricsAreCollected() bool {
+	if app.metricsCollector == nil {
+		fmt.Fprintf(app.eventOutputWriter, "Metrics collection is disabled\n")
+		return false
 	}
+
+	return true
 }
 
 func (app *StandardApplication) respondToReceivedPduEvent(event *AgentEvent) {
 	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatAPduWasReceivedByAnAgent(event.RemotePeerName, event.SourceAgent.Name(), event.SmppPDU))
 
-	if app.automaticResponsesEnabled {
-		switch event.SmppPDU.CommandID {
-		case smpp.CommandEnquireLink:
-			event.SourceAgent.SendMessageToPeer(&MessageDescriptor{
-				NameOfSendingPeer:   event.SourceAgent.Name(),
-				NameOfReceivingPeer: event.RemotePeerName,
-				PDU:                 app.pduFactory.CreateEnquireLinkRespFromRequest(event.SmppPDU),
-			})
+	if event.SmppPDU.CommandID == smpp.CommandDeliverSmResp {
+		app.completeDelivery(event)
+	}
+
+	if !requestIsAnsweredAutomatically(event.SmppPDU.CommandID) {
+		return
+	}
+
+	if !app.automaticResponsesEnabled {
+		if app.manualResponsesEnabled {
+			app.holdRequestForManualResponse(event)
+		}
+		return
+	}
+
+	rule := app.responsePolicy.RuleForRequest(event.SourceAgent.Name(), event.RemotePeerName, event.SmppPDU)
+	if rule == nil {
+		app.sendAutomaticResponse(event, EsmeRok)
+		return
+	}
+
+	if delay := app.responsePolicy.delayFor(rule); delay > 0 && rule.Action != ResponseActionDrop && rule.Action != ResponseActionHold {
+		time.AfterFunc(delay, func() { app.addDueDelayedResponse(&delayedResponse{rule, event}) })
+		return
+	}
+
+	app.applyResponseRule(rule, event)
+}
+
+// addDueDelayedResponse is called by the timer for a delayed ResponseRule.  The response is added to the list read by
+// the Start() loop, which is then signalled.  It never blocks, so timers that fire when Start() is not running, or
+// while it is busy, do not leave goroutines waiting.
+func (app *StandardApplication) addDueDelayedResponse(response *delayedResponse) {
+	app.delayedResponsesLock.Lock()
+	app.delayedResponses = append(app.delayedResponses, response)
+	app.delayedResponsesLock.Unlock()
+
+	select {
+	case app.delayedResponsesAreDue <- true:
+	default:
+	}
+}
+
+// takeDueDelayedResponses removes and returns the delayed responses whose timers have fired, in the order they fired
+func (app *StandardApplication) takeDueDelayedResponses() []*delayedResponse {
+	app.delayedResponsesLock.Lock()
+	defer app.delayedResponsesLock.Unlock()
+
+	dueResponses := app.delayedResponses
+	app.delayedResponses = make([]*delayedResponse, 0)
+
+	return dueResponses
+}
+
+// requestIsAnsweredAutomatically returns true for the request types to which the application sends automatic
+// responses
+func requestIsAnsweredAutomatically(commandID smpp.CommandIDType) bool {
+	switch commandID {
+	case smpp.CommandEnquireLink, smpp.CommandSubmitSm, smpp.CommandDeliverSm, smpp.CommandDataSm, smpp.CommandQuerySm,
+		smpp.CommandCancelSm, smpp.CommandReplaceSm, smpp.CommandSubmitMulti:
+		return true
+	}
+
+	return false
+}
+
+// applyResponseRule applies the action of a ResponseRule to a request that matched it
+func (app *StandardApplication) applyResponseRule(rule *ResponseRule, event *AgentEvent) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatAResponseRuleWasApplied(event.SourceAgent.Name(), event.RemotePeerName, event.SmppPDU, rule))
+
+	switch rule.Action {
+	case ResponseActionRespond:
+		app.sendAutomaticResponse(event, rule.CommandStatus)
+
+	case ResponseActionGenericNack:
+		event.SourceAgent.SendMessageToPeer(&MessageDescriptor{
+			NameOfSendingPeer:   event.SourceAgent.Name(),
+			NameOfReceivingPeer: event.RemotePeerName,
+			PDU:                 smpp.NewPDU(smpp.CommandGenericNack, rule.responseCommandStatus(), event.SmppPDU.SequenceNumber, []*smpp.Parameter{}, []*smpp.Parameter{}),
+		})
+
+	case ResponseActionClose:
+		closer, agentCanClosePeerTransport := event.SourceAgent.(peerTransportCloser)
+		if !agentCanClosePeerTransport {
+			fmt.Fprintf(app.eventOutputWriter, "Agent (%s) cannot close the transport toward (%s)", event.SourceAgent.Name(), event.RemotePeerName)
+			return
+		}
+
+		if err := closer.ClosePeerTransport(event.RemotePeerName); err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to close transport from (%s) to (%s): %s", event.SourceAgent.Name(), event.RemotePeerName, err)
+		}
+
+	case ResponseActionHold:
+		app.holdRequestForManualResponse(event)
+	}
+}
+
+// holdRequestForManualResponse adds a request to the PendingRequestQueue, where it waits for a Respond UserCommand
+func (app *StandardApplication) holdRequestForManualResponse(event *AgentEvent) {
+	app.pendingRequests.hold(event.SourceAgent.Name(), event.RemotePeerName, event.SmppPDU, time.Now())
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatARequestIsPending(event.SourceAgent.Name(), event.RemotePeerName, event.SmppPDU))
+}
+
+// respondToPendingRequest answers the request described by a Respond UserCommand, which must be in the
+// PendingRequestQueue.  The response is generated by the PduFactory from the request, so it carries the request
+// sequence_number.  A submit-sm, data-sm or submit-multi response has the message_id in the command parameters or,
+// if there is none and the command_status is ESME_ROK, the next message_id for the agent.  An accepted submit-sm is
+// stored, and its delivery receipt scheduled, as it would be for an automatic response.  An accepted cancel-sm or
+// replace-sm is applied to the agent MessageStore in the same way.  A query-sm response has the message_state,
+// final_date and error_code in the command parameters or, if there is no message_state, the values in the agent
+// MessageStore.
+func (app *StandardApplication) respondToPendingRequest(details *RespondDetails) {
+	agent := app.findManagedAgent(details.NameOfAgentThatWillRespond)
+	if agent == nil {
+		fmt.Fprintf(app.eventOutputWriter, "No agent named (%s) is managed by this application", details.NameOfAgentThatWillRespond)
+		return
+	}
+
+	request := app.pendingRequests.find(agent.Name(), details.NameOfPeerThatSentRequest, details.SequenceNumber)
+	if request == nil {
+		fmt.Fprintf(app.eventOutputWriter, "No request with sequence_number (%d) from (%s) is pending for (%s)", details.SequenceNumber, details.NameOfPeerThatSentRequest, agent.Name())
+		return
+	}
+
+	parameters := details.StringParametersMap
+	messageID, messageIDIsSet := parameters["message_id"]
+	if !messageIDIsSet && details.CommandStatus == EsmeRok {
+		switch request.PDU.CommandID {
+		case smpp.CommandSubmitSm, smpp.CommandDataSm, smpp.CommandSubmitMulti:
+			messageID = app.nextMessageIDForAgent(agent)
+		}
+	}
+
+	var response *smpp.PDU
+
+	switch request.PDU.CommandID {
+	case smpp.CommandEnquireLink:
+		response = app.pduFactory.CreateEnquireLinkRespFromRequest(request.PDU)
+
+	case smpp.CommandSubmitSm:
+		response = app.pduFactory.CreateSubmitSmRespFromRequest(request.PDU, messageID)
+
+	case smpp.CommandDeliverSm:
+		response = app.pduFactory.CreateDeliverSmRespFromRequest(request.PDU)
+
+	case smpp.CommandDataSm:
+		response = app.pduFactory.CreateDataSmRespFromRequest(request.PDU, messageID)
+
+	case smpp.CommandQuerySm:
+		if _, messageStateIsSet := parameters["message_state"]; !messageStateIsSet {
+			response = app.messageStoreForAgent(agent).respondToQuerySm(request.PDU, app.pduFactory)
+			break
+		}
+
+		messageState, err := MessageStateFromString(parameters["message_state"])
+		if err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to respond to query-sm: %s", err)
+			return
+		}
+
+		errorCode := uint64(0)
+		if value, errorCodeIsSet := parameters["error_code"]; errorCodeIsSet {
+			if errorCode, err = strconv.ParseUint(value, 0, 8); err != nil {
+				fmt.Fprintf(app.eventOutputWriter, "Unable to respond to query-sm: error_code (%s) is not an integer between 0 and 255", value)
+				return
+			}
+		}
+
+		finalDate, err := parseSmppTimeExpression(parameters["final_date"], time.Now())
+		if err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to respond to query-sm: final_date (%s) is invalid: %s", parameters["final_date"], err)
+			return
+		}
+
+		response = app.pduFactory.CreateQuerySmRespFromRequest(request.PDU, finalDate, messageState, uint8(errorCode))
+
+	case smpp.CommandCancelSm:
+		response = app.pduFactory.CreateCancelSmRespFromRequest(request.PDU)
+
+	case smpp.CommandReplaceSm:
+		response = app.pduFactory.CreateReplaceSmRespFromRequest(request.PDU)
+
+	case smpp.CommandSubmitMulti:
+		response = app.pduFactory.CreateSubmitMultiRespFromRequest(request.PDU, messageID, []*UnsuccessfulDelivery{})
+	}
+
+	response.CommandStatus = details.CommandStatus
+
+	submitSmIsAccepted := request.PDU.CommandID == smpp.CommandSubmitSm && details.CommandStatus == EsmeRok
+	if submitSmIsAccepted && app.messageStoreForAgent(agent).HasMessage(messageID) {
+		fmt.Fprintf(app.eventOutputWriter, "Unable to respond to submit-sm: message_id (%s) is already in the MessageStore for (%s)\n", messageID, agent.Name())
+		return
+	}
+
+	err := agent.SendMessageToPeer(&MessageDescriptor{
+		NameOfSendingPeer:   agent.Name(),
+		NameOfReceivingPeer: request.NameOfPeer,
+		PDU:                 response,
+	})
+
+	if err != nil {
+		fmt.Fprintf(app.eventOutputWriter, "Unable to send pdu (%s) from (%s) to (%s): %s", response.CommandName(), agent.Name(), request.NameOfPeer, err)
+		return
+	}
+
+	app.pendingRequests.Take(request.NameOfAgent, request.NameOfPeer, request.PDU.SequenceNumber)
+
+	if submitSmIsAccepted {
+		if _, err := app.messageStoreForAgent(agent).StoreSubmitSm(messageID, request.NameOfPeer, request.PDU); err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to store submit-sm: %s\n", err)
+			return
+		}
+
+		app.scheduleDeliveryReceipt(&AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: request.NameOfPeer, SmppPDU: request.PDU}, messageID)
+		return
+	}
+
+	if details.CommandStatus != EsmeRok {
+		return
+	}
+
+	switch request.PDU.CommandID {
+	case smpp.CommandCancelSm:
+		if !app.messageStoreForAgent(agent).applyCancelSm(request.PDU) {
+			fmt.Fprintf(app.eventOutputWriter, "No message in the MessageStore for (%s) was cancelled by the cancel-sm\n", agent.Name())
+		}
+
+	case smpp.CommandReplaceSm:
+		if !app.messageStoreForAgent(agent).applyReplaceSm(request.PDU) {
+			fmt.Fprintf(app.eventOutputWriter, "No message in the MessageStore for (%s) was replaced by the replace-sm\n", agent.Name())
+		}
+	}
+}
+
+// sendAutomaticResponse answers a request with its usual response.  If commandStatus is not ESME_ROK, the response
+// carries it instead, and a submit-sm is neither stored nor routed.
+func (app *StandardApplication) sendAutomaticResponse(event *AgentEvent, commandStatus uint32) {
+	var response *smpp.PDU
+
+	switch event.SmppPDU.CommandID {
+	case smpp.CommandEnquireLink:
+		response = app.pduFactory.CreateEnquireLinkRespFromRequest(event.SmppPDU)
+
+	case smpp.CommandSubmitSm:
+		if commandStatus != EsmeRok {
+			response = app.pduFactory.CreateSubmitSmRespFromRequest(event.SmppPDU, "")
+			break
+		}
+
+		if smsc, agentIsAnSmsc := event.SourceAgent.(*SMSC); agentIsAnSmsc && smsc.RoutingTable() != nil {
+			app.routeSubmitSm(smsc, event)
+			return
+		}
+
+		// the submit-sm is stored, and its delivery receipt scheduled, only once the response has been sent
+		messageID := app.nextMessageIDForAgent(event.SourceAgent)
+		err := event.SourceAgent.SendMessageToPeer(&MessageDescriptor{
+			NameOfSendingPeer:   event.SourceAgent.Name(),
+			NameOfReceivingPeer: event.RemotePeerName,
+			PDU:                 app.pduFactory.CreateSubmitSmRespFromRequest(event.SmppPDU, messageID),
+		})
+		if err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to send pdu (submit-sm-resp) from (%s) to (%s): %s\n", event.SourceAgent.Name(), event.RemotePeerName, err)
+			return
+		}
+
+		if _, err := app.messageStoreForAgent(event.SourceAgent).StoreSubmitSm(messageID, event.RemotePeerName, event.SmppPDU); err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to store submit-sm received by (%s): %s\n", event.SourceAgent.Name(), err)
+			return
+		}
+
+		app.scheduleDeliveryReceipt(event, messageID)
+		return
+
+	case smpp.CommandDeliverSm:
+		response = app.pduFactory.CreateDeliverSmRespFromRequest(event.SmppPDU)
+
+	case smpp.CommandDataSm:
+		response = app.pduFactory.CreateDataSmRespFromRequest(event.SmppPDU, app.nextMessageIDForAgent(event.SourceAgent))
+
+	case smpp.CommandQuerySm:
+		response = app.messageStoreForAgent(event.SourceAgent).respondToQuerySm(event.SmppPDU, app.pduFactory)
+
+	case smpp.CommandCancelSm:
+		response = app.messageStoreForAgent(event.SourceAgent).respondToCancelSm(event.SmppPDU, app.pduFactory)
+
+	case smpp.CommandReplaceSm:
+		response = app.messageStoreForAgent(event.SourceAgent).respondToReplaceSm(event.SmppPDU, app.pduFactory)
+
+	case smpp.CommandSubmitMulti:
+		response = app.generateSubmitMultiResp(app.nextMessageIDForAgent(event.SourceAgent), event.SmppPDU)
+
+	default:
+		return
+	}
+
+	if commandStatus != EsmeRok {
+		response.CommandStatus = commandStatus
+	}
+
+	event.SourceAgent.SendMessageToPeer(&MessageDescriptor{
+		NameOfSendingPeer:   event.SourceAgent.Name(),
+		NameOfReceivingPeer: event.RemotePeerName,
+		PDU:                 response,
+	})
+}
+
+// findManagedAgent returns the agent with the provided name in the AgentGroup, or nil if there is none
+func (app *StandardApplication) findManagedAgent(nameOfAgent string) Agent {
+	for _, agent := range app.agentGroup.SetOfManagedAgents() {
+		if agent.Name() == nameOfAgent {
+			return agent
+		}
+	}
+
+	return nil
+}
+
+// findManagedSmsc returns the SMSC with the provided name in the AgentGroup, or nil if there is none
+func (app *StandardApplication) findManagedSmsc(nameOfSmsc string) *SMSC {
+	smsc, _ := app.findManagedAgent(nameOfSmsc).(*SMSC)
+	return smsc
+}
+
+// messageStoreForAgent returns the store for messages accepted by the agent.  An SMSC has its own MessageStore.  For
+// any other agent, the application keeps a MessageStore.  It is called both from the Start() loop and from
+// ReceiveNextCommand(), so the map of stores is only accessed with its lock held.
+func (app *StandardApplication) messageStoreForAgent(agent Agent) *MessageStore {
+	if smsc, agentIsAnSmsc := agent.(*SMSC); agentIsAnSmsc {
+		return smsc.MessageStore()
+	}
+
+	app.messageStoresLock.Lock()
+	defer app.messageStoresLock.Unlock()
+
+	store, storeIsKnown := app.messageStoresByNameOfAgent[agent.Name()]
+	if !storeIsKnown {
+		store = NewMessageStore()
+		app.messageStoresByNameOfAgent[agent.Name()] = store
+	}
+
+	return store
+}
+
+// messageStoresOfAgentsOtherThanSmscs returns the MessageStores that the application keeps for agents that are not SMSCs
+func (app *StandardApplication) messageStoresOfAgentsOtherThanSmscs() []*MessageStore {
+	app.messageStoresLock.Lock()
+	defer app.messageStoresLock.Unlock()
+
+	stores := make([]*MessageStore, 0, len(app.messageStoresByNameOfAgent))
+	for _, store := range app.messageStoresByNameOfAgent {
+		stores = append(stores, store)
+	}
+
+	return stores
+}
+
+// nextMessageIDForAgent returns the message_id for a message accepted by the agent.  An SMSC uses its own
+// MessageIDGenerator.  Any other agent uses the application MessageIDGenerator, skipping any message_id that is
+// already in the MessageStore that the application keeps for the agent.
+func (app *StandardApplication) nextMessageIDForAgent(agent Agent) string {
+	if smsc, agentIsAnSmsc := agent.(*SMSC); agentIsAnSmsc {
+		return smsc.NextMessageID()
+	}
+
+	return nextMessageIDNotInStore(app.messageIDGenerator, agent.Name(), app.messageStoreForAgent(agent))
+}
+
+// scheduleDeliveryReceipt arranges for a delivery receipt to be sent for a submit-sm accepted by an SMSC agent, if
+// the submit-sm asks for one.  The receipt is recorded as pending in the SMSC message store (so that it survives a
+// restart if the store has a journal), and is due once the delay in the DeliveryReceiptPolicy for the SMSC has passed
+// from the time the message was accepted or, if it is later, its schedule_delivery_time.  Due receipts are sent by the
+// Start() loop, which a timer wakes when the receipt is due.  The timer never blocks: if the loop already has a wake-up
+// waiting, the one from the timer is dropped.
+func (app *StandardApplication) scheduleDeliveryReceipt(submitSmEvent *AgentEvent, messageID string) {
+	smsc, agentIsAnSmsc := submitSmEvent.SourceAgent.(*SMSC)
+	if !agentIsAnSmsc {
+		return
+	}
+
+	policy := smsc.DeliveryReceiptPolicy()
+	finalState, errorCode, receiptIsRequested := policy.outcomeForSubmitSm(submitSmEvent.SmppPDU)
+	if !receiptIsRequested {
+		return
+	}
+
+	message, isStored := smsc.MessageStore().Message(messageID)
+	if !isStored {
+		return
+	}
+
+	deliveryTime := message.SubmitDate
+	if scheduledTime, isSet, err := parseSmppTime(message.ScheduleDeliveryTime, message.SubmitDate); isSet && err == nil && scheduledTime.After(deliveryTime) {
+		deliveryTime = scheduledTime
+	}
+
+	pendingReceipt := &PendingDeliveryReceipt{
+		NameOfPeer: submitSmEvent.RemotePeerName,
+		DueAt:      deliveryTime.Add(policy.Delay()),
+		FinalState: finalState,
+		ErrorCode:  errorCode,
+	}
+
+	smsc.MessageStore().SetPendingDeliveryReceipt(messageID, pendingReceipt)
+
+	time.AfterFunc(time.Until(pendingReceipt.DueAt), func() {
+		select {
+		case app.dueDeliveryReceipts <- smsc:
+		default:
+		}
+	})
+}
+
+// sendDueDeliveryReceipts sends no more than maximumNumberOfReceipts of the delivery receipts pending in the SMSC
+// message store that are due at or before now, and returns the number that it took.  Each message moves to the final
+// state of its receipt, unless it has already reached a final state.  A receipt that cannot be sent is held in the
+// SMSC DeliveryQueue.
+func (app *StandardApplication) sendDueDeliveryReceipts(smsc *SMSC, now time.Time, maximumNumberOfReceipts int) int {
+	messagesWithDueReceipts := smsc.MessageStore().TakeDueDeliveryReceipts(now, maximumNumberOfReceipts)
+	for _, message := range messagesWithDueReceipts {
+		receipt := &DeliveryReceipt{
+			MessageID:  message.MessageID,
+			Submitted:  1,
+			SubmitDate: message.SubmitDate,
+			DoneDate:   message.FinalDate,
+			State:      message.State,
+			ErrorCode:  message.PendingReceipt.ErrorCode,
+			Text:       deliveryReceiptText(message.ShortMessage),
+		}
+
+		if message.State == MessageStateDelivered {
+			receipt.Delivered = 1
+		}
+
+		deliverSm, err := createDeliveryReceiptDeliverSm(app.pduFactory, receipt, message.SourceAddr, message.DestinationAddr)
+		if err != nil {
+			fmt.Fprintf(app.eventOutputWriter, "Unable to create delivery receipt for message (%s) from (%s): %s\n", message.MessageID, smsc.Name(), err)
+			continue
+		}
+
+		app.attemptDelivery(smsc, &QueuedDelivery{
+			NameOfPeer:        message.PendingReceipt.NameOfPeer,
+			MessageID:         message.MessageID,
+			IsDeliveryReceipt: true,
+			PDU:               deliverSm,
+		}, now)
+	}
+
+	return len(messagesWithDueReceipts)
+}
+
+// routeSubmitSm answers a submit-sm received by an SMSC in routing mode.  If the routing table has no route for the
+// message, the submit-sm-resp has the unroutable command_status.  Otherwise, the message is stored and accepted, and
+// is forwarded as a deliver-sm to the peer named by the route.  The message reaches its final state when the
+// deliver-sm-resp arrives or, if it cannot be delivered, when it is abandoned by the SMSC DeliveryQueue.
+func (app *StandardApplication) routeSubmitSm(smsc *SMSC, event *AgentEvent) {
+	route := smsc.RoutingTable().RouteForSubmitSm(event.SmppPDU)
+	if route == nil {
+		response := app.pduFactory.CreateSubmitSmRespFromRequest(event.SmppPDU, "")
+		response.CommandStatus = smsc.RoutingTable().UnroutableCommandStatus()
+		smsc.SendMessageToPeer(&MessageDescriptor{
+			NameOfSendingPeer:   smsc.Name(),
+			NameOfReceivingPeer: event.RemotePeerName,
+			PDU:                 response,
+		})
+		return
+	}
+
+	// as for an unrouted submit-sm, the message is stored and routed only once the response has been sent
+	messageID := smsc.NextMessageID()
+	err := smsc.SendMessageToPeer(&MessageDescriptor{
+		NameOfSendingPeer:   smsc.Name(),
+		NameOfReceivingPeer: event.RemotePeerName,
+		PDU:                 app.pduFactory.CreateSubmitSmRespFromRequest(event.SmppPDU, messageID),
+	})
+	if err != nil {
+		fmt.Fprintf(app.eventOutputWriter, "Unable to send pdu (submit-sm-resp) from (%s) to (%s): %s\n", smsc.Name(), event.RemotePeerName, err)
+		return
+	}
+
+	message, err := smsc.MessageStore().StoreSubmitSm(messageID, event.RemotePeerName, event.SmppPDU)
+	if err != nil {
+		fmt.Fprintf(app.eventOutputWriter, "Unable to store submit-sm received by (%s): %s\n", smsc.Name(), err)
+		return
+	}
+
+	smsc.MessageStore().RecordRoute(messageID, route.NameOfPeer, 0)
 
-		case smpp.CommandSubmitSm:
-			event.SourceAgent.SendMessageToPeer(&MessageDescriptor{
-				NameOfSendingPeer:   event.SourceAgent.Name(),
-				NameOfReceivingPeer: event.RemotePeerName,
-				PDU:                 app.pduFactory.CreateSubmitSmRespFromRequest(event.SmppPDU, event.SourceAgent.Name()),
+	app.attemptDelivery(smsc, &QueuedDelivery{
+		NameOfPeer: route.NameOfPeer,
+		MessageID:  messageID,
+		PDU:        createDeliverSmFromSubmitSm(event.SmppPDU),
+		ExpiresAt:  message.ExpiresAt,
+	}, time.Now())
+}
+
+// attemptDelivery sends a deliver-sm from an SMSC to a peer.  If it cannot be sent, it is held in the SMSC
+// DeliveryQueue to be retried.  Otherwise, it is tracked until the deliver-sm-resp arrives.
+func (app *StandardApplication) attemptDelivery(smsc *SMSC, delivery *QueuedDelivery, now time.Time) {
+	delivery.Attempts++
+	if delivery.Attempts > 1 {
+		app.raiseDeliveryQueueEvent(DeliveryRetried, smsc, delivery)
+	}
+
+	err := smsc.SendMessageToPeer(&MessageDescriptor{
+		NameOfSendingPeer:   smsc.Name(),
+		NameOfReceivingPeer: delivery.NameOfPeer,
+		PDU:                 delivery.PDU,
+	})
+	if err != nil {
+		app.holdOrAbandonDelivery(smsc, delivery, err.Error(), now)
+		return
+	}
+
+	smsc.DeliveryQueue().trackInFlight(delivery)
+	if !delivery.IsDeliveryReceipt {
+		smsc.MessageStore().RecordRoute(delivery.MessageID, delivery.NameOfPeer, delivery.PDU.SequenceNumber)
+	}
+}
+
+// holdOrAbandonDelivery holds a delivery that failed in the SMSC DeliveryQueue, or abandons it if it has been
+// attempted the maximum number of times
+func (app *StandardApplication) holdOrAbandonDelivery(smsc *SMSC, delivery *QueuedDelivery, failure string, now time.Time) {
+	if smsc.DeliveryQueue().hold(delivery, failure, now) {
+		app.raiseDeliveryQueueEvent(DeliveryQueued, smsc, delivery)
+		return
+	}
+
+	app.abandonDelivery(smsc, delivery, MessageStateUndeliverable, now)
+}
+
+// abandonDelivery gives up on a delivery.  If it carries a routed message, the message moves to the provided final
+// state, and a delivery receipt is sent to the peer that submitted it, if the submit-sm asked for one.
+func (app *StandardApplication) abandonDelivery(smsc *SMSC, delivery *QueuedDelivery, finalState MessageState, now time.Time) {
+	app.raiseDeliveryQueueEvent(DeliveryAbandoned, smsc, delivery)
+
+	if delivery.IsDeliveryReceipt {
+		return
+	}
+
+	if message, stateWasChanged := smsc.MessageStore().MoveMessageToFinalState(delivery.MessageID, finalState, now); stateWasChanged {
+		app.sendDeliveryReceiptForRoutedMessage(smsc, message, EsmeRdeliveryfailure)
+	}
+}
+
+// abandonExpiredDeliveries abandons the deliveries held by an SMSC that have expired
+func (app *StandardApplication) abandonExpiredDeliveries(smsc *SMSC, now time.Time) {
+	for _, delivery := range smsc.DeliveryQueue().takeExpiredDeliveries(now) {
+		app.abandonDelivery(smsc, delivery, MessageStateExpired, now)
+	}
+}
+
+// retryQueuedDeliveries tries again to send no more than maximumNumberOfDeliveries of the deliveries held by an
+// SMSC that are due, and returns the number that it tried
+func (app *StandardApplication) retryQueuedDeliveries(smsc *SMSC, now time.Time, maximumNumberOfDeliveries int) int {
+	dueDeliveries := smsc.DeliveryQueue().takeDueDeliveries(now, maximumNumberOfDeliveries)
+	for _, delivery := range dueDeliveries {
+		app.attemptDelivery(smsc, delivery, now)
+	}
+
+	return len(dueDeliveries)
+}
+
+// raiseDeliveryQueueEvent handles (and proxies) a DeliveryQueued, DeliveryRetried or DeliveryAbandoned AgentEvent as
+// if it arrived on the event channel
+func (app *StandardApplication) raiseDeliveryQueueEvent(eventType AgentEventType, smsc *SMSC, delivery *QueuedDelivery) {
+	deliveryCopy := *delivery
+
+	app.processAgentEvent(&AgentEvent{
+		Type:               eventType,
+		SourceAgent:        smsc,
+		RemotePeerName:     delivery.NameOfPeer,
+		SmppPDU:            delivery.PDU,
+		QueuedDelivery:     &deliveryCopy,
+		DeliveryQueueDepth: smsc.DeliveryQueue().Depth(delivery.NameOfPeer),
+	})
+}
+
+// completeDelivery handles the deliver-sm-resp for a deliver-sm sent by an SMSC from its DeliveryQueue.  If the peer
+// rejected the deliver-sm, the delivery is held to be retried.  Otherwise, a routed message moves to DELIVERED, and a
+// delivery receipt is sent to the peer that submitted it, if the submit-sm asked for one.
+func (app *StandardApplication) completeDelivery(deliverSmRespEvent *AgentEvent) {
+	smsc, agentIsAnSmsc := deliverSmRespEvent.SourceAgent.(*SMSC)
+	if !agentIsAnSmsc {
+		return
+	}
+
+	deliverSmResp := deliverSmRespEvent.SmppPDU
+	delivery := smsc.DeliveryQueue().acknowledge(deliverSmRespEvent.RemotePeerName, deliverSmResp.SequenceNumber)
+	if delivery == nil {
+		return
+	}
+
+	now := time.Now()
+
+	if deliverSmResp.CommandStatus != 0 {
+		app.holdOrAbandonDelivery(smsc, delivery, fmt.Sprintf("peer responded with %s", CommandStatusName(deliverSmResp.CommandStatus)), now)
+		return
+	}
+
+	if delivery.IsDeliveryReceipt {
+		return
+	}
+
+	if message, isRouted := smsc.MessageStore().CompleteRoute(delivery.NameOfPeer, deliverSmResp.SequenceNumber, 0, now); isRouted {
+		app.sendDeliveryReceiptForRoutedMessage(smsc, message, 0)
+	}
+}
+
+func (app *StandardApplication) sendDeliveryReceiptForRoutedMessage(smsc *SMSC, message *StoredMessage, commandStatus uint32) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatARoutedMessageWasCompleted(smsc.Name(), message))
+
+	if !deliveryReceiptIsRequested(message.RegisteredDelivery, message.State) {
+		return
+	}
+
+	smsc.MessageStore().SetPendingDeliveryReceipt(message.MessageID, &PendingDeliveryReceipt{
+		NameOfPeer: message.NameOfPeer,
+		DueAt:      message.FinalDate,
+		FinalState: message.State,
+		ErrorCode:  int(commandStatus),
+	})
+
+	app.queuedDeliveriesMayBeDue = true
+}
+
+// generateSubmitMultiResp answers a submit-multi, with an unsuccess_sme entry for each SME address that has a
+// failure set by SetSubmitMultiFailureForDestination().  If the dest_address list cannot be read, the response
+// has command_status ESME_RINVNUMDESTS.
+func (app *StandardApplication) generateSubmitMultiResp(messageID string, submitMulti *smpp.PDU) *smpp.PDU {
+	destinations, err := SubmitMultiDestinations(submitMulti)
+	if err != nil {
+		response := app.pduFactory.CreateSubmitMultiRespFromRequest(submitMulti, "", []*UnsuccessfulDelivery{})
+		response.CommandStatus = EsmeRinvnumdests
+		return response
+	}
+
+	app.submitMultiFailuresLock.Lock()
+	defer app.submitMultiFailuresLock.Unlock()
+
+	unsuccessfulDeliveries := make([]*UnsuccessfulDelivery, 0)
+	for _, destination := range destinations {
+		if destination.IsDistributionList {
+			continue
+		}
+
+		if errorStatusCode, destinationShouldFail := app.submitMultiFailures[destination.Address]; destinationShouldFail {
+			unsuccessfulDeliveries = append(unsuccessfulDeliveries, &UnsuccessfulDelivery{
+				AddrTon:         destination.AddrTon,
+				AddrNpi:         destination.AddrNpi,
+				Address:         destination.Address,
+				ErrorStatusCode: errorStatusCode,
 			})
 		}
 	}
+
+	return app.pduFactory.CreateSubmitMultiRespFromRequest(submitMulti, messageID, unsuccessfulDeliveries)
 }
 
 func (app *StandardApplication) respondToSentPduEvent(event *AgentEvent) {
 	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatAPduWasSentByAnAgent(event.SourceAgent.Name(), event.RemotePeerName, event.SmppPDU))
+
+	if !event.SmppPDU.IsRequest() {
+		app.pendingRequests.Take(event.SourceAgent.Name(), event.RemotePeerName, event.SmppPDU.SequenceNumber)
+	}
 }
 
 func (app *StandardApplication) respondToCompletedBindEvent(event *AgentEvent) {
 	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatATransceiverBindWasCompletedByAnAgent(event.SourceAgent.Name(), event.RemotePeerName))
 
+	if smsc, agentIsAnSmsc := event.SourceAgent.(*SMSC); agentIsAnSmsc {
+		smsc.DeliveryQueue().makeDeliveriesForPeerDue(event.RemotePeerName, time.Now())
+		app.queuedDeliveriesMayBeDue = true
+	}
 }
 
 func (app *StandardApplication) respondToPeerTransportClosedEvent(event *AgentEvent) {
 	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatTheTransportForAPeerClosed(event.SourceAgent.Name(), event.RemotePeerName))
+
+	if smsc, agentIsAnSmsc := event.SourceAgent.(*SMSC); agentIsAnSmsc {
+		now := time.Now()
+		for _, delivery := range smsc.DeliveryQueue().takeInFlightDeliveriesForPeer(event.RemotePeerName) {
+			app.holdOrAbandonDelivery(smsc, delivery, "transport closed before deliver-sm-resp", now)
+		}
+	}
+
+	app.pendingRequests.discardSession(event.SourceAgent.Name(), event.RemotePeerName)
 }
 
 func (app *StandardApplication) respondToTransportErrorEvent(event *AgentEvent) {
@@ -245,22 +1272,85 @@ func (app *StandardApplication) respondToApplicationErrorEvent(event *AgentEvent
 	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatAnApplicationErrorWasThrown(event.SourceAgent.Name(), event.Error))
 }
 
+func (app *StandardApplication) respondToProtocolErrorEvent(event *AgentEvent) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatAProtocolErrorOccurred(event.SourceAgent.Name(), event.RemotePeerName, event.Error))
+}
+
+func (app *StandardApplication) respondToReceivedCompleteMessageEvent(event *AgentEvent) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatACompleteMessageWasReceived(event.SourceAgent.Name(), event.RemotePeerName, event.ReassembledMessage))
+}
+
+func (app *StandardApplication) respondToIncompleteMessageTimedOutEvent(event *AgentEvent) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatAnIncompleteMessageTimedOut(event.SourceAgent.Name(), event.RemotePeerName, event.ReassembledMessage))
+}
+
+func (app *StandardApplication) respondToDeliveryReceiptReceivedEvent(event *AgentEvent) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayThatADeliveryReceiptWasReceived(event.SourceAgent.Name(), event.RemotePeerName, event.DeliveryReceipt))
+}
+
+func (app *StandardApplication) respondToDeliveryQueueEvent(event *AgentEvent) {
+	fmt.Fprintf(app.eventOutputWriter, app.outputGenerator.SayWhatHappenedToAQueuedDelivery(event.SourceAgent.Name(), event.Type, event.QueuedDelivery, event.DeliveryQueueDepth))
+}
+
 func (app *StandardApplication) writeToProxiedEventChannelWithoutBlockingThisFunction(event *AgentEvent) {
 	go func() { app.proxiedOutgoingEventChannel <- event }()
 }
 
-func (app *StandardApplication) tryToGeneratePDUFromUserCommandDetails(details *SendPduDetails) (*smpp.PDU, error) {
+// tryToGeneratePDUsFromUserCommandDetails generates the PDUs to send for a SendPDU command.  This is a single
+// PDU, except for a submit-sm with a segmentation parameter, which may produce several.
+func tryToGeneratePDUsFromUserCommandDetails(factory PduFactory, details *SendPduDetails) ([]*smpp.PDU, error) {
+	if _, segmentationIsRequested := details.StringParametersMap["segmentation"]; segmentationIsRequested && details.TypeOfSmppPDU == smpp.CommandSubmitSm {
+		return factory.CreateSegmentedSubmitSm(details.StringParametersMap)
+	}
+
+	pdu, err := tryToGeneratePDUFromUserCommandDetails(factory, details)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*smpp.PDU{pdu}, nil
+}
+
+func tryToGeneratePDUFromUserCommandDetails(factory PduFactory, details *SendPduDetails) (*smpp.PDU, error) {
 	switch details.TypeOfSmppPDU {
 	case smpp.CommandSubmitSm:
-		pdu, err := app.pduFactory.CreateSubmitSm(details.StringParametersMap)
+		pdu, err := factory.CreateSubmitSm(details.StringParametersMap)
 		if err != nil {
 			return nil, err
 		}
 
 		return pdu, nil
 
+	case smpp.CommandDeliverSm:
+		pdu, err := factory.CreateDeliverSm(details.StringParametersMap)
+		if err != nil {
+			return nil, err
+		}
+
+		return pdu, nil
+
+	case smpp.CommandDataSm:
+		pdu, err := factory.CreateDataSm(details.StringParametersMap)
+		if err != nil {
+			return nil, err
+		}
+
+		return pdu, nil
+
+	case smpp.CommandQuerySm:
+		return factory.CreateQuerySm(details.StringParametersMap)
+
+	case smpp.CommandCancelSm:
+		return factory.CreateCancelSm(details.StringParametersMap)
+
+	case smpp.CommandReplaceSm:
+		return factory.CreateReplaceSm(details.StringParametersMap)
+
+	case smpp.CommandSubmitMulti:
+		return factory.CreateSubmitMulti(details.StringParametersMap)
+
 	case smpp.CommandEnquireLink:
-		return app.pduFactory.CreateEnquireLink(), nil
+		return factory.CreateEnquireLink(), nil
 	}
 
 	return nil, fmt.Errorf("Don't know how to generate message of type (%s)", smpp.CommandName(details.TypeOfSmppPDU))
@@ -269,5 +1359,36 @@ func (app *StandardApplication) tryToGeneratePDUFromUserCommandDetails(details *
 func (app *StandardApplication) helpText() string {
 	return "<sending_agent_name>: send enquire-link to <peer_name>\n" +
 		"<sending_agent_name>: send submit-sm to <peer_name> [params]\n" +
-		"  params: [source_addr_ton=<ton_int>] [source_addr=<addr>] [dest_addr_ton=<ton_int>] [destination_addr=<addr>] [short_message=<message>]"
+		"<sending_agent_name>: send deliver-sm to <peer_name> [params]\n" +
+		"<sending_agent_name>: send data-sm to <peer_name> [data_sm_params]\n" +
+		"<sending_agent_name>: send query-sm to <peer_name> message_id=<id> [source_addr_ton=<ton_int>] [source_addr_npi=<npi_int>] [source_addr=<addr>]\n" +
+		"<sending_agent_name>: send cancel-sm to <peer_name> [message_id=<id>] [service_type=<type>] [source_addr=<addr>] [destination_addr=<addr>]\n" +
+		"<sending_agent_name>: send replace-sm to <peer_name> message_id=<id> [source_addr=<addr>] [registered_delivery=<int>] [encoding=<encoding>] [short_message=<message>]\n" +
+		"<sending_agent_name>: send submit-multi to <peer_name> dest=<addr>[,<addr>...] [dl_name=<name>[,<name>...]] [source_addr=<addr>] [registered_delivery=<int>] [encoding=<encoding>] [short_message=<message>]\n" +
+		"  params: [service_type=<type>] [source_addr_ton=<ton_int>] [source_addr_npi=<npi_int>] [source_addr=<addr>] [dest_addr_ton=<ton_int>] [dest_addr_npi=<npi_int>] [destination_addr=<addr>]\n" +
+		"          [esm_class=<int>] [protocol_id=<int>] [priority_flag=<int>] [schedule_delivery_time=<time>] [validity_period=<time>] [registered_delivery=<int>]\n" +
+		"          [replace_if_present_flag=<int>] [data_coding=<int>] [sm_default_msg_id=<int>] [encoding=<encoding>] [short_message=<message>]\n" +
+		"  times are in SMPP absolute (YYMMDDhhmmsstnn+ or -) or relative (YYMMDDhhmmss000R) format, +<duration> (e.g., +1h30m),\n" +
+		"          now[+|-<duration>] or RFC 3339; integers may be decimal, hex (0x40) or binary (0b01000000)\n" +
+		"  any string value may be given as hex octets (e.g., short_message=hex:0500030A0201), and double-quoted values may contain escapes\n" +
+		"  encoding is one of gsm7, gsm7-packed, ascii, latin1, ucs2 or binary, and sets data_coding to match\n" +
+		"  submit-sm also accepts [segmentation=udh|udh16|sar|payload] to split a long short_message\n" +
+		"  any send may add optional parameters by name (e.g., user_message_reference=<int>) or as tlv:0x<tag>=<hex_octets>\n" +
+		"  data_sm_params: [source_addr_npi=<npi_int>] [source_addr=<addr>] [dest_addr_npi=<npi_int>] [destination_addr=<addr>] [message_payload=<message>]\n" +
+		"stats [<agent_name>]\n" +
+		"sessions\n" +
+		"outstanding <agent_name> <peer_name>\n" +
+		"messages <smsc_name> [message_id=<id>] [peer=<peer_name>] [source_addr=<addr>] [destination_addr=<addr>] [state=<state>]\n" +
+		"responses\n" +
+		"responses add [name=<name>] [agent=<agent_name>] [peer=<peer_name>] [command=<pdu_type>] [match:<field>=<regex> ...] action=<action> [status=<status>]\n" +
+		"          [delay=<duration>] [max_delay=<duration>] [probability=<0..1>]\n" +
+		"  action is respond, drop, generic-nack, close or hold; field is service_type, source_addr, destination_addr, short_message, etc.\n" +
+		"responses remove <name>\n" +
+		"responses clear\n" +
+		"submit-multi-failures\n" +
+		"submit-multi-failures set <destination_addr> <status>\n" +
+		"submit-multi-failures clear [<destination_addr>]\n" +
+		"pending <agent_name> [<peer_name>]\n" +
+		"<agent_name>: respond to <peer_name> seq=<sequence_number> [status=<status>] [message_id=<id>]\n" +
+		"  a query-sm response also accepts [message_state=<state>] [final_date=<time>] [error_code=<int>]"
 }
@@ -0,0 +1,362 @@
+package smppth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// recordingAgent is an Agent that records each message it is asked to send.  Sending to a peer other than
+// nameOfPeer fails.
+type recordingAgent struct {
+	name         string
+	nameOfPeer   string
+	lock         sync.Mutex
+	sentMessages []*MessageDescriptor
+}
+
+func newRecordingAgent(name string, nameOfPeer string) *recordingAgent {
+	return &recordingAgent{name: name, nameOfPeer: nameOfPeer, sentMessages: make([]*MessageDescriptor, 0)}
+}
+
+func (agent *recordingAgent) Name() string                            { return agent.name }
+func (agent *recordingAgent) StartEventLoop()                         {}
+func (agent *recordingAgent) SetAgentEventChannel(chan<- *AgentEvent) {}
+
+func (agent *recordingAgent) SendMessageToPeer(message *MessageDescriptor) error {
+	if message.NameOfReceivingPeer != agent.nameOfPeer {
+		return fmt.Errorf("No such peer named (%s) is known to this agent", message.NameOfReceivingPeer)
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	agent.sentMessages = append(agent.sentMessages, message)
+
+	return nil
+}
+
+func (agent *recordingAgent) sentPDUs() []*smpp.PDU {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	pdus := make([]*smpp.PDU, len(agent.sentMessages))
+	for i, message := range agent.sentMessages {
+		pdus[i] = message.PDU
+	}
+
+	return pdus
+}
+
+func TestStandardApplicationWithoutMetricsCollector(t *testing.T) {
+	output := new(bytes.Buffer)
+	agent := newRecordingAgent("esme01", "smsc01")
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{agent})).SetEventOutputWriter(output).SetMetricsCollector(nil)
+
+	app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "smsc01", SmppPDU: NewDefaultPduFactory().CreateEnquireLink()})
+	if sentPDUs := agent.sentPDUs(); len(sentPDUs) != 1 || sentPDUs[0].CommandID != smpp.CommandEnquireLinkResp {
+		t.Errorf("Expected enquire-link-resp to be sent without a MetricsCollector, got (%d) PDUs", len(sentPDUs))
+	}
+
+	for _, command := range []*UserCommand{
+		{Type: Stats, Details: &StatsDetails{}},
+		{Type: Sessions},
+		{Type: Outstanding, Details: &OutstandingDetails{NameOfAgent: "esme01", NameOfPeer: "smsc01"}},
+	} {
+		output.Reset()
+		app.ReceiveNextCommand(command)
+		if !strings.Contains(output.String(), "Metrics collection is disabled") {
+			t.Errorf("Expected command (%d) to say that metrics collection is disabled, got = (%s)", command.Type, output.String())
+		}
+	}
+}
+
+func TestStandardApplicationWithoutMessageReassembler(t *testing.T) {
+	agent := newRecordingAgent("smsc01", "esme01")
+	agentEvents := make(chan *AgentEvent)
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{agent})).SetEventOutputWriter(new(bytes.Buffer)).SetMessageReassembler(nil)
+	proxiedAgentEvents := app.AttachEventChannel(agentEvents)
+	go app.Start()
+
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"short_message": "hello"})
+	agentEvents <- &AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme01", SmppPDU: submitSm}
+
+	if proxiedEvent := <-proxiedAgentEvents; proxiedEvent.SmppPDU != submitSm {
+		t.Fatalf("Expected received submit-sm to be proxied, got = (%+v)", proxiedEvent)
+	}
+
+	if sentPDUs := agent.sentPDUs(); len(sentPDUs) != 1 || sentPDUs[0].CommandID != smpp.CommandSubmitSmResp {
+		t.Errorf("Expected submit-sm-resp to be sent without a MessageReassembler, got (%d) PDUs", len(sentPDUs))
+	}
+}
+
+func TestStandardApplicationFlushesMoreQueuedDeliveriesThanTheEventChannelHolds(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	smsc := NewSMSC("smsc01", "smsc01", net.ParseIP("127.0.0.1"), uint16(port))
+	numberOfQueuedDeliveries := 250
+	for i := 0; i < numberOfQueuedDeliveries; i++ {
+		deliverSm, _ := NewDefaultPduFactory().CreateDeliverSm(map[string]string{"short_message": fmt.Sprintf("queued %d", i)})
+		smsc.DeliveryQueue().hold(&QueuedDelivery{NameOfPeer: "foo", MessageID: fmt.Sprintf("%d", i), IsDeliveryReceipt: true, PDU: deliverSm, Attempts: 1}, "not bound", time.Now())
+	}
+
+	group := NewAgentGroup([]Agent{smsc})
+	app := NewStandardApplication().SetAgentGroup(group).SetEventOutputWriter(ioutil.Discard).DisableAgentEventProxying()
+	app.AttachEventChannel(group.SharedAgentEventChannel())
+	group.StartAllAgents()
+	go app.Start()
+
+	var conn net.Conn
+	for attempt := 0; attempt < 50; attempt++ {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect to SMSC: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write(testSmppMsgBindTransceiver01())
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	reader := newPduStreamReader(conn)
+	numberOfDeliverSms := 0
+	for numberOfDeliverSms < numberOfQueuedDeliveries {
+		pdus, err := reader.Read()
+		if err != nil {
+			t.Fatalf("After (%d) deliver-sm PDUs, expected (%d), but read failed: %s", numberOfDeliverSms, numberOfQueuedDeliveries, err)
+		}
+
+		for _, pdu := range pdus {
+			if pdu.CommandID == smpp.CommandDeliverSm {
+				numberOfDeliverSms++
+			}
+		}
+	}
+
+	if depth := smsc.DeliveryQueue().Depth(""); depth != 0 {
+		t.Errorf("Expected every queued delivery to be sent, but (%d) are still held", depth)
+	}
+}
+
+func TestStandardApplicationRespondsToHeldSubmitSm(t *testing.T) {
+	smsc := NewSMSC("smsc01", "smsc01", net.ParseIP("127.0.0.1"), 2772)
+	smsc.DeliveryReceiptPolicy().SetDelay(time.Hour)
+	smscEvents := make(chan *AgentEvent, 100)
+	smsc.SetAgentEventChannel(smscEvents)
+
+	localConn, remoteConn := net.Pipe()
+	defer remoteConn.Close()
+	go newSmscPeerMessageHandler(smsc, localConn).startHandlingPeerConnection()
+
+	remoteConn.Write(testSmppMsgBindTransceiver01())
+	pdusFromSmsc := make(chan *smpp.PDU, 10)
+	go func() {
+		reader := newPduStreamReader(remoteConn)
+		for {
+			pdus, err := reader.ExtractNextPDUs()
+			if err != nil {
+				close(pdusFromSmsc)
+				return
+			}
+			for _, pdu := range pdus {
+				pdusFromSmsc <- pdu
+			}
+		}
+	}()
+
+	if bindResp := <-pdusFromSmsc; bindResp == nil || bindResp.CommandID != smpp.CommandBindTransceiverResp {
+		t.Fatalf("Expected bind-transceiver-resp from SMSC, got = (%v)", bindResp)
+	}
+	for _, eventType := range []AgentEventType{ReceivedPDU, SentPDU, CompletedBind} {
+		if _, err := eventChannelTypeCheck(smscEvents, eventType); err != nil {
+			t.Fatalf("On bind, %s", err)
+		}
+	}
+
+	output := new(bytes.Buffer)
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{smsc})).SetEventOutputWriter(output).EnableManualResponses()
+
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"destination_addr": "15551234567", "registered_delivery": "1", "short_message": "hello"})
+	submitSm.SequenceNumber = 42
+	app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: smsc, RemotePeerName: "foo", SmppPDU: submitSm})
+
+	if pending := app.PendingRequests().PendingRequests("smsc01", "foo"); len(pending) != 1 || pending[0].PDU != submitSm {
+		t.Fatalf("Expected submit-sm to be held, got = (%+v)", pending)
+	}
+
+	takenSubmitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"short_message": "taken"})
+	smsc.MessageStore().StoreSubmitSm("taken", "foo", takenSubmitSm)
+
+	app.ReceiveNextCommand(&UserCommand{Type: Respond, Details: &RespondDetails{NameOfAgentThatWillRespond: "smsc01", NameOfPeerThatSentRequest: "foo", SequenceNumber: 42, StringParametersMap: map[string]string{"message_id": "taken"}}})
+	if !strings.Contains(output.String(), "already in the MessageStore") || len(app.PendingRequests().PendingRequests("smsc01", "foo")) != 1 {
+		t.Errorf("Expected respond with a stored message_id to be refused and leave the request held, got output = (%s)", output.String())
+	}
+
+	app.ReceiveNextCommand(&UserCommand{Type: Respond, Details: &RespondDetails{NameOfAgentThatWillRespond: "smsc01", NameOfPeerThatSentRequest: "foo", SequenceNumber: 42, StringParametersMap: map[string]string{}}})
+
+	var submitSmResp *smpp.PDU
+	select {
+	case submitSmResp = <-pdusFromSmsc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected submit-sm-resp to be sent on respond, got output = (%s)", output.String())
+	}
+
+	if submitSmResp == nil || submitSmResp.CommandID != smpp.CommandSubmitSmResp || submitSmResp.SequenceNumber != 42 || submitSmResp.CommandStatus != EsmeRok {
+		t.Fatalf("Expected submit-sm-resp with seq 42 and ESME_ROK, got = (%v)", submitSmResp)
+	}
+
+	if len(app.PendingRequests().PendingRequests("smsc01", "foo")) != 0 {
+		t.Errorf("Expected submit-sm to no longer be held once answered")
+	}
+
+	messageID := submitSmResp.MandatoryParameters[0].Value.(string)
+	message, isStored := smsc.MessageStore().Message(messageID)
+	if !isStored || message.NameOfPeer != "foo" {
+		t.Fatalf("Expected answered submit-sm to be stored with message_id (%s), got = (%+v)", messageID, message)
+	}
+	if message.PendingReceipt == nil {
+		t.Errorf("Expected a delivery receipt to be scheduled for the answered submit-sm")
+	}
+
+	enquireLink := NewDefaultPduFactory().CreateEnquireLink()
+	enquireLink.SequenceNumber = 43
+	app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: smsc, RemotePeerName: "foo", SmppPDU: enquireLink})
+	app.processAgentEvent(&AgentEvent{Type: SentPDU, SourceAgent: smsc, RemotePeerName: "foo", SmppPDU: NewDefaultPduFactory().CreateEnquireLinkRespFromRequest(enquireLink)})
+
+	if pending := app.PendingRequests().PendingRequests("smsc01", "foo"); len(pending) != 0 {
+		t.Errorf("Expected a held request to be released when a response with its sequence_number is sent, got = (%+v)", pending)
+	}
+	app = NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{smsc})).SetEventOutputWriter(output).DisableAutomaticResponsesToRequestPdus()
+	app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: smsc, RemotePeerName: "foo", SmppPDU: enquireLink})
+	if pending := app.PendingRequests().PendingRequests("smsc01", "foo"); len(pending) != 0 {
+		t.Errorf("Expected no request to be held when only automatic responses are disabled, got = (%+v)", pending)
+	}
+}
+
+func TestStandardApplicationAppliesHeldCancelSmAndReplaceSmWhenAnswered(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	output := new(bytes.Buffer)
+	agent := newRecordingAgent("smsc01", "esme01")
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{agent})).SetEventOutputWriter(output).EnableManualResponses()
+	store := app.messageStoreForAgent(agent)
+
+	for _, messageID := range []string{"msg01", "msg02"} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000", "short_message": "hello"})
+		store.StoreSubmitSm(messageID, "esme01", submitSm)
+	}
+
+	replaceSm, _ := factory.CreateReplaceSm(map[string]string{"message_id": "msg01", "source_addr": "1000", "short_message": "replaced"})
+	replaceSm.SequenceNumber = 10
+	cancelSm, _ := factory.CreateCancelSm(map[string]string{"message_id": "msg02", "source_addr": "1000"})
+	cancelSm.SequenceNumber = 11
+	rejectedCancelSm, _ := factory.CreateCancelSm(map[string]string{"message_id": "msg01", "source_addr": "1000"})
+	rejectedCancelSm.SequenceNumber = 12
+
+	for _, request := range []*smpp.PDU{replaceSm, cancelSm, rejectedCancelSm} {
+		app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme01", SmppPDU: request})
+	}
+
+	if message, _ := store.Message("msg01"); string(message.ShortMessage) != "hello" {
+		t.Fatalf("Expected held replace-sm not to change the message before it is answered, got short_message (%s)", string(message.ShortMessage))
+	}
+
+	app.ReceiveNextCommand(&UserCommand{Type: Respond, Details: &RespondDetails{NameOfAgentThatWillRespond: "smsc01", NameOfPeerThatSentRequest: "esme01", SequenceNumber: 10, StringParametersMap: map[string]string{}}})
+	app.ReceiveNextCommand(&UserCommand{Type: Respond, Details: &RespondDetails{NameOfAgentThatWillRespond: "smsc01", NameOfPeerThatSentRequest: "esme01", SequenceNumber: 11, StringParametersMap: map[string]string{}}})
+	app.ReceiveNextCommand(&UserCommand{Type: Respond, Details: &RespondDetails{NameOfAgentThatWillRespond: "smsc01", NameOfPeerThatSentRequest: "esme01", SequenceNumber: 12, CommandStatus: EsmeRcancelfail, StringParametersMap: map[string]string{}}})
+
+	if sent := agent.sentPDUs(); len(sent) != 3 {
+		t.Fatalf("Expected (3) responses to be sent, got (%d), output = (%s)", len(sent), output.String())
+	}
+
+	if message, _ := store.Message("msg01"); string(message.ShortMessage) != "replaced" || message.State != MessageStateEnroute {
+		t.Errorf("Expected answered replace-sm to replace short_message and a rejected cancel-sm to leave it ENROUTE, got short_message (%s), state (%s)", string(message.ShortMessage), message.State)
+	}
+
+	if message, _ := store.Message("msg02"); message.State != MessageStateDeleted {
+		t.Errorf("Expected answered cancel-sm to delete the message, got state (%s)", message.State)
+	}
+}
+
+func TestStandardApplicationDeliveryReceiptTimersDoNotBlock(t *testing.T) {
+	smsc := NewSMSC("smsc01", "smsc01", net.ParseIP("127.0.0.1"), 2772)
+	smsc.DeliveryReceiptPolicy().SetDelay(0)
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{smsc})).SetEventOutputWriter(ioutil.Discard)
+
+	goroutinesBeforeTimers := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		messageID := fmt.Sprintf("msg%02d", i)
+		submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"registered_delivery": "1", "short_message": "hello"})
+		smsc.MessageStore().StoreSubmitSm(messageID, "esme01", submitSm)
+		app.scheduleDeliveryReceipt(&AgentEvent{Type: ReceivedPDU, SourceAgent: smsc, RemotePeerName: "esme01", SmppPDU: submitSm}, messageID)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if waiting := len(app.dueDeliveryReceipts); waiting != 1 {
+		t.Errorf("Expected one wake-up to be waiting for the Start() loop, got (%d)", waiting)
+	}
+	if goroutines := runtime.NumGoroutine(); goroutines > goroutinesBeforeTimers {
+		t.Errorf("Expected no delivery receipt timer to block while the Start() loop is not running, got (%d) goroutines, was (%d)", goroutines, goroutinesBeforeTimers)
+	}
+}
+
+func TestStandardApplicationStoresSubmitSmOnlyWhenResponseIsSent(t *testing.T) {
+	output := new(bytes.Buffer)
+	agent := newRecordingAgent("smsc01", "esme01")
+	app := NewStandardApplication().SetAgentGroup(NewAgentGroup([]Agent{agent})).SetEventOutputWriter(output)
+
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"short_message": "hello"})
+	app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme02", SmppPDU: submitSm})
+
+	if messages := app.messageStoreForAgent(agent).Messages(&MessageFilter{}); len(messages) != 0 {
+		t.Errorf("Expected submit-sm not to be stored when its response cannot be sent, got (%d) messages", len(messages))
+	}
+	if !strings.Contains(output.String(), "Unable to send pdu (submit-sm-resp)") {
+		t.Errorf("Expected the failed send to be reported, got output = (%s)", output.String())
+	}
+
+	app.processAgentEvent(&AgentEvent{Type: ReceivedPDU, SourceAgent: agent, RemotePeerName: "esme01", SmppPDU: submitSm})
+	if messages := app.messageStoreForAgent(agent).Messages(&MessageFilter{}); len(messages) != 1 {
+		t.Errorf("Expected submit-sm to be stored once its response is sent, got (%d) messages", len(messages))
+	}
+}
+
+func TestStandardApplicationMessageStoresAreSafeForConcurrentUse(t *testing.T) {
+	app := NewStandardApplication()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			app.messageStoreForAgent(newRecordingAgent(fmt.Sprintf("esme%d", i), ""))
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			if stores := app.messageStoresOfAgentsOtherThanSmscs(); len(stores) != 1000 {
+				t.Errorf("Expected 1000 message stores, got (%d)", len(stores))
+			}
+			return
+		default:
+			app.messageStoresOfAgentsOtherThanSmscs()
+		}
+	}
+}
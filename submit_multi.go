@@ -0,0 +1,290 @@
+package smppth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/blorticus/smpp"
+)
+
+// SubmitMultiDestination is an entry in the dest_address list of a submit_multi.  If IsDistributionList is
+// true, only DistributionListName is meaningful.  Otherwise, AddrTon, AddrNpi and Address describe an SME.
+type SubmitMultiDestination struct {
+	IsDistributionList   bool
+	AddrTon              uint8
+	AddrNpi              uint8
+	Address              string
+	DistributionListName string
+}
+
+// UnsuccessfulDelivery is an entry in the unsuccess_sme list of a submit_multi_resp
+type UnsuccessfulDelivery struct {
+	AddrTon         uint8
+	AddrNpi         uint8
+	Address         string
+	ErrorStatusCode uint32
+}
+
+const (
+	submitMultiDestFlagSmeAddress       uint8 = 1
+	submitMultiDestFlagDistributionList uint8 = 2
+)
+
+// In a submit_multi, the mandatory parameters are flattened: service_type, source_addr_ton, source_addr_npi,
+// source_addr and number_of_dests, then for each destination dest_flag followed by either dest_addr_ton,
+// dest_addr_npi and destination_addr or dl_name, then the ten parameters from esm_class through short_message.
+// In a submit_multi_resp, they are message_id and no_unsuccess, then for each entry dest_addr_ton,
+// dest_addr_npi, destination_addr and error_status_code.
+const (
+	submitMultiIndexOfNumberOfDests = 4
+	submitMultiIndexOfFirstDest     = 5
+	submitMultiRespIndexOfFirstSme  = 2
+)
+
+// SubmitMultiDestinations returns the dest_address list of a submit_multi PDU
+func SubmitMultiDestinations(pdu *smpp.PDU) ([]*SubmitMultiDestination, error) {
+	if pdu.CommandID != smpp.CommandSubmitMulti {
+		return nil, fmt.Errorf("PDU is %s, not submit-multi", pdu.CommandName())
+	}
+
+	if len(pdu.MandatoryParameters) <= submitMultiIndexOfNumberOfDests {
+		return nil, fmt.Errorf("submit-multi has no number_of_dests")
+	}
+
+	numberOfDests, _ := pdu.MandatoryParameters[submitMultiIndexOfNumberOfDests].Value.(uint8)
+	destinations := make([]*SubmitMultiDestination, 0, numberOfDests)
+
+	for i, nextIndex := 0, submitMultiIndexOfFirstDest; i < int(numberOfDests); i++ {
+		if nextIndex >= len(pdu.MandatoryParameters) {
+			return nil, fmt.Errorf("submit-multi has fewer than number_of_dests (%d) destinations", numberOfDests)
+		}
+
+		destFlag, _ := pdu.MandatoryParameters[nextIndex].Value.(uint8)
+		switch destFlag {
+		case submitMultiDestFlagDistributionList:
+			if nextIndex+1 >= len(pdu.MandatoryParameters) {
+				return nil, fmt.Errorf("submit-multi destination (%d) is truncated", i)
+			}
+
+			destinations = append(destinations, &SubmitMultiDestination{
+				IsDistributionList:   true,
+				DistributionListName: mandatoryStringParameter(pdu, nextIndex+1),
+			})
+			nextIndex += 2
+
+		default:
+			if nextIndex+3 >= len(pdu.MandatoryParameters) {
+				return nil, fmt.Errorf("submit-multi destination (%d) is truncated", i)
+			}
+
+			addrTon, _ := pdu.MandatoryParameters[nextIndex+1].Value.(uint8)
+			addrNpi, _ := pdu.MandatoryParameters[nextIndex+2].Value.(uint8)
+			destinations = append(destinations, &SubmitMultiDestination{
+				AddrTon: addrTon,
+				AddrNpi: addrNpi,
+				Address: mandatoryStringParameter(pdu, nextIndex+3),
+			})
+			nextIndex += 4
+		}
+	}
+
+	return destinations, nil
+}
+
+// SubmitMultiUnsuccessfulDeliveries returns the unsuccess_sme list of a submit_multi_resp PDU
+func SubmitMultiUnsuccessfulDeliveries(pdu *smpp.PDU) ([]*UnsuccessfulDelivery, error) {
+	if pdu.CommandID != smpp.CommandSubmitMultiResp {
+		return nil, fmt.Errorf("PDU is %s, not submit-multi-resp", pdu.CommandName())
+	}
+
+	if len(pdu.MandatoryParameters) < submitMultiRespIndexOfFirstSme {
+		return []*UnsuccessfulDelivery{}, nil
+	}
+
+	numberUnsuccessful, _ := pdu.MandatoryParameters[1].Value.(uint8)
+	if len(pdu.MandatoryParameters) < submitMultiRespIndexOfFirstSme+4*int(numberUnsuccessful) {
+		return nil, fmt.Errorf("submit-multi-resp has fewer than no_unsuccess (%d) entries", numberUnsuccessful)
+	}
+
+	unsuccessfulDeliveries := make([]*UnsuccessfulDelivery, 0, numberUnsuccessful)
+	for i := 0; i < int(numberUnsuccessful); i++ {
+		entryIndex := submitMultiRespIndexOfFirstSme + 4*i
+		addrTon, _ := pdu.MandatoryParameters[entryIndex].Value.(uint8)
+		addrNpi, _ := pdu.MandatoryParameters[entryIndex+1].Value.(uint8)
+		errorStatusCode, _ := pdu.MandatoryParameters[entryIndex+3].Value.(uint32)
+
+		unsuccessfulDeliveries = append(unsuccessfulDeliveries, &UnsuccessfulDelivery{
+			AddrTon:         addrTon,
+			AddrNpi:         addrNpi,
+			Address:         mandatoryStringParameter(pdu, entryIndex+2),
+			ErrorStatusCode: errorStatusCode,
+		})
+	}
+
+	return unsuccessfulDeliveries, nil
+}
+
+// submitMultiShortMessage returns the short_message of a submit_multi, decoded according to its data_coding,
+// or "" if there is none
+func submitMultiShortMessage(pdu *smpp.PDU) string {
+	if len(pdu.MandatoryParameters) < 4 {
+		return ""
+	}
+
+	if shortMessage, isOctetString := pdu.MandatoryParameters[len(pdu.MandatoryParameters)-1].Value.([]byte); isOctetString {
+		dataCoding, _ := pdu.MandatoryParameters[len(pdu.MandatoryParameters)-4].Value.(uint8)
+		return DecodeText(shortMessage, TextEncodingForDataCoding(dataCoding))
+	}
+
+	return ""
+}
+
+// submitMultiBodyDecoder reads the flattened mandatory parameters of a submit_multi or submit_multi_resp
+type submitMultiBodyDecoder struct {
+	body       []byte
+	offset     int
+	parameters []*smpp.Parameter
+	err        error
+}
+
+func (decoder *submitMultiBodyDecoder) readUint8() uint8 {
+	if decoder.err != nil {
+		return 0
+	}
+
+	if decoder.offset >= len(decoder.body) {
+		decoder.err = fmt.Errorf("body is truncated at offset (%d)", decoder.offset)
+		return 0
+	}
+
+	value := decoder.body[decoder.offset]
+	decoder.parameters = append(decoder.parameters, smpp.NewFLParameter(value))
+	decoder.offset++
+
+	return value
+}
+
+func (decoder *submitMultiBodyDecoder) readUint32() {
+	if decoder.err != nil {
+		return
+	}
+
+	if len(decoder.body)-decoder.offset < 4 {
+		decoder.err = fmt.Errorf("body is truncated at offset (%d)", decoder.offset)
+		return
+	}
+
+	decoder.parameters = append(decoder.parameters, smpp.NewFLParameter(binary.BigEndian.Uint32(decoder.body[decoder.offset:decoder.offset+4])))
+	decoder.offset += 4
+}
+
+func (decoder *submitMultiBodyDecoder) readCOctetString() {
+	if decoder.err != nil {
+		return
+	}
+
+	nullOffset := bytes.IndexByte(decoder.body[decoder.offset:], 0)
+	if nullOffset < 0 {
+		decoder.err = fmt.Errorf("C-octet string at offset (%d) has no null terminator", decoder.offset)
+		return
+	}
+
+	decoder.parameters = append(decoder.parameters, smpp.NewCOctetStringParameter(string(decoder.body[decoder.offset:decoder.offset+nullOffset])))
+	decoder.offset += nullOffset + 1
+}
+
+func (decoder *submitMultiBodyDecoder) readOctetString(length int) {
+	if decoder.err != nil || length == 0 {
+		return
+	}
+
+	if len(decoder.body)-decoder.offset < length {
+		decoder.err = fmt.Errorf("short_message length (%d) exceeds remaining data", length)
+		return
+	}
+
+	value := make([]byte, length)
+	copy(value, decoder.body[decoder.offset:decoder.offset+length])
+	decoder.parameters = append(decoder.parameters, &smpp.Parameter{Type: smpp.TypeOctetString, EncodeLength: uint32(length), Value: value})
+	decoder.offset += length
+}
+
+func (decoder *submitMultiBodyDecoder) finish(commandID smpp.CommandIDType, commandStatus uint32, sequenceNumber uint32) (*smpp.PDU, error) {
+	if decoder.err != nil {
+		return nil, fmt.Errorf("In %s with sequence number (%d), %s", smpp.CommandName(commandID), sequenceNumber, decoder.err)
+	}
+
+	optionalParameters, err := decodeTlvParameters(decoder.body[decoder.offset:])
+	if err != nil {
+		return nil, fmt.Errorf("In %s with sequence number (%d), %s", smpp.CommandName(commandID), sequenceNumber, err)
+	}
+
+	return smpp.NewPDU(commandID, commandStatus, sequenceNumber, decoder.parameters, optionalParameters), nil
+}
+
+func decodeSubmitMulti(commandStatus uint32, sequenceNumber uint32, body []byte) (*smpp.PDU, error) {
+	decoder := &submitMultiBodyDecoder{body: body, parameters: make([]*smpp.Parameter, 0, 20)}
+
+	decoder.readCOctetString() // service_type
+	decoder.readUint8()        // source_addr_ton
+	decoder.readUint8()        // source_addr_npi
+	decoder.readCOctetString() // source_addr
+
+	numberOfDests := decoder.readUint8()
+	for i := 0; i < int(numberOfDests) && decoder.err == nil; i++ {
+		if decoder.readUint8() == submitMultiDestFlagDistributionList {
+			decoder.readCOctetString() // dl_name
+		} else {
+			decoder.readUint8()        // dest_addr_ton
+			decoder.readUint8()        // dest_addr_npi
+			decoder.readCOctetString() // destination_addr
+		}
+	}
+
+	decoder.readUint8()        // esm_class
+	decoder.readUint8()        // protocol_id
+	decoder.readUint8()        // priority_flag
+	decoder.readCOctetString() // schedule_delivery_time
+	decoder.readCOctetString() // validity_period
+	decoder.readUint8()        // registered_delivery
+	decoder.readUint8()        // replace_if_present_flag
+	decoder.readUint8()        // data_coding
+	decoder.readUint8()        // sm_default_msg_id
+	smLength := decoder.readUint8()
+	decoder.readOctetString(int(smLength))
+
+	return decoder.finish(smpp.CommandSubmitMulti, commandStatus, sequenceNumber)
+}
+
+func decodeSubmitMultiResp(commandStatus uint32, sequenceNumber uint32, body []byte) (*smpp.PDU, error) {
+	decoder := &submitMultiBodyDecoder{body: body, parameters: make([]*smpp.Parameter, 0, 2)}
+
+	if len(body) > 0 {
+		decoder.readCOctetString() // message_id
+
+		numberUnsuccessful := decoder.readUint8()
+		for i := 0; i < int(numberUnsuccessful) && decoder.err == nil; i++ {
+			decoder.readUint8()        // dest_addr_ton
+			decoder.readUint8()        // dest_addr_npi
+			decoder.readCOctetString() // destination_addr
+			decoder.readUint32()       // error_status_code
+		}
+	}
+
+	return decoder.finish(smpp.CommandSubmitMultiResp, commandStatus, sequenceNumber)
+}
+
+// splitCommaSeparatedList splits a comma separated list, discarding empty elements and surrounding whitespace
+func splitCommaSeparatedList(list string) []string {
+	elements := make([]string, 0, 1)
+
+	for _, element := range strings.Split(list, ",") {
+		if trimmed := strings.TrimSpace(element); trimmed != "" {
+			elements = append(elements, trimmed)
+		}
+	}
+
+	return elements
+}
@@ -0,0 +1,212 @@
+package smppth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestSubmitMultiEncodeAndDecode(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	if _, err := factory.CreateSubmitMulti(map[string]string{}); err == nil {
+		t.Errorf("Expected error on submit-multi with no destinations, got none")
+	}
+
+	submitMulti, err := factory.CreateSubmitMulti(map[string]string{
+		"source_addr":   "1000",
+		"dest":          "2001, 2002",
+		"dl_name":       "everyone",
+		"dest_addr_npi": "1",
+		"short_message": "hello all",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSubmitMulti, got = (%s)", err)
+	}
+
+	encoded, err := submitMulti.Encode()
+	if err != nil {
+		t.Fatalf("Expected no error on Encode, got = (%s)", err)
+	}
+
+	decoded, err := decodePDU(encoded)
+	if err != nil {
+		t.Fatalf("Expected no error on decodePDU, got = (%s)", err)
+	}
+
+	destinations, err := SubmitMultiDestinations(decoded)
+	if err != nil {
+		t.Fatalf("Expected no error on SubmitMultiDestinations, got = (%s)", err)
+	}
+
+	if len(destinations) != 3 {
+		t.Fatalf("Expected 3 destinations, got (%d)", len(destinations))
+	}
+
+	if destinations[0].IsDistributionList || destinations[0].Address != "2001" || destinations[0].AddrNpi != 1 {
+		t.Errorf("Expected first destination SME 2001 with npi 1, got = (%+v)", destinations[0])
+	}
+
+	if destinations[1].IsDistributionList || destinations[1].Address != "2002" {
+		t.Errorf("Expected second destination SME 2002, got = (%+v)", destinations[1])
+	}
+
+	if !destinations[2].IsDistributionList || destinations[2].DistributionListName != "everyone" {
+		t.Errorf("Expected third destination distribution list everyone, got = (%+v)", destinations[2])
+	}
+
+	if mandatoryStringParameter(decoded, 3) != "1000" {
+		t.Errorf("Expected source_addr = (1000), got = (%s)", mandatoryStringParameter(decoded, 3))
+	}
+
+	if submitMultiShortMessage(decoded) != "hello all" {
+		t.Errorf("Expected short_message = (hello all), got = (%s)", submitMultiShortMessage(decoded))
+	}
+
+	if _, err := decodePDU(encoded[:len(encoded)-12]); err == nil {
+		t.Errorf("Expected error on decodePDU of truncated submit-multi, got none")
+	}
+}
+
+func TestSubmitMultiMessageFields(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	submitMulti, err := factory.CreateSubmitMulti(map[string]string{
+		"dest":                "2001",
+		"esm_class":           "0x40",
+		"priority_flag":       "2",
+		"registered_delivery": "1",
+		"encoding":            "ucs2",
+		"short_message":       "hi",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSubmitMulti, got = (%s)", err)
+	}
+
+	messageFields := submitMulti.MandatoryParameters[len(submitMulti.MandatoryParameters)-11:]
+	if esmClass := messageFields[0].Value.(uint8); esmClass != 0x40 {
+		t.Errorf("Expected esm_class = (0x40), got = (0x%02X)", esmClass)
+	}
+	if priorityFlag := messageFields[2].Value.(uint8); priorityFlag != 2 {
+		t.Errorf("Expected priority_flag = (2), got = (%d)", priorityFlag)
+	}
+	if registeredDelivery := messageFields[5].Value.(uint8); registeredDelivery != 1 {
+		t.Errorf("Expected registered_delivery = (1), got = (%d)", registeredDelivery)
+	}
+	if dataCoding := messageFields[7].Value.(uint8); dataCoding != TextEncodingUcs2.DataCoding() {
+		t.Errorf("Expected data_coding for ucs2, got = (%d)", dataCoding)
+	}
+	if shortMessage := submitMultiShortMessage(submitMulti); shortMessage != "hi" || messageFields[9].Value.(uint8) != 4 {
+		t.Errorf("Expected UCS-2 short_message (hi) with sm_length (4), got (%s) with sm_length (%d)", shortMessage, messageFields[9].Value)
+	}
+
+	for _, invalidParameters := range []map[string]string{
+		{"dest": "2001", "short_message": strings.Repeat("x", 255)},
+		{"dest": "2001", "priority_flag": "4"},
+		{"dest": "2001", "registered_delivery": "3"},
+		{"dest": "2001", "encoding": "nonesuch"},
+	} {
+		if _, err := factory.CreateSubmitMulti(invalidParameters); err == nil {
+			t.Errorf("Expected error for parameters (%v), got none", invalidParameters)
+		}
+	}
+}
+
+func TestSubmitMultiRespEncodeAndDecode(t *testing.T) {
+	factory := NewDefaultPduFactory()
+	submitMulti, _ := factory.CreateSubmitMulti(map[string]string{"dest": "2001,2002"})
+
+	submitMultiResp := factory.CreateSubmitMultiRespFromRequest(submitMulti, "msg01", []*UnsuccessfulDelivery{
+		{AddrTon: 1, AddrNpi: 1, Address: "2002", ErrorStatusCode: EsmeRinvdstadr},
+	})
+
+	encoded, err := submitMultiResp.Encode()
+	if err != nil {
+		t.Fatalf("Expected no error on Encode, got = (%s)", err)
+	}
+
+	decoded, err := decodePDU(encoded)
+	if err != nil {
+		t.Fatalf("Expected no error on decodePDU, got = (%s)", err)
+	}
+
+	if decoded.SequenceNumber != submitMulti.SequenceNumber || mandatoryStringParameter(decoded, 0) != "msg01" {
+		t.Errorf("Expected sequence number (%d) and message_id (msg01)", submitMulti.SequenceNumber)
+	}
+
+	unsuccessfulDeliveries, err := SubmitMultiUnsuccessfulDeliveries(decoded)
+	if err != nil {
+		t.Fatalf("Expected no error on SubmitMultiUnsuccessfulDeliveries, got = (%s)", err)
+	}
+
+	if len(unsuccessfulDeliveries) != 1 {
+		t.Fatalf("Expected 1 unsuccess_sme entry, got (%d)", len(unsuccessfulDeliveries))
+	}
+
+	if *unsuccessfulDeliveries[0] != (UnsuccessfulDelivery{AddrTon: 1, AddrNpi: 1, Address: "2002", ErrorStatusCode: EsmeRinvdstadr}) {
+		t.Errorf("Unexpected unsuccess_sme entry = (%+v)", unsuccessfulDeliveries[0])
+	}
+
+	emptyErrorResp, _ := smpp.NewPDU(smpp.CommandSubmitMultiResp, EsmeRinvnumdests, 9, []*smpp.Parameter{}, []*smpp.Parameter{}).Encode()
+	decoded, err = decodePDU(emptyErrorResp)
+	if err != nil || decoded.CommandStatus != EsmeRinvnumdests || len(decoded.MandatoryParameters) != 0 {
+		t.Errorf("Expected bodyless submit-multi-resp with ESME_RINVNUMDESTS, got error = (%v)", err)
+	}
+}
+
+func TestSubmitMultiRespGeneratedWithConfiguredFailures(t *testing.T) {
+	app := NewStandardApplication().SetSubmitMultiFailureForDestination("2002", EsmeRdeliveryfailure)
+	submitMulti, _ := NewDefaultPduFactory().CreateSubmitMulti(map[string]string{"dest": "2001,2002", "dl_name": "2002"})
+
+	response := app.generateSubmitMultiResp("smsc01", submitMulti)
+	if response.CommandID != smpp.CommandSubmitMultiResp || response.CommandStatus != 0 {
+		t.Fatalf("Expected successful submit-multi-resp, got (%s) with status (%s)", response.CommandName(), CommandStatusName(response.CommandStatus))
+	}
+
+	unsuccessfulDeliveries, err := SubmitMultiUnsuccessfulDeliveries(response)
+	if err != nil {
+		t.Fatalf("Expected no error on SubmitMultiUnsuccessfulDeliveries, got = (%s)", err)
+	}
+
+	if len(unsuccessfulDeliveries) != 1 || unsuccessfulDeliveries[0].Address != "2002" || unsuccessfulDeliveries[0].ErrorStatusCode != EsmeRdeliveryfailure {
+		t.Errorf("Expected a single unsuccess_sme entry for 2002 with ESME_RDELIVERYFAILURE, got (%d) entries", len(unsuccessfulDeliveries))
+	}
+}
+
+func TestSubmitMultiFailuresChangedByCommandWhileRunning(t *testing.T) {
+	output := new(bytes.Buffer)
+	app := NewStandardApplication().SetEventOutputWriter(output).SetSubmitMultiFailures(map[string]uint32{"2001": EsmeRinvdstadr})
+	submitMulti, _ := NewDefaultPduFactory().CreateSubmitMulti(map[string]string{"dest": "2001,2002"})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			app.generateSubmitMultiResp("smsc01", submitMulti)
+		}
+		done <- true
+	}()
+
+	for i := 0; i < 100; i++ {
+		app.ReceiveNextCommand(&UserCommand{Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{DestinationToFail: "2002", ErrorStatusCode: EsmeRdeliveryfailure}})
+		app.ReceiveNextCommand(&UserCommand{Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{DestinationToClear: "2002"}})
+	}
+	<-done
+
+	output.Reset()
+	app.ReceiveNextCommand(&UserCommand{Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{DestinationToFail: "2002", ErrorStatusCode: EsmeRdeliveryfailure}})
+	if output.String() != "2 submit-multi failures\n  2001 ESME_RINVDSTADR\n  2002 ESME_RDELIVERYFAILURE" {
+		t.Errorf("Unexpected submit-multi-failures output = (%s)", output.String())
+	}
+
+	unsuccessfulDeliveries, _ := SubmitMultiUnsuccessfulDeliveries(app.generateSubmitMultiResp("smsc01", submitMulti))
+	if len(unsuccessfulDeliveries) != 2 {
+		t.Errorf("Expected two unsuccess_sme entries after set, got (%d)", len(unsuccessfulDeliveries))
+	}
+
+	app.ReceiveNextCommand(&UserCommand{Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{ClearAll: true}})
+	if unsuccessfulDeliveries, _ := SubmitMultiUnsuccessfulDeliveries(app.generateSubmitMultiResp("smsc01", submitMulti)); len(unsuccessfulDeliveries) != 0 {
+		t.Errorf("Expected no unsuccess_sme entries after clear, got (%d)", len(unsuccessfulDeliveries))
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 func testSmppMsgBindTransceiver01() []byte {
 	return []byte{
-		0, 0, 0, 0x14, // len = 20
+		0, 0, 0, 0x1d, // len = 29
 		0x00, 0, 0, 0x09, // command = bind_transceiver_resp
 		0, 0, 0, 0x00, // status code = 0
 		0, 0, 0, 0x01, // seq number = 1
@@ -98,6 +98,20 @@ func eventTypeToString(eventType AgentEventType) string {
 		return "ReceivedPDU"
 	case CompletedBind:
 		return "CompletedBind"
+	case ProtocolError:
+		return "ProtocolError"
+	case ReceivedCompleteMessage:
+		return "ReceivedCompleteMessage"
+	case IncompleteMessageTimedOut:
+		return "IncompleteMessageTimedOut"
+	case DeliveryReceiptReceived:
+		return "DeliveryReceiptReceived"
+	case DeliveryQueued:
+		return "DeliveryQueued"
+	case DeliveryRetried:
+		return "DeliveryRetried"
+	case DeliveryAbandoned:
+		return "DeliveryAbandoned"
 	default:
 		return "<unknown>"
 	}
@@ -3,6 +3,8 @@ package smppth
 import (
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/blorticus/smpp"
 )
@@ -10,11 +12,43 @@ import (
 // TextCommandProcessor accepts incoming text commands and, if they match the TextCommandProcessor syntax,
 // then it emits a corresponding UserCommand structs.  The syntax includes:
 //    $agent_name: send enquire-link to $peer_name
-//    $agent_name: send submit-sm to $peer_name [source_addr_ton=$sat] [source_address=$saddr] [dest_addr_ton=$dat] [destination_address=$daddr] [short_message=$msg]
+//    $agent_name: send submit-sm to $peer_name [$submit_sm_field=$value ...] [encoding=$enc] [segmentation=udh|udh16|sar|payload] [short_message=$msg]
+//    $agent_name: send deliver-sm to $peer_name [$submit_sm_field=$value ...] [encoding=$enc] [short_message=$msg]
+//    $agent_name: send data-sm to $peer_name [source_addr_npi=$snpi] [source_address=$saddr] [dest_addr_npi=$dnpi] [destination_address=$daddr] [message_payload=$msg]
+//    $agent_name: send query-sm to $peer_name message_id=$id [source_addr_ton=$sat] [source_addr_npi=$snpi] [source_addr=$saddr]
+//    $agent_name: send cancel-sm to $peer_name [message_id=$id] [service_type=$st] [source_addr=$saddr] [destination_addr=$daddr]
+//    $agent_name: send replace-sm to $peer_name message_id=$id [source_addr=$saddr] [short_message=$msg]
+//    $agent_name: respond to $peer_name seq=$sequence_number [status=$status] [message_id=$id] [message_state=$state] [final_date=$date] [error_code=$code]
+//    $agent_name: send submit-multi to $peer_name dest=$daddr[,$daddr...] [dl_name=$dl[,$dl...]] [source_addr=$saddr] [short_message=$msg]
+//    stats [$agent_name]
+//    sessions
+//    outstanding $agent_name $peer_name
+//    pending $agent_name [$peer_name]
+//    messages $smsc_name [message_id=$id] [peer=$peer_name] [source_addr=$saddr] [destination_addr=$daddr] [state=$state]
+//    responses
+//    responses add [name=$name] [agent=$agent_name] [peer=$peer_name] [command=$pdu_type] [match:$field=$regex ...] action=$action [status=$status] [delay=$duration] [max_delay=$duration] [probability=$p]
+//    responses remove $name
+//    responses clear
+//    submit-multi-failures
+//    submit-multi-failures set $destination_addr $status
+//    submit-multi-failures clear [$destination_addr]
 //    help
+// where $submit_sm_field is any of the submit_sm mandatory fields (e.g., service_type, source_addr_ton, esm_class,
+// validity_period or registered_delivery), other than sm_length.  Any send command may also include optional
+// parameters, either by name (e.g., user_message_reference=7) or as tlv:0xNNNN=$hex_octets.  A parameter value
+// in double quotes may contain escape sequences (e.g., short_message="line 1\nline 2 \u20AC").  For responses add,
+// $action is respond, drop, generic-nack, close or hold (see ParseResponseRule).
 type TextCommandProcessor struct {
 	helpCommandMatcher           *regexp.Regexp
 	quitCommandMatcher           *regexp.Regexp
+	statsCommandMatcher          *regexp.Regexp
+	sessionsCommandMatcher       *regexp.Regexp
+	outstandingCommandMatcher    *regexp.Regexp
+	messagesCommandMatcher       *regexp.Regexp
+	responsesCommandMatcher      *regexp.Regexp
+	submitMultiFailuresMatcher   *regexp.Regexp
+	pendingCommandMatcher        *regexp.Regexp
+	respondCommandMatcher        *regexp.Regexp
 	sendCommandMatcher           *regexp.Regexp
 	sendCommandParametersMatcher *regexp.Regexp
 	emptyParameterMatcher        *regexp.Regexp
@@ -30,11 +64,19 @@ func NewTextCommandProcessor() *TextCommandProcessor {
 	return &TextCommandProcessor{
 		helpCommandMatcher:           regexp.MustCompile(`^help$`),
 		quitCommandMatcher:           regexp.MustCompile(`^quit$`),
+		statsCommandMatcher:          regexp.MustCompile(`^stats(?: +(\S+))? *$`),
+		sessionsCommandMatcher:       regexp.MustCompile(`^sessions *$`),
+		outstandingCommandMatcher:    regexp.MustCompile(`^outstanding +(\S+) +(\S+) *$`),
+		messagesCommandMatcher:       regexp.MustCompile(`^messages +(\S+)(.*)$`),
+		responsesCommandMatcher:      regexp.MustCompile(`^responses(?: +(add|remove|clear)(?: +(.*?))?)? *$`),
+		submitMultiFailuresMatcher:   regexp.MustCompile(`^submit-multi-failures(?: +(set|clear)(?: +(.*?))?)? *$`),
+		pendingCommandMatcher:        regexp.MustCompile(`^pending +(\S+)(?: +(\S+))? *$`),
+		respondCommandMatcher:        regexp.MustCompile(`^(\S+?): respond to (\S+) *(.*)$`),
 		sendCommandMatcher:           regexp.MustCompile(`^(\S+?): send (\S+) to (\S+) *(.*)?$`),
 		sendCommandParametersMatcher: regexp.MustCompile(`^ *short_message="(.+?)" *$`),
 		emptyParameterMatcher:        regexp.MustCompile(`^(\S+)=\s+`),
 		emptyLastParameterMatcher:    regexp.MustCompile(`^(\S+)=$`),
-		doubleQuotedParameterMatcher: regexp.MustCompile(`^(\S+)="(.+?)"\s*`),
+		doubleQuotedParameterMatcher: regexp.MustCompile(`^(\S+)="((?:[^"\\]|\\.)+)"\s*`),
 		singleQuotedParameterMatcher: regexp.MustCompile(`^(\S+)='(.+?)'\s*`),
 		unquotedParameterMatcher:     regexp.MustCompile(`^(\S+)=(\S+)\s*`),
 		lastSetOfMatchGroupValues:    []string{},
@@ -58,6 +100,66 @@ func (processor *TextCommandProcessor) ConvertCommandLineStringToUserCommand(com
 		}, nil
 	}
 
+	if processor.thisIsTheStatsCommand(commandLine) {
+		return &UserCommand{
+			Type:    Stats,
+			Details: &StatsDetails{NameOfAgent: processor.lastSetOfMatchGroupValues[1]},
+		}, nil
+	}
+
+	if processor.thisIsTheSessionsCommand(commandLine) {
+		return &UserCommand{
+			Type: Sessions,
+		}, nil
+	}
+
+	if processor.thisIsTheOutstandingCommand(commandLine) {
+		return &UserCommand{
+			Type: Outstanding,
+			Details: &OutstandingDetails{
+				NameOfAgent: processor.lastSetOfMatchGroupValues[1],
+				NameOfPeer:  processor.lastSetOfMatchGroupValues[2],
+			},
+		}, nil
+	}
+
+	if processor.thisIsTheMessagesCommand(commandLine) {
+		filter, err := ParseMessageFilter(processor.lastSetOfMatchGroupValues[2])
+		if err != nil {
+			return nil, err
+		}
+
+		return &UserCommand{
+			Type: Messages,
+			Details: &MessagesDetails{
+				NameOfSmsc: processor.lastSetOfMatchGroupValues[1],
+				Filter:     filter,
+			},
+		}, nil
+	}
+
+	if processor.thisIsThePendingCommand(commandLine) {
+		return &UserCommand{
+			Type: Pending,
+			Details: &PendingDetails{
+				NameOfAgent: processor.lastSetOfMatchGroupValues[1],
+				NameOfPeer:  processor.lastSetOfMatchGroupValues[2],
+			},
+		}, nil
+	}
+
+	if processor.thisIsARespondCommand(commandLine) {
+		return processor.convertRespondCommand(processor.lastSetOfMatchGroupValues[1], processor.lastSetOfMatchGroupValues[2], processor.lastSetOfMatchGroupValues[3])
+	}
+
+	if processor.thisIsTheResponsesCommand(commandLine) {
+		return processor.convertResponsesCommand(processor.lastSetOfMatchGroupValues[1], processor.lastSetOfMatchGroupValues[2])
+	}
+
+	if processor.thisIsTheSubmitMultiFailuresCommand(commandLine) {
+		return processor.convertSubmitMultiFailuresCommand(processor.lastSetOfMatchGroupValues[1], processor.lastSetOfMatchGroupValues[2])
+	}
+
 	if processor.thisIsASendCommand(commandLine) {
 		smppCommandName := processor.lastSetOfMatchGroupValues[2]
 
@@ -67,13 +169,22 @@ func (processor *TextCommandProcessor) ConvertCommandLineStringToUserCommand(com
 			return nil, fmt.Errorf("Invalid smpp PDU type name (%s)", smppCommandName)
 		}
 
+		parametersMap, err := processor.breakParametersIntoMap(processor.lastSetOfMatchGroupValues[4])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := processor.validateRawTlvParameters(parametersMap); err != nil {
+			return nil, err
+		}
+
 		return &UserCommand{
 			Type: SendPDU,
 			Details: &SendPduDetails{
 				NameOfAgentThatWillSendPdu:     processor.lastSetOfMatchGroupValues[1],
 				NameOfPeerThatShouldReceivePdu: processor.lastSetOfMatchGroupValues[3],
 				TypeOfSmppPDU:                  smppCommandID,
-				StringParametersMap:            processor.breakParametersIntoMap(processor.lastSetOfMatchGroupValues[4]),
+				StringParametersMap:            parametersMap,
 			},
 		}, nil
 	}
@@ -89,8 +200,145 @@ func (processor *TextCommandProcessor) thisIsTheHelpCommand(commandLine string)
 	return processor.helpCommandMatcher.Match([]byte(commandLine))
 }
 
+func (processor *TextCommandProcessor) thisIsTheSessionsCommand(commandLine string) bool {
+	return processor.sessionsCommandMatcher.Match([]byte(commandLine))
+}
+
+func (processor *TextCommandProcessor) thisIsTheStatsCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.statsCommandMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) thisIsTheOutstandingCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.outstandingCommandMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) thisIsTheMessagesCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.messagesCommandMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) thisIsThePendingCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.pendingCommandMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) thisIsARespondCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.respondCommandMatcher, commandLine)
+}
+
+// convertRespondCommand creates the Respond UserCommand.  seq is required, and is removed from the parameters map
+// along with status, which is ESME_ROK if it is not provided.
+func (processor *TextCommandProcessor) convertRespondCommand(nameOfAgent string, nameOfPeer string, parameterString string) (*UserCommand, error) {
+	parametersMap, err := processor.breakParametersIntoMap(parameterString)
+	if err != nil {
+		return nil, err
+	}
+
+	sequenceNumberString, sequenceNumberIsSet := parametersMap["seq"]
+	if !sequenceNumberIsSet {
+		return nil, fmt.Errorf("respond requires seq=$sequence_number")
+	}
+
+	sequenceNumber, err := strconv.ParseUint(sequenceNumberString, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("seq (%s) is not a valid sequence number", sequenceNumberString)
+	}
+
+	commandStatus := EsmeRok
+	if commandStatusString, commandStatusIsSet := parametersMap["status"]; commandStatusIsSet {
+		if commandStatus, err = CommandStatusFromString(commandStatusString); err != nil {
+			return nil, err
+		}
+	}
+
+	delete(parametersMap, "seq")
+	delete(parametersMap, "status")
+
+	return &UserCommand{
+		Type: Respond,
+		Details: &RespondDetails{
+			NameOfAgentThatWillRespond: nameOfAgent,
+			NameOfPeerThatSentRequest:  nameOfPeer,
+			SequenceNumber:             uint32(sequenceNumber),
+			CommandStatus:              commandStatus,
+			StringParametersMap:        parametersMap,
+		},
+	}, nil
+}
+
+func (processor *TextCommandProcessor) thisIsTheResponsesCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.responsesCommandMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) convertResponsesCommand(operation string, arguments string) (*UserCommand, error) {
+	details := &ResponsesDetails{}
+
+	switch operation {
+	case "add":
+		parametersMap, err := processor.breakParametersIntoMap(arguments)
+		if err != nil {
+			return nil, err
+		}
+
+		if details.RuleToAdd, err = ParseResponseRule(parametersMap); err != nil {
+			return nil, err
+		}
+
+	case "remove":
+		if len(strings.Fields(arguments)) != 1 {
+			return nil, fmt.Errorf("responses remove requires the name of one rule")
+		}
+		details.NameOfRuleToRemove = arguments
+
+	case "clear":
+		if arguments != "" {
+			return nil, fmt.Errorf("responses clear takes no arguments")
+		}
+		details.RemoveAllRules = true
+	}
+
+	return &UserCommand{Type: Responses, Details: details}, nil
+}
+
+func (processor *TextCommandProcessor) thisIsTheSubmitMultiFailuresCommand(commandLine string) bool {
+	return processor.matchAndRetainGroupValues(processor.submitMultiFailuresMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) convertSubmitMultiFailuresCommand(operation string, arguments string) (*UserCommand, error) {
+	details := &SubmitMultiFailuresDetails{}
+	fields := strings.Fields(arguments)
+
+	switch operation {
+	case "set":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("submit-multi-failures set requires a destination_addr and a status")
+		}
+
+		errorStatusCode, err := CommandStatusFromString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		details.DestinationToFail, details.ErrorStatusCode = fields[0], errorStatusCode
+
+	case "clear":
+		switch len(fields) {
+		case 0:
+			details.ClearAll = true
+		case 1:
+			details.DestinationToClear = fields[0]
+		default:
+			return nil, fmt.Errorf("submit-multi-failures clear takes at most one destination_addr")
+		}
+	}
+
+	return &UserCommand{Type: SubmitMultiFailures, Details: details}, nil
+}
+
 func (processor *TextCommandProcessor) thisIsASendCommand(commandLine string) bool {
-	submatches := processor.sendCommandMatcher.FindStringSubmatch(commandLine)
+	return processor.matchAndRetainGroupValues(processor.sendCommandMatcher, commandLine)
+}
+
+func (processor *TextCommandProcessor) matchAndRetainGroupValues(matcher *regexp.Regexp, commandLine string) bool {
+	submatches := matcher.FindStringSubmatch(commandLine)
 
 	if len(submatches) > 0 {
 		processor.lastSetOfMatchGroupValues = submatches
@@ -100,7 +348,10 @@ func (processor *TextCommandProcessor) thisIsASendCommand(commandLine string) bo
 	return false
 }
 
-func (processor *TextCommandProcessor) breakParametersIntoMap(parameterString string) map[string]string {
+// breakParametersIntoMap splits name=value parameters into a map.  Escape sequences (e.g., \n, \", \x41 or \u20AC)
+// in a double-quoted value are replaced by the characters they represent.  Single-quoted and unquoted values are
+// used as they are.
+func (processor *TextCommandProcessor) breakParametersIntoMap(parameterString string) (map[string]string, error) {
 	parameterMap := make(map[string]string)
 
 	for len(parameterString) > 0 {
@@ -110,6 +361,14 @@ func (processor *TextCommandProcessor) breakParametersIntoMap(parameterString st
 			itDoesMatch, parameterName, parameterValue, parameterStringLength := processor.extractMappableValueAndMatchingLengthFromMatcher(compiledMatcher, parameterString)
 
 			if itDoesMatch {
+				if compiledMatcher == processor.doubleQuotedParameterMatcher {
+					unescapedValue, err := strconv.Unquote(`"` + parameterValue + `"`)
+					if err != nil {
+						return nil, fmt.Errorf("parameter (%s) value (%s) has an invalid escape sequence", parameterName, parameterValue)
+					}
+					parameterValue = unescapedValue
+				}
+
 				parameterMap[parameterName] = parameterValue
 				parameterString = parameterString[parameterStringLength:]
 				foundSomeTypeOfMatch = true
@@ -122,7 +381,23 @@ func (processor *TextCommandProcessor) breakParametersIntoMap(parameterString st
 		}
 	}
 
-	return parameterMap
+	return parameterMap, nil
+}
+
+// validateRawTlvParameters returns an error if a parameter in the form tlv:0xNNNN=<hex> has an invalid tag
+// or value, so that the command is rejected before it reaches a PduFactory
+func (processor *TextCommandProcessor) validateRawTlvParameters(parameterMap map[string]string) error {
+	for name, value := range parameterMap {
+		if _, isRawTlv, err := parseRawTlvParameterName(name); err != nil {
+			return err
+		} else if isRawTlv {
+			if _, err := parseRawTlvParameterValue(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 func (processor *TextCommandProcessor) extractMappableValueAndMatchingLengthFromMatcher(compiledRegexp *regexp.Regexp, parseString string) (doesMatch bool, name string, value string, matchLen int) {
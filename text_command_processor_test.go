@@ -177,3 +177,157 @@ func compareUserCommandStructsForSendCommand(expected *UserCommand, got *UserCom
 
 	return nil
 }
+
+func TestValidOperationalStatisticsCommands(t *testing.T) {
+	for commandToTest, expectedStruct := range map[string]*UserCommand{
+		"stats":                     {Type: Stats, Details: &StatsDetails{NameOfAgent: ""}},
+		"stats esme01":              {Type: Stats, Details: &StatsDetails{NameOfAgent: "esme01"}},
+		"sessions":                  {Type: Sessions},
+		"outstanding esme01 smsc01": {Type: Outstanding, Details: &OutstandingDetails{NameOfAgent: "esme01", NameOfPeer: "smsc01"}},
+		"messages smsc01":           {Type: Messages, Details: &MessagesDetails{NameOfSmsc: "smsc01", Filter: &MessageFilter{}}},
+		"messages smsc01 state=ENROUTE peer=esme01": {Type: Messages, Details: &MessagesDetails{NameOfSmsc: "smsc01", Filter: &MessageFilter{State: MessageStateEnroute, NameOfPeer: "esme01"}}},
+	} {
+		processor := NewTextCommandProcessor()
+
+		userCommandStruct, err := processor.ConvertCommandLineStringToUserCommand(commandToTest)
+
+		if err != nil {
+			t.Errorf("For (%s) expected no error on ConvertCommandLineStringToUserCommand, got = (%s)", commandToTest, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(expectedStruct, userCommandStruct) {
+			t.Errorf("For (%s) expected struct = (%+v), got = (%+v)", commandToTest, expectedStruct, userCommandStruct)
+		}
+	}
+
+	for _, commandToTest := range []string{"stats esme01 smsc01", "outstanding esme01", "sessions esme01"} {
+		if _, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest); err == nil {
+			t.Errorf("For (%s) expected error on ConvertCommandLineStringToUserCommand but did not get one", commandToTest)
+		}
+	}
+}
+
+func TestCommandProcessorResponsesCommands(t *testing.T) {
+	for commandToTest, expectedStruct := range map[string]*UserCommand{
+		"responses":             {Type: Responses, Details: &ResponsesDetails{}},
+		"responses remove slow": {Type: Responses, Details: &ResponsesDetails{NameOfRuleToRemove: "slow"}},
+		"responses clear":       {Type: Responses, Details: &ResponsesDetails{RemoveAllRules: true}},
+	} {
+		userCommandStruct, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest)
+
+		if err != nil {
+			t.Errorf("For (%s) expected no error on ConvertCommandLineStringToUserCommand, got = (%s)", commandToTest, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(expectedStruct, userCommandStruct) {
+			t.Errorf("For (%s) expected struct = (%+v), got = (%+v)", commandToTest, expectedStruct, userCommandStruct)
+		}
+	}
+
+	command, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand("responses add name=slow agent=smsc01 command=submit-sm match:destination_addr=^44 action=respond status=ESME_RTHROTTLED delay=2s")
+	if err != nil {
+		t.Fatalf("Expected no error on responses add, got = (%s)", err)
+	}
+
+	rule := command.Details.(*ResponsesDetails).RuleToAdd
+	if rule == nil || rule.String() != "name=slow agent=smsc01 command=submit-sm match:destination_addr=^44 action=respond status=ESME_RTHROTTLED delay=2s" {
+		t.Errorf("Expected responses add to produce the described rule, got = (%v)", rule)
+	}
+
+	for _, commandToTest := range []string{"responses add action=explode", "responses remove", "responses remove a b", "responses clear all", "responses list"} {
+		if _, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest); err == nil {
+			t.Errorf("For (%s) expected error on ConvertCommandLineStringToUserCommand but did not get one", commandToTest)
+		}
+	}
+}
+
+func TestCommandProcessorSubmitMultiFailuresCommands(t *testing.T) {
+	for commandToTest, expectedStruct := range map[string]*UserCommand{
+		"submit-multi-failures": {Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{}},
+		"submit-multi-failures set 447700900123 ESME_RDELIVERYFAILURE": {Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{
+			DestinationToFail: "447700900123",
+			ErrorStatusCode:   EsmeRdeliveryfailure,
+		}},
+		"submit-multi-failures clear":      {Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{ClearAll: true}},
+		"submit-multi-failures clear 4477": {Type: SubmitMultiFailures, Details: &SubmitMultiFailuresDetails{DestinationToClear: "4477"}},
+	} {
+		userCommandStruct, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest)
+
+		if err != nil {
+			t.Errorf("For (%s) expected no error on ConvertCommandLineStringToUserCommand, got = (%s)", commandToTest, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(expectedStruct, userCommandStruct) {
+			t.Errorf("For (%s) expected struct = (%+v), got = (%+v)", commandToTest, expectedStruct, userCommandStruct)
+		}
+	}
+
+	for _, commandToTest := range []string{"submit-multi-failures set 4477", "submit-multi-failures set 4477 ESME_RBOGUS", "submit-multi-failures clear 4477 4478", "submit-multi-failures list"} {
+		if _, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest); err == nil {
+			t.Errorf("For (%s) expected error on ConvertCommandLineStringToUserCommand but did not get one", commandToTest)
+		}
+	}
+}
+
+func TestCommandProcessorPendingAndRespondCommands(t *testing.T) {
+	for commandToTest, expectedStruct := range map[string]*UserCommand{
+		"pending smsc01":        {Type: Pending, Details: &PendingDetails{NameOfAgent: "smsc01"}},
+		"pending smsc01 esme01": {Type: Pending, Details: &PendingDetails{NameOfAgent: "smsc01", NameOfPeer: "esme01"}},
+		"smsc01: respond to esme01 seq=7": {Type: Respond, Details: &RespondDetails{
+			NameOfAgentThatWillRespond: "smsc01",
+			NameOfPeerThatSentRequest:  "esme01",
+			SequenceNumber:             7,
+			CommandStatus:              EsmeRok,
+			StringParametersMap:        map[string]string{},
+		}},
+		"smsc01: respond to esme01 seq=0x10 status=ESME_RSYSERR message_id=abc": {Type: Respond, Details: &RespondDetails{
+			NameOfAgentThatWillRespond: "smsc01",
+			NameOfPeerThatSentRequest:  "esme01",
+			SequenceNumber:             16,
+			CommandStatus:              EsmeRsyserr,
+			StringParametersMap:        map[string]string{"message_id": "abc"},
+		}},
+	} {
+		userCommandStruct, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest)
+
+		if err != nil {
+			t.Errorf("For (%s) expected no error on ConvertCommandLineStringToUserCommand, got = (%s)", commandToTest, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(expectedStruct, userCommandStruct) {
+			t.Errorf("For (%s) expected struct = (%+v), got = (%+v)", commandToTest, expectedStruct, userCommandStruct)
+		}
+	}
+
+	for _, commandToTest := range []string{"pending", "pending a b c", "smsc01: respond to esme01", "smsc01: respond to esme01 seq=seven", "smsc01: respond to esme01 seq=1 status=ESME_RNOPE"} {
+		if _, err := NewTextCommandProcessor().ConvertCommandLineStringToUserCommand(commandToTest); err == nil {
+			t.Errorf("For (%s) expected error on ConvertCommandLineStringToUserCommand but did not get one", commandToTest)
+		}
+	}
+}
+
+func TestCommandProcessorUnescapesDoubleQuotedValues(t *testing.T) {
+	processor := NewTextCommandProcessor()
+
+	command, err := processor.ConvertCommandLineStringToUserCommand(`foo: send submit-sm to bar short_message="say \"hi\"\n€\x41" service_type='a\nb' source_addr=\t`)
+	if err != nil {
+		t.Fatalf("Expected no error on ConvertCommandLineStringToUserCommand, got = (%s)", err)
+	}
+
+	parameters := command.Details.(*SendPduDetails).StringParametersMap
+	if parameters["short_message"] != "say \"hi\"\n€A" {
+		t.Errorf("Expected escape sequences in double-quoted value to be replaced, got = (%q)", parameters["short_message"])
+	}
+
+	if parameters["service_type"] != `a\nb` || parameters["source_addr"] != `\t` {
+		t.Errorf("Expected single-quoted and unquoted values to be used as they are, got = (%q) and (%q)", parameters["service_type"], parameters["source_addr"])
+	}
+
+	if _, err := processor.ConvertCommandLineStringToUserCommand(`foo: send submit-sm to bar short_message="bad \q escape"`); err == nil {
+		t.Errorf("Expected error on invalid escape sequence, got none")
+	}
+}
@@ -0,0 +1,218 @@
+package smppth
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blorticus/smpp"
+)
+
+// rawTlvParameterPrefix starts a parameter map key that names an optional parameter by its tag (e.g., tlv:0x1401)
+const rawTlvParameterPrefix = "tlv:"
+
+// tlvDefinition describes an SMPP 3.4 optional parameter.  valueType is one of uint8, uint16, uint32, string
+// (a C-Octet String, to which a terminating NUL is added) or octets.
+type tlvDefinition struct {
+	name      string
+	tag       uint16
+	valueType string
+}
+
+var wellKnownTlvDefinitions = []*tlvDefinition{
+	{"dest_addr_subunit", 0x0005, "uint8"},
+	{"dest_network_type", 0x0006, "uint8"},
+	{"dest_bearer_type", 0x0007, "uint8"},
+	{"dest_telematics_id", 0x0008, "uint16"},
+	{"source_addr_subunit", 0x000D, "uint8"},
+	{"source_network_type", 0x000E, "uint8"},
+	{"source_bearer_type", 0x000F, "uint8"},
+	{"source_telematics_id", 0x0010, "uint8"},
+	{"qos_time_to_live", 0x0017, "uint32"},
+	{"payload_type", 0x0019, "uint8"},
+	{"additional_status_info_text", 0x001D, "string"},
+	{"receipted_message_id", tlvTagReceiptedMessageID, "string"},
+	{"ms_msg_wait_facilities", 0x0030, "uint8"},
+	{"privacy_indicator", 0x0201, "uint8"},
+	{"source_subaddress", 0x0202, "octets"},
+	{"dest_subaddress", 0x0203, "octets"},
+	{"user_message_reference", 0x0204, "uint16"},
+	{"user_response_code", 0x0205, "uint8"},
+	{"source_port", 0x020A, "uint16"},
+	{"destination_port", 0x020B, "uint16"},
+	{"sar_msg_ref_num", tlvTagSarMsgRefNum, "uint16"},
+	{"language_indicator", 0x020D, "uint8"},
+	{"sar_total_segments", tlvTagSarTotalSegments, "uint8"},
+	{"sar_segment_seqnum", tlvTagSarSegmentSeqnum, "uint8"},
+	{"sc_interface_version", 0x0210, "uint8"},
+	{"callback_num_pres_ind", 0x0302, "uint8"},
+	{"callback_num_atag", 0x0303, "octets"},
+	{"number_of_messages", 0x0304, "uint8"},
+	{"callback_num", 0x0381, "octets"},
+	{"dpf_result", 0x0420, "uint8"},
+	{"set_dpf", 0x0421, "uint8"},
+	{"ms_availability_status", 0x0422, "uint8"},
+	{"network_error_code", 0x0423, "octets"},
+	{"message_payload", tlvTagMessagePayload, "octets"},
+	{"delivery_failure_reason", 0x0425, "uint8"},
+	{"more_messages_to_send", 0x0426, "uint8"},
+	{"message_state", tlvTagMessageState, "uint8"},
+	{"ussd_service_op", 0x0501, "uint8"},
+	{"display_time", 0x1201, "uint8"},
+	{"sms_signal", 0x1203, "uint16"},
+	{"ms_validity", 0x1204, "uint8"},
+	{"alert_on_message_delivery", 0x130C, "octets"},
+	{"its_reply_type", 0x1380, "uint8"},
+	{"its_session_info", 0x1383, "uint16"},
+}
+
+var tlvDefinitionByName, tlvDefinitionByTag = indexTlvDefinitions()
+
+func indexTlvDefinitions() (map[string]*tlvDefinition, map[uint16]*tlvDefinition) {
+	byName := make(map[string]*tlvDefinition)
+	byTag := make(map[uint16]*tlvDefinition)
+
+	for _, definition := range wellKnownTlvDefinitions {
+		byName[definition.name] = definition
+		byTag[definition.tag] = definition
+	}
+
+	return byName, byTag
+}
+
+// TlvName returns the SMPP 3.4 name for an optional parameter tag (e.g., "user_message_reference" for 0x0204).
+// For a tag without a well-known name, the name is tlv:0xNNNN, which is the form accepted for raw optional
+// parameters by DefaultPduFactory.
+func TlvName(tag uint16) string {
+	if definition, isWellKnown := tlvDefinitionByTag[tag]; isWellKnown {
+		return definition.name
+	}
+
+	return fmt.Sprintf("%s0x%04X", rawTlvParameterPrefix, tag)
+}
+
+// parseRawTlvParameterName returns the tag from a parameter name in the form tlv:0xNNNN.  isRawTlv is false if
+// the name does not start with tlv:, and err is set if it does, but the tag is not valid.
+func parseRawTlvParameterName(name string) (tag uint16, isRawTlv bool, err error) {
+	if !strings.HasPrefix(name, rawTlvParameterPrefix) {
+		return 0, false, nil
+	}
+
+	tagString := strings.TrimPrefix(name, rawTlvParameterPrefix)
+	if !strings.HasPrefix(tagString, "0x") && !strings.HasPrefix(tagString, "0X") {
+		return 0, true, fmt.Errorf("optional parameter (%s) must have a tag in the form 0xNNNN", name)
+	}
+
+	parsedTag, err := strconv.ParseUint(tagString[2:], 16, 16)
+	if err != nil {
+		return 0, true, fmt.Errorf("optional parameter (%s) must have a tag in the form 0xNNNN", name)
+	}
+
+	return uint16(parsedTag), true, nil
+}
+
+// parseRawTlvParameterValue decodes the hex value of a raw optional parameter, which may start with hex:
+func parseRawTlvParameterValue(name string, value string) ([]byte, error) {
+	octets, err := hex.DecodeString(strings.TrimPrefix(value, rawOctetsValuePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("optional parameter (%s) value (%s) must be hex octets (e.g., 0A01FF)", name, value)
+	}
+
+	return octets, nil
+}
+
+// optionalParametersFromMap returns an optional parameter for each key in parameters that is either the name of a
+// well-known optional parameter or has the form tlv:0xNNNN.  Keys that are in mandatoryParameters are not optional
+// parameters for the PDU being created, so they are skipped.  The optional parameters are ordered by tag.
+func (factory *DefaultPduFactory) optionalParametersFromMap(parameters map[string]string, mandatoryParameters map[string]interface{}) ([]*smpp.Parameter, error) {
+	type taggedParameter struct {
+		tag       uint16
+		parameter *smpp.Parameter
+	}
+
+	taggedParameters := make([]*taggedParameter, 0)
+
+	for name, value := range parameters {
+		if _, isMandatory := mandatoryParameters[name]; isMandatory {
+			continue
+		}
+
+		tag, isRawTlv, err := parseRawTlvParameterName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if isRawTlv {
+			octets, err := parseRawTlvParameterValue(name, value)
+			if err != nil {
+				return nil, err
+			}
+
+			taggedParameters = append(taggedParameters, &taggedParameter{tag, smpp.NewTLVParameter(tag, octets)})
+			continue
+		}
+
+		definition, isWellKnown := tlvDefinitionByName[name]
+		if !isWellKnown {
+			continue
+		}
+
+		coercedType := definition.valueType
+		if coercedType == "octets" {
+			coercedType = "string"
+		}
+
+		coercedValue, err := factory.attemptCoersionFromStringToNamedType(value, coercedType)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to coerce optional parameter (%s) from (%s) to type (%s): %s", name, value, definition.valueType, err)
+		}
+
+		switch definition.valueType {
+		case "string":
+			coercedValue = append([]byte(coercedValue.(string)), 0)
+		case "octets":
+			coercedValue = []byte(coercedValue.(string))
+		}
+
+		taggedParameters = append(taggedParameters, &taggedParameter{definition.tag, smpp.NewTLVParameter(definition.tag, coercedValue)})
+	}
+
+	sort.Slice(taggedParameters, func(i, j int) bool { return taggedParameters[i].tag < taggedParameters[j].tag })
+
+	optionalParameters := make([]*smpp.Parameter, len(taggedParameters))
+	for i, tagged := range taggedParameters {
+		optionalParameters[i] = tagged.parameter
+	}
+
+	return optionalParameters, nil
+}
+
+// describeTlvValue formats the value of an optional parameter for output.  Integer parameters are formatted in
+// decimal, C-Octet String parameters without their NUL, and other octet strings as text if they are printable,
+// or as hex otherwise.
+func describeTlvValue(tlv *smpp.TLV) string {
+	octets, isOctets := tlv.Value.([]byte)
+	if !isOctets {
+		return tlvValueAsString(tlv)
+	}
+
+	definition, isWellKnown := tlvDefinitionByTag[tlv.Tag]
+	if isWellKnown {
+		switch definition.valueType {
+		case "uint8", "uint16", "uint32":
+			return strconv.FormatUint(uint64(tlvValueAsUint(tlv)), 10)
+		case "string":
+			return strings.TrimRight(string(octets), "\x00")
+		}
+	}
+
+	for _, octet := range octets {
+		if octet < 0x20 || octet > 0x7E {
+			return "0x" + strings.ToUpper(hex.EncodeToString(octets))
+		}
+	}
+
+	return string(octets)
+}
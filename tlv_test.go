@@ -0,0 +1,104 @@
+package smppth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestDefaultFactoryAddsOptionalParameters(t *testing.T) {
+	factory := NewDefaultPduFactory()
+
+	submitSm, err := factory.CreateSubmitSm(map[string]string{
+		"user_message_reference": "513",
+		"source_port":            "2948",
+		"callback_num":           "15551234",
+		"receipted_message_id":   "abc",
+		"tlv:0x1400":             "0A0BFF",
+		"not_a_tlv":              "ignored",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error on CreateSubmitSm with optional parameters, got = (%s)", err)
+	}
+
+	if len(submitSm.OptionalParameters) != 5 {
+		t.Fatalf("Expected 5 optional parameters, got (%d)", len(submitSm.OptionalParameters))
+	}
+
+	expectedTags := []uint16{0x001E, 0x0204, 0x020A, 0x0381, 0x1400}
+	for i, parameter := range submitSm.OptionalParameters {
+		if tag := parameter.Value.(smpp.TLV).Tag; tag != expectedTags[i] {
+			t.Errorf("Expected optional parameter (%d) tag = (0x%04X), got = (0x%04X)", i, expectedTags[i], tag)
+		}
+	}
+
+	if value := findTlvParameter(submitSm, 0x0204).Value; value != uint16(513) {
+		t.Errorf("Expected user_message_reference = uint16(513), got = (%v)", value)
+	}
+
+	if value := findTlvParameter(submitSm, 0x001E).Value.([]byte); !bytes.Equal(value, []byte("abc\x00")) {
+		t.Errorf("Expected receipted_message_id to be NUL terminated, got = (%v)", value)
+	}
+
+	if value := findTlvParameter(submitSm, 0x1400).Value.([]byte); !bytes.Equal(value, []byte{0x0A, 0x0B, 0xFF}) {
+		t.Errorf("Expected tlv:0x1400 = (0A0BFF), got = (%X)", value)
+	}
+
+	dataSm, err := factory.CreateDataSm(map[string]string{"message_payload": "payload", "its_session_info": "258"})
+	if err != nil || len(dataSm.OptionalParameters) != 2 || findTlvParameter(dataSm, 0x1383).Value != uint16(258) {
+		t.Errorf("Expected data-sm with message_payload and its_session_info, got error = (%v)", err)
+	}
+
+	for _, invalidParameters := range []map[string]string{
+		{"user_message_reference": "70000"},
+		{"tlv:1400": "00"},
+		{"tlv:0x14000": "00"},
+		{"tlv:0x1400": "0G"},
+	} {
+		if _, err := factory.CreateQuerySm(invalidParameters); err == nil {
+			t.Errorf("Expected error for optional parameters (%v), got none", invalidParameters)
+		}
+	}
+}
+
+func TestOutputGeneratorRendersReceivedOptionalParametersByName(t *testing.T) {
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{
+		"short_message":          "hi",
+		"user_message_reference": "513",
+		"receipted_message_id":   "abc",
+		"tlv:0x1400":             "0A0BFF",
+		"tlv:0x1401":             "6869",
+	})
+
+	encoded, _ := submitSm.Encode()
+	decoded, err := decodePDU(encoded)
+	if err != nil {
+		t.Fatalf("Expected no error on decodePDU, got = (%s)", err)
+	}
+
+	output := NewStandardOutputGenerator().SayThatAPduWasReceivedByAnAgent("esme01", "smsc01", decoded)
+	expectedSuffix := "short_message=(hi), receipted_message_id=(abc), user_message_reference=(513), tlv:0x1400=(0x0A0BFF), tlv:0x1401=(hi)"
+	if !strings.HasSuffix(output, expectedSuffix) {
+		t.Errorf("Expected output ending with (%s), got = (%s)", expectedSuffix, output)
+	}
+}
+
+func TestCommandProcessorCarriesOptionalParameters(t *testing.T) {
+	processor := NewTextCommandProcessor()
+
+	command, err := processor.ConvertCommandLineStringToUserCommand(`esme01: send submit-sm to smsc01 user_message_reference=7 tlv:0x1400=0A0B callback_num="555 1234"`)
+	if err != nil {
+		t.Fatalf("Expected no error on command with optional parameters, got = (%s)", err)
+	}
+
+	parameters := command.Details.(*SendPduDetails).StringParametersMap
+	if parameters["user_message_reference"] != "7" || parameters["tlv:0x1400"] != "0A0B" || parameters["callback_num"] != "555 1234" {
+		t.Errorf("Expected optional parameters in parameter map, got = (%v)", parameters)
+	}
+
+	if _, err := processor.ConvertCommandLineStringToUserCommand(`esme01: send submit-sm to smsc01 tlv:0x1400=xyz`); err == nil {
+		t.Errorf("Expected error on command with invalid raw optional parameter, got none")
+	}
+}
@@ -0,0 +1,289 @@
+package smppth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blorticus/smpp"
+)
+
+// WireTraceableAgent is an Agent that can write a trace of the raw bytes it exchanges with its peers.
+// Both ESME and SMSC implement it.
+type WireTraceableAgent interface {
+	AttachWireTraceWriter(writer io.Writer)
+	AttachWireTraceWriterForPeer(nameOfPeer string, writer io.Writer)
+}
+
+// WireTracer writes a trace of each chunk of data read from or written to a peer transport.  Each chunk
+// is written with its direction, a timestamp, the session ID and a hex+ASCII dump.  The start of each PDU
+// in the stream is marked, along with its length, type and sequence number.  A single WireTracer may be
+// shared by many sessions; the output for each chunk is written atomically.
+type WireTracer struct {
+	writer io.Writer
+	lock   sync.Mutex
+}
+
+// NewWireTracer creates a WireTracer that writes to the provided writer
+func NewWireTracer(writer io.Writer) *WireTracer {
+	return &WireTracer{writer: writer}
+}
+
+type wireTraceDirection int
+
+const (
+	wireTraceReceived wireTraceDirection = iota
+	wireTraceSent
+)
+
+func (direction wireTraceDirection) String() string {
+	if direction == wireTraceReceived {
+		return "received"
+	}
+
+	return "sent"
+}
+
+func (tracer *WireTracer) traceChunk(sessionID string, direction wireTraceDirection, chunk []byte, boundaries []*pduBoundary, err error) {
+	trace := new(strings.Builder)
+
+	fmt.Fprintf(trace, "%s [%s] %s %d bytes", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), sessionID, direction, len(chunk))
+	if err != nil {
+		fmt.Fprintf(trace, " (error: %s)", err)
+	}
+	trace.WriteString("\n")
+
+	nextBoundary := 0
+	for lineOffset := 0; lineOffset < len(chunk); lineOffset += 16 {
+		for ; nextBoundary < len(boundaries) && boundaries[nextBoundary].offset < lineOffset+16; nextBoundary++ {
+			fmt.Fprintf(trace, "  -- %s\n", boundaries[nextBoundary])
+		}
+
+		lineEnd := lineOffset + 16
+		if lineEnd > len(chunk) {
+			lineEnd = len(chunk)
+		}
+
+		writeHexDumpLine(trace, lineOffset, chunk[lineOffset:lineEnd])
+	}
+
+	for ; nextBoundary < len(boundaries); nextBoundary++ {
+		fmt.Fprintf(trace, "  -- %s\n", boundaries[nextBoundary])
+	}
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	io.WriteString(tracer.writer, trace.String())
+}
+
+func writeHexDumpLine(trace *strings.Builder, lineOffset int, lineBytes []byte) {
+	fmt.Fprintf(trace, "  %08x  ", lineOffset)
+
+	for i := 0; i < 16; i++ {
+		if i < len(lineBytes) {
+			fmt.Fprintf(trace, "%02x ", lineBytes[i])
+		} else {
+			trace.WriteString("   ")
+		}
+
+		if i == 7 {
+			trace.WriteString(" ")
+		}
+	}
+
+	trace.WriteString(" |")
+	for _, b := range lineBytes {
+		if b >= 0x20 && b < 0x7f {
+			trace.WriteByte(b)
+		} else {
+			trace.WriteByte('.')
+		}
+	}
+	trace.WriteString("|\n")
+}
+
+// pduBoundary describes a point in a chunk of stream data at which a PDU header starts or, if the
+// header was split across chunks, at which the header becomes complete.
+type pduBoundary struct {
+	offset                      int
+	headerIsComplete            bool
+	headerStartedInEarlierChunk bool
+	commandLength               uint32
+	commandID                   smpp.CommandIDType
+	sequenceNumber              uint32
+}
+
+func (boundary *pduBoundary) String() string {
+	if !boundary.headerIsComplete {
+		return fmt.Sprintf("PDU starts at offset 0x%04x (header continues in next chunk)", boundary.offset)
+	}
+
+	commandName := smpp.CommandName(boundary.commandID)
+	if commandName == "" {
+		commandName = fmt.Sprintf("command_id=0x%08x", uint32(boundary.commandID))
+	}
+
+	if boundary.headerStartedInEarlierChunk {
+		return fmt.Sprintf("PDU header completed at offset 0x%04x: %s length=%d seq=%d", boundary.offset, commandName, boundary.commandLength, boundary.sequenceNumber)
+	}
+
+	return fmt.Sprintf("PDU starts at offset 0x%04x: %s length=%d seq=%d", boundary.offset, commandName, boundary.commandLength, boundary.sequenceNumber)
+}
+
+// pduStreamFramer follows an SMPP byte stream, one chunk at a time, and locates the PDU boundaries in it.
+type pduStreamFramer struct {
+	partialHeader              []byte
+	bytesRemainingInCurrentPdu int
+}
+
+func newPduStreamFramer() *pduStreamFramer {
+	return &pduStreamFramer{partialHeader: make([]byte, 0, 16)}
+}
+
+func (framer *pduStreamFramer) locateBoundariesInChunk(chunk []byte) []*pduBoundary {
+	boundaries := make([]*pduBoundary, 0, 1)
+
+	for offset := 0; offset < len(chunk); {
+		if framer.bytesRemainingInCurrentPdu > 0 {
+			skip := framer.bytesRemainingInCurrentPdu
+			if skip > len(chunk)-offset {
+				skip = len(chunk) - offset
+			}
+
+			framer.bytesRemainingInCurrentPdu -= skip
+			offset += skip
+			continue
+		}
+
+		headerStartedInEarlierChunk := len(framer.partialHeader) > 0
+		headerBytesNeeded := 16 - len(framer.partialHeader)
+		if headerBytesNeeded > len(chunk)-offset {
+			if !headerStartedInEarlierChunk {
+				boundaries = append(boundaries, &pduBoundary{offset: offset})
+			}
+
+			framer.partialHeader = append(framer.partialHeader, chunk[offset:]...)
+			break
+		}
+
+		framer.partialHeader = append(framer.partialHeader, chunk[offset:offset+headerBytesNeeded]...)
+		boundary := &pduBoundary{
+			offset:                      offset,
+			headerIsComplete:            true,
+			headerStartedInEarlierChunk: headerStartedInEarlierChunk,
+			commandLength:               binary.BigEndian.Uint32(framer.partialHeader[0:4]),
+			commandID:                   smpp.CommandIDType(binary.BigEndian.Uint32(framer.partialHeader[4:8])),
+			sequenceNumber:              binary.BigEndian.Uint32(framer.partialHeader[12:16]),
+		}
+		boundaries = append(boundaries, boundary)
+
+		offset += headerBytesNeeded
+		framer.partialHeader = framer.partialHeader[:0]
+
+		if boundary.commandLength > 16 {
+			framer.bytesRemainingInCurrentPdu = int(boundary.commandLength) - 16
+		}
+	}
+
+	return boundaries
+}
+
+// wireTracingConn wraps a peer transport connection and, when a WireTracer is set, traces each chunk
+// read or written.  The tracer and session ID may be changed while the connection is in use (e.g., an
+// SMSC does not know the name of its peer until the bind arrives).
+type wireTracingConn struct {
+	net.Conn
+	lock           sync.Mutex
+	tracer         *WireTracer
+	sessionID      string
+	inboundFramer  *pduStreamFramer
+	outboundFramer *pduStreamFramer
+}
+
+func newWireTracingConn(underlyingConnection net.Conn, sessionID string) *wireTracingConn {
+	return &wireTracingConn{
+		Conn:           underlyingConnection,
+		sessionID:      sessionID,
+		inboundFramer:  newPduStreamFramer(),
+		outboundFramer: newPduStreamFramer(),
+	}
+}
+
+func (conn *wireTracingConn) setTracer(tracer *WireTracer) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.tracer = tracer
+}
+
+func (conn *wireTracingConn) setSessionID(sessionID string) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.sessionID = sessionID
+}
+
+func (conn *wireTracingConn) Read(b []byte) (int, error) {
+	bytesRead, err := conn.Conn.Read(b)
+	conn.traceChunk(wireTraceReceived, conn.inboundFramer, b[:bytesRead], err)
+	return bytesRead, err
+}
+
+func (conn *wireTracingConn) Write(b []byte) (int, error) {
+	bytesWritten, err := conn.Conn.Write(b)
+	conn.traceChunk(wireTraceSent, conn.outboundFramer, b[:bytesWritten], err)
+	return bytesWritten, err
+}
+
+func (conn *wireTracingConn) traceChunk(direction wireTraceDirection, framer *pduStreamFramer, chunk []byte, err error) {
+	conn.lock.Lock()
+	tracer, sessionID := conn.tracer, conn.sessionID
+	boundaries := framer.locateBoundariesInChunk(chunk)
+	conn.lock.Unlock()
+
+	if tracer != nil {
+		tracer.traceChunk(sessionID, direction, chunk, boundaries, err)
+	}
+}
+
+// wireTraceAttachments holds the agent-wide and per-peer WireTracers attached to an Agent.
+type wireTraceAttachments struct {
+	lock               sync.Mutex
+	tracerForAllPeers  *WireTracer
+	tracerByNameOfPeer map[string]*WireTracer
+}
+
+func newWireTraceAttachments() *wireTraceAttachments {
+	return &wireTraceAttachments{tracerByNameOfPeer: make(map[string]*WireTracer)}
+}
+
+func (attachments *wireTraceAttachments) attachForAllPeers(tracer *WireTracer) {
+	attachments.lock.Lock()
+	defer attachments.lock.Unlock()
+	attachments.tracerForAllPeers = tracer
+}
+
+func (attachments *wireTraceAttachments) attachForPeer(nameOfPeer string, tracer *WireTracer) {
+	attachments.lock.Lock()
+	defer attachments.lock.Unlock()
+	attachments.tracerByNameOfPeer[nameOfPeer] = tracer
+}
+
+// tracerForPeer returns the tracer attached for the named peer, or the tracer attached for all peers
+// if there is none for the named peer.  It returns nil if neither is attached.
+func (attachments *wireTraceAttachments) tracerForPeer(nameOfPeer string) *WireTracer {
+	attachments.lock.Lock()
+	defer attachments.lock.Unlock()
+
+	if tracer, isAttached := attachments.tracerByNameOfPeer[nameOfPeer]; isAttached {
+		return tracer
+	}
+
+	return attachments.tracerForAllPeers
+}
+
+func wireTraceSessionID(nameOfLocalAgent string, nameOfRemotePeer string) string {
+	return nameOfLocalAgent + "/" + nameOfRemotePeer
+}
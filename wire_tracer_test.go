@@ -0,0 +1,88 @@
+package smppth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/blorticus/smpp"
+)
+
+func TestPduStreamFramerWithPdusSplitAcrossChunks(t *testing.T) {
+	stream := append(testSmppMsgEnquireLink01(), testSmppMsgSubmitSm01()...)
+	framer := newPduStreamFramer()
+
+	boundaries := framer.locateBoundariesInChunk(stream[:24])
+	if len(boundaries) != 2 {
+		t.Fatalf("For first chunk, expected 2 boundaries, got (%d)", len(boundaries))
+	}
+
+	if !boundaries[0].headerIsComplete || boundaries[0].offset != 0 || boundaries[0].commandID != smpp.CommandEnquireLink || boundaries[0].sequenceNumber != 2 {
+		t.Errorf("For first chunk, first boundary is not enquire-link at offset 0: %s", boundaries[0])
+	}
+
+	if boundaries[1].headerIsComplete || boundaries[1].offset != 16 {
+		t.Errorf("For first chunk, second boundary should be an incomplete header at offset 16: %s", boundaries[1])
+	}
+
+	boundaries = framer.locateBoundariesInChunk(stream[24:])
+	if len(boundaries) != 1 {
+		t.Fatalf("For second chunk, expected 1 boundary, got (%d)", len(boundaries))
+	}
+
+	if !boundaries[0].headerIsComplete || !boundaries[0].headerStartedInEarlierChunk || boundaries[0].offset != 0 || boundaries[0].commandID != smpp.CommandSubmitSm || boundaries[0].commandLength != 0x25 {
+		t.Errorf("For second chunk, boundary should complete the submit-sm header at offset 0: %s", boundaries[0])
+	}
+
+	if boundaries = framer.locateBoundariesInChunk(testSmppMsgEnquireLink01()); len(boundaries) != 1 || boundaries[0].offset != 0 {
+		t.Errorf("After submit-sm, expected enquire-link boundary at offset 0, got = (%v)", boundaries)
+	}
+}
+
+func TestWireTracingConnTracesWritesWithHexDump(t *testing.T) {
+	traceOutput := new(bytes.Buffer)
+	conn := newWireTracingConn(newFakeNetConn(), "esme01/smsc01")
+
+	conn.Write(testSmppMsgEnquireLink01())
+	if traceOutput.Len() != 0 {
+		t.Errorf("Expected no trace output before tracer is set")
+	}
+
+	conn.setTracer(NewWireTracer(traceOutput))
+	conn.Write(testSmppMsgSubmitSm01())
+
+	trace := traceOutput.String()
+
+	for _, expectedFragment := range []string{
+		"[esme01/smsc01] sent 37 bytes",
+		"-- PDU starts at offset 0x0000: submit-sm length=37 seq=3",
+		"  00000000  00 00 00 25 00 00 00 04  00 00 00 00 00 00 00 03  |...%............|",
+		"  00000020  04 54 45 53 54                                    |.TEST|",
+	} {
+		if !strings.Contains(trace, expectedFragment) {
+			t.Errorf("Expected trace to contain (%s), trace is:\n%s", expectedFragment, trace)
+		}
+	}
+}
+
+func TestEsmeWireTraceAttachmentForPeer(t *testing.T) {
+	allPeersOutput, smsc01Output := new(bytes.Buffer), new(bytes.Buffer)
+
+	esme := NewEsme("esme01", nil, 0)
+	esme.mapOfConnectorForRemotePeerByRemotePeerName["smsc01"] = newEsmePeerMessageListener("smsc01", esme, newFakeNetConn())
+	esme.mapOfConnectorForRemotePeerByRemotePeerName["smsc02"] = newEsmePeerMessageListener("smsc02", esme, newFakeNetConn())
+
+	esme.AttachWireTraceWriter(allPeersOutput)
+	esme.AttachWireTraceWriterForPeer("smsc01", smsc01Output)
+
+	esme.SendMessageToPeer(&MessageDescriptor{NameOfSendingPeer: "esme01", NameOfReceivingPeer: "smsc01", PDU: testSmppPDUEnquireLink01()})
+	esme.SendMessageToPeer(&MessageDescriptor{NameOfSendingPeer: "esme01", NameOfReceivingPeer: "smsc02", PDU: testSmppPDUEnquireLink01()})
+
+	if !strings.Contains(smsc01Output.String(), "[esme01/smsc01] sent 16 bytes") || strings.Contains(smsc01Output.String(), "smsc02") {
+		t.Errorf("Expected per-peer trace to contain only the session with smsc01, trace is:\n%s", smsc01Output.String())
+	}
+
+	if !strings.Contains(allPeersOutput.String(), "[esme01/smsc02] sent 16 bytes") || strings.Contains(allPeersOutput.String(), "esme01/smsc01") {
+		t.Errorf("Expected all-peers trace to contain only the session with smsc02, trace is:\n%s", allPeersOutput.String())
+	}
+}
@@ -5,22 +5,96 @@ import (
 	"io"
 	"net"
 	"os"
+	"regexp"
+	"strconv"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 type applicationConfig struct {
-	SMSCs            []smscYaml            `yaml:"SMSCs"`
-	ESMEs            []esmeYaml            `yaml:"ESMEs"`
-	TransceiverBinds []transceiverBindYaml `yaml:"TransceiverBinds"`
+	SMSCs               []smscYaml            `yaml:"SMSCs"`
+	ESMEs               []esmeYaml            `yaml:"ESMEs"`
+	TransceiverBinds    []transceiverBindYaml `yaml:"TransceiverBinds"`
+	ResponseRules       []responseRuleYaml    `yaml:"ResponseRules"`
+	SubmitMultiFailures map[string]string     `yaml:"SubmitMultiFailures"`
+}
+
+type responseRuleYaml struct {
+	Name         string            `yaml:"Name"`
+	Agent        string            `yaml:"Agent"`
+	Peer         string            `yaml:"Peer"`
+	Command      string            `yaml:"Command"`
+	Match        map[string]string `yaml:"Match"`
+	Action       string            `yaml:"Action"`
+	Status       string            `yaml:"Status"`
+	Delay        string            `yaml:"Delay"`
+	MaximumDelay string            `yaml:"MaximumDelay"`
+	Probability  float64           `yaml:"Probability"`
 }
 
 type smscYaml struct {
-	Name         string `yaml:"Name"`
-	IP           string `yaml:"IP"`
-	Port         uint16 `yaml:"Port"`
-	BindPassword string `yaml:"BindPassword"`
-	BindSystemID string `yaml:"BindSystemID"`
+	Name          string `yaml:"Name"`
+	IP            string `yaml:"IP"`
+	Port          uint16 `yaml:"Port"`
+	BindPassword  string `yaml:"BindPassword"`
+	BindSystemID  string `yaml:"BindSystemID"`
+	WireTraceFile string `yaml:"WireTraceFile"`
+
+	DeliveryReceipts *deliveryReceiptsYaml `yaml:"DeliveryReceipts"`
+	MessageIDs       *messageIDsYaml       `yaml:"MessageIDs"`
+	MessageJournal   *messageJournalYaml   `yaml:"MessageJournal"`
+	MessageRetention *messageRetentionYaml `yaml:"MessageRetention"`
+	Routing          *routingYaml          `yaml:"Routing"`
+	DeliveryRetries  *deliveryRetriesYaml  `yaml:"DeliveryRetries"`
+}
+
+type deliveryRetriesYaml struct {
+	Intervals       []string `yaml:"Intervals"`
+	MaximumAttempts int      `yaml:"MaximumAttempts"`
+}
+
+type routingYaml struct {
+	UnroutableStatus string      `yaml:"UnroutableStatus"`
+	Routes           []routeYaml `yaml:"Routes"`
+}
+
+type routeYaml struct {
+	Peer                  string `yaml:"Peer"`
+	DestinationAddrPrefix string `yaml:"DestinationAddrPrefix"`
+	DestinationAddr       string `yaml:"DestinationAddr"`
+	DestAddrTon           *uint8 `yaml:"DestAddrTon"`
+	DestAddrNpi           *uint8 `yaml:"DestAddrNpi"`
+	ServiceType           string `yaml:"ServiceType"`
+}
+
+type messageJournalYaml struct {
+	File         string `yaml:"File"`
+	CompactAfter int    `yaml:"CompactAfter"`
+}
+
+type messageRetentionYaml struct {
+	FinalStateRetention  string `yaml:"FinalStateRetention"`
+	MaximumFinalMessages *int   `yaml:"MaximumFinalMessages"`
+}
+
+type messageIDsYaml struct {
+	Generator string  `yaml:"Generator"`
+	Start     *uint64 `yaml:"Start"`
+	Width     int     `yaml:"Width"`
+	Template  string  `yaml:"Template"`
+}
+
+type deliveryReceiptsYaml struct {
+	Delay string                    `yaml:"Delay"`
+	Rules []deliveryReceiptRuleYaml `yaml:"Rules"`
+}
+
+type deliveryReceiptRuleYaml struct {
+	SourceAddr      string `yaml:"SourceAddr"`
+	DestinationAddr string `yaml:"DestinationAddr"`
+	State           string `yaml:"State"`
+	Error           int    `yaml:"Error"`
 }
 
 type esmeYaml struct {
@@ -29,20 +103,80 @@ type esmeYaml struct {
 	Port           uint16 `yaml:"Port"`
 	BindSystemID   string `yaml:"BindSystemID"`
 	BindSystemType string `yaml:"BindSystemType"`
+	WireTraceFile  string `yaml:"WireTraceFile"`
 }
 
 type transceiverBindYaml struct {
-	EsmeName string `yaml:"ESME"`
-	SmscName string `yaml:"SMSC"`
+	EsmeName      string `yaml:"ESME"`
+	SmscName      string `yaml:"SMSC"`
+	WireTraceFile string `yaml:"WireTraceFile"`
 }
 
-// ApplicationConfigYamlReader reads a testharness application YAML config file
+// ApplicationConfigYamlReader reads a testharness application YAML config file.  An ESME, an SMSC or
+// a TransceiverBind may include a WireTraceFile, in which case a wire trace for the agent (or, for a
+// TransceiverBind, for the ESME's session with that SMSC) is appended to the named file.  The special
+// name "-" sends the trace to STDOUT.  The files stay open until CloseWireTraceFiles() is called.
+//
+// An SMSC may include DeliveryReceipts, which sets its DeliveryReceiptPolicy.  Delay is a Go duration
+// (e.g., 500ms).  Each of the Rules has a State (e.g., UNDELIV), an optional Error, and optional
+// SourceAddr and DestinationAddr regular expressions that a message must match.
+//
+// An SMSC may also include MessageIDs, which sets its MessageIDGenerator.  Generator is one of sequential
+// (decimal, counting from Start, or 1), hex (hex, counting from Start, or 1), uuid, random (random hex of Width digits)
+// or template (a Template such as {agent}:{seq}).  Without MessageIDs, the SMSC uses the template {agent}-{seq}.
+//
+// An SMSC may also include MessageJournal, which makes its MessageStore persistent.  File is the journal file,
+// which is created if it does not exist, and is replayed when the SMSC event loop starts.  CompactAfter is the
+// number of records written to the journal after which it may be compacted (by default, 1000).
+//
+// An SMSC may also include MessageRetention, which limits how many messages its MessageStore keeps once they reach a
+// final state.  FinalStateRetention is a Go duration (by default, 1h), and MaximumFinalMessages is the most messages
+// in a final state that are kept (by default, 10000).  Either may be 0, to remove that limit.
+//
+// An SMSC may also include Routing, which puts it in routing mode with a RoutingTable.  Each of the Routes names the
+// Peer (the bind system_id) to which matching messages are delivered, and may have a DestinationAddrPrefix, a
+// DestinationAddr regular expression, a DestAddrTon, a DestAddrNpi and a ServiceType that a message must match.
+// UnroutableStatus is the command_status for a message that matches no route (by default, ESME_RINVDSTADR).
+//
+// An SMSC may also include DeliveryRetries, which sets the DeliveryRetrySchedule for deliveries that it holds
+// because the peer is not bound or rejected them.  Intervals is a list of Go durations (e.g., [5s, 1m]), the last of
+// which is repeated, and MaximumAttempts is the number of attempts after which a delivery is abandoned (by default,
+// there is no maximum).
+//
+// The config may also include ResponseRules, which make up the ResponsePolicy returned by ResponsePolicy().  Each
+// rule has an Action (respond, which is the default, drop, generic-nack, close or hold), and may have a Name, the
+// Agent that received the request, the Peer that sent it, its Command (e.g., submit-sm), a Match map from field name
+// (e.g., destination_addr) to regular expression, a Status (e.g., ESME_RTHROTTLED), a Delay and a MaximumDelay (Go
+// durations), and a Probability.
+//
+// The config may also include SubmitMultiFailures, a map from destination address to the command_status (e.g.,
+// ESME_RDELIVERYFAILURE) in the unsuccess_sme entry for that address in automatic submit_multi_resp messages.  It is
+// returned by SubmitMultiFailures().
 type ApplicationConfigYamlReader struct {
+	wireTraceWriterByFileName map[string]io.Writer
+	responsePolicy            *ResponsePolicy
+	submitMultiFailures       map[string]uint32
 }
 
 // NewApplicationConfigYamlReader creates a new, empty ApplicationConfigYamlReader
 func NewApplicationConfigYamlReader() *ApplicationConfigYamlReader {
-	return &ApplicationConfigYamlReader{}
+	return &ApplicationConfigYamlReader{
+		wireTraceWriterByFileName: make(map[string]io.Writer),
+		responsePolicy:            NewResponsePolicy(),
+		submitMultiFailures:       make(map[string]uint32),
+	}
+}
+
+// ResponsePolicy returns the ResponsePolicy built from the ResponseRules in the most recently parsed config.  It has
+// no rules if the config has none.  It is generally passed to StandardApplication.SetResponsePolicy().
+func (reader *ApplicationConfigYamlReader) ResponsePolicy() *ResponsePolicy {
+	return reader.responsePolicy
+}
+
+// SubmitMultiFailures returns the map from destination address to error_status_code built from the SubmitMultiFailures
+// in the most recently parsed config.  It is generally passed to StandardApplication.SetSubmitMultiFailures().
+func (reader *ApplicationConfigYamlReader) SubmitMultiFailures() map[string]uint32 {
+	return reader.submitMultiFailures
 }
 
 // ParseFile opens a file and treats its contents as a validly formatted testharness config YAML file
@@ -58,8 +192,43 @@ func (reader *ApplicationConfigYamlReader) ParseFile(fileName string) ([]*ESME,
 }
 
 // ParseReader reads from an io.Reader stream, treating the contents provided as a validly formatted
-// testharness config YAML file
+// testharness config YAML file.  If the config cannot be parsed, any WireTraceFile opened while parsing it is
+// closed.
 func (reader *ApplicationConfigYamlReader) ParseReader(ioReader io.Reader) ([]*ESME, []*SMSC, error) {
+	wireTraceFileWasOpenBeforeParse := make(map[string]bool)
+	for fileName := range reader.wireTraceWriterByFileName {
+		wireTraceFileWasOpenBeforeParse[fileName] = true
+	}
+
+	esmes, smscs, err := reader.parseConfig(ioReader)
+	if err != nil {
+		for fileName := range reader.wireTraceWriterByFileName {
+			if !wireTraceFileWasOpenBeforeParse[fileName] {
+				reader.closeWireTraceFile(fileName)
+			}
+		}
+
+		return nil, nil, err
+	}
+
+	return esmes, smscs, nil
+}
+
+// CloseWireTraceFiles closes every WireTraceFile opened by the reader.  It should be called when the agents
+// returned by ParseFile() or ParseReader() are no longer in use.  If any file cannot be closed, the first
+// such error is returned, but the remaining files are still closed.
+func (reader *ApplicationConfigYamlReader) CloseWireTraceFiles() error {
+	var firstError error
+	for fileName := range reader.wireTraceWriterByFileName {
+		if err := reader.closeWireTraceFile(fileName); err != nil && firstError == nil {
+			firstError = err
+		}
+	}
+
+	return firstError
+}
+
+func (reader *ApplicationConfigYamlReader) parseConfig(ioReader io.Reader) ([]*ESME, []*SMSC, error) {
 	var config applicationConfig
 	decoder := yaml.NewDecoder(ioReader)
 	err := decoder.Decode(&config)
@@ -84,6 +253,16 @@ func (reader *ApplicationConfigYamlReader) ParseReader(ioReader io.Reader) ([]*E
 
 		esmeDefinitionByName[esmeDefinition.Name] = esmeDefinition
 		esme := NewEsme(esmeDefinition.Name, bindIP, esmeDefinition.Port)
+
+		if esmeDefinition.WireTraceFile != "" {
+			writer, err := reader.openWireTraceFile(esmeDefinition.WireTraceFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to open WireTraceFile for ESME [%s]: %s", esmeDefinition.Name, err)
+			}
+
+			esme.AttachWireTraceWriter(writer)
+		}
+
 		esmeObjectByName[esmeDefinition.Name] = esme
 		esmeObjectList[i] = esme
 	}
@@ -97,6 +276,69 @@ func (reader *ApplicationConfigYamlReader) ParseReader(ioReader io.Reader) ([]*E
 
 		smscDefinitionByName[smscDefinition.Name] = smscDefinition
 		smscObjectList[i] = NewSMSC(smscDefinition.Name, smscDefinition.BindSystemID, bindIP, smscDefinition.Port)
+
+		if smscDefinition.WireTraceFile != "" {
+			writer, err := reader.openWireTraceFile(smscDefinition.WireTraceFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to open WireTraceFile for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].AttachWireTraceWriter(writer)
+		}
+
+		if smscDefinition.DeliveryReceipts != nil {
+			policy, err := deliveryReceiptPolicyFromYaml(smscDefinition.DeliveryReceipts)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid DeliveryReceipts for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].SetDeliveryReceiptPolicy(policy)
+		}
+
+		if smscDefinition.MessageIDs != nil {
+			generator, err := messageIDGeneratorFromYaml(smscDefinition.MessageIDs)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid MessageIDs for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].SetMessageIDGenerator(generator)
+		}
+
+		if smscDefinition.MessageJournal != nil {
+			journal, err := messageJournalFromYaml(smscDefinition.MessageJournal)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid MessageJournal for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].AttachMessageJournal(journal)
+		}
+
+		if smscDefinition.MessageRetention != nil {
+			retention, maximumFinalMessages, err := messageRetentionFromYaml(smscDefinition.MessageRetention)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid MessageRetention for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].MessageStore().SetFinalMessageRetention(retention, maximumFinalMessages)
+		}
+
+		if smscDefinition.Routing != nil {
+			table, err := routingTableFromYaml(smscDefinition.Routing)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid Routing for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].SetRoutingTable(table)
+		}
+
+		if smscDefinition.DeliveryRetries != nil {
+			schedule, err := deliveryRetryScheduleFromYaml(smscDefinition.DeliveryRetries)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid DeliveryRetries for SMSC [%s]: %s", smscDefinition.Name, err)
+			}
+
+			smscObjectList[i].DeliveryQueue().SetRetrySchedule(schedule)
+		}
 	}
 
 	for _, bindDefinition := range config.TransceiverBinds {
@@ -122,7 +364,283 @@ func (reader *ApplicationConfigYamlReader) ParseReader(ioReader io.Reader) ([]*E
 				systemID:   esmeDefinition.BindSystemID,
 				systemType: esmeDefinition.BindSystemType,
 			})
+
+		if bindDefinition.WireTraceFile != "" {
+			writer, err := reader.openWireTraceFile(bindDefinition.WireTraceFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to open WireTraceFile for TransceiverBind from [%s] to [%s]: %s", bindDefinition.EsmeName, bindDefinition.SmscName, err)
+			}
+
+			esme.AttachWireTraceWriterForPeer(bindDefinition.SmscName, writer)
+		}
 	}
 
+	policy, err := responsePolicyFromYaml(config.ResponseRules, esmeDefinitionByName, smscDefinitionByName)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader.responsePolicy = policy
+
+	submitMultiFailures := make(map[string]uint32)
+	for destinationAddress, status := range config.SubmitMultiFailures {
+		errorStatusCode, err := CommandStatusFromString(status)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid Status for SubmitMultiFailures destination [%s]: %s", destinationAddress, err)
+		}
+
+		submitMultiFailures[destinationAddress] = errorStatusCode
+	}
+	reader.submitMultiFailures = submitMultiFailures
+
 	return esmeObjectList, smscObjectList, nil
 }
+
+func responsePolicyFromYaml(definitions []responseRuleYaml, esmeDefinitionByName map[string]esmeYaml, smscDefinitionByName map[string]smscYaml) (*ResponsePolicy, error) {
+	policy := NewResponsePolicy()
+
+	for i, definition := range definitions {
+		nameOfRule := definition.Name
+		if nameOfRule == "" {
+			nameOfRule = fmt.Sprintf("%d", i+1)
+		}
+
+		if definition.Agent != "" {
+			_, agentIsAnEsme := esmeDefinitionByName[definition.Agent]
+			_, agentIsAnSmsc := smscDefinitionByName[definition.Agent]
+			if !agentIsAnEsme && !agentIsAnSmsc {
+				return nil, fmt.Errorf("Invalid Agent name [%s] in ResponseRule [%s]", definition.Agent, nameOfRule)
+			}
+		}
+
+		parameters := map[string]string{
+			"name":  definition.Name,
+			"agent": definition.Agent,
+			"peer":  definition.Peer,
+		}
+
+		for name, value := range map[string]string{"action": definition.Action, "command": definition.Command, "status": definition.Status, "delay": definition.Delay, "max_delay": definition.MaximumDelay} {
+			if value != "" {
+				parameters[name] = value
+			}
+		}
+
+		if definition.Probability != 0 {
+			parameters["probability"] = strconv.FormatFloat(definition.Probability, 'g', -1, 64)
+		}
+
+		for fieldName, pattern := range definition.Match {
+			parameters["match:"+fieldName] = pattern
+		}
+
+		rule, err := ParseResponseRule(parameters)
+		if err == nil {
+			err = policy.AddRule(rule)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ResponseRule [%s]: %s", nameOfRule, err)
+		}
+	}
+
+	return policy, nil
+}
+
+func deliveryReceiptPolicyFromYaml(definition *deliveryReceiptsYaml) (*DeliveryReceiptPolicy, error) {
+	policy := NewDeliveryReceiptPolicy()
+
+	if definition.Delay != "" {
+		delay, err := time.ParseDuration(definition.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("Delay [%s] is not a duration", definition.Delay)
+		}
+
+		policy.SetDelay(delay)
+	}
+
+	for _, ruleDefinition := range definition.Rules {
+		rule := &DeliveryReceiptRule{ErrorCode: ruleDefinition.Error}
+
+		state, err := MessageStateFromString(ruleDefinition.State)
+		if err != nil {
+			return nil, err
+		}
+		rule.FinalState = state
+
+		if ruleDefinition.SourceAddr != "" {
+			if rule.SourceAddrPattern, err = regexp.Compile(ruleDefinition.SourceAddr); err != nil {
+				return nil, fmt.Errorf("SourceAddr [%s] is not a valid regular expression", ruleDefinition.SourceAddr)
+			}
+		}
+
+		if ruleDefinition.DestinationAddr != "" {
+			if rule.DestinationAddrPattern, err = regexp.Compile(ruleDefinition.DestinationAddr); err != nil {
+				return nil, fmt.Errorf("DestinationAddr [%s] is not a valid regular expression", ruleDefinition.DestinationAddr)
+			}
+		}
+
+		if err := policy.AddRule(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+func messageIDGeneratorFromYaml(definition *messageIDsYaml) (MessageIDGenerator, error) {
+	firstValue := uint64(1)
+	if definition.Start != nil {
+		firstValue = *definition.Start
+	}
+
+	switch definition.Generator {
+	case "sequential", "":
+		return NewSequentialMessageIDGenerator(firstValue), nil
+	case "hex":
+		return NewHexMessageIDGenerator(firstValue), nil
+	case "uuid":
+		return NewUUIDMessageIDGenerator(), nil
+	case "random":
+		return NewRandomMessageIDGenerator(definition.Width)
+	case "template":
+		return NewTemplateMessageIDGenerator(definition.Template)
+	}
+
+	return nil, fmt.Errorf("Generator [%s] must be one of sequential, hex, uuid, random or template", definition.Generator)
+}
+
+func routingTableFromYaml(definition *routingYaml) (*RoutingTable, error) {
+	table := NewRoutingTable()
+
+	if definition.UnroutableStatus != "" {
+		commandStatus, err := CommandStatusFromString(definition.UnroutableStatus)
+		if err != nil {
+			return nil, err
+		}
+		table.SetUnroutableCommandStatus(commandStatus)
+	}
+
+	for _, routeDefinition := range definition.Routes {
+		rule := &RoutingRule{
+			NameOfPeer:            routeDefinition.Peer,
+			DestinationAddrPrefix: routeDefinition.DestinationAddrPrefix,
+			DestAddrTon:           routeDefinition.DestAddrTon,
+			DestAddrNpi:           routeDefinition.DestAddrNpi,
+			ServiceType:           routeDefinition.ServiceType,
+		}
+
+		if routeDefinition.DestinationAddr != "" {
+			pattern, err := regexp.Compile(routeDefinition.DestinationAddr)
+			if err != nil {
+				return nil, fmt.Errorf("DestinationAddr [%s] is not a valid regular expression: %s", routeDefinition.DestinationAddr, err)
+			}
+			rule.DestinationAddrPattern = pattern
+		}
+
+		if err := table.AddRule(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return table, nil
+}
+
+func deliveryRetryScheduleFromYaml(definition *deliveryRetriesYaml) (*DeliveryRetrySchedule, error) {
+	schedule := NewDeliveryRetrySchedule()
+
+	if len(definition.Intervals) > 0 {
+		intervals := make([]time.Duration, len(definition.Intervals))
+		for i, intervalString := range definition.Intervals {
+			interval, err := time.ParseDuration(intervalString)
+			if err != nil {
+				return nil, fmt.Errorf("Interval [%s] is not a valid duration", intervalString)
+			}
+			intervals[i] = interval
+		}
+
+		if err := schedule.SetIntervals(intervals); err != nil {
+			return nil, err
+		}
+	}
+
+	if definition.MaximumAttempts < 0 {
+		return nil, fmt.Errorf("MaximumAttempts [%d] must not be negative", definition.MaximumAttempts)
+	}
+
+	return schedule.SetMaximumAttempts(definition.MaximumAttempts), nil
+}
+
+func messageJournalFromYaml(definition *messageJournalYaml) (*MessageJournal, error) {
+	if definition.File == "" {
+		return nil, fmt.Errorf("File is required")
+	}
+
+	if definition.CompactAfter < 0 {
+		return nil, fmt.Errorf("CompactAfter [%d] must not be negative", definition.CompactAfter)
+	}
+
+	journal, err := OpenMessageJournal(definition.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if definition.CompactAfter > 0 {
+		journal.SetCompactionThreshold(definition.CompactAfter)
+	}
+
+	return journal, nil
+}
+
+func messageRetentionFromYaml(definition *messageRetentionYaml) (time.Duration, int, error) {
+	retention, maximumFinalMessages := DefaultFinalMessageRetention, DefaultMaximumNumberOfFinalMessages
+
+	if definition.FinalStateRetention != "" {
+		var err error
+		if retention, err = time.ParseDuration(definition.FinalStateRetention); err != nil {
+			return 0, 0, fmt.Errorf("FinalStateRetention [%s] is not a valid duration", definition.FinalStateRetention)
+		}
+
+		if retention < 0 {
+			return 0, 0, fmt.Errorf("FinalStateRetention [%s] must not be negative", definition.FinalStateRetention)
+		}
+	}
+
+	if definition.MaximumFinalMessages != nil {
+		if maximumFinalMessages = *definition.MaximumFinalMessages; maximumFinalMessages < 0 {
+			return 0, 0, fmt.Errorf("MaximumFinalMessages [%d] must not be negative", maximumFinalMessages)
+		}
+	}
+
+	return retention, maximumFinalMessages, nil
+}
+
+func (reader *ApplicationConfigYamlReader) openWireTraceFile(fileName string) (io.Writer, error) {
+	if writer, alreadyOpen := reader.wireTraceWriterByFileName[fileName]; alreadyOpen {
+		return writer, nil
+	}
+
+	if fileName == "-" {
+		reader.wireTraceWriterByFileName[fileName] = os.Stdout
+		return os.Stdout, nil
+	}
+
+	fileHandle, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.wireTraceWriterByFileName[fileName] = fileHandle
+
+	return fileHandle, nil
+}
+
+// closeWireTraceFile closes the named WireTraceFile, unless it is STDOUT, and forgets it
+func (reader *ApplicationConfigYamlReader) closeWireTraceFile(fileName string) error {
+	writer := reader.wireTraceWriterByFileName[fileName]
+	delete(reader.wireTraceWriterByFileName, fileName)
+
+	if fileHandle, isAFile := writer.(*os.File); isAFile && fileHandle != os.Stdout {
+		return fileHandle.Close()
+	}
+
+	return nil
+}
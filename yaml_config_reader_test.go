@@ -2,9 +2,14 @@ package smppth
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // TestParseIoReader tests applicationConfigYamlReader.parseIoReader()
@@ -116,6 +121,88 @@ TransceiverBinds:
 
 }
 
+func TestParseIoReaderWithWireTraceFiles(t *testing.T) {
+	traceDirectory, err := ioutil.TempDir("", "smppth-wire-trace")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(traceDirectory)
+
+	agentTraceFileName := filepath.Join(traceDirectory, "agents.trace")
+	bindTraceFileName := filepath.Join(traceDirectory, "bind.trace")
+
+	ioReader := strings.NewReader(fmt.Sprintf(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    WireTraceFile: %s
+ESMEs:
+  - Name: esme01
+    IP: 10.1.1.1
+    Port: 2775
+    BindSystemID: esme01
+TransceiverBinds:
+  - ESME: esme01
+    SMSC: smsc01
+    WireTraceFile: %s
+`, agentTraceFileName, bindTraceFileName))
+
+	reader := NewApplicationConfigYamlReader()
+	esmeList, smscList, err := reader.ParseReader(ioReader)
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	if smscList[0].wireTraceAttachments.tracerForPeer("esme01") == nil {
+		t.Errorf("Expected SMSC smsc01 to have a wire tracer for all peers, but it does not")
+	}
+
+	if esmeList[0].wireTraceAttachments.tracerForPeer("smsc01") == nil {
+		t.Errorf("Expected ESME esme01 to have a wire tracer for peer smsc01, but it does not")
+	}
+
+	if esmeList[0].wireTraceAttachments.tracerForPeer("smsc02") != nil {
+		t.Errorf("Expected ESME esme01 to have no wire tracer for peer smsc02, but it does")
+	}
+
+	for _, fileName := range []string{agentTraceFileName, bindTraceFileName} {
+		if _, err := os.Stat(fileName); err != nil {
+			t.Errorf("Expected WireTraceFile (%s) to be created: %s", fileName, err)
+		}
+	}
+
+	openFiles := make([]*os.File, 0, 2)
+	for _, writer := range reader.wireTraceWriterByFileName {
+		openFiles = append(openFiles, writer.(*os.File))
+	}
+
+	if err := reader.CloseWireTraceFiles(); err != nil || len(reader.wireTraceWriterByFileName) != 0 {
+		t.Errorf("Expected CloseWireTraceFiles() to close and forget both files, got error = (%v)", err)
+	}
+
+	for _, fileHandle := range openFiles {
+		if _, err := fileHandle.Write([]byte("x")); err == nil {
+			t.Errorf("Expected WireTraceFile (%s) to be closed, but it accepted a write", fileHandle.Name())
+		}
+	}
+
+	failedReader := NewApplicationConfigYamlReader()
+	if _, _, err := failedReader.ParseReader(strings.NewReader(fmt.Sprintf(`
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    WireTraceFile: %s
+TransceiverBinds:
+  - ESME: esme01
+    SMSC: smsc02
+`, agentTraceFileName))); err == nil || len(failedReader.wireTraceWriterByFileName) != 0 {
+		t.Errorf("Expected config error to close WireTraceFile, got error = (%v) and (%d) open files", err, len(failedReader.wireTraceWriterByFileName))
+	}
+}
+
 func compareEsme(received *ESME, expected *ESME) (bool, error) {
 	if received.Name() != expected.Name() {
 		return false, fmt.Errorf("Received Name = (%s), expected = (%s)", received.Name(), expected.Name())
@@ -169,3 +256,369 @@ func compareSmppBindInfo(received smppBindInfo, expected smppBindInfo) (bool, er
 
 	return true, nil
 }
+
+func TestParseIoReaderWithDeliveryReceipts(t *testing.T) {
+	ioReader := strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    DeliveryReceipts:
+      Delay: 250ms
+      Rules:
+        - DestinationAddr: ^999
+          State: UNDELIV
+          Error: 11
+        - SourceAddr: ^1
+          State: EXPIRED
+`)
+
+	_, smscList, err := NewApplicationConfigYamlReader().ParseReader(ioReader)
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	policy := smscList[0].DeliveryReceiptPolicy()
+	if policy.Delay() != 250*time.Millisecond {
+		t.Errorf("Expected delivery receipt delay (250ms), got (%s)", policy.Delay())
+	}
+
+	if len(policy.rules) != 2 || policy.rules[0].FinalState != MessageStateUndeliverable || policy.rules[0].ErrorCode != 11 || policy.rules[1].SourceAddrPattern == nil {
+		t.Errorf("Expected two delivery receipt rules as defined")
+	}
+
+	_, _, err = NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    DeliveryReceipts:
+      Rules:
+        - State: ENROUTE
+`))
+	if err == nil {
+		t.Errorf("Expected error on DeliveryReceipts rule with ENROUTE state, got none")
+	}
+}
+
+func TestParseIoReaderWithMessageIDs(t *testing.T) {
+	_, smscList, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    MessageIDs:
+      Generator: hex
+      Start: 255
+  - Name: smsc02
+    IP: 192.168.1.2
+    Port: 2775
+    MessageIDs:
+      Generator: template
+      Template: "{agent}:{seq}"
+  - Name: smsc03
+    IP: 192.168.1.3
+    Port: 2775
+`))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	for i, expectedMessageID := range []string{"FF", "smsc02:1", "smsc03-1"} {
+		if messageID := smscList[i].NextMessageID(); messageID != expectedMessageID {
+			t.Errorf("Expected first message_id for (%s) = (%s), got = (%s)", smscList[i].Name(), expectedMessageID, messageID)
+		}
+	}
+
+	_, _, err = NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    MessageIDs:
+      Generator: snowflake
+`))
+	if err == nil {
+		t.Errorf("Expected error on unknown MessageIDs Generator, got none")
+	}
+}
+
+func TestParseIoReaderWithMessageJournal(t *testing.T) {
+	directory, err := ioutil.TempDir("", "smppth-journal")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileName := filepath.Join(directory, "smsc01.journal")
+
+	_, smscList, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(fmt.Sprintf(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    MessageJournal:
+      File: %s
+      CompactAfter: 50
+`, fileName)))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	submitSm, _ := NewDefaultPduFactory().CreateSubmitSm(map[string]string{"source_addr": "1000", "destination_addr": "2000"})
+	smscList[0].MessageStore().StoreSubmitSm("msg01", "esme01", submitSm)
+
+	if contents, _ := ioutil.ReadFile(fileName); !strings.Contains(string(contents), `"MessageID":"msg01"`) {
+		t.Errorf("Expected stored message to be written to MessageJournal File, got = (%s)", string(contents))
+	}
+
+	_, _, err = NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    MessageJournal:
+      CompactAfter: 50
+`))
+	if err == nil {
+		t.Errorf("Expected error on MessageJournal without File, got none")
+	}
+}
+
+func TestParseIoReaderWithRouting(t *testing.T) {
+	_, smscList, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    Routing:
+      UnroutableStatus: ESME_RSYSERR
+      Routes:
+        - Peer: esme02
+          DestinationAddrPrefix: "44"
+          DestAddrTon: 1
+        - Peer: esme03
+          DestinationAddr: ^1\d+$
+          ServiceType: CMT
+  - Name: smsc02
+    IP: 192.168.1.2
+    Port: 2775
+`))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	if smscList[1].RoutingTable() != nil {
+		t.Errorf("Expected SMSC without Routing to have no RoutingTable")
+	}
+
+	table := smscList[0].RoutingTable()
+	if table == nil {
+		t.Fatalf("Expected SMSC with Routing to have a RoutingTable")
+	}
+
+	if table.UnroutableCommandStatus() != EsmeRsyserr {
+		t.Errorf("Expected UnroutableStatus ESME_RSYSERR, got (%s)", CommandStatusName(table.UnroutableCommandStatus()))
+	}
+
+	factory := NewDefaultPduFactory()
+	for parameters, expectedPeer := range map[[3]string]string{
+		{"1", "", "447700900123"}: "esme02",
+		{"0", "CMT", "15551234"}:  "esme03",
+		{"0", "WAP", "15551234"}:  "",
+		{"0", "", "447700900123"}: "",
+	} {
+		submitSm, _ := factory.CreateSubmitSm(map[string]string{"dest_addr_ton": parameters[0], "service_type": parameters[1], "destination_addr": parameters[2]})
+
+		nameOfPeer := ""
+		if route := table.RouteForSubmitSm(submitSm); route != nil {
+			nameOfPeer = route.NameOfPeer
+		}
+
+		if nameOfPeer != expectedPeer {
+			t.Errorf("For submit-sm (%v) expected route to (%s), got (%s)", parameters, expectedPeer, nameOfPeer)
+		}
+	}
+
+	_, _, err = NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    Routing:
+      Routes:
+        - DestinationAddrPrefix: "44"
+`))
+	if err == nil {
+		t.Errorf("Expected error on Routing route without Peer, got none")
+	}
+}
+
+func TestParseIoReaderWithDeliveryRetries(t *testing.T) {
+	_, smscList, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    DeliveryRetries:
+      Intervals: [2s, 1m]
+      MaximumAttempts: 5
+`))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	schedule := smscList[0].DeliveryQueue().RetrySchedule()
+	if schedule.MaximumAttempts() != 5 || schedule.IntervalAfterAttempt(1) != 2*time.Second || schedule.IntervalAfterAttempt(3) != time.Minute {
+		t.Errorf("Expected DeliveryRetries schedule of 2s then 1m, with 5 attempts")
+	}
+
+	_, _, err = NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    DeliveryRetries:
+      Intervals: [soon]
+`))
+	if err == nil {
+		t.Errorf("Expected error on DeliveryRetries with invalid interval, got none")
+	}
+}
+
+func TestParseIoReaderWithResponseRules(t *testing.T) {
+	reader := NewApplicationConfigYamlReader()
+	_, _, err := reader.ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+ResponseRules:
+  - Name: throttle-uk
+    Agent: smsc01
+    Command: submit-sm
+    Match:
+      destination_addr: ^44
+    Status: ESME_RTHROTTLED
+    Delay: 100ms
+    MaximumDelay: 1s
+  - Peer: esme02
+    Command: enquire-link
+    Action: drop
+    Probability: 0.5
+`))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	rules := reader.ResponsePolicy().Rules()
+	if len(rules) != 2 {
+		t.Fatalf("Expected two response rules, got (%d)", len(rules))
+	}
+
+	for i, expected := range []string{
+		"name=throttle-uk agent=smsc01 command=submit-sm match:destination_addr=^44 action=respond status=ESME_RTHROTTLED delay=100ms max_delay=1s",
+		"name=rule-1 peer=esme02 command=enquire-link action=drop probability=0.5",
+	} {
+		if rules[i].String() != expected {
+			t.Errorf("Expected rule (%d) = (%s), got = (%s)", i, expected, rules[i].String())
+		}
+	}
+
+	for _, invalidRule := range []string{
+		"  - Agent: smsc02\n    Action: drop",
+		"  - Action: explode",
+		"  - Action: drop\n    Match:\n      message_id: abc",
+	} {
+		_, _, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+ResponseRules:
+` + invalidRule + "\n"))
+		if err == nil {
+			t.Errorf("Expected error on ResponseRules (%s), got none", invalidRule)
+		}
+	}
+}
+
+func TestParseIoReaderWithSubmitMultiFailures(t *testing.T) {
+	reader := NewApplicationConfigYamlReader()
+	_, _, err := reader.ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+SubmitMultiFailures:
+  "447700900123": ESME_RDELIVERYFAILURE
+  "2002": ESME_RINVDSTADR
+`))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	if !reflect.DeepEqual(reader.SubmitMultiFailures(), map[string]uint32{"447700900123": EsmeRdeliveryfailure, "2002": EsmeRinvdstadr}) {
+		t.Errorf("Unexpected SubmitMultiFailures = (%v)", reader.SubmitMultiFailures())
+	}
+
+	_, _, err = NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+SubmitMultiFailures:
+  "2002": ESME_RBOGUS
+`))
+	if err == nil {
+		t.Errorf("Expected error on SubmitMultiFailures with an invalid status, got none")
+	}
+}
+
+func TestParseIoReaderWithMessageRetention(t *testing.T) {
+	_, smscList, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    MessageRetention:
+      FinalStateRetention: 10m
+      MaximumFinalMessages: 500
+`))
+	if err != nil {
+		t.Fatalf("On parseReader() received error: %s", err)
+	}
+
+	if store := smscList[0].MessageStore(); store.finalMessageRetention != 10*time.Minute || store.maximumNumberOfFinalMessages != 500 {
+		t.Errorf("Expected MessageRetention of 10m and 500 messages, got (%s) and (%d)", store.finalMessageRetention, store.maximumNumberOfFinalMessages)
+	}
+
+	for _, invalidRetention := range []string{"FinalStateRetention: soon", "FinalStateRetention: -1m", "MaximumFinalMessages: -1"} {
+		_, _, err := NewApplicationConfigYamlReader().ParseReader(strings.NewReader(`
+---
+SMSCs:
+  - Name: smsc01
+    IP: 192.168.1.1
+    Port: 2775
+    MessageRetention:
+      ` + invalidRetention + "\n"))
+		if err == nil {
+			t.Errorf("Expected error on MessageRetention (%s), got none", invalidRetention)
+		}
+	}
+}